@@ -70,7 +70,7 @@ func NewLogHandler(dbm db.Manager, stats *stats.Stats) *LogHandler {
 }
 
 func (lh *LogHandler) WriteLog(agentId uint, logEntries []proto.LogEntry) error {
-	tx, err := lh.dbm.DB().Begin()
+	tx, err := lh.dbm.DB().BeginTx(lh.dbm.Context(), nil)
 	if err != nil {
 		return err
 	}
@@ -113,7 +113,7 @@ func (lh *LogHandler) GetLog(agentId uint, f LogFilter) ([]proto.LogEntry, error
 		" AND (level BETWEEN ? AND ?)" +
 		serviceLike
 
-	rows, err := lh.dbm.DB().Query(query, agentId, f.Begin.Unix(), f.End.Unix(), f.MinLevel, f.MaxLevel)
+	rows, err := lh.dbm.DB().QueryContext(lh.dbm.Context(), query, agentId, f.Begin.Unix(), f.End.Unix(), f.MinLevel, f.MaxLevel)
 	if err != nil {
 		return nil, err
 	}
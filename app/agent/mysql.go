@@ -45,7 +45,7 @@ func NewMySQLHandler(dbm db.Manager, ih instance.DbHandler) *MySQLHandler {
 func (h *MySQLHandler) Create(agent proto.Agent) (string, error) {
 	if agent.UUID == "" {
 		var uuid string
-		if err := h.dbm.DB().QueryRow("SELECT REPLACE(UUID(), '-', '')").Scan(&uuid); err != nil {
+		if err := h.dbm.DB().QueryRowContext(h.dbm.Context(), "SELECT REPLACE(UUID(), '-', '')").Scan(&uuid); err != nil {
 			return "", fmt.Errorf("mysql.agent.CreateAgent: uuid: %s", err)
 		}
 		agent.UUID = uuid
@@ -78,10 +78,11 @@ func (h *MySQLHandler) Get(uuid string) (uint, *proto.Agent, error) {
 }
 
 func (h *MySQLHandler) GetAll() ([]proto.Agent, error) {
-	rows, err := h.dbm.DB().Query(
-		"SELECT uuid, parent_uuid, name, version, created, deleted" +
-			" FROM instances" +
-			" WHERE subsystem_id = 2 ORDER by name")
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(),
+		"SELECT uuid, parent_uuid, name, version, created, deleted"+
+			" FROM instances"+
+			" WHERE subsystem_id = ? ORDER by name",
+		instance.SubsystemAgent)
 	if err != nil {
 		return nil, mysql.Error(err, "MySQLHandler.GetAll SELECT instances")
 	}
@@ -126,7 +127,7 @@ func (h *MySQLHandler) SetConfig(agentId uint, service, otherUUID string, set, r
 	}
 
 	// in_file = set because "set" is a reserved word: https://dev.mysql.com/doc/refman/5.5/en/keywords.html
-	_, err = h.dbm.DB().Exec(
+	_, err = h.dbm.DB().ExecContext(h.dbm.Context(),
 		"INSERT INTO agent_configs (agent_instance_id, other_instance_id, service, in_file, running)"+
 			" VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE in_file=VALUES(in_file), running=VALUES(running)",
 		agentId,
@@ -143,13 +144,13 @@ func (h *MySQLHandler) RemoveConfig(agentId uint, service, otherUUID string) err
 	if err != nil {
 		return err
 	}
-	_, err = h.dbm.DB().Exec("DELETE FROM agent_configs WHERE agent_instance_id = ? and other_instance_id = ? and service = ?",
+	_, err = h.dbm.DB().ExecContext(h.dbm.Context(), "DELETE FROM agent_configs WHERE agent_instance_id = ? and other_instance_id = ? and service = ?",
 		agentId, otherId, service)
 	return mysql.Error(err, "MySQLHandler.RemoveConfig DELETE agent_configs")
 }
 
 func (h *MySQLHandler) GetConfigs(agentId uint) ([]proto.AgentConfig, error) {
-	rows, err := h.dbm.DB().Query("SELECT service, COALESCE(i.uuid, '') uuid, in_file, running, updated" +
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(), "SELECT service, COALESCE(i.uuid, '') uuid, in_file, running, updated"+
 		" FROM agent_configs c LEFT JOIN instances i ON (c.other_instance_id = i.instance_id)")
 	if err != nil {
 		return nil, mysql.Error(err, "MySQLHandler.GetConfigs SELECT agent_configs instances")
@@ -185,7 +186,7 @@ func (h *MySQLHandler) Update(agentId uint, agent proto.Agent) error {
 }
 
 func (h *MySQLHandler) UpdateConfigs(agentId uint, configs []proto.AgentConfig, reset bool) error {
-	tx, err := h.dbm.DB().Begin()
+	tx, err := h.dbm.DB().BeginTx(h.dbm.Context(), nil)
 	if err != nil {
 		return err
 	}
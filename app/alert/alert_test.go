@@ -0,0 +1,301 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package alert_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/alert"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/models"
+	"github.com/shatteredsilicon/qan-api/config"
+	"github.com/shatteredsilicon/qan-api/stats"
+	testDb "github.com/shatteredsilicon/qan-api/tests/setup/db"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type RuleTestSuite struct{}
+
+var _ = Suite(&RuleTestSuite{})
+
+func (s *RuleTestSuite) TestValidate(t *C) {
+	r := alert.Rule{
+		Name:         "r1",
+		InstanceUUID: "521740123bae11e5a38e3aca4a148664",
+		Type:         alert.TypeShare,
+		Threshold:    0.2,
+		WebhookURL:   "https://hooks.example.com/qan",
+	}
+	t.Assert(r.Validate(), IsNil)
+	t.Check(r.Metric, Equals, "Query_time")
+	t.Check(r.Stat, Equals, "sum")
+	t.Check(r.Window, Equals, uint(3600))
+
+	bad := r
+	bad.Threshold = 20 // percent instead of share
+	t.Check(bad.Validate(), NotNil)
+
+	bad = r
+	bad.Metric = "Tmp_table_on_disk"
+	bad.Stat = "max"
+	t.Check(bad.Validate(), NotNil)
+
+	bad = r
+	bad.Metric = "Rows_examined"
+	bad.Stat = "p95"
+	t.Check(bad.Validate(), NotNil) // not a share
+
+	bad = r
+	bad.Type = alert.TypeLoad
+	t.Check(bad.Validate(), NotNil) // Metric and Stat are set
+
+	bad = r
+	bad.Type = "slow"
+	t.Check(bad.Validate(), NotNil)
+
+	bad = r
+	bad.WebhookURL = "hooks.example.com/qan"
+	t.Check(bad.Validate(), NotNil)
+}
+
+func (s *RuleTestSuite) TestMatches(t *C) {
+	q := models.QueryRank{RankPercentage: 0.3, Percentage: 0.3, Load: 0.4}
+	t.Check(alert.Matches(alert.Rule{Type: alert.TypeShare, Threshold: 0.2}, q), Equals, true)
+	t.Check(alert.Matches(alert.Rule{Type: alert.TypeShare, Threshold: 0.5}, q), Equals, false)
+	t.Check(alert.Matches(alert.Rule{Type: alert.TypeLoad, Threshold: 0.5}, q), Equals, false)
+	t.Check(alert.Matches(alert.Rule{Type: alert.TypeNew, Threshold: 0.1}, q), Equals, true)
+}
+
+func (s *RuleTestSuite) TestMatchesRankMetric(t *C) {
+	// A query that examines most of the rows but takes little of the
+	// Query_time: a Rows_examined share rule matches on the rows.
+	r := alert.Rule{Type: alert.TypeShare, Metric: "Rows_examined", Stat: "sum", Threshold: 0.5}
+	q := models.QueryRank{RankPercentage: 0.8, Percentage: 0.05}
+	t.Check(alert.Matches(r, q), Equals, true)
+
+	// And the other way around.
+	q = models.QueryRank{RankPercentage: 0.05, Percentage: 0.8}
+	t.Check(alert.Matches(r, q), Equals, false)
+}
+
+func (s *RuleTestSuite) TestBackoff(t *C) {
+	base, max := 30*time.Second, 5*time.Minute
+	t.Check(alert.Backoff(base, max, 1), Equals, 30*time.Second)
+	t.Check(alert.Backoff(base, max, 2), Equals, time.Minute)
+	t.Check(alert.Backoff(base, max, 3), Equals, 2*time.Minute)
+	t.Check(alert.Backoff(base, max, 5), Equals, max)
+	t.Check(alert.Backoff(base, max, 100), Equals, max)
+}
+
+// --------------------------------------------------------------------------
+
+type AlerterTestSuite struct {
+	testDb    *testDb.Db
+	cfg       alert.Config
+	mysqlUUID string
+	// --
+	mux      *sync.Mutex
+	received []alert.Payload
+	status   []int // webhook responses, then 200
+}
+
+var _ = Suite(&AlerterTestSuite{})
+
+func (s *AlerterTestSuite) SetUpSuite(t *C) {
+	dsn := config.Get("mysql.dsn")
+	s.testDb = testDb.NewDb(dsn, config.SchemaDir, config.TestDir)
+	if err := s.testDb.Start(); err != nil {
+		t.Fatalf("Could not prepare org db for %s: %s", dsn, err)
+	}
+	s.cfg = alert.Config{
+		Dedup:       time.Hour,
+		Timeout:     time.Second,
+		MaxAttempts: 3,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  time.Hour,
+	}
+	s.mux = &sync.Mutex{}
+}
+
+func (s *AlerterTestSuite) SetUpTest(t *C) {
+	s.testDb.TruncateDataTables()
+	s.testDb.TruncateTables([]string{"alert_rules", "alert_notifications"})
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/01")
+	err := s.testDb.DB().QueryRow("SELECT uuid FROM instances WHERE instance_id = 1259").Scan(&s.mysqlUUID)
+	t.Assert(err, IsNil)
+	s.received = nil
+	s.status = nil
+}
+
+func (s *AlerterTestSuite) webhook() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		if len(s.status) > 0 {
+			w.WriteHeader(s.status[0])
+			s.status = s.status[1:]
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var p alert.Payload
+		json.Unmarshal(body, &p)
+		s.received = append(s.received, p)
+	}))
+}
+
+func (s *AlerterTestSuite) createRule(t *C, r alert.Rule) alert.Rule {
+	t.Assert(r.Validate(), IsNil)
+	id, err := alert.NewMySQLHandler(db.DBManager).Create(r)
+	t.Assert(err, IsNil)
+	r.Id = id
+	return r
+}
+
+// --------------------------------------------------------------------------
+
+func (s *AlerterTestSuite) TestEvaluateAndDeliver(t *C) {
+	ts := s.webhook()
+	defer ts.Close()
+
+	r := s.createRule(t, alert.Rule{
+		Name:         "any load",
+		InstanceUUID: s.mysqlUUID,
+		Type:         alert.TypeLoad,
+		Threshold:    0,
+		Window:       86400,
+		WebhookURL:   ts.URL,
+		Enabled:      true,
+	})
+
+	now := time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+	a := alert.NewAlerter(db.DBManager, s.cfg, stats.NullStats())
+	queued, err := a.Evaluate(now)
+	t.Assert(err, IsNil)
+	t.Assert(queued > 0, Equals, true)
+
+	// Same queries again within the dedup time.
+	n, err := a.Evaluate(now.Add(time.Minute))
+	t.Assert(err, IsNil)
+	t.Check(n, Equals, uint(0))
+
+	sent, err := a.Deliver(now)
+	t.Assert(err, IsNil)
+	t.Check(sent, Equals, queued)
+	t.Assert(s.received, HasLen, int(queued))
+	t.Check(s.received[0].Rule.Id, Equals, r.Id)
+	t.Check(s.received[0].Query.ID, Not(Equals), "")
+	t.Check(s.received[0].Query.Log, IsNil)
+
+	notifications, err := alert.NewMySQLHandler(db.DBManager).Notifications(r.Id, 1000)
+	t.Assert(err, IsNil)
+	t.Assert(notifications, HasLen, int(queued))
+	for _, n := range notifications {
+		t.Check(n.Status, Equals, alert.StatusSent)
+		t.Check(n.Attempts, Equals, uint(1))
+	}
+}
+
+func (s *AlerterTestSuite) TestRetry(t *C) {
+	ts := s.webhook()
+	defer ts.Close()
+
+	r := s.createRule(t, alert.Rule{
+		Name:         "top query",
+		InstanceUUID: s.mysqlUUID,
+		Type:         alert.TypeShare,
+		Threshold:    0.01,
+		Window:       86400,
+		WebhookURL:   ts.URL,
+		Enabled:      true,
+	})
+	now := time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+	a := alert.NewAlerter(db.DBManager, s.cfg, stats.NullStats())
+	queued, err := a.Evaluate(now)
+	t.Assert(err, IsNil)
+	t.Assert(queued > 0, Equals, true)
+
+	// Every notification fails once.
+	for i := uint(0); i < queued; i++ {
+		s.status = append(s.status, http.StatusServiceUnavailable)
+	}
+	sent, err := a.Deliver(now)
+	t.Assert(err, IsNil)
+	t.Check(sent, Equals, uint(0))
+
+	// Not due until the backoff.
+	sent, err = a.Deliver(now.Add(10 * time.Second))
+	t.Assert(err, IsNil)
+	t.Check(sent, Equals, uint(0))
+
+	sent, err = a.Deliver(now.Add(30 * time.Second))
+	t.Assert(err, IsNil)
+	t.Check(sent, Equals, queued)
+
+	notifications, err := alert.NewMySQLHandler(db.DBManager).Notifications(r.Id, 1000)
+	t.Assert(err, IsNil)
+	for _, n := range notifications {
+		t.Check(n.Status, Equals, alert.StatusSent)
+		t.Check(n.Attempts, Equals, uint(2))
+	}
+}
+
+func (s *AlerterTestSuite) TestGiveUp(t *C) {
+	ts := s.webhook()
+	defer ts.Close()
+
+	r := s.createRule(t, alert.Rule{
+		Name:         "top query",
+		InstanceUUID: s.mysqlUUID,
+		Type:         alert.TypeShare,
+		Threshold:    0.5,
+		Window:       86400,
+		WebhookURL:   ts.URL,
+		Enabled:      true,
+	})
+	now := time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+	a := alert.NewAlerter(db.DBManager, s.cfg, stats.NullStats())
+	queued, err := a.Evaluate(now)
+	t.Assert(err, IsNil)
+
+	for i := uint(0); i < queued*s.cfg.MaxAttempts; i++ {
+		s.status = append(s.status, http.StatusInternalServerError)
+	}
+	for i := 0; i < int(s.cfg.MaxAttempts); i++ {
+		now = now.Add(s.cfg.MaxBackoff)
+		_, err := a.Deliver(now)
+		t.Assert(err, IsNil)
+	}
+
+	notifications, err := alert.NewMySQLHandler(db.DBManager).Notifications(r.Id, 1000)
+	t.Assert(err, IsNil)
+	t.Check(notifications, HasLen, int(queued))
+	for _, n := range notifications {
+		t.Check(n.Status, Equals, alert.StatusFailed)
+		t.Check(n.Attempts, Equals, s.cfg.MaxAttempts)
+		t.Check(n.LastError, Not(Equals), "")
+	}
+}
@@ -0,0 +1,357 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/revel/revel"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/app/instance"
+	"github.com/shatteredsilicon/qan-api/app/models"
+	"github.com/shatteredsilicon/qan-api/stats"
+)
+
+// Notification statuses
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+	StatusFailed  = "failed" // gave up after Config.MaxAttempts
+)
+
+// Max queries in the profile a rule is evaluated against. Queries that match
+// a rule have a large share or load, so they're at the top.
+const profileLimit = 100
+
+// Max notifications sent per Deliver.
+const deliverBatch = 100
+
+// Max bytes of a failed webhook response kept as the error.
+const maxErrorBody = 1024
+
+type Config struct {
+	Interval    time.Duration // how often to evaluate rules and send notifications
+	Dedup       time.Duration // don't notify the same rule and query again within this
+	Timeout     time.Duration // webhook request timeout
+	MaxAttempts uint          // webhook attempts before giving up
+	Backoff     time.Duration // wait after the first failed attempt, doubled after each
+	MaxBackoff  time.Duration
+}
+
+// LoadConfig reads the alert config from app.conf:
+//
+//	alert.interval            = 1m
+//	alert.dedup               = 1h
+//	alert.webhook.timeout     = 10s
+//	alert.retry.max_attempts  = 5
+//	alert.retry.backoff       = 30s
+//	alert.retry.max_backoff   = 1h
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		MaxAttempts: uint(revel.Config.IntDefault("alert.retry.max_attempts", 5)),
+	}
+	durations := []struct {
+		key string
+		def string
+		d   *time.Duration
+	}{
+		{"alert.interval", "1m", &cfg.Interval},
+		{"alert.dedup", "1h", &cfg.Dedup},
+		{"alert.webhook.timeout", "10s", &cfg.Timeout},
+		{"alert.retry.backoff", "30s", &cfg.Backoff},
+		{"alert.retry.max_backoff", "1h", &cfg.MaxBackoff},
+	}
+	for _, d := range durations {
+		var err error
+		if *d.d, err = time.ParseDuration(revel.Config.StringDefault(d.key, d.def)); err != nil {
+			return cfg, fmt.Errorf("invalid %s: %s", d.key, err)
+		}
+	}
+	if cfg.MaxAttempts == 0 {
+		return cfg, fmt.Errorf("invalid alert.retry.max_attempts: 0")
+	}
+	return cfg, nil
+}
+
+// Payload is the JSON body POSTed to the webhook of a rule.
+type Payload struct {
+	Rule  Rule
+	Begin time.Time // time range the rule was evaluated over
+	End   time.Time
+	Query models.QueryRank // without Log
+}
+
+// Alerter periodically evaluates the enabled rules and POSTs a notification
+// to the rule's webhook for every query that matches. A rule and query are
+// notified at most once per Config.Dedup. Notifications are stored in
+// alert_notifications and retried with exponential backoff until the
+// webhook returns 2xx or Config.MaxAttempts is reached.
+type Alerter struct {
+	dbm    db.Manager
+	cfg    Config
+	stats  *stats.Stats
+	client *http.Client
+}
+
+func NewAlerter(dbm db.Manager, cfg Config, stats *stats.Stats) *Alerter {
+	a := &Alerter{
+		dbm:   dbm,
+		cfg:   cfg,
+		stats: stats,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+		},
+	}
+	return a
+}
+
+func (a *Alerter) Run() {
+	if a.cfg.Interval <= 0 {
+		revel.WARN.Printf("Alerter disabled: alert.interval=%s", a.cfg.Interval)
+		return
+	}
+	t := time.NewTicker(a.cfg.Interval)
+	defer t.Stop()
+	for now := range t.C {
+		if err := a.dbm.Open(); err != nil {
+			revel.ERROR.Printf("Alerter: dbm.Open: %s", err)
+			continue
+		}
+		if _, err := a.Evaluate(now); err != nil {
+			revel.ERROR.Printf("Alerter: %s", err)
+		}
+		if _, err := a.Deliver(now); err != nil {
+			revel.ERROR.Printf("Alerter: %s", err)
+		}
+	}
+}
+
+// Evaluate evaluates all enabled rules and queues a notification for every
+// query that matches and wasn't notified within the dedup time. It returns
+// the number of notifications queued. A rule that can't be evaluated, e.g.
+// because its instance was deleted, doesn't stop the other rules.
+func (a *Alerter) Evaluate(now time.Time) (uint, error) {
+	rules, err := NewMySQLHandler(a.dbm).GetAll(true)
+	if err != nil {
+		return 0, err
+	}
+	var queued uint
+	for _, r := range rules {
+		n, err := a.evaluate(r, now)
+		queued += n
+		if err != nil {
+			revel.ERROR.Printf("Alerter: rule %d: %s", r.Id, err)
+		}
+	}
+	if queued > 0 {
+		a.stats.Inc(a.stats.System("alerts-queued"), int64(queued), a.stats.SampleRate)
+	}
+	return queued, nil
+}
+
+func (a *Alerter) evaluate(r Rule, now time.Time) (uint, error) {
+	instanceIds, err := instance.GetInstanceIds(a.dbm.Context(), a.dbm.DB(), []string{r.InstanceUUID})
+	if err != nil {
+		return 0, err
+	}
+	if len(instanceIds) == 0 {
+		return 0, fmt.Errorf("instance %s not found", r.InstanceUUID)
+	}
+
+	end := now.UTC().Truncate(time.Second)
+	begin := end.Add(-time.Duration(r.Window) * time.Second)
+	metric, stat := r.Metric, r.Stat
+	if r.Type != TypeShare {
+		metric, stat = "Query_time", "sum" // by load
+	}
+	rank, err := models.NewRankBy(metric, stat, profileLimit)
+	if err != nil {
+		return 0, err
+	}
+	profile, err := models.Report.ProfileRanks(a.dbm.Context(), instanceIds, begin, end, rank, r.Type == TypeNew)
+	if err != nil {
+		return 0, err
+	}
+
+	var queued uint
+	for i, q := range profile.Query {
+		if i == 0 || !Matches(r, q) {
+			continue // 0 is the total
+		}
+		sent, err := a.queue(r, q, begin, end)
+		if err != nil {
+			return queued, err
+		}
+		if sent {
+			queued++
+		}
+	}
+	return queued, nil
+}
+
+// Matches returns true if the query of a profile evaluated for the rule
+// matches the rule.
+func Matches(r Rule, q models.QueryRank) bool {
+	switch r.Type {
+	case TypeShare:
+		// The profile is ranked by the rule's Metric and Stat, but
+		// Percentage is always the Query_time share.
+		return q.RankPercentage > r.Threshold
+	case TypeLoad, TypeNew:
+		// For TypeNew the profile only has queries first seen in the
+		// window, see Report.Profile.
+		return q.Load > r.Threshold
+	}
+	return false
+}
+
+// queue inserts a pending notification unless the rule and query were
+// notified within the dedup time. It returns true if one was inserted.
+func (a *Alerter) queue(r Rule, q models.QueryRank, begin, end time.Time) (bool, error) {
+	var n int
+	err := a.dbm.DB().QueryRow(
+		"SELECT COUNT(*) FROM alert_notifications WHERE rule_id = ? AND checksum = ? AND fired_at > ?",
+		r.Id, q.ID, end.Add(-a.cfg.Dedup)).Scan(&n)
+	if err != nil {
+		return false, mysql.Error(err, "Alerter.queue: SELECT alert_notifications")
+	}
+	if n > 0 {
+		return false, nil
+	}
+	payload, err := json.Marshal(Payload{
+		Rule:  r,
+		Begin: begin,
+		End:   end,
+		Query: q,
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = a.dbm.DB().Exec(
+		"INSERT INTO alert_notifications (rule_id, checksum, fired_at, payload, status, next_attempt)"+
+			" VALUES (?, ?, ?, ?, ?, ?)",
+		r.Id, q.ID, end, payload, StatusPending, end)
+	if err != nil {
+		return false, mysql.Error(err, "Alerter.queue: INSERT alert_notifications")
+	}
+	return true, nil
+}
+
+// Deliver POSTs the pending notifications that are due and returns the
+// number sent.
+func (a *Alerter) Deliver(now time.Time) (uint, error) {
+	type notification struct {
+		id       uint64
+		url      string
+		payload  []byte
+		attempts uint
+	}
+	rows, err := a.dbm.DB().Query(
+		"SELECT n.notification_id, r.webhook_url, n.payload, n.attempts"+
+			" FROM alert_notifications n JOIN alert_rules r ON r.rule_id = n.rule_id"+
+			" WHERE n.status = ? AND n.next_attempt <= ?"+
+			" ORDER BY n.next_attempt"+
+			fmt.Sprintf(" LIMIT %d", deliverBatch),
+		StatusPending, now.UTC())
+	if err != nil {
+		return 0, mysql.Error(err, "Alerter.Deliver: SELECT alert_notifications")
+	}
+	due := []notification{}
+	for rows.Next() {
+		n := notification{}
+		if err := rows.Scan(&n.id, &n.url, &n.payload, &n.attempts); err != nil {
+			rows.Close()
+			return 0, mysql.Error(err, "Alerter.Deliver: rows.Scan")
+		}
+		due = append(due, n)
+	}
+	rows.Close()
+
+	var sent uint
+	for _, n := range due {
+		n.attempts++
+		postErr := a.post(n.url, n.payload)
+		var err error
+		switch {
+		case postErr == nil:
+			sent++
+			_, err = a.dbm.DB().Exec(
+				"UPDATE alert_notifications SET status = ?, attempts = ?, sent_at = ?, last_error = NULL"+
+					" WHERE notification_id = ?",
+				StatusSent, n.attempts, now.UTC(), n.id)
+		case n.attempts >= a.cfg.MaxAttempts:
+			revel.WARN.Printf("Alerter: notification %d failed after %d attempts: %s", n.id, n.attempts, postErr)
+			a.stats.Inc(a.stats.System("alerts-failed"), 1, a.stats.SampleRate)
+			_, err = a.dbm.DB().Exec(
+				"UPDATE alert_notifications SET status = ?, attempts = ?, last_error = ? WHERE notification_id = ?",
+				StatusFailed, n.attempts, truncate(postErr.Error(), 255), n.id)
+		default:
+			_, err = a.dbm.DB().Exec(
+				"UPDATE alert_notifications SET attempts = ?, next_attempt = ?, last_error = ? WHERE notification_id = ?",
+				n.attempts, now.UTC().Add(Backoff(a.cfg.Backoff, a.cfg.MaxBackoff, n.attempts)), truncate(postErr.Error(), 255), n.id)
+		}
+		if err != nil {
+			return sent, mysql.Error(err, "Alerter.Deliver: UPDATE alert_notifications")
+		}
+	}
+	if sent > 0 {
+		a.stats.Inc(a.stats.System("alerts-sent"), int64(sent), a.stats.SampleRate)
+	}
+	return sent, nil
+}
+
+func (a *Alerter) post(url string, payload []byte) error {
+	resp, err := a.client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Backoff returns the wait before the next attempt after the given number of
+// failed attempts: base, 2*base, 4*base, ... up to max.
+func Backoff(base, max time.Duration, attempts uint) time.Duration {
+	d := base
+	for i := uint(1); i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
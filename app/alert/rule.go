@@ -0,0 +1,256 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package alert evaluates alert rules against query profiles and POSTs the
+// queries that match to webhooks.
+package alert
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/app/models"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+)
+
+// Rule types
+const (
+	// A query's share of the total Metric sum is greater than Threshold,
+	// e.g. 0.2 for 20% of Query_time_sum.
+	TypeShare = "share"
+	// A query's load (Query_time_sum / Window) is greater than Threshold.
+	TypeLoad = "load"
+	// A query first seen in the Window has load greater than Threshold.
+	TypeNew = "new"
+)
+
+const defaultWindow = 3600 // 1h
+
+// Rule is evaluated every alert.interval against the query profile of the
+// instance for the last Window seconds.
+type Rule struct {
+	Id           uint
+	Name         string
+	InstanceUUID string
+	Type         string  // TypeShare, TypeLoad or TypeNew
+	Metric       string  // for TypeShare, default Query_time
+	Stat         string  // for TypeShare, only sum
+	Threshold    float64 // see Type
+	Window       uint    // seconds, default 3600
+	WebhookURL   string
+	Enabled      bool
+	Created      time.Time
+	Updated      time.Time
+}
+
+// Validate checks the rule and sets the defaults.
+func (r *Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	if r.InstanceUUID == "" {
+		return fmt.Errorf("InstanceUUID is required")
+	}
+	switch r.Type {
+	case TypeShare:
+		if r.Threshold <= 0 || r.Threshold >= 1 {
+			return fmt.Errorf("invalid Threshold: %f: must be a share between 0 and 1", r.Threshold)
+		}
+		rank, err := models.NewRankBy(r.Metric, r.Stat, 0)
+		if err != nil {
+			return err
+		}
+		// Only sums add up to the total, a query's max or p95 isn't a
+		// share of the total max or p95.
+		if rank.Stat != "sum" {
+			return fmt.Errorf("invalid Stat for %s rules: %s: only sum is a share", TypeShare, rank.Stat)
+		}
+		r.Metric, r.Stat = rank.Metric, rank.Stat
+	case TypeLoad, TypeNew:
+		if r.Metric != "" || r.Stat != "" {
+			return fmt.Errorf("Metric and Stat are only for %s rules", TypeShare)
+		}
+		if r.Threshold < 0 {
+			return fmt.Errorf("invalid Threshold: %f", r.Threshold)
+		}
+	default:
+		return fmt.Errorf("invalid Type: %s: must be %s, %s or %s", r.Type, TypeShare, TypeLoad, TypeNew)
+	}
+	if r.Window == 0 {
+		r.Window = defaultWindow
+	}
+	u, err := url.Parse(r.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid WebhookURL: %s: must be an http or https URL", r.WebhookURL)
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------------
+
+type MySQLHandler struct {
+	dbm db.Manager
+}
+
+func NewMySQLHandler(dbm db.Manager) *MySQLHandler {
+	h := &MySQLHandler{
+		dbm: dbm,
+	}
+	return h
+}
+
+const ruleCols = "rule_id, name, instance_uuid, type, metric, stat, threshold, window_sec, webhook_url, enabled, created, updated"
+
+// Create inserts a validated rule and returns its ID.
+func (h *MySQLHandler) Create(r Rule) (uint, error) {
+	res, err := h.dbm.DB().ExecContext(h.dbm.Context(),
+		"INSERT INTO alert_rules"+
+			" (name, instance_uuid, type, metric, stat, threshold, window_sec, webhook_url, enabled)"+
+			" VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		r.Name, r.InstanceUUID, r.Type, r.Metric, r.Stat, r.Threshold, r.Window, r.WebhookURL, r.Enabled)
+	if err != nil {
+		return 0, mysql.Error(err, "alert.MySQLHandler.Create: INSERT alert_rules")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("cannot get alert rule last insert id")
+	}
+	return uint(id), nil
+}
+
+func (h *MySQLHandler) Get(id uint) (*Rule, error) {
+	r, err := scanRule(h.dbm.DB().QueryRowContext(h.dbm.Context(), "SELECT "+ruleCols+" FROM alert_rules WHERE rule_id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, shared.ErrNotFound
+	}
+	if err != nil {
+		return nil, mysql.Error(err, "alert.MySQLHandler.Get: SELECT alert_rules")
+	}
+	return r, nil
+}
+
+// GetAll returns all rules, or only the enabled ones.
+func (h *MySQLHandler) GetAll(onlyEnabled bool) ([]Rule, error) {
+	q := "SELECT " + ruleCols + " FROM alert_rules"
+	if onlyEnabled {
+		q += " WHERE enabled"
+	}
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(), q+" ORDER BY rule_id")
+	if err != nil {
+		return nil, mysql.Error(err, "alert.MySQLHandler.GetAll: SELECT alert_rules")
+	}
+	defer rows.Close()
+	rules := []Rule{}
+	for rows.Next() {
+		r, err := scanRule(rows)
+		if err != nil {
+			return nil, mysql.Error(err, "alert.MySQLHandler.GetAll: rows.Scan")
+		}
+		rules = append(rules, *r)
+	}
+	return rules, mysql.Error(rows.Err(), "alert.MySQLHandler.GetAll: rows.Next")
+}
+
+// Update replaces the validated rule with ID r.Id.
+func (h *MySQLHandler) Update(r Rule) error {
+	if _, err := h.Get(r.Id); err != nil {
+		return err
+	}
+	_, err := h.dbm.DB().ExecContext(h.dbm.Context(),
+		"UPDATE alert_rules SET"+
+			" name = ?, instance_uuid = ?, type = ?, metric = ?, stat = ?, threshold = ?,"+
+			" window_sec = ?, webhook_url = ?, enabled = ?"+
+			" WHERE rule_id = ?",
+		r.Name, r.InstanceUUID, r.Type, r.Metric, r.Stat, r.Threshold, r.Window, r.WebhookURL, r.Enabled, r.Id)
+	return mysql.Error(err, "alert.MySQLHandler.Update: UPDATE alert_rules")
+}
+
+// Delete deletes the rule and its notifications.
+func (h *MySQLHandler) Delete(id uint) error {
+	res, err := h.dbm.DB().ExecContext(h.dbm.Context(), "DELETE FROM alert_rules WHERE rule_id = ?", id)
+	if err != nil {
+		return mysql.Error(err, "alert.MySQLHandler.Delete: DELETE alert_rules")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return shared.ErrNotFound
+	}
+	_, err = h.dbm.DB().ExecContext(h.dbm.Context(), "DELETE FROM alert_notifications WHERE rule_id = ?", id)
+	return mysql.Error(err, "alert.MySQLHandler.Delete: DELETE alert_notifications")
+}
+
+// Notification is a webhook notification of a query that matched a rule.
+type Notification struct {
+	Id          uint64
+	RuleId      uint
+	QueryId     string // checksum
+	FiredAt     time.Time
+	Status      string // StatusPending, StatusSent or StatusFailed
+	Attempts    uint
+	NextAttempt time.Time
+	SentAt      *time.Time
+	LastError   string
+}
+
+// Notifications returns the latest notifications of the rule, the most
+// recent first.
+func (h *MySQLHandler) Notifications(ruleId uint, limit uint) ([]Notification, error) {
+	if _, err := h.Get(ruleId); err != nil {
+		return nil, err
+	}
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(),
+		"SELECT notification_id, rule_id, checksum, fired_at, status, attempts, next_attempt, sent_at, COALESCE(last_error, '')"+
+			" FROM alert_notifications WHERE rule_id = ?"+
+			" ORDER BY fired_at DESC, notification_id DESC"+
+			fmt.Sprintf(" LIMIT %d", limit),
+		ruleId)
+	if err != nil {
+		return nil, mysql.Error(err, "alert.MySQLHandler.Notifications: SELECT alert_notifications")
+	}
+	defer rows.Close()
+	notifications := []Notification{}
+	for rows.Next() {
+		n := Notification{}
+		var sentAt sql.NullTime
+		err := rows.Scan(&n.Id, &n.RuleId, &n.QueryId, &n.FiredAt, &n.Status, &n.Attempts, &n.NextAttempt, &sentAt, &n.LastError)
+		if err != nil {
+			return nil, mysql.Error(err, "alert.MySQLHandler.Notifications: rows.Scan")
+		}
+		if sentAt.Valid {
+			n.SentAt = &sentAt.Time
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, mysql.Error(rows.Err(), "alert.MySQLHandler.Notifications: rows.Next")
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRule(row scanner) (*Rule, error) {
+	r := &Rule{}
+	err := row.Scan(&r.Id, &r.Name, &r.InstanceUUID, &r.Type, &r.Metric, &r.Stat, &r.Threshold,
+		&r.Window, &r.WebhookURL, &r.Enabled, &r.Created, &r.Updated)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
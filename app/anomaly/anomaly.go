@@ -0,0 +1,286 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package anomaly detects query classes whose latency or query count
+// deviates from their usual value for the same hour of the week.
+//
+// The baseline of a query class on an instance for an hour of the week is
+// the mean and standard deviation of its hourly Query_time_avg and
+// query_count in the same hour of the previous weeks. Hourly values are read
+// from the hourly rollup, so the analyzer is only as current as the rollup.
+package anomaly
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/revel/revel"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/app/rollup"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+	"github.com/shatteredsilicon/qan-api/stats"
+)
+
+// Metrics that have a baseline, as stored in query_anomalies.metric.
+const (
+	MetricQueryTimeAvg = "Query_time_avg"
+	MetricQueryCount   = "query_count"
+)
+
+const week = 7 * 24 * time.Hour
+
+// minRelStddev is the min stddev relative to the mean used for scoring.
+// Without it a query class whose value barely changed in the baseline weeks
+// is an anomaly on the slightest change.
+const minRelStddev = 0.1
+
+type Config struct {
+	Interval      time.Duration // how often to analyze
+	Threshold     float64       // stddevs from the mean to be an anomaly
+	BaselineWeeks int           // weeks in the baseline
+	MinSamples    int           // min weeks a class must be in the baseline to be scored
+	Lookback      time.Duration // hours before the end of the hourly rollup to (re)analyze
+}
+
+// LoadConfig reads the anomaly config from app.conf:
+//
+//	anomaly.interval             = 5m
+//	anomaly.threshold            = 3
+//	anomaly.baseline.weeks       = 4
+//	anomaly.baseline.min_samples = 3
+//	anomaly.lookback             = 3h
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		BaselineWeeks: revel.Config.IntDefault("anomaly.baseline.weeks", 4),
+		MinSamples:    revel.Config.IntDefault("anomaly.baseline.min_samples", 3),
+	}
+	var err error
+	if cfg.Interval, err = time.ParseDuration(revel.Config.StringDefault("anomaly.interval", "5m")); err != nil {
+		return cfg, fmt.Errorf("invalid anomaly.interval: %s", err)
+	}
+	if cfg.Lookback, err = time.ParseDuration(revel.Config.StringDefault("anomaly.lookback", "3h")); err != nil {
+		return cfg, fmt.Errorf("invalid anomaly.lookback: %s", err)
+	}
+	if cfg.Threshold, err = strconv.ParseFloat(revel.Config.StringDefault("anomaly.threshold", "3"), 64); err != nil || cfg.Threshold <= 0 {
+		return cfg, fmt.Errorf("invalid anomaly.threshold: %s", revel.Config.StringDefault("anomaly.threshold", ""))
+	}
+	if cfg.BaselineWeeks < 1 {
+		return cfg, fmt.Errorf("invalid anomaly.baseline.weeks: %d", cfg.BaselineWeeks)
+	}
+	if cfg.MinSamples < 1 || cfg.MinSamples > cfg.BaselineWeeks {
+		return cfg, fmt.Errorf("invalid anomaly.baseline.min_samples: %d: must be between 1 and anomaly.baseline.weeks", cfg.MinSamples)
+	}
+	return cfg, nil
+}
+
+// HourOfWeek returns the hour of the week of t in UTC, 0 = Sunday 00:00.
+func HourOfWeek(t time.Time) int {
+	t = t.UTC()
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+// Score returns how many stddevs value is from mean, positive if value is
+// greater. stddev is raised to minRelStddev of the mean. ok is false if
+// there is no deviation to score against, i.e. mean and stddev are zero.
+func Score(value, mean, stddev float64) (score float64, ok bool) {
+	d := math.Max(stddev, math.Abs(mean)*minRelStddev)
+	if d == 0 {
+		return 0, false
+	}
+	return (value - mean) / d, true
+}
+
+// Analyzer periodically updates the baselines in query_class_baselines and
+// records the hourly values that deviate from them in query_anomalies.
+// Every run re-analyzes the hours within the lookback, so anomalies are
+// updated when late data is rolled up.
+type Analyzer struct {
+	dbm   db.Manager
+	cfg   Config
+	stats *stats.Stats
+}
+
+func NewAnalyzer(dbm db.Manager, cfg Config, stats *stats.Stats) *Analyzer {
+	a := &Analyzer{
+		dbm:   dbm,
+		cfg:   cfg,
+		stats: stats,
+	}
+	return a
+}
+
+func (a *Analyzer) Run() {
+	if a.cfg.Interval <= 0 {
+		revel.WARN.Printf("Anomaly analyzer disabled: anomaly.interval=%s", a.cfg.Interval)
+		return
+	}
+	t := time.NewTicker(a.cfg.Interval)
+	defer t.Stop()
+	for range t.C {
+		if _, err := a.Analyze(); err != nil {
+			revel.ERROR.Printf("Anomaly analyzer: %s", err)
+		}
+	}
+}
+
+// Analyze analyzes the hours in the lookback up to the end of the hourly
+// rollup and returns the number of anomalies recorded.
+func (a *Analyzer) Analyze() (uint, error) {
+	if err := a.dbm.Open(); err != nil {
+		return 0, fmt.Errorf("dbm.Open: %s", err)
+	}
+	upTo, err := rollup.RolledUpTo(a.dbm.DB(), rollup.Hourly)
+	if err != nil {
+		return 0, err
+	}
+	if upTo.IsZero() {
+		return 0, nil // not rolled up yet
+	}
+	upTo = upTo.UTC().Truncate(time.Hour)
+
+	var total uint
+	t := time.Now()
+	for hour := upTo.Add(-a.cfg.Lookback).Truncate(time.Hour); hour.Before(upTo); hour = hour.Add(time.Hour) {
+		n, err := a.AnalyzeHour(hour)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	a.stats.TimingDuration(a.stats.System("anomaly-analyze"), time.Now().Sub(t), a.stats.SampleRate)
+	if total > 0 {
+		a.stats.Inc(a.stats.System("anomalies"), int64(total), a.stats.SampleRate)
+		revel.INFO.Printf("Anomaly analyzer: %d anomalies up to %s", total, upTo)
+	}
+	return total, nil
+}
+
+// AnalyzeHour updates the baselines for the hour of the week of hour from
+// the weeks before it, then records the query classes whose values in hour
+// deviate from them. It returns the number of anomalies recorded.
+func (a *Analyzer) AnalyzeHour(hour time.Time) (uint, error) {
+	hour = hour.UTC().Truncate(time.Hour)
+	how := HourOfWeek(hour)
+	if err := a.updateBaselines(hour, how); err != nil {
+		return 0, err
+	}
+
+	rows, err := a.dbm.DB().Query(
+		"SELECT qcm.query_class_id, qcm.instance_id, qcm.Query_time_avg, qcm.query_count,"+
+			" b.query_time_avg_mean, b.query_time_avg_stddev, b.query_count_mean, b.query_count_stddev"+
+			" FROM "+rollup.Hourly.ClassTable+" qcm"+
+			" JOIN query_class_baselines b"+
+			"  ON b.query_class_id = qcm.query_class_id AND b.instance_id = qcm.instance_id AND b.hour_of_week = ?"+
+			" WHERE qcm.start_ts = ? AND b.samples >= ?",
+		how, hour, a.cfg.MinSamples)
+	if err != nil {
+		return 0, mysql.Error(err, "Analyzer: SELECT "+rollup.Hourly.ClassTable)
+	}
+	var found []anomaly
+	for rows.Next() {
+		var classID, instanceID uint
+		var avg, avgMean, avgStddev *float64
+		var cnt, cntMean, cntStddev float64
+		if err := rows.Scan(&classID, &instanceID, &avg, &cnt, &avgMean, &avgStddev, &cntMean, &cntStddev); err != nil {
+			rows.Close()
+			return 0, mysql.Error(err, "Analyzer: rows.Scan")
+		}
+		if score, ok := Score(cnt, cntMean, cntStddev); ok && math.Abs(score) >= a.cfg.Threshold {
+			found = append(found, anomaly{classID, instanceID, MetricQueryCount, cnt, cntMean, cntStddev, score})
+		}
+		if avg == nil || avgMean == nil || avgStddev == nil {
+			continue // no Query_time, e.g. counters only
+		}
+		if score, ok := Score(*avg, *avgMean, *avgStddev); ok && math.Abs(score) >= a.cfg.Threshold {
+			found = append(found, anomaly{classID, instanceID, MetricQueryTimeAvg, *avg, *avgMean, *avgStddev, score})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, mysql.Error(err, "Analyzer: rows.Next")
+	}
+
+	// Remove anomalies of a previous run of this hour that aren't anomalies
+	// anymore after late data was rolled up.
+	if _, err := a.dbm.DB().Exec("DELETE FROM query_anomalies WHERE start_ts = ?", hour); err != nil {
+		return 0, mysql.Error(err, "Analyzer: DELETE query_anomalies")
+	}
+	if len(found) == 0 {
+		return 0, nil
+	}
+	vals := make([]string, len(found))
+	args := make([]interface{}, 0, len(found)*8)
+	for i, f := range found {
+		vals[i] = "(?, ?, ?, ?, ?, ?, ?, ?)"
+		args = append(args, f.classID, f.instanceID, hour, f.metric, f.value, f.mean, f.stddev, f.score)
+	}
+	_, err = a.dbm.DB().Exec(
+		"INSERT INTO query_anomalies"+
+			" (query_class_id, instance_id, start_ts, metric, value, baseline_mean, baseline_stddev, score)"+
+			" VALUES "+strings.Join(vals, ", "),
+		args...)
+	if err != nil {
+		return 0, mysql.Error(err, "Analyzer: INSERT query_anomalies")
+	}
+	return uint(len(found)), nil
+}
+
+type anomaly struct {
+	classID    uint
+	instanceID uint
+	metric     string
+	value      float64
+	mean       float64
+	stddev     float64
+	score      float64
+}
+
+// updateBaselines computes the baselines for hour of the week how from the
+// same hour in the weeks before hour. A week without queries is a zero
+// query_count, but doesn't count for Query_time_avg. The old baselines are
+// deleted first so a class without queries in any of the weeks has none.
+func (a *Analyzer) updateBaselines(hour time.Time, how int) error {
+	if _, err := a.dbm.DB().Exec("DELETE FROM query_class_baselines WHERE hour_of_week = ?", how); err != nil {
+		return mysql.Error(err, "Analyzer: DELETE query_class_baselines")
+	}
+	n := a.cfg.BaselineWeeks
+	args := make([]interface{}, 0, n+1)
+	args = append(args, how)
+	for i := 1; i <= n; i++ {
+		args = append(args, hour.Add(-time.Duration(i)*week))
+	}
+	_, err := a.dbm.DB().Exec(
+		"REPLACE INTO query_class_baselines"+
+			" (query_class_id, instance_id, hour_of_week, samples,"+
+			"  query_time_avg_mean, query_time_avg_stddev, query_count_mean, query_count_stddev)"+
+			" SELECT query_class_id, instance_id, ?, COUNT(*),"+
+			"  AVG(Query_time_avg), STDDEV_POP(Query_time_avg),"+
+			fmt.Sprintf("  SUM(query_count) / %d,", n)+
+			fmt.Sprintf("  SQRT(GREATEST(SUM(query_count * query_count) / %d - POW(SUM(query_count) / %d, 2), 0))", n, n)+
+			" FROM "+rollup.Hourly.ClassTable+
+			" WHERE start_ts IN ("+shared.Placeholders(n)+")"+
+			" GROUP BY query_class_id, instance_id",
+		args...)
+	if err != nil {
+		return mysql.Error(err, "Analyzer: REPLACE query_class_baselines")
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package anomaly_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/anomaly"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/config"
+	"github.com/shatteredsilicon/qan-api/stats"
+	testDb "github.com/shatteredsilicon/qan-api/tests/setup/db"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ScoreTestSuite struct{}
+
+var _ = Suite(&ScoreTestSuite{})
+
+func (s *ScoreTestSuite) TestScore(t *C) {
+	score, ok := anomaly.Score(13, 10, 1)
+	t.Check(ok, Equals, true)
+	t.Check(score, Equals, 3.0)
+
+	score, ok = anomaly.Score(7, 10, 1)
+	t.Check(ok, Equals, true)
+	t.Check(score, Equals, -3.0)
+
+	// A baseline that never changed is scored against 10% of the mean.
+	score, ok = anomaly.Score(12, 10, 0)
+	t.Check(ok, Equals, true)
+	t.Check(score, Equals, 2.0)
+
+	_, ok = anomaly.Score(1, 0, 0)
+	t.Check(ok, Equals, false)
+}
+
+func (s *ScoreTestSuite) TestHourOfWeek(t *C) {
+	t.Check(anomaly.HourOfWeek(time.Date(2015, time.May, 03, 0, 0, 0, 0, time.UTC)), Equals, 0) // Sunday
+	t.Check(anomaly.HourOfWeek(time.Date(2015, time.May, 04, 10, 30, 0, 0, time.UTC)), Equals, 34)
+	t.Check(anomaly.HourOfWeek(time.Date(2015, time.May, 02, 23, 0, 0, 0, time.UTC)), Equals, 167)
+}
+
+// --------------------------------------------------------------------------
+
+type AnalyzerTestSuite struct {
+	testDb *testDb.Db
+	cfg    anomaly.Config
+}
+
+var _ = Suite(&AnalyzerTestSuite{})
+
+func (s *AnalyzerTestSuite) SetUpSuite(t *C) {
+	dsn := config.Get("mysql.dsn")
+	s.testDb = testDb.NewDb(dsn, config.SchemaDir, config.TestDir)
+	if err := s.testDb.Start(); err != nil {
+		t.Fatalf("Could not prepare org db for %s: %s", dsn, err)
+	}
+	s.cfg = anomaly.Config{
+		Threshold:     3,
+		BaselineWeeks: 4,
+		MinSamples:    3,
+		Lookback:      3 * time.Hour,
+	}
+}
+
+func (s *AnalyzerTestSuite) SetUpTest(t *C) {
+	s.testDb.TruncateDataTables()
+}
+
+func (s *AnalyzerTestSuite) insertHour(t *C, classID uint, hour time.Time, cnt uint, avg float64) {
+	_, err := s.testDb.DB().Exec(
+		"INSERT INTO query_class_metrics_hourly"+
+			" (query_class_id, instance_id, start_ts, end_ts, query_count, Query_time_sum, Query_time_avg)"+
+			" VALUES (?, 1, ?, ?, ?, ?, ?)",
+		classID, hour, hour.Add(time.Hour), cnt, float64(cnt)*avg, avg)
+	t.Assert(err, IsNil)
+}
+
+// --------------------------------------------------------------------------
+
+func (s *AnalyzerTestSuite) TestAnalyze(t *C) {
+	hour := time.Date(2015, time.May, 04, 10, 0, 0, 0, time.UTC)
+	week := 7 * 24 * time.Hour
+
+	// Class 1 got 10x slower, class 2 is as usual, class 3 is new.
+	for i, v := range []struct {
+		cnt uint
+		avg float64
+	}{{100, 0.10}, {110, 0.11}, {90, 0.09}, {100, 0.10}} {
+		prev := hour.Add(-time.Duration(i+1) * week)
+		s.insertHour(t, 1, prev, v.cnt, v.avg)
+		s.insertHour(t, 2, prev, v.cnt, v.avg)
+	}
+	s.insertHour(t, 1, hour, 100, 1.0)
+	s.insertHour(t, 2, hour, 105, 0.105)
+	s.insertHour(t, 3, hour, 1000, 5.0)
+	_, err := s.testDb.DB().Exec("INSERT INTO query_rollups (level, rolled_up_to) VALUES ('hourly', ?)", hour.Add(time.Hour))
+	t.Assert(err, IsNil)
+
+	a := anomaly.NewAnalyzer(db.DBManager, s.cfg, stats.NullStats())
+	n, err := a.Analyze()
+	t.Assert(err, IsNil)
+	t.Check(n, Equals, uint(1))
+
+	var classID uint
+	var metric string
+	var start time.Time
+	var score float64
+	err = s.testDb.DB().QueryRow("SELECT query_class_id, metric, start_ts, score FROM query_anomalies").Scan(&classID, &metric, &start, &score)
+	t.Assert(err, IsNil)
+	t.Check(classID, Equals, uint(1))
+	t.Check(metric, Equals, anomaly.MetricQueryTimeAvg)
+	t.Check(start.Equal(hour), Equals, true)
+	t.Check(score > 3, Equals, true)
+
+	// Analyzing again, e.g. after late data, doesn't duplicate anomalies.
+	n, err = a.Analyze()
+	t.Assert(err, IsNil)
+	t.Check(n, Equals, uint(1))
+	var cnt int
+	err = s.testDb.DB().QueryRow("SELECT COUNT(*) FROM query_anomalies").Scan(&cnt)
+	t.Assert(err, IsNil)
+	t.Check(cnt, Equals, 1)
+}
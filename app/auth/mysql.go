@@ -22,6 +22,7 @@ import (
 
 	"github.com/shatteredsilicon/qan-api/app/db"
 	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/app/instance"
 )
 
 type MySQLHandler struct {
@@ -40,8 +41,8 @@ func (h *MySQLHandler) GetAgentId(uuid string) (uint, error) {
 	if err := h.dbm.Open(); err != nil {
 		return 0, mysql.Error(err, "auth.MySQLHandler.GetAgentId: dbm.Open")
 	}
-	err := h.dbm.DB().QueryRow(
-		"SELECT instance_id FROM instances WHERE uuid = ? AND subsystem_id = 2 AND (deleted IS NULL OR YEAR(deleted)=1970) ",
-		uuid).Scan(&instanceId)
+	err := h.dbm.DB().QueryRowContext(h.dbm.Context(),
+		"SELECT instance_id FROM instances WHERE uuid = ? AND subsystem_id = ? AND (deleted IS NULL OR YEAR(deleted)=1970) ",
+		uuid, instance.SubsystemAgent).Scan(&instanceId)
 	return instanceId, mysql.Error(err, "auth.MySQLHandler.GetAgentId: SELECT instances")
 }
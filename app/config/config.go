@@ -42,7 +42,7 @@ func (h *MySQLHandler) GetQAN(instanceId uint) ([]pc.RunningQAN, error) {
 		" FROM agent_configs c" +
 		" LEFT JOIN instances i ON (c.agent_instance_id = i.instance_id)" +
 		" WHERE service='qan' AND other_instance_id = ?"
-	rows, err := h.dbm.DB().Query(q, instanceId)
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(), q, instanceId)
 	if err != nil {
 		return nil, err
 	}
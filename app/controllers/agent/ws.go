@@ -119,7 +119,6 @@ func (c Agent) Data(conn *websocket.Conn) revel.Result {
 	wsConn := ws.ExistingConnection(origin, c.Request.URL.String(), conn)
 	defer wsConn.Disconnect()
 
-	dbStats := msgStats // copy
 	dbm := db.NewMySQLManager()
 	if err := dbm.Open(); err != nil {
 		return c.RenderError(fmt.Errorf("Agent.Data: dbm.Open: %s", err.Error()))
@@ -129,17 +128,17 @@ func (c Agent) Data(conn *websocket.Conn) revel.Result {
 	// create instance handler
 	ih := instance.NewMySQLHandler(dbm)
 
-	dbh := qan.NewMySQLMetricWriter(dbm, ih, shared.QueryAbstracter, &dbStats)
-
-	// Read and queue log entries from agent.
+	// Read and queue data from agent.
 	dataStats := msgStats // copy
 
 	// Synchronous data transfer from agent to API: agent sends data as proto.Data,
-	// API accepts, queues, and sends data.Response; repeat.
-	if err := qan.SaveData(wsConn, agentId, dbh, &dataStats); err != nil {
+	// API spools it in qan.DataQueue and sends data.Response; repeat.
+	if err := qan.SaveData(wsConn, agentId, ih, qan.DataQueue, &dataStats); err != nil {
 		switch err {
 		case io.EOF:
 			// We got everything, client disconnected.
+		case qan.ErrQueueFull:
+			// Agent sends the rest later, SaveData logged it.
 		default:
 			return c.RenderError(fmt.Errorf("Agent.Data: qan.SaveData: %s", err.Error()))
 		}
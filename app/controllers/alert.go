@@ -0,0 +1,168 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/revel/revel"
+	"github.com/shatteredsilicon/qan-api/app/alert"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/instance"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+)
+
+type Alert struct {
+	BackEnd
+}
+
+// GET /alerts/rules
+func (c *Alert) List() revel.Result {
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Alert.List: dbm.Open")
+	}
+	rules, err := alert.NewMySQLHandler(dbm).GetAll(false)
+	if err != nil {
+		return c.Error(err, "Alert.List: ah.GetAll")
+	}
+	return c.RenderJSON(rules)
+}
+
+// POST /alerts/rules
+func (c *Alert) Create() revel.Result {
+	r, res := c.readRule()
+	if res != nil {
+		return res
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Alert.Create: dbm.Open")
+	}
+	if res := c.checkInstance(dbm, r.InstanceUUID); res != nil {
+		return res
+	}
+	id, err := alert.NewMySQLHandler(dbm).Create(r)
+	if err != nil {
+		return c.Error(err, "Alert.Create: ah.Create")
+	}
+
+	return c.RenderCreated(fmt.Sprintf("%s/alerts/rules/%d", c.Args["httpBase"].(string), id))
+}
+
+// GET /alerts/rules/:id
+func (c *Alert) Get(id uint) revel.Result {
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Alert.Get: dbm.Open")
+	}
+	r, err := alert.NewMySQLHandler(dbm).Get(id)
+	if err != nil {
+		return c.Error(err, "Alert.Get: ah.Get")
+	}
+	return c.RenderJSON(r)
+}
+
+// PUT /alerts/rules/:id
+func (c *Alert) Update(id uint) revel.Result {
+	r, res := c.readRule()
+	if res != nil {
+		return res
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Alert.Update: dbm.Open")
+	}
+	if res := c.checkInstance(dbm, r.InstanceUUID); res != nil {
+		return res
+	}
+	// Like Instance.Update, the ID in the body is ignored.
+	r.Id = id
+	if err := alert.NewMySQLHandler(dbm).Update(r); err != nil {
+		return c.Error(err, "Alert.Update: ah.Update")
+	}
+
+	return c.RenderNoContent()
+}
+
+// DELETE /alerts/rules/:id
+func (c *Alert) Delete(id uint) revel.Result {
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Alert.Delete: dbm.Open")
+	}
+	if err := alert.NewMySQLHandler(dbm).Delete(id); err != nil {
+		return c.Error(err, "Alert.Delete: ah.Delete")
+	}
+	return c.RenderNoContent()
+}
+
+// GET /alerts/rules/:id/notifications
+func (c *Alert) Notifications(id uint) revel.Result {
+	var limit uint
+	c.Params.Bind(&limit, "limit")
+	if limit == 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		return c.BadRequest(nil, "invalid limit: must be between 1 and 1000")
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Alert.Notifications: dbm.Open")
+	}
+	notifications, err := alert.NewMySQLHandler(dbm).Notifications(id, limit)
+	if err != nil {
+		return c.Error(err, "Alert.Notifications: ah.Notifications")
+	}
+	return c.RenderJSON(notifications)
+}
+
+func (c *Alert) readRule() (alert.Rule, revel.Result) {
+	r := alert.Rule{}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return r, c.Error(err, "Alert: ioutil.ReadAll")
+	}
+	if len(body) == 0 {
+		return r, c.BadRequest(nil, "empty body (no data posted)")
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return r, c.BadRequest(err, "cannot decode alert.Rule")
+	}
+	if err := r.Validate(); err != nil {
+		return r, c.BadRequest(err, "invalid alert rule")
+	}
+	return r, nil
+}
+
+func (c *Alert) checkInstance(dbm db.Manager, uuid string) revel.Result {
+	id, err := instance.GetInstanceId(dbm.DB(), uuid)
+	if err != nil && err != shared.ErrNotFound {
+		return c.Error(err, "Alert: instance.GetInstanceId")
+	}
+	if id == 0 {
+		return c.BadRequest(nil, "invalid InstanceUUID: instance not found")
+	}
+	return nil
+}
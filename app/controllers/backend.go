@@ -18,6 +18,8 @@
 package controllers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -30,7 +32,21 @@ type BackEnd struct {
 	*revel.Controller
 }
 
+// Non-standard status for a request the client closed before the response,
+// as in nginx.
+const statusClientClosedRequest = 499
+
 func (c BackEnd) Error(err error, op string) revel.Result {
+	// Query errors are often wrapped, e.g. in a models.QueryError.
+	switch {
+	case errors.Is(err, shared.ErrQueryTimeout), errors.Is(err, context.DeadlineExceeded):
+		err = shared.ErrQueryTimeout
+	case errors.Is(err, shared.ErrQueryCanceled), errors.Is(err, context.Canceled):
+		err = shared.ErrQueryCanceled
+	case errors.Is(err, shared.ErrReadOnlyDb):
+		err = shared.ErrReadOnlyDb
+	}
+
 	switch err {
 	// //////////////////////////////////////////////////////////////////////
 	// Not really an error, no content
@@ -66,6 +82,17 @@ func (c BackEnd) Error(err error, op string) revel.Result {
 		}
 		c.Response.Status = http.StatusServiceUnavailable // 503
 		return c.RenderJSON(res)
+	case shared.ErrQueryTimeout:
+		revel.WARN.Printf("%s: %s", op, err)
+		res := proto.Error{
+			Error: fmt.Sprintf("%s: %s", op, err),
+		}
+		c.Response.Status = http.StatusGatewayTimeout // 504
+		return c.RenderJSON(res)
+	case shared.ErrQueryCanceled:
+		// The client is gone, nobody reads the response.
+		c.Response.Status = statusClientClosedRequest
+		return c.RenderText("")
 
 	// //////////////////////////////////////////////////////////////////////
 	// 500 error, something blew up
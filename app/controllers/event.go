@@ -0,0 +1,154 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/revel/revel"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/instance"
+	"github.com/shatteredsilicon/qan-api/app/models"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+)
+
+type Event struct {
+	BackEnd
+}
+
+// POST /events
+func (c *Event) Create() revel.Result {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return c.Error(err, "Event.Create: ioutil.ReadAll")
+	}
+	if len(body) == 0 {
+		return c.BadRequest(nil, "empty body (no data posted)")
+	}
+
+	var req struct {
+		InstanceUUIDs []string
+		models.Event
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.BadRequest(err, "cannot decode event")
+	}
+	if len(req.InstanceUUIDs) == 0 {
+		return c.BadRequest(nil, "InstanceUUIDs is required")
+	}
+	if req.User == "" {
+		req.User, _, _ = c.Request.BasicAuth()
+	}
+	if err := req.Validate(); err != nil {
+		return c.BadRequest(err, "invalid event")
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Event.Create: dbm.Open")
+	}
+	instanceIds, res := c.instanceIds(dbm, req.InstanceUUIDs)
+	if res != nil {
+		return res
+	}
+	ids, err := models.Events.Create(dbm.Context(), instanceIds, req.Event)
+	if err != nil {
+		return c.Error(err, "Event.Create: Events.Create")
+	}
+
+	c.Response.Status = http.StatusCreated
+	return c.RenderJSON(ids)
+}
+
+// GET /events?uuids=UUID,...&labels=name=value,...&begin&end
+func (c *Event) List() revel.Result {
+	var uuids, selector, beginTs, endTs string
+	c.Params.Bind(&uuids, "uuids")
+	c.Params.Bind(&selector, "labels")
+	c.Params.Bind(&beginTs, "begin")
+	c.Params.Bind(&endTs, "end")
+	if uuids == "" && selector == "" {
+		return c.BadRequest(nil, "uuids or labels is required")
+	}
+	var sel instance.Selector
+	if selector != "" {
+		var err error
+		if sel, err = instance.ParseSelector(selector); err != nil {
+			return c.BadRequest(err, "invalid labels")
+		}
+	}
+	begin, end, err := shared.ValidateTimeRange(beginTs, endTs)
+	if err != nil {
+		return c.BadRequest(err, "invalid time range")
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Event.List: dbm.Open")
+	}
+	instanceIds := []uint{}
+	if uuids != "" {
+		var res revel.Result
+		if instanceIds, res = c.instanceIds(dbm, strings.Split(uuids, ",")); res != nil {
+			return res
+		}
+	}
+	if sel != nil {
+		// Events of the instances with the labels, e.g. a deploy of the
+		// team's servers.
+		selectedIds, err := instance.NewMySQLHandler(dbm).SelectInstanceIds(sel)
+		if err != nil {
+			return c.Error(err, "Event.List: ih.SelectInstanceIds")
+		}
+		instanceIds = shared.AppendIds(instanceIds, selectedIds)
+	}
+	events, err := models.Events.Get(dbm.Context(), instanceIds, begin, end)
+	if err != nil {
+		return c.Error(err, "Event.List: Events.Get")
+	}
+
+	return c.RenderJSON(events)
+}
+
+// DELETE /events/:id
+func (c *Event) Delete(id uint) revel.Result {
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Event.Delete: dbm.Open")
+	}
+	if err := models.Events.Delete(dbm.Context(), id); err != nil {
+		return c.Error(err, "Event.Delete: Events.Delete")
+	}
+
+	return c.RenderNoContent()
+}
+
+// instanceIds returns the IDs of the instances, or 404 if any is not found.
+func (c *Event) instanceIds(dbm db.Manager, uuids []string) ([]uint, revel.Result) {
+	instanceIds, err := instance.GetInstanceIds(dbm.Context(), dbm.DB(), uuids)
+	if err != nil {
+		return nil, c.Error(err, "Event: instance.GetInstanceIds")
+	}
+	if len(instanceIds) != len(uuids) {
+		return nil, c.Error(shared.ErrNotFound, "instance not found")
+	}
+	return instanceIds, nil
+}
@@ -34,6 +34,12 @@ type Instance struct {
 	BackEnd
 }
 
+// labeledInstance is an instance with its labels, see instance.Labels.
+type labeledInstance struct {
+	proto.Instance
+	Labels instance.Labels `json:",omitempty"`
+}
+
 // GET /instances
 func (c *Instance) List() revel.Result {
 	dbm := c.Args["dbm"].(db.Manager)
@@ -42,25 +48,50 @@ func (c *Instance) List() revel.Result {
 	}
 	instanceHandler := instance.NewMySQLHandler(dbm)
 
-	var instanceType, instanceName, parentUUID string
+	var instanceType, instanceName, parentUUID, selector string
 	c.Params.Bind(&instanceType, "type")
 	c.Params.Bind(&instanceName, "name")
 	c.Params.Bind(&parentUUID, "parent_uuid")
+	c.Params.Bind(&selector, "labels")
 	if instanceType != "" && instanceName != "" {
-		_, in, err := instanceHandler.GetByName(instanceType, instanceName, parentUUID)
+		id, in, err := instanceHandler.GetByName(instanceType, instanceName, parentUUID)
 		if err != nil {
 			return c.Error(err, "Instance.List: ih.GetByName")
 		}
 		if in == nil {
 			return c.Error(shared.ErrNotFound, "Instance.List: ih.GetByName")
 		}
-		return c.RenderJSON(in)
+		labels, err := instanceHandler.GetLabels(id)
+		if err != nil {
+			return c.Error(err, "Instance.List: ih.GetLabels")
+		}
+		return c.RenderJSON(labeledInstance{*in, labels})
 	} else {
+		// Only the instances with the labels, e.g. labels=env=prod,team=payments.
+		var sel instance.Selector
+		if selector != "" {
+			var err error
+			if sel, err = instance.ParseSelector(selector); err != nil {
+				return c.BadRequest(err, "invalid labels")
+			}
+		}
+
 		instances, err := instanceHandler.GetAll(true)
 		if err != nil {
 			return c.Error(err, "Instance.List: ih.GetAll")
 		}
-		return c.RenderJSON(instances)
+		labels, err := instanceHandler.GetAllLabels()
+		if err != nil {
+			return c.Error(err, "Instance.List: ih.GetAllLabels")
+		}
+		list := make([]labeledInstance, 0, len(instances))
+		for _, in := range instances {
+			if !sel.Matches(labels[in.UUID]) {
+				continue
+			}
+			list = append(list, labeledInstance{in, labels[in.UUID]})
+		}
+		return c.RenderJSON(list)
 	}
 }
 
@@ -80,6 +111,10 @@ func (c *Instance) Create() revel.Result {
 		return c.BadRequest(err, "cannot decode proto.Instance")
 	}
 
+	if _, err := instance.Lookup(in.Subsystem); err != nil {
+		return c.BadRequest(err, "invalid subsystem: "+in.Subsystem)
+	}
+
 	if in.UUID == "" {
 		u4, _ := uuid.NewV4()
 		in.UUID = strings.Replace(u4.String(), "-", "", -1)
@@ -116,11 +151,15 @@ func (c *Instance) Get(uuid string) revel.Result {
 		return c.Error(err, "Instance.Get: dbm.Open")
 	}
 	instanceHandler := instance.NewMySQLHandler(dbm)
-	_, instance, err := instanceHandler.Get(uuid)
+	id, in, err := instanceHandler.Get(uuid)
 	if err != nil {
 		return c.Error(err, "Instance.Get: ih.Get")
 	}
-	return c.RenderJSON(instance)
+	labels, err := instanceHandler.GetLabels(id)
+	if err != nil {
+		return c.Error(err, "Instance.Get: ih.GetLabels")
+	}
+	return c.RenderJSON(labeledInstance{*in, labels})
 }
 
 // PUT /instances/:uuid
@@ -158,6 +197,35 @@ func (c *Instance) Update(uuid string) revel.Result {
 	return c.RenderNoContent()
 }
 
+// PUT /instances/:uuid/labels
+func (c *Instance) UpdateLabels(uuid string) revel.Result {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return c.Error(err, "Instance.UpdateLabels: ioutil.ReadAll")
+	}
+	if len(body) == 0 {
+		return c.BadRequest(nil, "empty body (no data posted)")
+	}
+
+	labels := instance.Labels{}
+	if err := json.Unmarshal(body, &labels); err != nil {
+		return c.BadRequest(err, "cannot decode instance.Labels")
+	}
+	if err := labels.Validate(); err != nil {
+		return c.BadRequest(err, "invalid labels")
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Instance.UpdateLabels: dbm.Open")
+	}
+	if err := instance.NewMySQLHandler(dbm).SetLabels(uuid, labels); err != nil {
+		return c.Error(err, "Instance.UpdateLabels: ih.SetLabels")
+	}
+
+	return c.RenderNoContent()
+}
+
 // DELETE /instances/:uuid
 func (c *Instance) Delete(uuid string) revel.Result {
 	dbm := c.Args["dbm"].(db.Manager)
@@ -0,0 +1,128 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package controllers
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/revel/revel"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/instance"
+)
+
+type InstanceGroup struct {
+	BackEnd
+}
+
+// GET /instance-groups
+func (c *InstanceGroup) List() revel.Result {
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "InstanceGroup.List: dbm.Open")
+	}
+	groups, err := instance.NewMySQLHandler(dbm).GetGroups()
+	if err != nil {
+		return c.Error(err, "InstanceGroup.List: ih.GetGroups")
+	}
+	return c.RenderJSON(groups)
+}
+
+// POST /instance-groups
+func (c *InstanceGroup) Create() revel.Result {
+	g, res := c.readGroup("")
+	if res != nil {
+		return res
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "InstanceGroup.Create: dbm.Open")
+	}
+	if err := instance.NewMySQLHandler(dbm).CreateGroup(g); err != nil {
+		if errors.Is(err, instance.ErrInvalidMember) {
+			return c.BadRequest(err, "invalid instance group")
+		}
+		return c.Error(err, "InstanceGroup.Create: ih.CreateGroup")
+	}
+
+	return c.RenderCreated(c.Args["httpBase"].(string) + "/instance-groups/" + url.PathEscape(g.Name))
+}
+
+// GET /instance-groups/:name
+func (c *InstanceGroup) Get(name string) revel.Result {
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "InstanceGroup.Get: dbm.Open")
+	}
+	g, err := instance.NewMySQLHandler(dbm).GetGroup(name)
+	if err != nil {
+		return c.Error(err, "InstanceGroup.Get: ih.GetGroup")
+	}
+	return c.RenderJSON(g)
+}
+
+// PUT /instance-groups/:name
+func (c *InstanceGroup) Update(name string) revel.Result {
+	g, res := c.readGroup(name)
+	if res != nil {
+		return res
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "InstanceGroup.Update: dbm.Open")
+	}
+	if err := instance.NewMySQLHandler(dbm).UpdateGroup(g); err != nil {
+		if errors.Is(err, instance.ErrInvalidMember) {
+			return c.BadRequest(err, "invalid instance group")
+		}
+		return c.Error(err, "InstanceGroup.Update: ih.UpdateGroup")
+	}
+
+	return c.RenderNoContent()
+}
+
+// DELETE /instance-groups/:name
+func (c *InstanceGroup) Delete(name string) revel.Result {
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "InstanceGroup.Delete: dbm.Open")
+	}
+	if err := instance.NewMySQLHandler(dbm).DeleteGroup(name); err != nil {
+		return c.Error(err, "InstanceGroup.Delete: ih.DeleteGroup")
+	}
+	return c.RenderNoContent()
+}
+
+// readGroup reads the group in the body, see instance.ParseGroup.
+func (c *InstanceGroup) readGroup(name string) (instance.Group, revel.Result) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return instance.Group{}, c.Error(err, "InstanceGroup: ioutil.ReadAll")
+	}
+	if len(body) == 0 {
+		return instance.Group{}, c.BadRequest(nil, "empty body (no data posted)")
+	}
+	g, err := instance.ParseGroup(body, name)
+	if err != nil {
+		return g, c.BadRequest(err, "invalid instance group")
+	}
+	return g, nil
+}
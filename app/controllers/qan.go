@@ -20,11 +20,13 @@ package controllers
 import (
 	"encoding/base64"
 	"fmt"
+	"strings"
 
 	"github.com/revel/revel"
 	"github.com/shatteredsilicon/qan-api/app/config"
 	"github.com/shatteredsilicon/qan-api/app/db"
 	"github.com/shatteredsilicon/qan-api/app/models"
+	"github.com/shatteredsilicon/qan-api/app/qan"
 	"github.com/shatteredsilicon/qan-api/app/query"
 	"github.com/shatteredsilicon/qan-api/app/shared"
 	"github.com/shatteredsilicon/qan-api/stats"
@@ -39,8 +41,9 @@ func (c QAN) Profile() revel.Result {
 	instanceIds := c.Args["instanceIds"].([]uint)
 
 	// Convert and validate the time range.
-	var beginTs, endTs, search, searchB64, sortBy string
+	var beginTs, endTs, search, searchB64, sortBy, rankMetric, rankStat, statusList, tagList string
 	var offset int
+	var limit uint
 	var firstSeen bool
 	c.Params.Bind(&beginTs, "begin")
 	c.Params.Bind(&endTs, "end")
@@ -48,6 +51,11 @@ func (c QAN) Profile() revel.Result {
 	c.Params.Bind(&offset, "offset")
 	c.Params.Bind(&firstSeen, "first_seen")
 	c.Params.Bind(&sortBy, "sort_by")
+	c.Params.Bind(&rankMetric, "metric")
+	c.Params.Bind(&rankStat, "stat")
+	c.Params.Bind(&limit, "limit")
+	c.Params.Bind(&statusList, "status")
+	c.Params.Bind(&tagList, "tag")
 	searchB, err := base64.StdEncoding.DecodeString(searchB64)
 	if err != nil {
 		fmt.Println("error decoding base64 search :", err)
@@ -59,11 +67,32 @@ func (c QAN) Profile() revel.Result {
 		return c.BadRequest(err, "invalid time range")
 	}
 
-	// todo: let caller specify rank by args via URL params
-	r := models.RankBy{
-		Metric: "Query_time",
-		Stat:   "sum",
-		Limit:  10,
+	// Only queries with the given statuses, e.g. status=new,needs-attention.
+	var statuses []string
+	if statusList != "" {
+		statuses = strings.Split(statusList, ",")
+		for _, status := range statuses {
+			if !query.ValidStatus(status) {
+				return c.BadRequest(nil, fmt.Sprintf("invalid status: %s: must be one of %s", status, strings.Join(query.Statuses, ", ")))
+			}
+		}
+	}
+
+	// Only queries with notes tagged with any of the given tags, e.g. tag=orm,missing-index.
+	var tags []string
+	if tagList != "" {
+		tags = strings.Split(strings.ToLower(tagList), ",")
+		for _, tag := range tags {
+			if !query.ValidTag(tag) {
+				return c.BadRequest(nil, fmt.Sprintf("invalid tag: %s", tag))
+			}
+		}
+	}
+
+	// Rank by Query_time_sum, top 10, unless the caller says otherwise.
+	r, err := models.NewRankBy(rankMetric, rankStat, limit)
+	if err != nil {
+		return c.BadRequest(err, "invalid rank by")
 	}
 
 	// Get the server profile, aka query rank.
@@ -71,7 +100,7 @@ func (c QAN) Profile() revel.Result {
 	if err := dbm.Open(); err != nil {
 		return c.Error(err, "QAN.Profile: dbm.Open")
 	}
-	profile, err := models.Report.Profile(instanceIds, begin, end, r, offset, search, firstSeen, sortBy)
+	profile, err := models.Report.Profile(dbm.Context(), instanceIds, begin, end, r, offset, search, firstSeen, sortBy, statuses, tags)
 	if err != nil {
 		return c.Error(err, "qh.Profile")
 	}
@@ -79,6 +108,107 @@ func (c QAN) Profile() revel.Result {
 	return c.RenderJSON(profile)
 }
 
+// Compare compares the top query classes of two time ranges, e.g. before
+// and after a deploy.
+func (c QAN) Compare() revel.Result {
+	instanceIds := c.Args["instanceIds"].([]uint)
+
+	var begin1Ts, end1Ts, begin2Ts, end2Ts, rankMetric, rankStat string
+	var limit uint
+	c.Params.Bind(&begin1Ts, "begin1")
+	c.Params.Bind(&end1Ts, "end1")
+	c.Params.Bind(&begin2Ts, "begin2")
+	c.Params.Bind(&end2Ts, "end2")
+	c.Params.Bind(&rankMetric, "metric")
+	c.Params.Bind(&rankStat, "stat")
+	c.Params.Bind(&limit, "limit")
+
+	begin1, end1, err := shared.ValidateTimeRange(begin1Ts, end1Ts)
+	if err != nil {
+		return c.BadRequest(err, "invalid time range 1")
+	}
+	begin2, end2, err := shared.ValidateTimeRange(begin2Ts, end2Ts)
+	if err != nil {
+		return c.BadRequest(err, "invalid time range 2")
+	}
+
+	r, err := models.NewRankBy(rankMetric, rankStat, limit)
+	if err != nil {
+		return c.BadRequest(err, "invalid rank by")
+	}
+	if r.Limit > models.MaxCompareLimit {
+		return c.BadRequest(fmt.Errorf("must be between 1 and %d", models.MaxCompareLimit), "invalid limit")
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "QAN.Compare: dbm.Open")
+	}
+	comparison, err := models.Report.Compare(dbm.Context(), instanceIds, begin1, end1, begin2, end2, r)
+	if err != nil {
+		return c.Error(err, "Report.Compare")
+	}
+
+	return c.RenderJSON(comparison)
+}
+
+// Anomalies returns the query classes that deviated from their hour-of-week
+// baseline, see anomaly.Analyzer.
+func (c QAN) Anomalies() revel.Result {
+	instanceIds := c.Args["instanceIds"].([]uint)
+
+	var beginTs, endTs string
+	c.Params.Bind(&beginTs, "begin")
+	c.Params.Bind(&endTs, "end")
+	begin, end, err := shared.ValidateTimeRange(beginTs, endTs)
+	if err != nil {
+		return c.BadRequest(err, "invalid time range")
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "QAN.Anomalies: dbm.Open")
+	}
+	anomalies, err := models.Anomalies.Get(dbm.Context(), instanceIds, begin, end)
+	if err != nil {
+		return c.Error(err, "Anomalies.Get")
+	}
+
+	return c.RenderJSON(anomalies)
+}
+
+// Ledger returns the reports written for the instances, see qan.Ledger.
+func (c QAN) Ledger() revel.Result {
+	instanceIds := c.Args["instanceIds"].([]uint)
+
+	var beginTs, endTs string
+	var limit uint
+	c.Params.Bind(&beginTs, "begin")
+	c.Params.Bind(&endTs, "end")
+	c.Params.Bind(&limit, "limit")
+	begin, end, err := shared.ValidateTimeRange(beginTs, endTs)
+	if err != nil {
+		return c.BadRequest(err, "invalid time range")
+	}
+	if limit == 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		return c.BadRequest(nil, "invalid limit: must be between 1 and 1000")
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "QAN.Ledger: dbm.Open")
+	}
+	entries, err := qan.Ledger(dbm, instanceIds, begin, end, limit)
+	if err != nil {
+		return c.Error(err, "qan.Ledger")
+	}
+
+	return c.RenderJSON(entries)
+}
+
 func (c QAN) QueryReport(queryId string) revel.Result {
 	instanceIds := c.Args["instanceIds"].([]uint)
 
@@ -105,7 +235,7 @@ func (c QAN) QueryReport(queryId string) revel.Result {
 	}
 
 	// Convert query ID to class ID so we can pull data from other tables.
-	classId, err := query.GetClassId(dbm.DB(), queryId)
+	classId, err := query.GetClassId(dbm.Context(), dbm.DB(), queryId)
 	if err != nil {
 		return c.Error(err, "qh.GetQueryId")
 	}
@@ -126,11 +256,37 @@ func (c QAN) QueryReport(queryId string) revel.Result {
 		Example:    s,
 	}
 
-	metrics2, sparks2 := models.Metrics.GetClassMetrics(classId, instanceIds, begin, end)
+	metrics2, sparks2, err := models.Metrics.GetClassMetrics(dbm.Context(), classId, instanceIds, begin, end)
+	if err != nil {
+		return c.Error(err, "Metrics.GetClassMetrics")
+	}
 	report.Metrics2 = metrics2
 	report.Sparks2 = sparks2
 
-	return c.RenderJSON(report)
+	notes, err := qh.Notes(classId)
+	if err != nil {
+		return c.Error(err, "qh.Notes")
+	}
+	events, err := models.Metrics.GetEvents(dbm.Context(), instanceIds, begin, end)
+	if err != nil {
+		return c.Error(err, "Metrics.GetEvents")
+	}
+
+	// The query on each instance, e.g. the nodes of a group.
+	var instances []models.InstanceClassMetrics
+	if len(instanceIds) > 1 {
+		instances, err = models.Metrics.GetClassInstances(dbm.Context(), classId, instanceIds, begin, end)
+		if err != nil {
+			return c.Error(err, "Metrics.GetClassInstances")
+		}
+	}
+
+	return c.RenderJSON(struct {
+		qp.QueryReport
+		Notes     []query.Note
+		Events    []models.SparkEvent           `json:",omitempty"` // on Sparks2
+		Instances []models.InstanceClassMetrics `json:",omitempty"`
+	}{report, notes, events, instances})
 }
 
 func (c QAN) QueryUserSource(queryId string) revel.Result {
@@ -151,7 +307,7 @@ func (c QAN) QueryUserSource(queryId string) revel.Result {
 	qh := query.NewMySQLHandler(dbm, stats.NullStats())
 
 	// Convert query ID to class ID so we can pull data from other tables.
-	classId, err := query.GetClassId(dbm.DB(), queryId)
+	classId, err := query.GetClassId(dbm.Context(), dbm.DB(), queryId)
 	if err != nil {
 		return c.Error(err, "qh.GetQueryId")
 	}
@@ -186,11 +342,23 @@ func (c QAN) ServerSummary(uuid string) revel.Result {
 		End:        end,
 	}
 
-	metrics2, sparks2 := models.Metrics.GetGlobalMetrics(instanceIds, begin, end)
+	dbm := c.Args["dbm"].(db.Manager)
+	metrics2, sparks2, err := models.Metrics.GetGlobalMetrics(dbm.Context(), instanceIds, begin, end)
+	if err != nil {
+		return c.Error(err, "Metrics.GetGlobalMetrics")
+	}
 	summary.Metrics2 = metrics2
 	summary.Sparks2 = sparks2
 
-	return c.RenderJSON(summary)
+	events, err := models.Metrics.GetEvents(dbm.Context(), instanceIds, begin, end)
+	if err != nil {
+		return c.Error(err, "Metrics.GetEvents")
+	}
+
+	return c.RenderJSON(struct {
+		qp.Summary
+		Events []models.SparkEvent `json:",omitempty"` // on Sparks2
+	}{summary, events})
 }
 
 func (c QAN) Config(uuid string) revel.Result {
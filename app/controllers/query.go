@@ -21,6 +21,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"github.com/revel/revel"
 	"github.com/shatteredsilicon/qan-api/app/db"
@@ -47,11 +48,18 @@ func (c *Query) Get(id string) revel.Result {
 	if err != nil {
 		return c.Error(err, "Query.Get: queryHandler.Get")
 	}
-	query, ok := queries[id]
+	q, ok := queries[id]
 	if !ok {
 		return c.Error(shared.ErrNotFound, "")
 	}
-	return c.RenderJSON(query)
+	notes, err := queryHandler.Notes(c.Args["classId"].(uint))
+	if err != nil {
+		return c.Error(err, "Query.Get: queryHandler.Notes")
+	}
+	return c.RenderJSON(struct {
+		queryProto.Query
+		Notes []query.Note
+	}{q, notes})
 }
 
 // GET /queries/:id/tables
@@ -223,3 +231,197 @@ func (c *Query) UpdateExample(id string) revel.Result {
 
 	return c.RenderNoContent()
 }
+
+// GET /queries/:id/status
+func (c *Query) GetStatus(id string) revel.Result {
+	classId := c.Args["classId"].(uint)
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Query.GetStatus: dbm.Open")
+	}
+
+	queryHandler := query.NewMySQLHandler(dbm, stats.NullStats())
+	queries, err := queryHandler.Get([]string{id})
+	if err != nil {
+		return c.Error(err, "Query.GetStatus: queryHandler.Get")
+	}
+	log, err := queryHandler.StatusLog(classId)
+	if err != nil {
+		return c.Error(err, "Query.GetStatus: queryHandler.StatusLog")
+	}
+
+	res := struct {
+		Status string
+		Log    []query.StatusChange
+	}{
+		Status: queries[id].Status,
+		Log:    log,
+	}
+	return c.RenderJSON(res)
+}
+
+// PUT /queries/:id/status
+func (c *Query) UpdateStatus(id string) revel.Result {
+	classId := c.Args["classId"].(uint)
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return c.Error(err, "Query.UpdateStatus: ioutil.ReadAll")
+	}
+	if len(body) == 0 {
+		return c.BadRequest(nil, "empty body (no data posted)")
+	}
+
+	var req struct {
+		Status  string
+		User    string // who changed it, default the HTTP basic auth user
+		Comment string
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.BadRequest(err, "cannot decode status")
+	}
+	if !query.ValidStatus(req.Status) {
+		return c.BadRequest(nil, fmt.Sprintf("invalid status: %s: must be one of %s", req.Status, strings.Join(query.Statuses, ", ")))
+	}
+	if req.User == "" {
+		req.User, _, _ = c.Request.BasicAuth()
+	}
+	if req.User == "" {
+		return c.BadRequest(nil, "User is required")
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Query.UpdateStatus: dbm.Open")
+	}
+
+	queryHandler := query.NewMySQLHandler(dbm, stats.NullStats())
+	if err := queryHandler.SetStatus(classId, req.Status, req.User, req.Comment); err != nil {
+		return c.Error(err, "Query.UpdateStatus: queryHandler.SetStatus")
+	}
+
+	return c.RenderNoContent()
+}
+
+// GET /queries/:id/notes
+func (c *Query) GetNotes(id string) revel.Result {
+	classId := c.Args["classId"].(uint)
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Query.GetNotes: dbm.Open")
+	}
+
+	queryHandler := query.NewMySQLHandler(dbm, stats.NullStats())
+	notes, err := queryHandler.Notes(classId)
+	if err != nil {
+		return c.Error(err, "Query.GetNotes: queryHandler.Notes")
+	}
+
+	return c.RenderJSON(notes)
+}
+
+// POST /queries/:id/notes
+func (c *Query) CreateNote(id string) revel.Result {
+	classId := c.Args["classId"].(uint)
+
+	note, result := c.readNote()
+	if result != nil {
+		return result
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Query.CreateNote: dbm.Open")
+	}
+
+	queryHandler := query.NewMySQLHandler(dbm, stats.NullStats())
+	noteId, err := queryHandler.CreateNote(classId, note)
+	if err != nil {
+		return c.Error(err, "Query.CreateNote: queryHandler.CreateNote")
+	}
+
+	return c.RenderCreated(fmt.Sprintf("%s/queries/%s/notes/%d", c.Args["httpBase"].(string), id, noteId))
+}
+
+// GET /queries/:id/notes/:noteId
+func (c *Query) GetNote(id string, noteId uint) revel.Result {
+	classId := c.Args["classId"].(uint)
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Query.GetNote: dbm.Open")
+	}
+
+	queryHandler := query.NewMySQLHandler(dbm, stats.NullStats())
+	note, err := queryHandler.Note(classId, noteId)
+	if err != nil {
+		return c.Error(err, "Query.GetNote: queryHandler.Note")
+	}
+
+	return c.RenderJSON(note)
+}
+
+// PUT /queries/:id/notes/:noteId
+func (c *Query) UpdateNote(id string, noteId uint) revel.Result {
+	classId := c.Args["classId"].(uint)
+
+	note, result := c.readNote()
+	if result != nil {
+		return result
+	}
+	note.Id = noteId
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Query.UpdateNote: dbm.Open")
+	}
+
+	queryHandler := query.NewMySQLHandler(dbm, stats.NullStats())
+	if err := queryHandler.UpdateNote(classId, note); err != nil {
+		return c.Error(err, "Query.UpdateNote: queryHandler.UpdateNote")
+	}
+
+	return c.RenderNoContent()
+}
+
+// DELETE /queries/:id/notes/:noteId
+func (c *Query) DeleteNote(id string, noteId uint) revel.Result {
+	classId := c.Args["classId"].(uint)
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Query.DeleteNote: dbm.Open")
+	}
+
+	queryHandler := query.NewMySQLHandler(dbm, stats.NullStats())
+	if err := queryHandler.DeleteNote(classId, noteId); err != nil {
+		return c.Error(err, "Query.DeleteNote: queryHandler.DeleteNote")
+	}
+
+	return c.RenderNoContent()
+}
+
+// readNote decodes and validates the note in the request body. User defaults
+// to the HTTP basic auth user.
+func (c *Query) readNote() (query.Note, revel.Result) {
+	var note query.Note
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return note, c.Error(err, "Query.readNote: ioutil.ReadAll")
+	}
+	if len(body) == 0 {
+		return note, c.BadRequest(nil, "empty body (no data posted)")
+	}
+	if err := json.Unmarshal(body, &note); err != nil {
+		return note, c.BadRequest(err, "cannot decode note")
+	}
+	if note.User == "" {
+		note.User, _, _ = c.Request.BasicAuth()
+	}
+	if err := note.Validate(); err != nil {
+		return note, c.BadRequest(err, "invalid note")
+	}
+	return note, nil
+}
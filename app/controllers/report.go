@@ -0,0 +1,81 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/revel/revel"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/instance"
+	"github.com/shatteredsilicon/qan-api/app/qan"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+)
+
+type Report struct {
+	BackEnd
+}
+
+// POST /qan/reports
+func (c *Report) Create() revel.Result {
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, qan.MaxChunkedSize+1))
+	if err != nil {
+		return c.Error(err, "Report.Create: ioutil.ReadAll")
+	}
+	if len(body) == 0 {
+		return c.BadRequest(nil, "empty body (no data posted)")
+	}
+	if len(body) > qan.MaxChunkedSize {
+		c.Response.Status = http.StatusRequestEntityTooLarge
+		return c.RenderText(fmt.Sprintf("body larger than %d bytes, post fewer reports", qan.MaxChunkedSize))
+	}
+
+	dbm := c.Args["dbm"].(db.Manager)
+	if err := dbm.Open(); err != nil {
+		return c.Error(err, "Report.Create: dbm.Open")
+	}
+	ih := instance.NewMySQLHandler(dbm)
+	reportStats := shared.InternalStats // copy
+	reportStats.SetAgent(c.Args["agentId"].(uint))
+	h := qan.NewMySQLMetricWriter(dbm, ih, shared.QueryAbstracter, &reportStats)
+	defer h.Close()
+
+	results, err := qan.WriteReports(body, c.Request.Header.Get("Content-Encoding"), ih, h)
+	if err != nil && len(results) == 0 {
+		if errors.Is(err, qan.ErrInvalidBody) {
+			return c.BadRequest(err, "cannot read reports")
+		}
+		return c.Error(err, "Report.Create: qan.WriteReports")
+	}
+	if err != nil {
+		// Some reports were written: return their results so the client
+		// knows where it stopped, with the status of the error.
+		revel.WARN.Printf("Report.Create: qan.WriteReports: stopped at line %d: %s", results[len(results)-1].Line, err)
+		if errors.Is(err, qan.ErrInvalidBody) {
+			c.Response.Status = http.StatusBadRequest
+		} else {
+			c.Response.Status = http.StatusServiceUnavailable
+		}
+	}
+
+	return c.RenderJSON(results)
+}
@@ -18,24 +18,49 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"log"
+	"time"
 
 	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/config"
 )
 
+// Pool is the MySQL connection pool shared by all Managers, see mysql.Pool.
+var Pool *mysql.Pool
+
 var DBManager *mysql.Manager
 
 type Manager interface {
 	Open() error
 	DB() *sql.DB
+	Context() context.Context
 	Close() error
 }
 
 func init() {
-	DBManager = mysql.NewManager()
+	cfg, err := mysql.LoadPoolConfig()
+	if err != nil {
+		log.Panic(err)
+	}
+	Pool, err = mysql.NewPool(config.Get("mysql.dsn"), cfg)
+	if err != nil {
+		log.Panic(err)
+	}
+	DBManager = mysql.NewManager(Pool)
 	DBManager.Open()
 }
 
+// NewMySQLManager returns a Manager on the shared pool for a websocket stream
+// or background worker.
 func NewMySQLManager() Manager {
-	return mysql.NewManager()
+	return mysql.NewManager(Pool)
+}
+
+// NewRequestManager returns a Manager on the shared pool for an API request.
+// Its context is cancelled when the request ends, see Manager.Close, or
+// after timeout; 0 is mysql.pool.request_timeout.
+func NewRequestManager(ctx context.Context, timeout time.Duration) Manager {
+	return mysql.NewRequestManager(ctx, Pool, timeout)
 }
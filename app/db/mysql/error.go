@@ -18,7 +18,9 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 
 	"github.com/go-sql-driver/mysql"
@@ -37,13 +39,18 @@ func Error(err error, msg string) error {
 		return shared.ErrDuplicateEntry
 	case err == sql.ErrNoRows:
 		return shared.ErrNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		return shared.ErrQueryTimeout
+	case errors.Is(err, context.Canceled):
+		return shared.ErrQueryCanceled
 	default:
-		return fmt.Errorf("%s: %s", msg, err)
+		return fmt.Errorf("%s: %w", msg, err)
 	}
 }
 
 func ErrorCode(err error) uint16 {
-	if val, ok := err.(*mysql.MySQLError); ok {
+	var val *mysql.MySQLError
+	if errors.As(err, &val) {
 		return val.Number
 	}
 
@@ -53,5 +60,6 @@ func ErrorCode(err error) uint16 {
 // MySQL error codes
 const (
 	ER_DUP_ENTRY                 = 1062
+	ER_LOCK_DEADLOCK             = 1213
 	ER_OPTION_PREVENTS_STATEMENT = 1290
 )
@@ -18,65 +18,64 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
-	"sync"
 	"time"
-
-	"github.com/shatteredsilicon/qan-api/config"
 )
 
+// Manager is a handle on the shared Pool for one request, websocket stream
+// or worker. It carries the context of the request: queries run with it are
+// cancelled when the request ends or its deadline passes.
 type Manager struct {
-	dsn string
-	db  *sql.DB
-	*sync.RWMutex
+	pool   *Pool
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewManager() *Manager {
+// NewManager returns a Manager without a deadline, for long-lived users of
+// the pool like websocket streams and background workers.
+func NewManager(pool *Pool) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Manager{
-		dsn:     config.Get("mysql.dsn"),
-		RWMutex: &sync.RWMutex{},
+		pool:   pool,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
-func (m *Manager) Open() error {
-	m.Lock()
-	defer m.Unlock()
-
-	if m.db != nil {
-		return nil
+// NewRequestManager returns a Manager for a request with the timeout, or the
+// pool's RequestTimeout if zero.
+func NewRequestManager(ctx context.Context, pool *Pool, timeout time.Duration) *Manager {
+	if timeout == 0 {
+		timeout = pool.cfg.RequestTimeout
 	}
-
-	db, err := sql.Open("mysql", m.dsn)
-	if err != nil {
-		return err
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
 	}
-	if err := db.Ping(); err != nil {
-		return err
+	return &Manager{
+		pool:   pool,
+		ctx:    ctx,
+		cancel: cancel,
 	}
+}
 
-	// Logically, we want 1 conneciton per request, but some request need 2
-	// physical connections because conn 1 will start a transaction, then do
-	// some other queries (e.g. get an instance ID given its UUID).
-	db.SetMaxIdleConns(2)
-	db.SetMaxOpenConns(2)
-	// it should autoclose lost descriptors
-	db.SetConnMaxLifetime(time.Duration(30) * time.Second)
-
-	m.db = db
-	return nil
+func (m *Manager) Open() error {
+	return m.pool.Open()
 }
 
 func (m *Manager) DB() *sql.DB {
-	return m.db
+	return m.pool.DB()
+}
+
+func (m *Manager) Context() context.Context {
+	return m.ctx
 }
 
+// Close cancels the Manager's context. It doesn't close the shared pool.
 func (m *Manager) Close() error {
-	m.Lock()
-	defer m.Unlock()
-	var err error
-	if m.db != nil {
-		err = m.db.Close()
-		m.db = nil
-	}
-	return err
+	m.cancel()
+	return nil
 }
@@ -0,0 +1,204 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/config"
+)
+
+type PoolConfig struct {
+	MaxOpen        int           // max open connections, 0 = unlimited
+	MaxIdle        int           // max idle connections kept open
+	MaxLifetime    time.Duration // close connections older than this, 0 = never
+	MaxIdleTime    time.Duration // close connections idle longer than this, 0 = never
+	HealthCheck    time.Duration // how often to ping MySQL, 0 = never
+	ConnectTimeout time.Duration // timeout of the first ping and health checks
+	RequestTimeout time.Duration // deadline of a request's Manager, 0 = none
+}
+
+// LoadPoolConfig reads the pool config from the API config:
+//
+//	mysql.pool.max_open        = 32
+//	mysql.pool.max_idle        = 16
+//	mysql.pool.max_lifetime    = 5m
+//	mysql.pool.max_idle_time   = 1m
+//	mysql.pool.health_check    = 10s
+//	mysql.pool.connect_timeout = 5s
+//	mysql.pool.request_timeout = 0
+func LoadPoolConfig() (PoolConfig, error) {
+	cfg := PoolConfig{}
+	ints := []struct {
+		key string
+		def string
+		n   *int
+	}{
+		{"mysql.pool.max_open", "32", &cfg.MaxOpen},
+		{"mysql.pool.max_idle", "16", &cfg.MaxIdle},
+	}
+	for _, i := range ints {
+		n, err := strconv.Atoi(config.GetDefault(i.key, i.def))
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid %s: %s", i.key, config.GetDefault(i.key, ""))
+		}
+		*i.n = n
+	}
+	durations := []struct {
+		key string
+		def string
+		d   *time.Duration
+	}{
+		{"mysql.pool.max_lifetime", "5m", &cfg.MaxLifetime},
+		{"mysql.pool.max_idle_time", "1m", &cfg.MaxIdleTime},
+		{"mysql.pool.health_check", "10s", &cfg.HealthCheck},
+		{"mysql.pool.connect_timeout", "5s", &cfg.ConnectTimeout},
+		{"mysql.pool.request_timeout", "0", &cfg.RequestTimeout},
+	}
+	for _, d := range durations {
+		var err error
+		if *d.d, err = time.ParseDuration(config.GetDefault(d.key, d.def)); err != nil {
+			return cfg, fmt.Errorf("invalid %s: %s", d.key, err)
+		}
+	}
+	if cfg.MaxOpen > 0 && cfg.MaxIdle > cfg.MaxOpen {
+		cfg.MaxIdle = cfg.MaxOpen
+	}
+	return cfg, nil
+}
+
+// Pool is the connection pool shared by the whole API: controllers, agent
+// websocket streams and background workers. It stays open until Close on
+// shutdown. database/sql reconnects lost connections; the health check only
+// detects and logs when MySQL goes away and comes back so Open can fail fast
+// in the meantime.
+type Pool struct {
+	cfg PoolConfig
+	db  *sql.DB
+	// --
+	mux     *sync.Mutex
+	opened  bool
+	healthy bool
+	stop    chan struct{}
+}
+
+// NewPool creates the pool. It doesn't connect to MySQL until Open.
+func NewPool(dsn string, cfg PoolConfig) (*Pool, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpen)
+	db.SetMaxIdleConns(cfg.MaxIdle)
+	db.SetConnMaxLifetime(cfg.MaxLifetime)
+	db.SetConnMaxIdleTime(cfg.MaxIdleTime)
+	p := &Pool{
+		cfg: cfg,
+		db:  db,
+		mux: &sync.Mutex{},
+	}
+	return p, nil
+}
+
+// Open pings MySQL the first time and starts the health check. After that,
+// it only pings again if the last health check failed so callers get an
+// error instead of waiting for a connection that can't be made.
+func (p *Pool) Open() error {
+	p.mux.Lock()
+	ok := p.opened && p.healthy
+	p.mux.Unlock()
+	if ok {
+		return nil
+	}
+
+	err := p.ping()
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.healthy = err == nil
+	if err != nil {
+		return err
+	}
+	if !p.opened {
+		p.opened = true
+		if p.cfg.HealthCheck > 0 {
+			p.stop = make(chan struct{})
+			go p.healthCheck(p.stop)
+		}
+	}
+	return nil
+}
+
+func (p *Pool) DB() *sql.DB {
+	return p.db
+}
+
+// Stats returns the pool stats, e.g. to see if MaxOpen is too low.
+func (p *Pool) Stats() sql.DBStats {
+	return p.db.Stats()
+}
+
+// Close closes the pool on shutdown. Managers don't close the pool, and it
+// can't be opened again.
+func (p *Pool) Close() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	return p.db.Close()
+}
+
+func (p *Pool) ping() error {
+	ctx := context.Background()
+	if p.cfg.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.ConnectTimeout)
+		defer cancel()
+	}
+	return p.db.PingContext(ctx)
+}
+
+func (p *Pool) healthCheck(stop chan struct{}) {
+	t := time.NewTicker(p.cfg.HealthCheck)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		err := p.ping()
+		p.mux.Lock()
+		switch {
+		case err != nil && p.healthy:
+			log.Printf("MySQL pool health check failed: %s", err)
+		case err == nil && !p.healthy:
+			log.Printf("MySQL pool health check OK again")
+		}
+		p.healthy = err == nil
+		p.mux.Unlock()
+	}
+}
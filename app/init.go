@@ -30,12 +30,17 @@ import (
 	"github.com/cactus/go-statsd-client/statsd"
 	"github.com/revel/revel"
 	"github.com/shatteredsilicon/qan-api/app/agent"
+	"github.com/shatteredsilicon/qan-api/app/alert"
+	"github.com/shatteredsilicon/qan-api/app/anomaly"
 	"github.com/shatteredsilicon/qan-api/app/auth"
 	"github.com/shatteredsilicon/qan-api/app/controllers"
 	agentCtrl "github.com/shatteredsilicon/qan-api/app/controllers/agent"
 	"github.com/shatteredsilicon/qan-api/app/db"
 	"github.com/shatteredsilicon/qan-api/app/instance"
+	"github.com/shatteredsilicon/qan-api/app/purge"
+	"github.com/shatteredsilicon/qan-api/app/qan"
 	"github.com/shatteredsilicon/qan-api/app/query"
+	"github.com/shatteredsilicon/qan-api/app/rollup"
 	"github.com/shatteredsilicon/qan-api/app/shared"
 	"github.com/shatteredsilicon/qan-api/config"
 	queryService "github.com/shatteredsilicon/qan-api/service/query"
@@ -130,6 +135,90 @@ func init() {
 	shared.InstanceTasks = instance.NewTasker(10)
 	go shared.InstanceTasks.Run()
 
+	// Purge old QAN data. The retention is in app.conf which isn't loaded
+	// until Revel starts.
+	revel.OnAppStart(func() {
+		cfg, err := purge.LoadConfig()
+		if err != nil {
+			panic(fmt.Sprintf("ERROR: purge.LoadConfig: %s", err))
+		}
+		purgeStats := shared.InternalStats // copy
+		purgeStats.SetComponent("purge")
+		go purge.NewPurger(db.NewMySQLManager(), cfg, &purgeStats).Run()
+	})
+
+	// Roll up QAN data into the hourly and daily tables used for long ranges.
+	revel.OnAppStart(func() {
+		cfg, err := rollup.LoadConfig()
+		if err != nil {
+			panic(fmt.Sprintf("ERROR: rollup.LoadConfig: %s", err))
+		}
+		rollupStats := shared.InternalStats // copy
+		rollupStats.SetComponent("rollup")
+		go rollup.NewAggregator(db.NewMySQLManager(), cfg, &rollupStats).Run()
+	})
+
+	// Flag query classes that deviate from their hour-of-week baseline.
+	revel.OnAppStart(func() {
+		cfg, err := anomaly.LoadConfig()
+		if err != nil {
+			panic(fmt.Sprintf("ERROR: anomaly.LoadConfig: %s", err))
+		}
+		anomalyStats := shared.InternalStats // copy
+		anomalyStats.SetComponent("anomaly")
+		go anomaly.NewAnalyzer(db.NewMySQLManager(), cfg, &anomalyStats).Run()
+	})
+
+	// Evaluate alert rules and send webhook notifications.
+	revel.OnAppStart(func() {
+		cfg, err := alert.LoadConfig()
+		if err != nil {
+			panic(fmt.Sprintf("ERROR: alert.LoadConfig: %s", err))
+		}
+		alertStats := shared.InternalStats // copy
+		alertStats.SetComponent("alert")
+		go alert.NewAlerter(db.NewMySQLManager(), cfg, &alertStats).Run()
+	})
+
+	// Revert fixed query classes whose load rises again.
+	revel.OnAppStart(func() {
+		cfg, err := query.LoadReverterConfig()
+		if err != nil {
+			panic(fmt.Sprintf("ERROR: query.LoadReverterConfig: %s", err))
+		}
+		statusStats := shared.InternalStats // copy
+		statusStats.SetComponent("status")
+		go query.NewReverter(db.NewMySQLManager(), cfg, &statusStats).Run()
+	})
+
+	// Write QAN data from agents to MySQL in the background, see Agent.Data.
+	revel.OnAppStart(func() {
+		cfg, err := qan.LoadQueueConfig()
+		if err != nil {
+			panic(fmt.Sprintf("ERROR: qan.LoadQueueConfig: %s", err))
+		}
+		queueStats := shared.InternalStats // copy
+		queueStats.SetComponent("qan-queue")
+		newWriter := func() qan.MetricWriter {
+			dbm := db.NewMySQLManager()
+			writerStats := queueStats // copy, the writer sets its component
+			return qan.NewMySQLMetricWriter(dbm, instance.NewMySQLHandler(dbm), shared.QueryAbstracter, &writerStats)
+		}
+		qan.DataQueue = qan.NewQueue(cfg, newWriter, &queueStats)
+		if err := qan.DataQueue.Start(); err != nil {
+			panic(fmt.Sprintf("ERROR: qan.DataQueue.Start: %s", err))
+		}
+	})
+
+	// Per-action deadlines of request queries, see beforeController.
+	revel.OnAppStart(func() {
+		timeouts, err := loadDbTimeouts()
+		if err != nil {
+			panic(fmt.Sprintf("ERROR: loadDbTimeouts: %s", err))
+		}
+		dbTimeouts = timeouts
+	})
+
 	revel.Filters = []revel.Filter{
 		revel.PanicFilter,             // Recover from panics and display an error page instead.
 		revel.RouterFilter,            // Use the routing table to select the right Action
@@ -144,8 +233,10 @@ func init() {
 	revel.InterceptFunc(beforeController, revel.BEFORE, revel.AllControllers)
 	revel.InterceptFunc(afterController, revel.FINALLY, revel.AllControllers)
 
-	// All access to agent resources (/agents/:uuid/*) must specify a valid agent.
+	// All access to agent resources (/agents/:uuid/*) and reports posted by
+	// agents must specify a valid agent.
 	revel.InterceptFunc(authAgent, revel.BEFORE, &agentCtrl.Agent{})
+	revel.InterceptFunc(authAgent, revel.BEFORE, &controllers.Report{})
 
 	revel.InterceptFunc(getInstanceId, revel.BEFORE, &controllers.QAN{})
 	revel.InterceptFunc(getQueryId, revel.BEFORE, &controllers.Query{})
@@ -173,13 +264,18 @@ func beforeController(c *revel.Controller) revel.Result {
 
 	if c.Action == "Home.Ping" {
 		c.Response.Out.Header().Set("X-Percona-QAN-API-Version", AppVersion)
+		// Agents send QAN data with the latest protocol and encoding both
+		// support, see qan.EncodeReport.
+		c.Response.Out.Header().Set("X-Percona-QAN-Data-Protocols", strings.Join(qan.ProtocolVersions, ","))
+		c.Response.Out.Header().Set("X-Percona-QAN-Data-Encodings", strings.Join(qan.ContentEncodings, ","))
 	}
 
 	// Create a MySQL db manager for the controller because most need it, but
-	// don't open the connection yet, let the controller do that when it's
-	// ready because it might return early (e.g. on invalid input).
-	// The controller doesn't need to close it; we do that in afterController.
-	c.Args["dbm"] = db.NewMySQLManager()
+	// don't open it yet, let the controller do that when it's ready because
+	// it might return early (e.g. on invalid input). All managers share one
+	// pool; the manager only carries the request context. The controller
+	// doesn't need to close it; we do that in afterController.
+	c.Args["dbm"] = db.NewRequestManager(c.Request.Request.Context(), dbTimeouts[c.Action])
 
 	// Args for various controllers/routes.
 	apiBasePath := os.Getenv("BASE_PATH")
@@ -208,6 +304,25 @@ func beforeController(c *revel.Controller) revel.Result {
 	return nil
 }
 
+// dbTimeouts are the deadlines of the MySQL queries of a request, keyed on
+// Controller.Action. Actions without one use mysql.pool.request_timeout.
+var dbTimeouts = map[string]time.Duration{}
+
+// loadDbTimeouts reads the per-action deadlines from app.conf, e.g.
+//
+//	db.timeout.QAN.Profile = 60s
+func loadDbTimeouts() (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, key := range revel.Config.Options("db.timeout.") {
+		d, err := time.ParseDuration(revel.Config.StringDefault(key, ""))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", key, revel.Config.StringDefault(key, ""))
+		}
+		timeouts[strings.TrimPrefix(key, "db.timeout.")] = d
+	}
+	return timeouts, nil
+}
+
 func afterController(c *revel.Controller) revel.Result {
 	if c.Action == "Home.Options" {
 		return nil
@@ -241,8 +356,12 @@ func authAgent(c *revel.Controller) revel.Result {
 		return nil
 	}
 
+	// /agents/:uuid/*, or the header for other routes, e.g. POST /qan/reports.
 	var agentUuid string
 	c.Params.Bind(&agentUuid, "uuid")
+	if agentUuid == "" {
+		agentUuid = c.Request.Header.Get("X-Percona-QAN-Agent-UUID")
+	}
 
 	dbm := c.Args["dbm"].(db.Manager)
 	dbh := auth.NewMySQLHandler(dbm)
@@ -274,38 +393,83 @@ func authAgent(c *revel.Controller) revel.Result {
 }
 
 func getInstanceId(c *revel.Controller) revel.Result {
-	// Get the internal (auto-inc) instance ID(s) of the UUID.
-	var uuid string
+	// Get the internal (auto-inc) instance ID(s) of the UUID, the UUIDs,
+	// the instance group and the label selector. With children=true, the
+	// instances include their children, e.g. the MySQL instances of an OS
+	// instance. Group members always do, see instance.Group.
+	var uuid, group, selector string
 	var uuids []string
+	var children bool
 	c.Params.Bind(&uuid, "uuid")
 	c.Params.Bind(&uuids, "uuids")
+	c.Params.Bind(&group, "group")
+	c.Params.Bind(&selector, "labels")
+	c.Params.Bind(&children, "children")
 	if uuid != "" {
 		uuids = []string{uuid}
 	}
-	if len(uuids) == 0 {
+	if len(uuids) == 0 && group == "" && selector == "" {
 		c.Response.Status = http.StatusBadRequest
 		return c.RenderText("")
 	}
+	var sel instance.Selector
+	if selector != "" {
+		var err error
+		if sel, err = instance.ParseSelector(selector); err != nil {
+			c.Response.Status = http.StatusBadRequest
+			return c.RenderJSON(proto.Error{Error: err.Error()})
+		}
+	}
 
 	dbm := c.Args["dbm"].(db.Manager)
 	if err := dbm.Open(); err != nil {
 		return internalError(c, "init.getInstanceId: dbm.Open", err)
 	}
 
-	instanceIds, err := instance.GetInstanceIds(dbm.DB(), uuids)
+	instanceIds, err := instance.GetInstanceIds(dbm.Context(), dbm.DB(), uuids)
 	if err != nil {
 		return internalError(c, "init.getInstanceId: ih.GetInstanceIds", err)
 	}
-	if len(instanceIds) == 0 {
+	if len(instanceIds) == 0 && len(uuids) > 0 {
 		c.Response.Status = http.StatusNotFound
 		return c.RenderText("")
 	}
-
-	c.Args["instanceIds"] = instanceIds
 	if uuid != "" {
 		c.Args["instanceId"] = instanceIds[0]
 	}
 
+	if sel != nil {
+		selectedIds, err := instance.NewMySQLHandler(dbm).SelectInstanceIds(sel)
+		if err != nil {
+			return internalError(c, "init.getInstanceId: ih.SelectInstanceIds", err)
+		}
+		instanceIds = shared.AppendIds(instanceIds, selectedIds)
+	}
+	if children {
+		if instanceIds, err = instance.GetDescendantIds(dbm.Context(), dbm.DB(), instanceIds); err != nil {
+			return internalError(c, "init.getInstanceId: instance.GetDescendantIds", err)
+		}
+	}
+	if group != "" {
+		groupIds, err := instance.NewMySQLHandler(dbm).GetGroupInstanceIds(group)
+		switch err {
+		case nil:
+		case shared.ErrNotFound:
+			c.Response.Status = http.StatusNotFound
+			return c.RenderText("")
+		default:
+			return internalError(c, "init.getInstanceId: ih.GetGroupInstanceIds", err)
+		}
+		instanceIds = shared.AppendIds(instanceIds, groupIds)
+	}
+	if len(instanceIds) == 0 {
+		// An empty group or no instances with the labels.
+		c.Response.Status = http.StatusNotFound
+		return c.RenderText("")
+	}
+
+	c.Args["instanceIds"] = instanceIds
+
 	return nil // success
 }
 
@@ -320,7 +484,7 @@ func getQueryId(c *revel.Controller) revel.Result {
 	}
 
 	// 92F3B1B361FB0E5B -> 5
-	classId, err := query.GetClassId(dbm.DB(), queryId)
+	classId, err := query.GetClassId(dbm.Context(), dbm.DB(), queryId)
 	if err != nil {
 		switch err {
 		case shared.ErrNotFound:
@@ -0,0 +1,312 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+)
+
+const maxGroupName = 100 // instance_groups.name
+
+var ErrInvalidMember = errors.New("invalid member: instance not found")
+
+// A Group is a named set of instances, e.g. the nodes of a Galera cluster,
+// a replica set or an environment, to report on them together. The
+// members include their children, see GetDescendantIds, so a group of OS
+// instances is the MySQL, MongoDB, etc. instances running on them.
+type Group struct {
+	Name    string
+	Type    string   // informative, e.g. cluster, replica-set or environment
+	Members []string // instance UUIDs
+	Created time.Time
+}
+
+// Validate checks the group.
+func (g *Group) Validate() error {
+	if g.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	if len(g.Name) > maxGroupName {
+		return fmt.Errorf("invalid Name: longer than %d characters", maxGroupName)
+	}
+	if strings.Contains(g.Name, "/") {
+		return fmt.Errorf("invalid Name: %s: cannot contain /", g.Name)
+	}
+	return nil
+}
+
+// ParseGroup decodes and validates a group from a request body. name is
+// the name of the group being updated, from the route, or "" to create one.
+// Groups can't be renamed because reports are requested by name, so when
+// updating the Name in the body is optional and must be name if given.
+func ParseGroup(data []byte, name string) (Group, error) {
+	g := Group{}
+	if err := json.Unmarshal(data, &g); err != nil {
+		return g, fmt.Errorf("cannot decode instance group: %s", err)
+	}
+	if name != "" {
+		if g.Name != "" && g.Name != name {
+			return g, fmt.Errorf("invalid Name: %s: cannot rename instance group %s", g.Name, name)
+		}
+		g.Name = name
+	}
+	return g, g.Validate()
+}
+
+// GetDescendantIds returns the instance ids and those of their children,
+// grandchildren, etc. following instances.parent_uuid, e.g. the agent and
+// MySQL instances of an OS instance. The ids are sorted.
+func GetDescendantIds(ctx context.Context, db *sql.DB, instanceIds []uint) ([]uint, error) {
+	seen := map[uint]bool{}
+	parents := []uint{}
+	for _, id := range instanceIds {
+		if !seen[id] {
+			seen[id] = true
+			parents = append(parents, id)
+		}
+	}
+	for len(parents) > 0 {
+		rows, err := db.QueryContext(ctx,
+			"SELECT c.instance_id FROM instances c JOIN instances p ON c.parent_uuid = p.uuid"+
+				" WHERE p.instance_id IN ("+shared.UintList(parents)+")")
+		if err != nil {
+			return nil, mysql.Error(err, "GetDescendantIds: SELECT instances")
+		}
+		children := []uint{}
+		for rows.Next() {
+			var id uint
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, mysql.Error(err, "GetDescendantIds: rows.Scan")
+			}
+			if !seen[id] {
+				seen[id] = true
+				children = append(children, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, mysql.Error(err, "GetDescendantIds: rows.Next")
+		}
+		parents = children
+	}
+
+	ids := make([]uint, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// CreateGroup inserts the validated group and its members.
+func (h *MySQLHandler) CreateGroup(g Group) error {
+	memberIds, err := h.memberIds(g.Members)
+	if err != nil {
+		return err
+	}
+	tx, err := h.dbm.DB().BeginTx(h.dbm.Context(), nil)
+	if err != nil {
+		return mysql.Error(err, "MySQLHandler.CreateGroup: Begin")
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(h.dbm.Context(), "INSERT INTO instance_groups (name, type) VALUES (?, ?)", g.Name, g.Type)
+	if err != nil {
+		return mysql.Error(err, "MySQLHandler.CreateGroup: INSERT instance_groups")
+	}
+	groupId, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("cannot get instance group last insert id")
+	}
+	if err := insertMembers(h.dbm.Context(), tx, uint(groupId), memberIds); err != nil {
+		return err
+	}
+	return mysql.Error(tx.Commit(), "MySQLHandler.CreateGroup: Commit")
+}
+
+// GetGroup returns the group with the name, or shared.ErrNotFound.
+func (h *MySQLHandler) GetGroup(name string) (*Group, error) {
+	groups, err := h.getGroups("WHERE g.name = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, shared.ErrNotFound
+	}
+	return &groups[0], nil
+}
+
+// GetGroups returns all groups ordered by name.
+func (h *MySQLHandler) GetGroups() ([]Group, error) {
+	return h.getGroups("")
+}
+
+// UpdateGroup replaces the type and members of the validated group with
+// the name g.Name.
+func (h *MySQLHandler) UpdateGroup(g Group) error {
+	memberIds, err := h.memberIds(g.Members)
+	if err != nil {
+		return err
+	}
+	groupId, err := h.groupId(g.Name)
+	if err != nil {
+		return err
+	}
+	tx, err := h.dbm.DB().BeginTx(h.dbm.Context(), nil)
+	if err != nil {
+		return mysql.Error(err, "MySQLHandler.UpdateGroup: Begin")
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(h.dbm.Context(), "UPDATE instance_groups SET type = ? WHERE group_id = ?", g.Type, groupId); err != nil {
+		return mysql.Error(err, "MySQLHandler.UpdateGroup: UPDATE instance_groups")
+	}
+	if _, err := tx.ExecContext(h.dbm.Context(), "DELETE FROM instance_group_members WHERE group_id = ?", groupId); err != nil {
+		return mysql.Error(err, "MySQLHandler.UpdateGroup: DELETE instance_group_members")
+	}
+	if err := insertMembers(h.dbm.Context(), tx, groupId, memberIds); err != nil {
+		return err
+	}
+	return mysql.Error(tx.Commit(), "MySQLHandler.UpdateGroup: Commit")
+}
+
+// DeleteGroup deletes the group, not its instances.
+func (h *MySQLHandler) DeleteGroup(name string) error {
+	groupId, err := h.groupId(name)
+	if err != nil {
+		return err
+	}
+	tx, err := h.dbm.DB().BeginTx(h.dbm.Context(), nil)
+	if err != nil {
+		return mysql.Error(err, "MySQLHandler.DeleteGroup: Begin")
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(h.dbm.Context(), "DELETE FROM instance_group_members WHERE group_id = ?", groupId); err != nil {
+		return mysql.Error(err, "MySQLHandler.DeleteGroup: DELETE instance_group_members")
+	}
+	if _, err := tx.ExecContext(h.dbm.Context(), "DELETE FROM instance_groups WHERE group_id = ?", groupId); err != nil {
+		return mysql.Error(err, "MySQLHandler.DeleteGroup: DELETE instance_groups")
+	}
+	return mysql.Error(tx.Commit(), "MySQLHandler.DeleteGroup: Commit")
+}
+
+// GetGroupInstanceIds returns the instance ids of the members of the group
+// and their descendants, see GetDescendantIds.
+func (h *MySQLHandler) GetGroupInstanceIds(name string) ([]uint, error) {
+	groupId, err := h.groupId(name)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(), "SELECT instance_id FROM instance_group_members WHERE group_id = ?", groupId)
+	if err != nil {
+		return nil, mysql.Error(err, "MySQLHandler.GetGroupInstanceIds: SELECT instance_group_members")
+	}
+	defer rows.Close()
+	memberIds := []uint{}
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			return nil, mysql.Error(err, "MySQLHandler.GetGroupInstanceIds: rows.Scan")
+		}
+		memberIds = append(memberIds, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, mysql.Error(err, "MySQLHandler.GetGroupInstanceIds: rows.Next")
+	}
+	return GetDescendantIds(h.dbm.Context(), h.dbm.DB(), memberIds)
+}
+
+func (h *MySQLHandler) getGroups(where string, args ...interface{}) ([]Group, error) {
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(),
+		"SELECT g.name, g.type, g.created, COALESCE(i.uuid, '')"+
+			" FROM instance_groups g"+
+			" LEFT JOIN instance_group_members m USING (group_id)"+
+			" LEFT JOIN instances i USING (instance_id) "+
+			where+
+			" ORDER BY g.name, i.uuid", args...)
+	if err != nil {
+		return nil, mysql.Error(err, "MySQLHandler.getGroups: SELECT instance_groups")
+	}
+	defer rows.Close()
+	groups := []Group{}
+	for rows.Next() {
+		g := Group{}
+		var uuid string
+		if err := rows.Scan(&g.Name, &g.Type, &g.Created, &uuid); err != nil {
+			return nil, mysql.Error(err, "MySQLHandler.getGroups: rows.Scan")
+		}
+		if n := len(groups); n == 0 || groups[n-1].Name != g.Name {
+			g.Members = []string{}
+			groups = append(groups, g)
+		}
+		if uuid != "" {
+			last := &groups[len(groups)-1]
+			last.Members = append(last.Members, uuid)
+		}
+	}
+	return groups, mysql.Error(rows.Err(), "MySQLHandler.getGroups: rows.Next")
+}
+
+func (h *MySQLHandler) groupId(name string) (uint, error) {
+	var groupId uint
+	err := h.dbm.DB().QueryRowContext(h.dbm.Context(), "SELECT group_id FROM instance_groups WHERE name = ?", name).Scan(&groupId)
+	return groupId, mysql.Error(err, "MySQLHandler.groupId: SELECT instance_groups")
+}
+
+// memberIds returns the instance ids of the member UUIDs, or an error if
+// one isn't an instance.
+func (h *MySQLHandler) memberIds(uuids []string) ([]uint, error) {
+	ids := make([]uint, 0, len(uuids))
+	for _, uuid := range uuids {
+		id, err := h.instanceId(uuid)
+		if err == shared.ErrNotFound {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidMember, uuid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// instanceId is GetInstanceId with the request context.
+func (h *MySQLHandler) instanceId(uuid string) (uint, error) {
+	var instanceId uint
+	err := h.dbm.DB().QueryRowContext(h.dbm.Context(), "SELECT instance_id FROM instances WHERE uuid = ?", uuid).Scan(&instanceId)
+	return instanceId, mysql.Error(err, "MySQLHandler.instanceId: SELECT instances")
+}
+
+func insertMembers(ctx context.Context, tx *sql.Tx, groupId uint, memberIds []uint) error {
+	for _, id := range memberIds {
+		_, err := tx.ExecContext(ctx, "INSERT IGNORE INTO instance_group_members (group_id, instance_id) VALUES (?, ?)", groupId, id)
+		if err != nil {
+			return mysql.Error(err, "insertMembers: INSERT instance_group_members")
+		}
+	}
+	return nil
+}
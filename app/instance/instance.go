@@ -18,6 +18,7 @@
 package instance
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -54,7 +55,7 @@ func GetInstanceId(db *sql.DB, uuid string) (uint, error) {
 	return instanceId, nil
 }
 
-func GetInstanceIds(db *sql.DB, uuids []string) ([]uint, error) {
+func GetInstanceIds(ctx context.Context, db *sql.DB, uuids []string) ([]uint, error) {
 	var instanceIds []uint
 
 	if len(uuids) == 0 {
@@ -66,7 +67,7 @@ func GetInstanceIds(db *sql.DB, uuids []string) ([]uint, error) {
 	for i := range uuids {
 		values[i] = uuids[i]
 	}
-	rows, err := db.Query(fmt.Sprintf("SELECT instance_id FROM instances WHERE uuid IN (%s)", placeholders), values...)
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT instance_id FROM instances WHERE uuid IN (%s)", placeholders), values...)
 	if err != nil {
 		return []uint{}, mysql.Error(err, "SELECT instances")
 	}
@@ -126,7 +127,7 @@ func (h *MySQLHandler) Create(in proto.Instance) (uint, error) {
 		args = append(args, in.Deleted)
 	}
 
-	res, err := h.dbm.DB().Exec(
+	res, err := h.dbm.DB().ExecContext(h.dbm.Context(),
 		fmt.Sprintf("INSERT INTO instances (%s) VALUES (?%s)", strings.Join(columns, ", "), strings.Repeat(", ?", len(columns)-1)), args...)
 	if err != nil {
 		return 0, mysql.Error(err, "MySQLHandlerCreate INSERT instances")
@@ -178,7 +179,7 @@ func (h *MySQLHandler) GetAll(regardInternalData bool) ([]proto.Instance, error)
 	}
 	query += " ORDER BY name"
 
-	rows, err := h.dbm.DB().Query(query)
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(), query)
 	if err != nil {
 		return nil, mysql.Error(err, "MySQLHandler.GetAll SELECT instances")
 	}
@@ -241,7 +242,7 @@ func (h *MySQLHandler) getInstance(query string, params ...interface{}) (uint, *
 	var dsn, parentUUID, distro, version sql.NullString
 	var deleted mysqlDriver.NullTime
 
-	err := h.dbm.DB().QueryRow(query, params...).Scan(
+	err := h.dbm.DB().QueryRowContext(h.dbm.Context(), query, params...).Scan(
 		&subsystemId,
 		&instanceId,
 		&parentUUID,
@@ -286,7 +287,7 @@ func (h *MySQLHandler) Update(in proto.Instance) error {
 	if in.Deleted.IsZero() {
 		in.Deleted = time.Unix(1, 0)
 	}
-	_, err := h.dbm.DB().Exec(
+	_, err := h.dbm.DB().ExecContext(h.dbm.Context(),
 		"UPDATE instances SET parent_uuid = ?, dsn = ?, name = ?, distro = ?, version = ?, deleted = ? WHERE uuid = ?",
 		in.ParentUUID, in.DSN, in.Name, in.Distro, in.Version, in.Deleted, in.UUID)
 	if err != nil {
@@ -299,13 +300,13 @@ func (h *MySQLHandler) Update(in proto.Instance) error {
 }
 
 func (h *MySQLHandler) Delete(uuid string) error {
-	_, err := h.dbm.DB().Exec("UPDATE instances SET deleted = NOW() WHERE uuid = ?", uuid)
+	_, err := h.dbm.DB().ExecContext(h.dbm.Context(), "UPDATE instances SET deleted = NOW() WHERE uuid = ?", uuid)
 	return mysql.Error(err, "MySQLHandler.Delete UPDATE instances")
 }
 
 func (h *MySQLHandler) DeleteData(uuid string) error {
 	// clear query_class_metrics table
-	_, err := h.dbm.DB().Exec(`
+	_, err := h.dbm.DB().ExecContext(h.dbm.Context(), `
 DELETE qcm
 FROM query_class_metrics qcm
 JOIN instances i ON qcm.instance_id = i.instance_id
@@ -316,7 +317,7 @@ WHERE i.uuid = ?
 	}
 
 	// clear query_examples table
-	_, err = h.dbm.DB().Exec(`
+	_, err = h.dbm.DB().ExecContext(h.dbm.Context(), `
 DELETE qe
 FROM query_examples qe
 JOIN instances i ON qe.instance_id = i.instance_id
@@ -327,7 +328,7 @@ WHERE i.uuid = ?
 	}
 
 	// clear query_global_metrics table
-	_, err = h.dbm.DB().Exec(`
+	_, err = h.dbm.DB().ExecContext(h.dbm.Context(), `
 DELETE qgm
 FROM query_global_metrics qgm
 JOIN instances i ON qgm.instance_id = i.instance_id
@@ -338,7 +339,7 @@ WHERE i.uuid = ?
 	}
 
 	// clear agent_configs table data
-	_, err = h.dbm.DB().Exec(`
+	_, err = h.dbm.DB().ExecContext(h.dbm.Context(), `
 DELETE ac
 FROM agent_configs ac
 JOIN instances i ON ac.other_instance_id = i.instance_id
@@ -18,6 +18,8 @@
 package instance_test
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 
@@ -49,6 +51,9 @@ func (s *InstanceTestSuite) SetUpSuite(t *C) {
 
 func (s *InstanceTestSuite) SetUpTest(t *C) {
 	s.testDb.DB().Exec("TRUNCATE TABLE instances")
+	s.testDb.DB().Exec("TRUNCATE TABLE instance_groups")
+	s.testDb.DB().Exec("TRUNCATE TABLE instance_group_members")
+	s.testDb.DB().Exec("TRUNCATE TABLE instance_labels")
 	s.testDb.LoadDataInfiles(config.ApiRootDir + "/test/instances/008")
 }
 
@@ -131,3 +136,156 @@ func (s *InstanceTestSuite) TestUpdate(t *C) {
 	t.Check(instance.Name, Equals, "fipar")
 	t.Check(instance.DSN, Equals, "new dsn")
 }
+
+func (s *InstanceTestSuite) TestGroups(t *C) {
+	ih := appInstance.NewMySQLHandler(db.DBManager)
+
+	// os-001 and its agent-001 and mysql-001, and mysql-002 but not os-002.
+	g := appInstance.Group{
+		Name:    "galera",
+		Type:    "cluster",
+		Members: []string{"2e6eef26d97b48b4af3179d414899d57", "3d341070b1d74a84bb5f797c3ddbc002"},
+	}
+	t.Assert(g.Validate(), IsNil)
+	t.Assert(ih.CreateGroup(g), IsNil)
+	t.Check(ih.CreateGroup(g), Equals, shared.ErrDuplicateEntry)
+
+	got, err := ih.GetGroup("galera")
+	t.Assert(err, IsNil)
+	t.Check(got.Type, Equals, "cluster")
+	t.Check(got.Members, DeepEquals, g.Members)
+
+	ids, err := ih.GetGroupInstanceIds("galera")
+	t.Assert(err, IsNil)
+	t.Check(ids, DeepEquals, []uint{1, 2, 3, 5})
+
+	g.Members = []string{"3d341070b1d74a84bb5f797c3ddbccc4"}
+	t.Assert(ih.UpdateGroup(g), IsNil)
+	ids, err = ih.GetGroupInstanceIds("galera")
+	t.Assert(err, IsNil)
+	t.Check(ids, DeepEquals, []uint{3})
+
+	g.Members = []string{"00000000000000000000000000000000"}
+	t.Check(errors.Is(ih.UpdateGroup(g), appInstance.ErrInvalidMember), Equals, true)
+
+	groups, err := ih.GetGroups()
+	t.Assert(err, IsNil)
+	t.Check(groups, HasLen, 1)
+
+	t.Assert(ih.DeleteGroup("galera"), IsNil)
+	_, err = ih.GetGroup("galera")
+	t.Check(err, Equals, shared.ErrNotFound)
+	_, err = ih.GetGroupInstanceIds("galera")
+	t.Check(err, Equals, shared.ErrNotFound)
+}
+
+func (s *InstanceTestSuite) TestGetDescendantIds(t *C) {
+	ids, err := appInstance.GetDescendantIds(db.DBManager.Context(), db.DBManager.DB(), []uint{4, 1})
+	t.Assert(err, IsNil)
+	t.Check(ids, DeepEquals, []uint{1, 2, 3, 4, 5})
+
+	ids, err = appInstance.GetDescendantIds(db.DBManager.Context(), db.DBManager.DB(), []uint{3})
+	t.Assert(err, IsNil)
+	t.Check(ids, DeepEquals, []uint{3})
+
+	canceled, cancel := context.WithCancel(db.DBManager.Context())
+	cancel()
+	_, err = appInstance.GetDescendantIds(canceled, db.DBManager.DB(), []uint{4})
+	t.Check(err, Equals, shared.ErrQueryCanceled)
+}
+
+func (s *InstanceTestSuite) TestLabels(t *C) {
+	ih := appInstance.NewMySQLHandler(db.DBManager)
+
+	prod := appInstance.Labels{"env": "prod", "team": "payments"}
+	t.Assert(prod.Validate(), IsNil)
+	t.Assert(ih.SetLabels("3d341070b1d74a84bb5f797c3ddbccc4", prod), IsNil) // mysql-001
+	t.Assert(ih.SetLabels("3d341070b1d74a84bb5f797c3ddbc002", appInstance.Labels{"env": "staging"}), IsNil)
+	t.Check(ih.SetLabels("00000000000000000000000000000000", prod), Equals, shared.ErrNotFound)
+
+	got, err := ih.GetLabels(3)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, prod)
+	got, err = ih.GetLabels(1)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, appInstance.Labels{})
+
+	all, err := ih.GetAllLabels()
+	t.Assert(err, IsNil)
+	t.Check(all, DeepEquals, map[string]appInstance.Labels{
+		"3d341070b1d74a84bb5f797c3ddbccc4": prod,
+		"3d341070b1d74a84bb5f797c3ddbc002": {"env": "staging"},
+	})
+
+	selects := map[string][]uint{
+		"env=prod,team=payments": {3},
+		"env":                    {3, 5},
+		"env!=prod":              {1, 2, 4, 5},
+		"env=prod,team=checkout": {},
+	}
+	for selector, expect := range selects {
+		sel, err := appInstance.ParseSelector(selector)
+		t.Assert(err, IsNil)
+		ids, err := ih.SelectInstanceIds(sel)
+		t.Assert(err, IsNil)
+		t.Check(ids, DeepEquals, expect, Commentf(selector))
+
+		// Matches is the same.
+		matches := []uint{}
+		for id := uint(1); id <= 5; id++ {
+			labels, err := ih.GetLabels(id)
+			t.Assert(err, IsNil)
+			if sel.Matches(labels) {
+				matches = append(matches, id)
+			}
+		}
+		t.Check(matches, DeepEquals, expect, Commentf(selector))
+	}
+
+	// Replace
+	t.Assert(ih.SetLabels("3d341070b1d74a84bb5f797c3ddbccc4", appInstance.Labels{"env": "dev"}), IsNil)
+	got, err = ih.GetLabels(3)
+	t.Assert(err, IsNil)
+	t.Check(got, DeepEquals, appInstance.Labels{"env": "dev"})
+}
+
+func (s *InstanceTestSuite) TestParseGroup(t *C) {
+	// Create requires the Name.
+	g, err := appInstance.ParseGroup([]byte(`{"Name": "galera", "Type": "cluster"}`), "")
+	t.Assert(err, IsNil)
+	t.Check(g.Name, Equals, "galera")
+	_, err = appInstance.ParseGroup([]byte(`{"Type": "cluster"}`), "")
+	t.Check(err, NotNil)
+
+	// Update (PUT) takes the name from the route, the Name in the body is
+	// optional.
+	g, err = appInstance.ParseGroup([]byte(`{"Type": "cluster", "Members": ["3d341070b1d74a84bb5f797c3ddbccc4"]}`), "galera")
+	t.Assert(err, IsNil)
+	t.Check(g.Name, Equals, "galera")
+	t.Check(g.Members, DeepEquals, []string{"3d341070b1d74a84bb5f797c3ddbccc4"})
+	g, err = appInstance.ParseGroup([]byte(`{"Name": "galera"}`), "galera")
+	t.Assert(err, IsNil)
+	t.Check(g.Name, Equals, "galera")
+
+	// But groups can't be renamed.
+	_, err = appInstance.ParseGroup([]byte(`{"Name": "galera-02"}`), "galera")
+	t.Check(err, ErrorMatches, "invalid Name: galera-02: cannot rename.*")
+
+	_, err = appInstance.ParseGroup([]byte(`{"Name":`), "")
+	t.Check(err, NotNil)
+}
+
+func (s *InstanceTestSuite) TestParseSelector(t *C) {
+	sel, err := appInstance.ParseSelector("env=prod, team!=payments,canary")
+	t.Assert(err, IsNil)
+	t.Check(sel, DeepEquals, appInstance.Selector{
+		{Name: "env", Operator: "=", Value: "prod"},
+		{Name: "team", Operator: "!=", Value: "payments"},
+		{Name: "canary"},
+	})
+
+	for _, selector := range []string{"", "env=prod,", "=prod", "env=a=b", "env=prod!"} {
+		_, err := appInstance.ParseSelector(selector)
+		t.Check(err, NotNil, Commentf(selector))
+	}
+}
@@ -0,0 +1,208 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+)
+
+const maxLabel = 63 // instance_labels.name and value
+
+// Label names and values are like Kubernetes': letters, digits, '-', '_'
+// and '.', beginning and ending with a letter or digit. Values can be
+// empty. So they can't contain the ',', '=' and '!' of selectors.
+var labelRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?$`)
+
+// Labels are the key/value labels of an instance, e.g. env=prod, to select
+// instances by them instead of by UUID, see Selector.
+type Labels map[string]string
+
+// Validate checks the names and values of the labels.
+func (l Labels) Validate() error {
+	for name, value := range l {
+		if len(name) > maxLabel || !labelRe.MatchString(name) {
+			return fmt.Errorf("invalid label name: %q: must be 1 to %d letters, digits, '-', '_' or '.', beginning and ending with a letter or digit", name, maxLabel)
+		}
+		if value != "" && (len(value) > maxLabel || !labelRe.MatchString(value)) {
+			return fmt.Errorf("invalid label %s value: %q: must be empty or 1 to %d letters, digits, '-', '_' or '.', beginning and ending with a letter or digit", name, value, maxLabel)
+		}
+	}
+	return nil
+}
+
+// A Selector selects instances by their labels: the instances that match all
+// its requirements.
+type Selector []Requirement
+
+// A Requirement is one comma-separated requirement of a selector: the label
+// Name has the Value (name=value), the label doesn't have the Value or the
+// instance doesn't have the label (name!=value), or the instance has the
+// label (name).
+type Requirement struct {
+	Name     string
+	Operator string // "=", "!=" or "" for has the label
+	Value    string
+}
+
+// ParseSelector parses a selector like "env=prod,team=payments".
+func ParseSelector(s string) (Selector, error) {
+	sel := Selector{}
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		req := Requirement{Name: r}
+		if i := strings.Index(r, "!="); i >= 0 {
+			req = Requirement{Name: r[:i], Operator: "!=", Value: r[i+2:]}
+		} else if i := strings.Index(r, "="); i >= 0 {
+			req = Requirement{Name: r[:i], Operator: "=", Value: r[i+1:]}
+		}
+		if err := (Labels{req.Name: req.Value}).Validate(); err != nil {
+			return nil, fmt.Errorf("invalid selector %s: %s", s, err)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// Matches returns true if the labels match all the requirements of the
+// selector, like SelectInstanceIds.
+func (sel Selector) Matches(labels Labels) bool {
+	for _, r := range sel {
+		value, ok := labels[r.Name]
+		switch r.Operator {
+		case "=":
+			if !ok || value != r.Value {
+				return false
+			}
+		case "!=":
+			if ok && value == r.Value {
+				return false
+			}
+		default:
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// GetLabels returns the labels of the instance.
+func (h *MySQLHandler) GetLabels(instanceId uint) (Labels, error) {
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(), "SELECT name, value FROM instance_labels WHERE instance_id = ?", instanceId)
+	if err != nil {
+		return nil, mysql.Error(err, "MySQLHandler.GetLabels: SELECT instance_labels")
+	}
+	defer rows.Close()
+	labels := Labels{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, mysql.Error(err, "MySQLHandler.GetLabels: rows.Scan")
+		}
+		labels[name] = value
+	}
+	return labels, mysql.Error(rows.Err(), "MySQLHandler.GetLabels: rows.Next")
+}
+
+// GetAllLabels returns the labels of all instances with labels keyed on
+// instance UUID.
+func (h *MySQLHandler) GetAllLabels() (map[string]Labels, error) {
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(),
+		"SELECT i.uuid, l.name, l.value FROM instance_labels l JOIN instances i USING (instance_id)")
+	if err != nil {
+		return nil, mysql.Error(err, "MySQLHandler.GetAllLabels: SELECT instance_labels")
+	}
+	defer rows.Close()
+	all := map[string]Labels{}
+	for rows.Next() {
+		var uuid, name, value string
+		if err := rows.Scan(&uuid, &name, &value); err != nil {
+			return nil, mysql.Error(err, "MySQLHandler.GetAllLabels: rows.Scan")
+		}
+		if all[uuid] == nil {
+			all[uuid] = Labels{}
+		}
+		all[uuid][name] = value
+	}
+	return all, mysql.Error(rows.Err(), "MySQLHandler.GetAllLabels: rows.Next")
+}
+
+// SetLabels replaces the labels of the instance with the validated labels.
+func (h *MySQLHandler) SetLabels(uuid string, labels Labels) error {
+	instanceId, err := h.instanceId(uuid)
+	if err != nil {
+		return err
+	}
+	tx, err := h.dbm.DB().BeginTx(h.dbm.Context(), nil)
+	if err != nil {
+		return mysql.Error(err, "MySQLHandler.SetLabels: Begin")
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(h.dbm.Context(), "DELETE FROM instance_labels WHERE instance_id = ?", instanceId); err != nil {
+		return mysql.Error(err, "MySQLHandler.SetLabels: DELETE instance_labels")
+	}
+	for name, value := range labels {
+		_, err := tx.ExecContext(h.dbm.Context(), "INSERT INTO instance_labels (instance_id, name, value) VALUES (?, ?, ?)", instanceId, name, value)
+		if err != nil {
+			return mysql.Error(err, "MySQLHandler.SetLabels: INSERT instance_labels")
+		}
+	}
+	return mysql.Error(tx.Commit(), "MySQLHandler.SetLabels: Commit")
+}
+
+// SelectInstanceIds returns the sorted ids of the instances the selector
+// selects, deleted ones too for their data.
+func (h *MySQLHandler) SelectInstanceIds(sel Selector) ([]uint, error) {
+	where := []string{}
+	args := []interface{}{}
+	for _, r := range sel {
+		switch r.Operator {
+		case "=":
+			where = append(where, "instance_id IN (SELECT instance_id FROM instance_labels WHERE name = ? AND value = ?)")
+			args = append(args, r.Name, r.Value)
+		case "!=":
+			where = append(where, "instance_id NOT IN (SELECT instance_id FROM instance_labels WHERE name = ? AND value = ?)")
+			args = append(args, r.Name, r.Value)
+		default:
+			where = append(where, "instance_id IN (SELECT instance_id FROM instance_labels WHERE name = ?)")
+			args = append(args, r.Name)
+		}
+	}
+	q := "SELECT instance_id FROM instances"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(), q+" ORDER BY instance_id", args...)
+	if err != nil {
+		return nil, mysql.Error(err, "MySQLHandler.SelectInstanceIds: SELECT instances")
+	}
+	defer rows.Close()
+	ids := []uint{}
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			return nil, mysql.Error(err, "MySQLHandler.SelectInstanceIds: rows.Scan")
+		}
+		ids = append(ids, id)
+	}
+	return ids, mysql.Error(rows.Err(), "MySQLHandler.SelectInstanceIds: rows.Next")
+}
@@ -19,7 +19,11 @@ package instance
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"sync"
 
+	"github.com/shatteredsilicon/qan-api/service/query"
 	"github.com/shatteredsilicon/ssm/proto"
 )
 
@@ -28,63 +32,137 @@ const (
 	SubsystemAgent
 	SubsystemMySQL
 	SubsystemMongo
+	SubsystemPostgreSQL
 )
 
 const (
-	SubsystemNameOS    = "os"
-	SubsystemNameAgent = "agent"
-	SubsystemNameMySQL = "mysql"
-	SubsystemNameMongo = "mongo"
+	SubsystemNameOS         = "os"
+	SubsystemNameAgent      = "agent"
+	SubsystemNameMySQL      = "mysql"
+	SubsystemNameMongo      = "mongo"
+	SubsystemNamePostgreSQL = "postgresql"
 )
 
-var subsysName map[uint]string = map[uint]string{
-	SubsystemOS:    SubsystemNameOS,
-	SubsystemAgent: SubsystemNameAgent,
-	SubsystemMySQL: SubsystemNameMySQL,
-	SubsystemMongo: SubsystemNameMongo,
+// Metric groups of query classes, see Subsystem.MetricGroups. They're the
+// groups of app/models.metricGroup.
+const (
+	MetricGroupBasic             = "basic"
+	MetricGroupPerconaServer     = "percona_server"
+	MetricGroupPerformanceSchema = "performance_schema"
+	MetricGroupPostgreSQL        = "postgresql"
+	MetricGroupMongo             = "mongo"
+)
+
+var (
+	ErrNotFound       = errors.New("subsystem not found")
+	ErrNoQueryClasses = errors.New("subsystem has no query classes")
+)
+
+// A Subsystem is a type of instance, e.g. mysql. Subsystems are registered
+// by Register and the code that handles instances and their data, like
+// qan.MySQLMetricWriter, dispatches through them, so adding a datastore is
+// implementing and registering a Subsystem.
+type Subsystem interface {
+	// Proto returns the id, parent id, name and label of the subsystem.
+	// The id is instances.subsystem_id, so it must never change.
+	Proto() proto.Subsystem
+
+	// Parse returns the fingerprint, abstract, tables and procedures of a
+	// query class from the fingerprint and example of the agent and the db
+	// of the example, like query.Mini.Parse. It returns ErrNoQueryClasses
+	// if the subsystem has none, e.g. os.
+	Parse(m *query.Mini, fingerprint, example, defaultDb string) (query.QueryInfo, error)
+
+	// MetricGroups returns the metric groups of the query classes, e.g.
+	// MetricGroupBasic, or none if the subsystem has no query classes.
+	MetricGroups() []string
+
+	// MetricAliases returns the metrics of the subsystem keyed on the
+	// metrics agents send them as, if any, e.g. Docs_examined as
+	// Rows_examined for MongoDB.
+	MetricAliases() map[string]string
 }
 
-var subsys map[string]proto.Subsystem = map[string]proto.Subsystem{
-	SubsystemNameOS: {
-		Id:       1,
-		ParentId: 0,
-		Name:     SubsystemNameOS,
-		Label:    "OS",
-	},
-	SubsystemNameAgent: {
-		Id:       2,
-		ParentId: 1,
-		Name:     SubsystemNameAgent,
-		Label:    "Agent",
-	},
-	SubsystemNameMySQL: {
-		Id:       3,
-		ParentId: 1,
-		Name:     SubsystemNameMySQL,
-		Label:    "MySQL",
-	},
-	SubsystemNameMongo: {
-		Id:       4,
-		ParentId: 1,
-		Name:     SubsystemNameMongo,
-		Label:    "MongoDB",
-	},
+var registry = struct {
+	sync.RWMutex
+	byId   map[uint]Subsystem
+	byName map[string]Subsystem
+}{
+	byId:   map[uint]Subsystem{},
+	byName: map[string]Subsystem{},
 }
 
-var ErrNotFound = errors.New("subsystem not found")
+// Register registers the subsystem. It panics if the id or name of the
+// subsystem is already registered, like sql.Register.
+func Register(s Subsystem) {
+	p := s.Proto()
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.byId[p.Id]; ok {
+		panic(fmt.Sprintf("subsystem id %d registered twice", p.Id))
+	}
+	if _, ok := registry.byName[p.Name]; ok {
+		panic(fmt.Sprintf("subsystem %s registered twice", p.Name))
+	}
+	registry.byId[p.Id] = s
+	registry.byName[p.Name] = s
+}
 
-func GetSubsystemById(id uint) (proto.Subsystem, error) {
-	name, ok := subsysName[id]
+// Lookup returns the subsystem with the name, or ErrNotFound.
+func Lookup(name string) (Subsystem, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	s, ok := registry.byName[name]
 	if !ok {
-		return proto.Subsystem{}, ErrNotFound
+		return nil, ErrNotFound
 	}
-	return subsys[name], nil
+	return s, nil
 }
 
-func GetSubsystemByName(name string) (proto.Subsystem, error) {
-	s, ok := subsys[name]
+// LookupId returns the subsystem with the id, or ErrNotFound.
+func LookupId(id uint) (Subsystem, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	s, ok := registry.byId[id]
 	if !ok {
-		return proto.Subsystem{}, ErrNotFound
+		return nil, ErrNotFound
 	}
 	return s, nil
 }
+
+// Subsystems returns the registered subsystems ordered by id.
+func Subsystems() []Subsystem {
+	registry.RLock()
+	defer registry.RUnlock()
+	subsystems := make([]Subsystem, 0, len(registry.byId))
+	for _, s := range registry.byId {
+		subsystems = append(subsystems, s)
+	}
+	sort.Slice(subsystems, func(i, j int) bool {
+		return subsystems[i].Proto().Id < subsystems[j].Proto().Id
+	})
+	return subsystems
+}
+
+// HasQueryClasses returns true if the subsystem with the name has query
+// classes, i.e. QAN data.
+func HasQueryClasses(name string) bool {
+	s, err := Lookup(name)
+	return err == nil && len(s.MetricGroups()) > 0
+}
+
+func GetSubsystemById(id uint) (proto.Subsystem, error) {
+	s, err := LookupId(id)
+	if err != nil {
+		return proto.Subsystem{}, err
+	}
+	return s.Proto(), nil
+}
+
+func GetSubsystemByName(name string) (proto.Subsystem, error) {
+	s, err := Lookup(name)
+	if err != nil {
+		return proto.Subsystem{}, err
+	}
+	return s.Proto(), nil
+}
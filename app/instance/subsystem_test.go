@@ -20,15 +20,40 @@ package instance
 import (
 	"testing"
 
+	"github.com/shatteredsilicon/ssm/proto"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestGetSubsystemByIdEqualByName(t *testing.T) {
-	for id, name := range subsysName {
-		subById, err := GetSubsystemById(id)
+	subsystems := Subsystems()
+	assert.Len(t, subsystems, 5)
+	for _, s := range subsystems {
+		subById, err := GetSubsystemById(s.Proto().Id)
 		assert.Nil(t, err)
-		subByName, err := GetSubsystemByName(name)
+		subByName, err := GetSubsystemByName(s.Proto().Name)
 		assert.Nil(t, err)
 		assert.Equal(t, subById, subByName)
 	}
+
+	_, err := GetSubsystemByName("oracle")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestRegister(t *testing.T) {
+	assert.Panics(t, func() {
+		Register(&subsystem{proto: proto.Subsystem{Id: SubsystemMySQL, Name: "mysql2"}})
+	})
+	assert.Panics(t, func() {
+		Register(&subsystem{proto: proto.Subsystem{Id: 100, Name: SubsystemNameMySQL}})
+	})
+
+	assert.True(t, HasQueryClasses(SubsystemNameMySQL))
+	assert.True(t, HasQueryClasses(SubsystemNamePostgreSQL))
+	assert.False(t, HasQueryClasses(SubsystemNameOS))
+	assert.False(t, HasQueryClasses("oracle"))
+
+	s, err := Lookup(SubsystemNameOS)
+	assert.Nil(t, err)
+	_, err = s.Parse(nil, "select 1", "", "")
+	assert.Equal(t, ErrNoQueryClasses, err)
 }
@@ -0,0 +1,92 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package instance
+
+import (
+	appMetrics "github.com/shatteredsilicon/qan-api/app/metrics"
+	"github.com/shatteredsilicon/qan-api/service/query"
+	"github.com/shatteredsilicon/ssm/proto"
+)
+
+// The subsystems of the API.
+func init() {
+	Register(&subsystem{
+		proto: proto.Subsystem{Id: SubsystemOS, ParentId: 0, Name: SubsystemNameOS, Label: "OS"},
+	})
+	Register(&subsystem{
+		proto: proto.Subsystem{Id: SubsystemAgent, ParentId: SubsystemOS, Name: SubsystemNameAgent, Label: "Agent"},
+	})
+	Register(&subsystem{
+		proto: proto.Subsystem{Id: SubsystemMySQL, ParentId: SubsystemOS, Name: SubsystemNameMySQL, Label: "MySQL"},
+		parse: func(m *query.Mini, fingerprint, example, defaultDb string) (query.QueryInfo, error) {
+			return m.Parse(fingerprint, example, defaultDb)
+		},
+		metricGroups: []string{MetricGroupBasic, MetricGroupPerconaServer, MetricGroupPerformanceSchema},
+	})
+	Register(&subsystem{
+		proto:         proto.Subsystem{Id: SubsystemMongo, ParentId: SubsystemOS, Name: SubsystemNameMongo, Label: "MongoDB"},
+		parse:         parseMongo,
+		metricGroups:  []string{MetricGroupBasic, MetricGroupMongo},
+		metricAliases: appMetrics.MongoAliases,
+	})
+	Register(&subsystem{
+		proto: proto.Subsystem{Id: SubsystemPostgreSQL, ParentId: SubsystemOS, Name: SubsystemNamePostgreSQL, Label: "PostgreSQL"},
+		parse: func(m *query.Mini, fingerprint, example, defaultDb string) (query.QueryInfo, error) {
+			return query.ParsePostgreSQL(fingerprint, example, defaultDb)
+		},
+		metricGroups: []string{MetricGroupBasic, MetricGroupPostgreSQL},
+	})
+}
+
+// parseMongo parses the fingerprint of a MongoDB query class. Fingerprints
+// it can't parse are the abstract, like before they were parsed.
+func parseMongo(m *query.Mini, fingerprint, example, defaultDb string) (query.QueryInfo, error) {
+	q, err := query.ParseMongo(fingerprint, example, defaultDb)
+	if err == query.ErrNotMongoFingerprint {
+		q.Abstract = q.Fingerprint
+		return q, nil
+	}
+	return q, err
+}
+
+// subsystem is a Subsystem of values, see Subsystem.
+type subsystem struct {
+	proto         proto.Subsystem
+	parse         func(m *query.Mini, fingerprint, example, defaultDb string) (query.QueryInfo, error)
+	metricGroups  []string
+	metricAliases map[string]string
+}
+
+func (s *subsystem) Proto() proto.Subsystem {
+	return s.proto
+}
+
+func (s *subsystem) Parse(m *query.Mini, fingerprint, example, defaultDb string) (query.QueryInfo, error) {
+	if s.parse == nil {
+		return query.QueryInfo{}, ErrNoQueryClasses
+	}
+	return s.parse(m, fingerprint, example, defaultDb)
+}
+
+func (s *subsystem) MetricGroups() []string {
+	return s.metricGroups
+}
+
+func (s *subsystem) MetricAliases() map[string]string {
+	return s.metricAliases
+}
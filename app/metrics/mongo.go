@@ -0,0 +1,42 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package metrics
+
+import (
+	"github.com/shatteredsilicon/ssm/proto/metrics"
+)
+
+// MONGO flags the metrics of the MongoDB profiler, like POSTGRESQL.
+const MONGO = 128
+
+// Mongo are the metrics of MongoDB query classes in addition to the
+// universal Query_time and Rows_sent (nreturned). Older agents send
+// docsExamined as Rows_examined and responseLength as Bytes_sent, see
+// MongoAliases.
+var Mongo []metrics.MetricFlags = []metrics.MetricFlags{
+	{Name: "Docs_examined", Flags: MONGO},
+	{Name: "Keys_examined", Flags: MONGO},
+	{Name: "Response_length", Flags: MONGO},
+}
+
+// MongoAliases are the Mongo metrics keyed on the MySQL metrics older agents
+// send them as.
+var MongoAliases = map[string]string{
+	"Rows_examined": "Docs_examined",
+	"Bytes_sent":    "Response_length",
+}
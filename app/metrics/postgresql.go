@@ -0,0 +1,39 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package metrics
+
+import (
+	"github.com/shatteredsilicon/ssm/proto/metrics"
+)
+
+// POSTGRESQL flags the metrics of pg_stat_statements. The other flags are
+// those of the proto, so it must not be one of them.
+const POSTGRESQL = 64
+
+// PostgreSQL are the metrics of PostgreSQL query classes in addition to the
+// universal Query_time and Rows_sent (pg_stat_statements total_exec_time and
+// rows). Agents send them like slow log metrics, e.g. Wal_bytes in
+// NumberMetrics and Plan_time, in seconds, in TimeMetrics.
+var PostgreSQL []metrics.MetricFlags = []metrics.MetricFlags{
+	{Name: "Shared_blks_hit", Flags: POSTGRESQL},
+	{Name: "Shared_blks_read", Flags: POSTGRESQL},
+	{Name: "Temp_blks_read", Flags: POSTGRESQL},
+	{Name: "Temp_blks_written", Flags: POSTGRESQL},
+	{Name: "Wal_bytes", Flags: POSTGRESQL},
+	{Name: "Plan_time", Flags: POSTGRESQL | metrics.MICROSECOND},
+}
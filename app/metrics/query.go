@@ -42,6 +42,19 @@ var (
 	ErrNoMetrics = errors.New("no metrics exist")
 )
 
+// Query are the metrics stored for query classes: those of the proto, then
+// those of PostgreSQL and MongoDB. Like metrics.Query, the order is
+// significant.
+var Query = queryMetrics()
+
+func queryMetrics() []metrics.MetricFlags {
+	q := make([]metrics.MetricFlags, 0, len(metrics.Query)+len(PostgreSQL)+len(Mongo))
+	q = append(q, metrics.Query...)
+	q = append(q, PostgreSQL...)
+	q = append(q, Mongo...)
+	return q
+}
+
 func init() {
 	basicMetrics = []string{}
 	psMetrics = []string{}
@@ -0,0 +1,89 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/shared"
+)
+
+type anomalies struct{}
+
+// Anomalies reads the anomalies recorded by anomaly.Analyzer.
+var Anomalies = anomalies{}
+
+// Anomaly - an hour in which a query class deviated from its baseline for
+// the same hour of the week
+type Anomaly struct {
+	InstanceID     string    `json:"InstanceId" db:"instance_uuid"` // UUID of MySQL instance
+	ID             string    `json:"Id" db:"checksum"`              // hex checksum
+	Abstract       string    `db:"abstract"`
+	Fingerprint    string    `db:"fingerprint"`
+	Start          time.Time `db:"start_ts"` // start of the hour
+	Metric         string    `db:"metric"`   // Query_time_avg or query_count
+	Value          float64   `db:"value"`
+	BaselineMean   float64   `db:"baseline_mean"`
+	BaselineStddev float64   `db:"baseline_stddev"`
+	Score          float64   `db:"score"` // stddevs from BaselineMean, negative if Value is less
+}
+
+// Get returns the anomalies of the instances in hours that overlap the time
+// range, the most recent first.
+func (a anomalies) Get(ctx context.Context, instanceIDs []uint, begin, end time.Time) ([]Anomaly, error) {
+	found := []Anomaly{}
+	if len(instanceIDs) == 0 {
+		return found, nil
+	}
+	err := db.SelectContext(ctx, &found,
+		"SELECT i.uuid AS instance_uuid, qc.checksum, qc.abstract, qc.fingerprint,"+
+			" qa.start_ts, qa.metric, qa.value, qa.baseline_mean, qa.baseline_stddev, qa.score"+
+			" FROM query_anomalies qa"+
+			" JOIN query_classes qc ON qc.query_class_id = qa.query_class_id"+
+			" JOIN instances i ON i.instance_id = qa.instance_id"+
+			" WHERE qa.instance_id IN ("+shared.UintList(instanceIDs)+") AND qa.start_ts > ? AND qa.start_ts < ?"+
+			" ORDER BY qa.start_ts DESC, ABS(qa.score) DESC",
+		begin.Add(-time.Hour), end)
+	if err != nil {
+		return nil, queryError(err, "Anomalies.Get: SELECT query_anomalies")
+	}
+	return found, nil
+}
+
+// classes returns the query classes that have an anomaly in the time range.
+// instanceIDs is a comma-separated list as in the templates.
+func (a anomalies) classes(ctx context.Context, classIDs []uint, instanceIDs string, begin, end time.Time) (map[uint]bool, error) {
+	found := map[uint]bool{}
+	if len(classIDs) == 0 {
+		return found, nil
+	}
+	ids := []uint{}
+	err := db.SelectContext(ctx, &ids,
+		"SELECT DISTINCT query_class_id FROM query_anomalies"+
+			" WHERE query_class_id IN ("+shared.UintList(classIDs)+") AND instance_id IN ("+instanceIDs+")"+
+			" AND start_ts > ? AND start_ts < ?",
+		begin.Add(-time.Hour), end)
+	if err != nil {
+		return nil, queryError(err, "Anomalies.classes: SELECT query_anomalies")
+	}
+	for _, id := range ids {
+		found[id] = true
+	}
+	return found, nil
+}
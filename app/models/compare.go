@@ -0,0 +1,259 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package models
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/shared"
+)
+
+// MaxCompareLimit is the max RankBy.Limit for Compare. Every query class in
+// the top of either time range is a query report for both ranges, so this is
+// lower than for Profile.
+const MaxCompareLimit = 100
+
+// Comparison - query classes compared between two time ranges, e.g. before
+// and after a deploy
+type Comparison struct {
+	Begin1 time.Time // first time range [Begin1, End1)
+	End1   time.Time
+	Begin2 time.Time // second time range [Begin2, End2)
+	End2   time.Time
+	RankBy RankBy            // criteria for the top queries of each time range
+	Total  ClassComparison   // all queries
+	Query  []ClassComparison // by largest absolute load delta first
+}
+
+// ClassComparison - a query class in both time ranges
+type ClassComparison struct {
+	ID          string `json:"Id"` // hex checksum, empty for Comparison.Total
+	Abstract    string
+	Fingerprint string
+	New         bool // no queries in the first time range
+	Gone        bool // no queries in the second time range
+	Stats1      CompareStats
+	Stats2      CompareStats
+	Delta       CompareDeltas
+}
+
+// CompareStats - stats of a query class in one time range
+type CompareStats struct {
+	Count           float64 // queries
+	Load            float64 // Query_time_sum / (End - Begin)
+	QueryTimeAvg    float64
+	QueryTimeP95    float64
+	RowsExaminedSum float64
+}
+
+// CompareDeltas - changes from Stats1 to Stats2
+type CompareDeltas struct {
+	Count           Delta
+	Load            Delta
+	QueryTimeAvg    Delta
+	QueryTimeP95    Delta
+	RowsExaminedSum Delta
+}
+
+// Delta - absolute and relative change of a value. Rel is null if the first
+// value is zero.
+type Delta struct {
+	Abs float64  // value2 - value1
+	Rel *float64 // (value2 - value1) / value1
+}
+
+func newDelta(v1, v2 float64) Delta {
+	d := Delta{Abs: v2 - v1}
+	if v1 != 0 {
+		rel := (v2 - v1) / v1
+		d.Rel = &rel
+	}
+	return d
+}
+
+// Compare compares the query classes that are in the top of either time
+// range according to rank.
+func (r report) Compare(ctx context.Context, instanceIDs []uint, begin1, end1, begin2, end2 time.Time, rank RankBy) (Comparison, error) {
+	if err := rank.Validate(); err != nil {
+		return Comparison{}, err
+	}
+	if rank.Limit > MaxCompareLimit {
+		return Comparison{}, fmt.Errorf("limit must be between 1 and %d", MaxCompareLimit)
+	}
+	c := Comparison{
+		Begin1: begin1,
+		End1:   end1,
+		Begin2: begin2,
+		End2:   end2,
+		RankBy: rank,
+	}
+
+	profile1, err := r.ProfileRanks(ctx, instanceIDs, begin1, end1, rank, false)
+	if err != nil {
+		return c, err
+	}
+	profile2, err := r.ProfileRanks(ctx, instanceIDs, begin2, end2, rank, false)
+	if err != nil {
+		return c, err
+	}
+
+	// Union of the top query classes, index 0 is the total.
+	var top []QueryRank
+	var classIDs []uint
+	seen := map[uint]bool{}
+	for _, profile := range []Profile{profile1, profile2} {
+		for i, q := range profile.Query {
+			if i == 0 || seen[q.classID] {
+				continue
+			}
+			seen[q.classID] = true
+			top = append(top, q)
+			classIDs = append(classIDs, q.classID)
+		}
+	}
+
+	global1, _, err := Metrics.GetGlobalMetrics(ctx, instanceIDs, begin1, end1)
+	if err != nil {
+		return c, err
+	}
+	global2, _, err := Metrics.GetGlobalMetrics(ctx, instanceIDs, begin2, end2)
+	if err != nil {
+		return c, err
+	}
+	c.Total = newClassComparison(
+		newCompareStats(global1.generalMetrics, begin1, end1),
+		newCompareStats(global2.generalMetrics, begin2, end2),
+	)
+
+	classes1, err := compareClassStats(ctx, classIDs, instanceIDs, begin1, end1)
+	if err != nil {
+		return c, err
+	}
+	classes2, err := compareClassStats(ctx, classIDs, instanceIDs, begin2, end2)
+	if err != nil {
+		return c, err
+	}
+	c.Query = make([]ClassComparison, len(top))
+	for i, q := range top {
+		c.Query[i] = newClassComparison(classes1[q.classID], classes2[q.classID])
+		c.Query[i].ID = q.ID
+		c.Query[i].Abstract = q.Abstract
+		c.Query[i].Fingerprint = q.Fingerprint
+	}
+	sort.SliceStable(c.Query, func(i, j int) bool {
+		return math.Abs(c.Query[i].Delta.Load.Abs) > math.Abs(c.Query[j].Delta.Load.Abs)
+	})
+
+	return c, nil
+}
+
+var compareClassesTmpl = template.Must(template.New("compareClassesSQL").Parse(compareClassesTemplate))
+
+// Like queryClassMetricsTemplate, but only the compared metrics, for all
+// the classes at once.
+const compareClassesTemplate = `
+SELECT query_class_id,
+	COALESCE(SUM(query_count), 0) AS query_count,
+	COALESCE(SUM(Query_time_sum), 0) AS query_time_sum,
+	COALESCE(AVG(Query_time_avg), 0) AS query_time_avg,
+	COALESCE(AVG(Query_time_med), 0) AS query_time_med,
+	COALESCE(AVG(Query_time_p95), 0) AS query_time_p95,
+	COALESCE(SUM(Rows_examined_sum), 0) AS rows_examined_sum
+FROM {{ .ClassMetrics }} AS qcm
+WHERE query_class_id IN ({{ .ClassIDs }}) AND
+	 instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end)
+GROUP BY query_class_id;
+`
+
+// compareClassStats returns the stats of the query classes in the time range
+// keyed on query_class_id, like Metrics.GetClassMetrics of each class but in
+// one query. Classes without queries in the range have zero stats.
+func compareClassStats(ctx context.Context, classIDs, instanceIDs []uint, begin, end time.Time) (map[uint]CompareStats, error) {
+	stats := map[uint]CompareStats{}
+	if len(classIDs) == 0 {
+		return stats, nil
+	}
+	_, intervalTs := Metrics.sparklinePoints(begin, end)
+	group := struct {
+		ClassIDs     string
+		InstanceIDs  string
+		ClassMetrics string
+	}{
+		ClassIDs:    shared.UintList(classIDs),
+		InstanceIDs: shared.UintList(instanceIDs),
+	}
+	group.ClassMetrics = Metrics.pickSource(begin, end, intervalTs).ClassMetrics(group.InstanceIDs, begin, end)
+
+	compareClassesSQL, err := execTemplate(compareClassesTmpl, group, "Report.Compare")
+	if err != nil {
+		return nil, err
+	}
+	nstmt, err := db.PrepareNamedContext(ctx, compareClassesSQL)
+	if err != nil {
+		return nil, queryError(err, "Report.Compare: db.PrepareNamed")
+	}
+	defer nstmt.Close()
+	rows := []struct {
+		Query_class_id uint
+		generalMetrics
+	}{}
+	if err := nstmt.SelectContext(ctx, &rows, args{Begin: begin, End: end}); err != nil {
+		return nil, queryError(err, "Report.Compare: nstmt.Select")
+	}
+
+	sketches, err := querySketches(ctx, group.ClassMetrics, classIDs, group.InstanceIDs, begin, end, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		row.generalMetrics.setPercentiles(sketches[row.Query_class_id])
+		stats[row.Query_class_id] = newCompareStats(row.generalMetrics, begin, end)
+	}
+	return stats, nil
+}
+
+func newCompareStats(m generalMetrics, begin, end time.Time) CompareStats {
+	return CompareStats{
+		Count:           float64(m.Query_count),
+		Load:            float64(m.Query_time_sum) / end.Sub(begin).Seconds(),
+		QueryTimeAvg:    float64(m.Query_time_avg),
+		QueryTimeP95:    float64(m.Query_time_p95),
+		RowsExaminedSum: float64(m.Rows_examined_sum),
+	}
+}
+
+func newClassComparison(s1, s2 CompareStats) ClassComparison {
+	return ClassComparison{
+		New:    s1.Count == 0 && s2.Count > 0,
+		Gone:   s1.Count > 0 && s2.Count == 0,
+		Stats1: s1,
+		Stats2: s2,
+		Delta: CompareDeltas{
+			Count:           newDelta(s1.Count, s2.Count),
+			Load:            newDelta(s1.Load, s2.Load),
+			QueryTimeAvg:    newDelta(s1.QueryTimeAvg, s2.QueryTimeAvg),
+			QueryTimeP95:    newDelta(s1.QueryTimeP95, s2.QueryTimeP95),
+			RowsExaminedSum: newDelta(s1.RowsExaminedSum, s2.RowsExaminedSum),
+		},
+	}
+}
@@ -0,0 +1,64 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package models
+
+import (
+	"bytes"
+	"errors"
+	"text/template"
+
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+)
+
+// QueryError is returned by the models when a query fails, e.g. because
+// MySQL is down or the request deadline passed. Callers can still check
+// errors.Is(err, shared.ErrQueryTimeout), etc.
+type QueryError struct {
+	Op  string // e.g. "Metrics.getMetrics: nstmt.Get"
+	Err error  // a shared error like shared.ErrQueryTimeout, else the driver error
+}
+
+func (e *QueryError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// queryError returns a QueryError for err, or nil if err is nil. MySQL
+// errors that the API handles are mapped like mysql.Error.
+func queryError(err error, op string) error {
+	if err == nil {
+		return nil
+	}
+	if mapped := mysql.Error(err, op); !errors.Is(mapped, err) {
+		err = mapped // e.g. shared.ErrNotFound
+	}
+	return &QueryError{Op: op, Err: err}
+}
+
+// execTemplate returns the SQL of a query template. The templates are
+// parsed once with template.Must, so only executing them can fail.
+func execTemplate(tmpl *template.Template, data interface{}, op string) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", &QueryError{Op: op + ": " + tmpl.Name(), Err: err}
+	}
+	return buf.String(), nil
+}
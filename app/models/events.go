@@ -0,0 +1,163 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/shared"
+)
+
+// Event types
+const (
+	EventDeploy    = "deploy"
+	EventMigration = "migration" // schema migration
+	EventConfig    = "config"    // config change
+	EventFailover  = "failover"
+	EventOther     = "other"
+)
+
+var EventTypes = []string{EventDeploy, EventMigration, EventConfig, EventFailover, EventOther}
+
+const maxEventLabel = 255
+
+type events struct{}
+
+// Events records deploys, migrations, etc. on instances so they can be shown
+// on the sparklines of the instances.
+var Events = events{}
+
+// Event - something that happened on an instance at a point in time
+type Event struct {
+	ID         uint      `json:"Id" db:"event_id"`
+	InstanceID string    `json:"InstanceId" db:"instance_uuid"` // UUID of MySQL instance
+	Ts         time.Time `db:"ts"`
+	Type       string    `db:"type"`
+	Label      string    `db:"label"`
+	User       string    `db:"user"`
+}
+
+// SparkEvent - an event and the sparkline point it falls in, the same as
+// QueryLog.Point and rateMetrics.Point
+type SparkEvent struct {
+	Event
+	Point int64
+}
+
+// Validate checks the event. Ts defaults to now.
+func (e *Event) Validate() error {
+	valid := false
+	for _, t := range EventTypes {
+		if e.Type == t {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid Type: %s: must be one of %s", e.Type, strings.Join(EventTypes, ", "))
+	}
+	if strings.TrimSpace(e.Label) == "" {
+		return fmt.Errorf("Label is required")
+	}
+	if len(e.Label) > maxEventLabel {
+		return fmt.Errorf("Label is too long: %d bytes, max %d", len(e.Label), maxEventLabel)
+	}
+	if e.Ts.IsZero() {
+		e.Ts = time.Now()
+	}
+	e.Ts = e.Ts.UTC().Truncate(time.Second)
+	return nil
+}
+
+// Create records the validated event on every instance and returns the
+// event IDs in the same order.
+func (ev events) Create(ctx context.Context, instanceIDs []uint, e Event) ([]uint, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, queryError(err, "Events.Create: Begin")
+	}
+	defer tx.Rollback()
+	ids := make([]uint, len(instanceIDs))
+	for i, instanceID := range instanceIDs {
+		res, err := tx.ExecContext(ctx,
+			"INSERT INTO events (instance_id, ts, type, label, user) VALUES (?, ?, ?, ?, ?)",
+			instanceID, e.Ts, e.Type, e.Label, e.User)
+		if err != nil {
+			return nil, queryError(err, "Events.Create: INSERT events")
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get event last insert id")
+		}
+		ids[i] = uint(id)
+	}
+	return ids, queryError(tx.Commit(), "Events.Create: Commit")
+}
+
+// Get returns the events of the instances in the time range [begin, end),
+// the oldest first.
+func (ev events) Get(ctx context.Context, instanceIDs []uint, begin, end time.Time) ([]Event, error) {
+	found := []Event{}
+	if len(instanceIDs) == 0 {
+		return found, nil
+	}
+	err := db.SelectContext(ctx, &found,
+		"SELECT e.event_id, i.uuid AS instance_uuid, e.ts, e.type, e.label, e.user"+
+			" FROM events e"+
+			" JOIN instances i ON i.instance_id = e.instance_id"+
+			" WHERE e.instance_id IN ("+shared.UintList(instanceIDs)+") AND e.ts >= ? AND e.ts < ?"+
+			" ORDER BY e.ts, e.event_id",
+		begin, end)
+	if err != nil {
+		return nil, queryError(err, "Events.Get: SELECT events")
+	}
+	return found, nil
+}
+
+// Delete deletes the event.
+func (ev events) Delete(ctx context.Context, id uint) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM events WHERE event_id = ?", id)
+	if err != nil {
+		return queryError(err, "Events.Delete: DELETE events")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return shared.ErrNotFound
+	}
+	return nil
+}
+
+// sparkline returns the events in the time range with the sparkline point
+// each one falls in, or nil if there are none. endTs and intervalTs are the
+// same as for the sparkline, e.g. see SparklineData.
+func (ev events) sparkline(ctx context.Context, instanceIDs []uint, begin, end time.Time, endTs, intervalTs int64) ([]SparkEvent, error) {
+	found, err := ev.Get(ctx, instanceIDs, begin, end)
+	if err != nil || len(found) == 0 || intervalTs <= 0 {
+		return nil, err
+	}
+	sparkEvents := make([]SparkEvent, len(found))
+	for i, e := range found {
+		sparkEvents[i] = SparkEvent{
+			Event: e,
+			Point: (endTs - e.Ts.Unix()) / intervalTs,
+		}
+	}
+	return sparkEvents, nil
+}
@@ -0,0 +1,40 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package models
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/shatteredsilicon/qan-api/app/rollup"
+)
+
+// SetDB replaces the shared pool, e.g. with one that fails, and returns
+// the previous one to restore.
+func SetDB(d *sqlx.DB) *sqlx.DB {
+	prev := db
+	db = d
+	return prev
+}
+
+// RollupTable returns the table expression of a rollup source with the
+// period, rolled up to rolledUpTo, for instance 1 and the range.
+func RollupTable(period time.Duration, rolledUpTo, begin, end time.Time) string {
+	l := rollup.Level{Period: period, ClassTable: "rollup", GlobalTable: "rollup"}
+	return source{level: &l, rolledUpTo: rolledUpTo}.table("rollup", "raw", "1", begin, end)
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package models_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/shatteredsilicon/qan-api/app/models"
+	"github.com/shatteredsilicon/qan-api/config"
+	. "gopkg.in/check.v1"
+)
+
+// FailureTestSuite checks that the models return a QueryError instead of
+// exiting when MySQL fails.
+type FailureTestSuite struct {
+	bad  map[string]*sqlx.DB
+	prev *sqlx.DB
+}
+
+var _ = Suite(&FailureTestSuite{})
+
+func (s *FailureTestSuite) SetUpSuite(t *C) {
+	// Every query on a closed pool fails without reaching MySQL.
+	closed, err := sqlx.Open("mysql", config.Get("mysql.dsn"))
+	t.Assert(err, IsNil)
+	closed.Close()
+
+	// Nothing listens on port 1, so every connection fails.
+	down, err := sqlx.Open("mysql", "root@tcp(127.0.0.1:1)/test?timeout=1s")
+	t.Assert(err, IsNil)
+
+	s.bad = map[string]*sqlx.DB{
+		"closed": closed,
+		"down":   down,
+	}
+}
+
+func (s *FailureTestSuite) TearDownSuite(t *C) {
+	s.bad["down"].Close()
+}
+
+func (s *FailureTestSuite) TearDownTest(t *C) {
+	if s.prev != nil {
+		models.SetDB(s.prev)
+		s.prev = nil
+	}
+}
+
+// each calls f with each bad pool in place of the shared pool.
+func (s *FailureTestSuite) each(f func(name string)) {
+	for name, bad := range s.bad {
+		prev := models.SetDB(bad)
+		if s.prev == nil {
+			s.prev = prev
+		}
+		f(name)
+	}
+}
+
+func checkQueryError(t *C, err error, name string) {
+	var qe *models.QueryError
+	t.Check(errors.As(err, &qe), Equals, true, Commentf("%s: %v", name, err))
+}
+
+var (
+	failBegin = time.Date(2015, time.May, 01, 0, 0, 0, 0, time.UTC)
+	failEnd   = time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+	failRank  = models.RankBy{Metric: "Query_time", Stat: "sum", Limit: 5}
+)
+
+// --------------------------------------------------------------------------
+
+func (s *FailureTestSuite) TestProfile(t *C) {
+	s.each(func(name string) {
+		_, err := models.Report.Profile(ctx, []uint{1}, failBegin, failEnd, failRank, 0, "", false, "", nil, nil)
+		checkQueryError(t, err, name)
+
+		_, err = models.Report.Compare(ctx, []uint{1}, failBegin, failEnd, failEnd, failEnd.Add(24*time.Hour), failRank)
+		checkQueryError(t, err, name)
+	})
+}
+
+func (s *FailureTestSuite) TestMetrics(t *C) {
+	s.each(func(name string) {
+		_, _, err := models.Metrics.GetClassMetrics(ctx, 1, []uint{1}, failBegin, failEnd)
+		checkQueryError(t, err, name)
+
+		_, _, err = models.Metrics.GetGlobalMetrics(ctx, []uint{1}, failBegin, failEnd)
+		checkQueryError(t, err, name)
+
+		_, err = models.Metrics.GetEvents(ctx, []uint{1}, failBegin, failEnd)
+		checkQueryError(t, err, name)
+	})
+}
+
+func (s *FailureTestSuite) TestEventsAndAnomalies(t *C) {
+	s.each(func(name string) {
+		e := models.Event{Type: models.EventDeploy, Label: "v1.2.3"}
+		t.Assert(e.Validate(), IsNil)
+		_, err := models.Events.Create(ctx, []uint{1}, e)
+		checkQueryError(t, err, name)
+
+		_, err = models.Events.Get(ctx, []uint{1}, failBegin, failEnd)
+		checkQueryError(t, err, name)
+
+		err = models.Events.Delete(ctx, 1)
+		checkQueryError(t, err, name)
+
+		_, err = models.Anomalies.Get(ctx, []uint{1}, failBegin, failEnd)
+		checkQueryError(t, err, name)
+	})
+}
@@ -1,13 +1,16 @@
 package models
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"reflect"
 	"strings"
 	"text/template"
 	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/instance"
+	"github.com/shatteredsilicon/qan-api/app/shared"
 )
 
 // Metrics provire instruments to works with metrics
@@ -20,9 +23,13 @@ type metricGroup struct {
 	Basic             bool
 	PerconaServer     bool `db:"percona_server"`
 	PerformanceSchema bool `db:"performance_schema"`
+	PostgreSQL        bool `db:"postgresql"`
+	Mongo             bool `db:"mongo"`
 	ServerSummary     bool
 	CountField        string
 	InstanceIDs       string
+	ClassMetrics      string // table expressions, see source
+	GlobalMetrics     string
 }
 
 type args struct {
@@ -33,23 +40,33 @@ type args struct {
 	IntervalTS int64 `db:"interval_ts"`
 }
 
+var metricGroupTmpl = template.Must(template.New("metricGroupSQL").Parse(metricGroupQueryTemplate))
+
 const metricGroupQueryTemplate = `
 SELECT
-    IFNULL((SELECT true FROM query_global_metrics
+    IFNULL((SELECT true FROM {{ .GlobalMetrics }} AS qgm
         WHERE instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end)
         AND Query_time_sum IS NOT NULL
         LIMIT 1), false) AS basic,
-    IFNULL((SELECT true FROM query_global_metrics
+    IFNULL((SELECT true FROM {{ .GlobalMetrics }} AS qgm
         WHERE instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end)
         AND Rows_affected_sum IS NOT NULL
         LIMIT 1), false) AS percona_server,
-    IFNULL((SELECT true FROM query_global_metrics
+    IFNULL((SELECT true FROM {{ .GlobalMetrics }} AS qgm
         WHERE instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end)
         AND Errors_sum IS NOT NULL
-        LIMIT 1), false) AS performance_schema;
+        LIMIT 1), false) AS performance_schema,
+    IFNULL((SELECT true FROM {{ .GlobalMetrics }} AS qgm
+        WHERE instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end)
+        AND Shared_blks_hit_sum IS NOT NULL
+        LIMIT 1), false) AS postgresql,
+    IFNULL((SELECT true FROM {{ .GlobalMetrics }} AS qgm
+        WHERE instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end)
+        AND Docs_examined_sum IS NOT NULL
+        LIMIT 1), false) AS mongo;
 `
 
-func (m metrics) identifyMetricGroup(instanceIDs []uint, begin, end time.Time) metricGroup {
+func (m metrics) identifyMetricGroup(ctx context.Context, instanceIDs []uint, begin, end time.Time, src source) (metricGroup, error) {
 	currentMetricGroup := metricGroup{}
 	currentMetricGroup.CountField = "query_count"
 	instanceIDStrs := make([]string, len(instanceIDs))
@@ -57,25 +74,64 @@ func (m metrics) identifyMetricGroup(instanceIDs []uint, begin, end time.Time) m
 		instanceIDStrs[i] = fmt.Sprintf("%d", instanceIDs[i])
 	}
 	currentMetricGroup.InstanceIDs = strings.Join(instanceIDStrs, ", ")
+	currentMetricGroup.ClassMetrics = src.ClassMetrics(currentMetricGroup.InstanceIDs, begin, end)
+	currentMetricGroup.GlobalMetrics = src.GlobalMetrics(currentMetricGroup.InstanceIDs, begin, end)
 	args := args{
 		Begin: begin,
 		End:   end,
 	}
 
-	var metricGroupBuffer bytes.Buffer
-	if tmpl, err := template.New("metricGroupSQL").Parse(metricGroupQueryTemplate); err != nil {
-		log.Fatalln(err)
-	} else if err = tmpl.Execute(&metricGroupBuffer, currentMetricGroup); err != nil {
-		log.Fatalln(err)
+	metricGroupSQL, err := execTemplate(metricGroupTmpl, currentMetricGroup, "Metrics.identifyMetricGroup")
+	if err != nil {
+		return currentMetricGroup, err
+	}
+
+	nstmt, err := db.PrepareNamedContext(ctx, metricGroupSQL)
+	if err != nil {
+		return currentMetricGroup, queryError(err, "Metrics.identifyMetricGroup: db.PrepareNamed")
+	}
+	defer nstmt.Close()
+	if err := nstmt.GetContext(ctx, &currentMetricGroup, args); err != nil {
+		return currentMetricGroup, queryError(err, "Metrics.identifyMetricGroup: nstmt.Get")
 	}
 
-	if nstmt, err := db.PrepareNamed(metricGroupBuffer.String()); err != nil {
-		log.Fatalln(err)
-	} else if err = nstmt.Get(&currentMetricGroup, args); err != nil {
-		log.Fatalln(err)
+	// Only the metric groups of the subsystems of the instances, see
+	// instance.Subsystem.MetricGroups.
+	groups, err := m.subsystemMetricGroups(ctx, currentMetricGroup.InstanceIDs)
+	if err != nil {
+		return currentMetricGroup, err
 	}
+	currentMetricGroup.Basic = currentMetricGroup.Basic && groups[instance.MetricGroupBasic]
+	currentMetricGroup.PerconaServer = currentMetricGroup.PerconaServer && groups[instance.MetricGroupPerconaServer]
+	currentMetricGroup.PerformanceSchema = currentMetricGroup.PerformanceSchema && groups[instance.MetricGroupPerformanceSchema]
+	currentMetricGroup.PostgreSQL = currentMetricGroup.PostgreSQL && groups[instance.MetricGroupPostgreSQL]
+	currentMetricGroup.Mongo = currentMetricGroup.Mongo && groups[instance.MetricGroupMongo]
+
+	return currentMetricGroup, nil
+}
 
-	return currentMetricGroup
+// subsystemMetricGroups returns the metric groups of the subsystems of the
+// instances, a comma-separated list of instance ids.
+func (m metrics) subsystemMetricGroups(ctx context.Context, instanceIDs string) (map[string]bool, error) {
+	groups := map[string]bool{}
+	if instanceIDs == "" {
+		return groups, nil
+	}
+	var subsystemIDs []uint
+	if err := db.SelectContext(ctx, &subsystemIDs,
+		"SELECT DISTINCT subsystem_id FROM instances WHERE instance_id IN ("+instanceIDs+")"); err != nil {
+		return groups, queryError(err, "Metrics.subsystemMetricGroups: SELECT instances")
+	}
+	for _, id := range subsystemIDs {
+		subsystem, err := instance.LookupId(id)
+		if err != nil {
+			continue
+		}
+		for _, group := range subsystem.MetricGroups() {
+			groups[group] = true
+		}
+	}
+	return groups, nil
 }
 
 type classMetrics struct {
@@ -86,17 +142,15 @@ type classMetrics struct {
 }
 
 // GetClassMetrics return metrics for given instance and query class
-func (m metrics) GetClassMetrics(classID uint, instanceIDs []uint, begin, end time.Time) (classMetrics, []rateMetrics) {
-	currentMetricGroup := m.identifyMetricGroup(instanceIDs, begin, end)
-	currentMetricGroup.CountField = "query_count"
+func (m metrics) GetClassMetrics(ctx context.Context, classID uint, instanceIDs []uint, begin, end time.Time) (classMetrics, []rateMetrics, error) {
+	amountOfPoints, intervalTs := m.sparklinePoints(begin, end)
+	endTs := end.Unix()
 
-	intervalTimeMinutes := end.Sub(begin).Minutes()
-	amountOfPoints := int64(maxAmountOfPoints)
-	if intervalTimeMinutes < maxAmountOfPoints {
-		amountOfPoints = int64(intervalTimeMinutes)
+	currentMetricGroup, err := m.identifyMetricGroup(ctx, instanceIDs, begin, end, m.pickSource(begin, end, intervalTs))
+	if err != nil {
+		return classMetrics{}, nil, err
 	}
-	endTs := end.Unix()
-	intervalTs := int64(end.Sub(begin).Seconds()) / amountOfPoints
+	currentMetricGroup.CountField = "query_count"
 	args := args{
 		classID,
 		begin,
@@ -105,13 +159,22 @@ func (m metrics) GetClassMetrics(classID uint, instanceIDs []uint, begin, end ti
 		intervalTs,
 	}
 	// this two lines should be before ServerSummary = true
-	generalClassMetrics := m.getMetrics(currentMetricGroup, args)
-	sparks := m.getSparklines(currentMetricGroup, args, amountOfPoints)
+	generalClassMetrics, err := m.getMetrics(ctx, currentMetricGroup, args)
+	if err != nil {
+		return classMetrics{}, nil, err
+	}
+	sparks, err := m.getSparklines(ctx, currentMetricGroup, args, amountOfPoints)
+	if err != nil {
+		return classMetrics{}, nil, err
+	}
 
 	// turns metric group to global
 	currentMetricGroup.ServerSummary = true
 	currentMetricGroup.CountField = "total_query_count"
-	generalGlobalMetrics := m.getMetrics(currentMetricGroup, args)
+	generalGlobalMetrics, err := m.getMetrics(ctx, currentMetricGroup, args)
+	if err != nil {
+		return classMetrics{}, nil, err
+	}
 
 	classMetricsOfTotal := m.computeOfTotal(generalClassMetrics, generalGlobalMetrics)
 	aMetrics := m.computeRateMetrics(generalClassMetrics, begin, end)
@@ -123,7 +186,78 @@ func (m metrics) GetClassMetrics(classID uint, instanceIDs []uint, begin, end ti
 		rateMetrics:           aMetrics,
 		specialMetrics:        sMetrics,
 	}
-	return classMetrics, sparks
+	return classMetrics, sparks, nil
+}
+
+// InstanceClassMetrics are the metrics of a query class on one of the
+// instances of GetClassInstances, e.g. a node of a cluster.
+type InstanceClassMetrics struct {
+	UUID              string
+	Name              string
+	Query_count       float32
+	Query_load        float32 // Query_time_sum per second of the time range
+	Query_time_sum    float32
+	Query_time_avg    float32
+	Query_time_max    float32
+	Query_time_of_sum float32 // share of the Query_time_sum of all instances
+	Rows_sent_sum     float32
+	Rows_examined_sum float32
+}
+
+var classInstancesTmpl = template.Must(template.New("classInstancesSQL").Parse(classInstancesTemplate))
+
+const classInstancesTemplate = `
+SELECT i.uuid, i.name,
+	COALESCE(SUM(query_count), 0) AS query_count,
+	COALESCE(SUM(Query_time_sum), 0) AS query_time_sum,
+	COALESCE(SUM(Query_time_sum) / SUM(query_count), 0) AS query_time_avg,
+	COALESCE(MAX(Query_time_max), 0) AS query_time_max,
+	COALESCE(SUM(Rows_sent_sum), 0) AS rows_sent_sum,
+	COALESCE(SUM(Rows_examined_sum), 0) AS rows_examined_sum
+FROM {{ .ClassMetrics }} AS qcm
+JOIN instances i ON i.instance_id = qcm.instance_id
+WHERE query_class_id = :class_id AND
+	 qcm.instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end)
+GROUP BY qcm.instance_id, i.uuid, i.name
+ORDER BY query_time_sum DESC;
+`
+
+// GetClassInstances returns the metrics of the query class on each of the
+// instances it ran on, the instance with the most Query_time first, e.g.
+// which nodes of a cluster a query loads.
+func (m metrics) GetClassInstances(ctx context.Context, classID uint, instanceIDs []uint, begin, end time.Time) ([]InstanceClassMetrics, error) {
+	_, intervalTs := m.sparklinePoints(begin, end)
+	group := metricGroup{InstanceIDs: shared.UintList(instanceIDs)}
+	group.ClassMetrics = m.pickSource(begin, end, intervalTs).ClassMetrics(group.InstanceIDs, begin, end)
+
+	classInstancesSQL, err := execTemplate(classInstancesTmpl, group, "Metrics.GetClassInstances")
+	if err != nil {
+		return nil, err
+	}
+	nstmt, err := db.PrepareNamedContext(ctx, classInstancesSQL)
+	if err != nil {
+		return nil, queryError(err, "Metrics.GetClassInstances: db.PrepareNamed")
+	}
+	defer nstmt.Close()
+	instances := []InstanceClassMetrics{}
+	if err := nstmt.SelectContext(ctx, &instances, args{ClassID: classID, Begin: begin, End: end}); err != nil {
+		return nil, queryError(err, "Metrics.GetClassInstances: nstmt.Select")
+	}
+
+	var total float32
+	for _, in := range instances {
+		total += in.Query_time_sum
+	}
+	duration := float32(end.Sub(begin).Seconds())
+	for i := range instances {
+		if duration > 0 {
+			instances[i].Query_load = instances[i].Query_time_sum / duration
+		}
+		if total > 0 {
+			instances[i].Query_time_of_sum = instances[i].Query_time_sum / total
+		}
+	}
+	return instances, nil
 }
 
 type globalMetrics struct {
@@ -133,18 +267,16 @@ type globalMetrics struct {
 }
 
 // GetGlobalMetrics return metrics for given instance
-func (m metrics) GetGlobalMetrics(instanceIDs []uint, begin, end time.Time) (globalMetrics, []rateMetrics) {
-	currentMetricGroup := m.identifyMetricGroup(instanceIDs, begin, end)
-	currentMetricGroup.ServerSummary = true
-	currentMetricGroup.CountField = "total_query_count"
-
-	intervalTimeMinutes := end.Sub(begin).Minutes()
+func (m metrics) GetGlobalMetrics(ctx context.Context, instanceIDs []uint, begin, end time.Time) (globalMetrics, []rateMetrics, error) {
 	endTs := end.Unix()
-	amountOfPoints := int64(maxAmountOfPoints)
-	if intervalTimeMinutes < maxAmountOfPoints {
-		amountOfPoints = int64(intervalTimeMinutes)
+	amountOfPoints, intervalTs := m.sparklinePoints(begin, end)
+
+	currentMetricGroup, err := m.identifyMetricGroup(ctx, instanceIDs, begin, end, m.pickSource(begin, end, intervalTs))
+	if err != nil {
+		return globalMetrics{}, nil, err
 	}
-	intervalTs := int64(end.Sub(begin).Seconds()) / amountOfPoints
+	currentMetricGroup.ServerSummary = true
+	currentMetricGroup.CountField = "total_query_count"
 	args := args{
 		0,
 		begin,
@@ -153,8 +285,14 @@ func (m metrics) GetGlobalMetrics(instanceIDs []uint, begin, end time.Time) (glo
 		intervalTs,
 	}
 
-	generalGlobalMetrics := m.getMetrics(currentMetricGroup, args)
-	sparks := m.getSparklines(currentMetricGroup, args, amountOfPoints)
+	generalGlobalMetrics, err := m.getMetrics(ctx, currentMetricGroup, args)
+	if err != nil {
+		return globalMetrics{}, nil, err
+	}
+	sparks, err := m.getSparklines(ctx, currentMetricGroup, args, amountOfPoints)
+	if err != nil {
+		return globalMetrics{}, nil, err
+	}
 
 	aMetrics := m.computeRateMetrics(generalGlobalMetrics, begin, end)
 	sMetrics := m.computeSpecialMetrics(generalGlobalMetrics)
@@ -163,42 +301,86 @@ func (m metrics) GetGlobalMetrics(instanceIDs []uint, begin, end time.Time) (glo
 		aMetrics,
 		sMetrics,
 	}
-	return globalMetrics, sparks
+	return globalMetrics, sparks, nil
+}
+
+// GetEvents returns the events of the instances in the time range with the
+// point of the sparklines of GetClassMetrics and GetGlobalMetrics each one
+// falls in.
+func (m metrics) GetEvents(ctx context.Context, instanceIDs []uint, begin, end time.Time) ([]SparkEvent, error) {
+	_, intervalTs := m.sparklinePoints(begin, end)
+	return Events.sparkline(ctx, instanceIDs, begin, end, end.Unix(), intervalTs)
+}
+
+// sparklinePoints returns the number of sparkline points for the time range,
+// one per minute up to maxAmountOfPoints, and the seconds per point.
+func (m metrics) sparklinePoints(begin, end time.Time) (amountOfPoints, intervalTs int64) {
+	intervalTimeMinutes := end.Sub(begin).Minutes()
+	amountOfPoints = int64(maxAmountOfPoints)
+	if intervalTimeMinutes < maxAmountOfPoints {
+		amountOfPoints = int64(intervalTimeMinutes)
+	}
+	if amountOfPoints > 0 {
+		intervalTs = int64(end.Sub(begin).Seconds()) / amountOfPoints
+	}
+	return amountOfPoints, intervalTs
 }
 
-func (m metrics) getMetrics(group metricGroup, args args) generalMetrics {
-	var queryClassMetricsBuffer bytes.Buffer
-	if tmpl, err := template.New("queryClassMetricsSQL").Parse(queryClassMetricsTemplate); err != nil {
-		log.Fatalln(err)
-	} else if err = tmpl.Execute(&queryClassMetricsBuffer, group); err != nil {
-		log.Fatalln(err)
+// pickSource is like the package pickSource but falls back to the raw tables on error
+// because the rollups are only an optimization.
+func (m metrics) pickSource(begin, end time.Time, intervalTs int64) source {
+	src, err := pickSource(begin, end, intervalTs)
+	if err != nil {
+		log.Println(err)
+		return rawSource
 	}
+	return src
+}
 
-	queryClassMetricsSQL := queryClassMetricsBuffer.String()
+func (m metrics) getMetrics(ctx context.Context, group metricGroup, args args) (generalMetrics, error) {
 	gMetrics := generalMetrics{}
-	if nstmt, err := db.PrepareNamed(queryClassMetricsSQL); err != nil {
-		log.Fatalln(err)
-	} else if err = nstmt.Get(&gMetrics, args); err != nil {
-		log.Fatalln(err)
+	queryClassMetricsSQL, err := execTemplate(queryClassMetricsTmpl, group, "Metrics.getMetrics")
+	if err != nil {
+		return gMetrics, err
+	}
+	nstmt, err := db.PrepareNamedContext(ctx, queryClassMetricsSQL)
+	if err != nil {
+		return gMetrics, queryError(err, "Metrics.getMetrics: db.PrepareNamed")
+	}
+	defer nstmt.Close()
+	if err := nstmt.GetContext(ctx, &gMetrics, args); err != nil {
+		return gMetrics, queryError(err, "Metrics.getMetrics: nstmt.Get")
+	}
+
+	// True percentiles from the Query_time sketches instead of averages.
+	if group.Basic {
+		table, classIDs := group.ClassMetrics, []uint{args.ClassID}
+		if group.ServerSummary {
+			table, classIDs = group.GlobalMetrics, nil
+		}
+		sketches, err := querySketches(ctx, table, classIDs, group.InstanceIDs, args.Begin, args.End, false)
+		if err != nil {
+			return gMetrics, err
+		}
+		gMetrics.setPercentiles(sketches[args.ClassID])
 	}
 
-	return gMetrics
+	return gMetrics, nil
 }
 
-func (m metrics) getSparklines(group metricGroup, args args, amountOfPoints int64) []rateMetrics {
-	var querySparklinesBuffer bytes.Buffer
-	if tmpl, err := template.New("querySparklinesSQL").Parse(querySparklinesTemplate); err != nil {
-		log.Fatalln(err)
-	} else if err = tmpl.Execute(&querySparklinesBuffer, group); err != nil {
-		log.Fatalln(err)
+func (m metrics) getSparklines(ctx context.Context, group metricGroup, args args, amountOfPoints int64) ([]rateMetrics, error) {
+	querySparklinesSQL, err := execTemplate(querySparklinesTmpl, group, "Metrics.getSparklines")
+	if err != nil {
+		return nil, err
 	}
-
-	querySparklinesSQL := querySparklinesBuffer.String()
 	var sparksWithGaps []rateMetrics
-	if nstmt, err := db.PrepareNamed(querySparklinesSQL); err != nil {
-		log.Fatalln(err)
-	} else if err = nstmt.Select(&sparksWithGaps, args); err != nil {
-		log.Fatalln(err)
+	nstmt, err := db.PrepareNamedContext(ctx, querySparklinesSQL)
+	if err != nil {
+		return nil, queryError(err, "Metrics.getSparklines: db.PrepareNamed")
+	}
+	defer nstmt.Close()
+	if err := nstmt.SelectContext(ctx, &sparksWithGaps, args); err != nil {
+		return nil, queryError(err, "Metrics.getSparklines: nstmt.Select")
 	}
 
 	metricLogRaw := make(map[int64]rateMetrics)
@@ -219,7 +401,7 @@ func (m metrics) getSparklines(group metricGroup, args args, amountOfPoints int6
 		}
 		sparks = append(sparks, val)
 	}
-	return sparks
+	return sparks, nil
 }
 
 func (m metrics) computeOfTotal(classMetrics, globalMetrics generalMetrics) metricsPercentOfTotal {
@@ -298,6 +480,10 @@ type specialMetrics struct {
 	Tmp_table_on_disk_sum_per_query                  float32 `json:",omitempty" divider:"Query_count"`
 	Tmp_disk_tables_sum_per_query_with_tmp_table     float32 `json:",omitempty" divider:"Tmp_table_on_disk_sum"`
 	Tmp_table_sizes_sum_per_query_with_any_tmp_table float32 `json:",omitempty" divider:"Total_tmp_tables_sum"` // = Tmp_table_sum + Tmp_table_on_disk_sum
+	Plan_time_avg_per_query_time                     float32 `json:",omitempty" divider:"Query_time_avg"`
+	Shared_blks_read_sum_per_query                   float32 `json:",omitempty" divider:"Query_count"`
+	Docs_examined_sum_per_rows                       float32 `json:",omitempty" divider:"Rows_sent_sum"`
+	Keys_examined_sum_per_rows                       float32 `json:",omitempty" divider:"Rows_sent_sum"`
 }
 
 type rateMetrics struct {
@@ -341,6 +527,21 @@ type rateMetrics struct {
 	Sort_scan_sum_per_sec              float32 `json:",omitempty"`
 	No_index_used_sum_per_sec          float32 `json:",omitempty"`
 	No_good_index_used_sum_per_sec     float32 `json:",omitempty"`
+
+	/* PostgreSQL */
+
+	Shared_blks_hit_sum_per_sec   float32 `json:",omitempty"`
+	Shared_blks_read_sum_per_sec  float32 `json:",omitempty"`
+	Temp_blks_read_sum_per_sec    float32 `json:",omitempty"`
+	Temp_blks_written_sum_per_sec float32 `json:",omitempty"`
+	Wal_bytes_sum_per_sec         float32 `json:",omitempty"`
+	Plan_time_sum_per_sec         float32 `json:",omitempty"`
+
+	/* MongoDB */
+
+	Docs_examined_sum_per_sec   float32 `json:",omitempty"`
+	Keys_examined_sum_per_sec   float32 `json:",omitempty"`
+	Response_length_sum_per_sec float32 `json:",omitempty"`
 }
 
 type metricsPercentOfTotal struct {
@@ -388,9 +589,24 @@ type metricsPercentOfTotal struct {
 	No_index_used_sum_of_total          float32 `json:",omitempty"`
 	No_good_index_used_sum_of_total     float32 `json:",omitempty"`
 	// 10
+	/* PostgreSQL */
+
+	Shared_blks_hit_sum_of_total   float32 `json:",omitempty"`
+	Shared_blks_read_sum_of_total  float32 `json:",omitempty"`
+	Temp_blks_read_sum_of_total    float32 `json:",omitempty"`
+	Temp_blks_written_sum_of_total float32 `json:",omitempty"`
+	Wal_bytes_sum_of_total         float32 `json:",omitempty"`
+	Plan_time_sum_of_total         float32 `json:",omitempty"`
+	// 6
+	/* MongoDB */
+
+	Docs_examined_sum_of_total   float32 `json:",omitempty"`
+	Keys_examined_sum_of_total   float32 `json:",omitempty"`
+	Response_length_sum_of_total float32 `json:",omitempty"`
+	// 3
 }
 
-// 34
+// 43
 
 type generalMetrics struct {
 
@@ -402,6 +618,7 @@ type generalMetrics struct {
 	Query_time_avg    float32
 	Query_time_med    float32
 	Query_time_p95    float32
+	Query_time_p99    float32 `json:",omitempty"` // only from sketches and an estimate
 	Query_time_max    float32
 	Lock_time_sum     float32
 	Lock_time_min     float32
@@ -469,6 +686,66 @@ type generalMetrics struct {
 	Merge_passes_p95      float32 `json:",omitempty"`
 	Merge_passes_max      float32 `json:",omitempty"`
 
+	/* PostgreSQL */
+
+	Shared_blks_hit_sum   float32 `json:",omitempty"`
+	Shared_blks_hit_min   float32 `json:",omitempty"`
+	Shared_blks_hit_avg   float32 `json:",omitempty"`
+	Shared_blks_hit_med   float32 `json:",omitempty"`
+	Shared_blks_hit_p95   float32 `json:",omitempty"`
+	Shared_blks_hit_max   float32 `json:",omitempty"`
+	Shared_blks_read_sum  float32 `json:",omitempty"`
+	Shared_blks_read_min  float32 `json:",omitempty"`
+	Shared_blks_read_avg  float32 `json:",omitempty"`
+	Shared_blks_read_med  float32 `json:",omitempty"`
+	Shared_blks_read_p95  float32 `json:",omitempty"`
+	Shared_blks_read_max  float32 `json:",omitempty"`
+	Temp_blks_read_sum    float32 `json:",omitempty"`
+	Temp_blks_read_min    float32 `json:",omitempty"`
+	Temp_blks_read_avg    float32 `json:",omitempty"`
+	Temp_blks_read_med    float32 `json:",omitempty"`
+	Temp_blks_read_p95    float32 `json:",omitempty"`
+	Temp_blks_read_max    float32 `json:",omitempty"`
+	Temp_blks_written_sum float32 `json:",omitempty"`
+	Temp_blks_written_min float32 `json:",omitempty"`
+	Temp_blks_written_avg float32 `json:",omitempty"`
+	Temp_blks_written_med float32 `json:",omitempty"`
+	Temp_blks_written_p95 float32 `json:",omitempty"`
+	Temp_blks_written_max float32 `json:",omitempty"`
+	Wal_bytes_sum         float32 `json:",omitempty"`
+	Wal_bytes_min         float32 `json:",omitempty"`
+	Wal_bytes_avg         float32 `json:",omitempty"`
+	Wal_bytes_med         float32 `json:",omitempty"`
+	Wal_bytes_p95         float32 `json:",omitempty"`
+	Wal_bytes_max         float32 `json:",omitempty"`
+	Plan_time_sum         float32 `json:",omitempty"`
+	Plan_time_min         float32 `json:",omitempty"`
+	Plan_time_avg         float32 `json:",omitempty"`
+	Plan_time_med         float32 `json:",omitempty"`
+	Plan_time_p95         float32 `json:",omitempty"`
+	Plan_time_max         float32 `json:",omitempty"`
+
+	/* MongoDB */
+
+	Docs_examined_sum   float32 `json:",omitempty"`
+	Docs_examined_min   float32 `json:",omitempty"`
+	Docs_examined_avg   float32 `json:",omitempty"`
+	Docs_examined_med   float32 `json:",omitempty"`
+	Docs_examined_p95   float32 `json:",omitempty"`
+	Docs_examined_max   float32 `json:",omitempty"`
+	Keys_examined_sum   float32 `json:",omitempty"`
+	Keys_examined_min   float32 `json:",omitempty"`
+	Keys_examined_avg   float32 `json:",omitempty"`
+	Keys_examined_med   float32 `json:",omitempty"`
+	Keys_examined_p95   float32 `json:",omitempty"`
+	Keys_examined_max   float32 `json:",omitempty"`
+	Response_length_sum float32 `json:",omitempty"`
+	Response_length_min float32 `json:",omitempty"`
+	Response_length_avg float32 `json:",omitempty"`
+	Response_length_med float32 `json:",omitempty"`
+	Response_length_p95 float32 `json:",omitempty"`
+	Response_length_max float32 `json:",omitempty"`
+
 	/* Percona Server */
 
 	InnoDB_IO_r_ops_sum       float32 `json:",omitempty"`
@@ -522,6 +799,8 @@ type generalMetrics struct {
 	No_good_index_used_sum     float32 `json:",omitempty"`
 }
 
+var queryClassMetricsTmpl = template.Must(template.New("queryClassMetricsSQL").Parse(queryClassMetricsTemplate))
+
 const queryClassMetricsTemplate = `
 SELECT
 
@@ -562,6 +841,74 @@ SELECT
 
 {{ end }}
 
+{{ if .PostgreSQL }}
+ /* PostgreSQL */
+
+ , /* <-- final comma for basic metrics */
+
+ COALESCE(SUM(Shared_blks_hit_sum), 0) AS shared_blks_hit_sum,
+ COALESCE(MIN(Shared_blks_hit_min), 0) AS shared_blks_hit_min,
+ COALESCE(AVG(Shared_blks_hit_avg), 0) AS shared_blks_hit_avg,
+ COALESCE(AVG(Shared_blks_hit_med), 0) AS shared_blks_hit_med,
+ COALESCE(AVG(Shared_blks_hit_p95), 0) AS shared_blks_hit_p95,
+ COALESCE(MAX(Shared_blks_hit_max), 0) AS shared_blks_hit_max,
+ COALESCE(SUM(Shared_blks_read_sum), 0) AS shared_blks_read_sum,
+ COALESCE(MIN(Shared_blks_read_min), 0) AS shared_blks_read_min,
+ COALESCE(AVG(Shared_blks_read_avg), 0) AS shared_blks_read_avg,
+ COALESCE(AVG(Shared_blks_read_med), 0) AS shared_blks_read_med,
+ COALESCE(AVG(Shared_blks_read_p95), 0) AS shared_blks_read_p95,
+ COALESCE(MAX(Shared_blks_read_max), 0) AS shared_blks_read_max,
+ COALESCE(SUM(Temp_blks_read_sum), 0) AS temp_blks_read_sum,
+ COALESCE(MIN(Temp_blks_read_min), 0) AS temp_blks_read_min,
+ COALESCE(AVG(Temp_blks_read_avg), 0) AS temp_blks_read_avg,
+ COALESCE(AVG(Temp_blks_read_med), 0) AS temp_blks_read_med,
+ COALESCE(AVG(Temp_blks_read_p95), 0) AS temp_blks_read_p95,
+ COALESCE(MAX(Temp_blks_read_max), 0) AS temp_blks_read_max,
+ COALESCE(SUM(Temp_blks_written_sum), 0) AS temp_blks_written_sum,
+ COALESCE(MIN(Temp_blks_written_min), 0) AS temp_blks_written_min,
+ COALESCE(AVG(Temp_blks_written_avg), 0) AS temp_blks_written_avg,
+ COALESCE(AVG(Temp_blks_written_med), 0) AS temp_blks_written_med,
+ COALESCE(AVG(Temp_blks_written_p95), 0) AS temp_blks_written_p95,
+ COALESCE(MAX(Temp_blks_written_max), 0) AS temp_blks_written_max,
+ COALESCE(SUM(Wal_bytes_sum), 0) AS wal_bytes_sum,
+ COALESCE(MIN(Wal_bytes_min), 0) AS wal_bytes_min,
+ COALESCE(AVG(Wal_bytes_avg), 0) AS wal_bytes_avg,
+ COALESCE(AVG(Wal_bytes_med), 0) AS wal_bytes_med,
+ COALESCE(AVG(Wal_bytes_p95), 0) AS wal_bytes_p95,
+ COALESCE(MAX(Wal_bytes_max), 0) AS wal_bytes_max,
+ COALESCE(SUM(Plan_time_sum), 0) AS plan_time_sum,
+ COALESCE(MIN(Plan_time_min), 0) AS plan_time_min,
+ COALESCE(AVG(Plan_time_avg), 0) AS plan_time_avg,
+ COALESCE(AVG(Plan_time_med), 0) AS plan_time_med,
+ COALESCE(AVG(Plan_time_p95), 0) AS plan_time_p95,
+ COALESCE(MAX(Plan_time_max), 0) AS plan_time_max
+{{ end }}
+
+{{ if .Mongo }}
+ /* MongoDB */
+
+ , /* <-- final comma for basic metrics */
+
+ COALESCE(SUM(Docs_examined_sum), 0) AS docs_examined_sum,
+ COALESCE(MIN(Docs_examined_min), 0) AS docs_examined_min,
+ COALESCE(AVG(Docs_examined_avg), 0) AS docs_examined_avg,
+ COALESCE(AVG(Docs_examined_med), 0) AS docs_examined_med,
+ COALESCE(AVG(Docs_examined_p95), 0) AS docs_examined_p95,
+ COALESCE(MAX(Docs_examined_max), 0) AS docs_examined_max,
+ COALESCE(SUM(Keys_examined_sum), 0) AS keys_examined_sum,
+ COALESCE(MIN(Keys_examined_min), 0) AS keys_examined_min,
+ COALESCE(AVG(Keys_examined_avg), 0) AS keys_examined_avg,
+ COALESCE(AVG(Keys_examined_med), 0) AS keys_examined_med,
+ COALESCE(AVG(Keys_examined_p95), 0) AS keys_examined_p95,
+ COALESCE(MAX(Keys_examined_max), 0) AS keys_examined_max,
+ COALESCE(SUM(Response_length_sum), 0) AS response_length_sum,
+ COALESCE(MIN(Response_length_min), 0) AS response_length_min,
+ COALESCE(AVG(Response_length_avg), 0) AS response_length_avg,
+ COALESCE(AVG(Response_length_med), 0) AS response_length_med,
+ COALESCE(AVG(Response_length_p95), 0) AS response_length_p95,
+ COALESCE(MAX(Response_length_max), 0) AS response_length_max
+{{ end }}
+
 {{ if or .PerconaServer .PerformanceSchema }}
  /* Perf Schema or Percona Server */
 
@@ -668,11 +1015,13 @@ SELECT
 	COALESCE(SUM(No_good_index_used_sum), 0) AS no_good_index_used_sum
 {{ end }}
 
-FROM {{if .ServerSummary }} query_global_metrics {{ else }} query_class_metrics {{ end }}
+FROM {{if .ServerSummary }} {{ .GlobalMetrics }} AS qgm {{ else }} {{ .ClassMetrics }} AS qcm {{ end }}
 WHERE {{if not .ServerSummary }} query_class_id = :class_id AND {{ end }}
 	 instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end);
 `
 
+var querySparklinesTmpl = template.Must(template.New("querySparklinesSQL").Parse(querySparklinesTemplate))
+
 const querySparklinesTemplate = `
 SELECT
     (:end_ts - UNIX_TIMESTAMP(start_ts)) DIV :interval_ts as point,
@@ -686,6 +1035,23 @@ SELECT
 	COALESCE(SUM(Rows_examined_sum), 0) / :interval_ts AS rows_examined_sum_per_sec,
 	COALESCE(SUM(Bytes_sent_sum), 0) / :interval_ts AS bytes_sent_sum_per_sec
 	{{ end }}
+	{{ if .PostgreSQL }}
+	/* PostgreSQL */
+	, /* <-- final comma for basic metrics */
+	COALESCE(SUM(Shared_blks_hit_sum), 0) / :interval_ts AS shared_blks_hit_sum_per_sec,
+	COALESCE(SUM(Shared_blks_read_sum), 0) / :interval_ts AS shared_blks_read_sum_per_sec,
+	COALESCE(SUM(Temp_blks_read_sum), 0) / :interval_ts AS temp_blks_read_sum_per_sec,
+	COALESCE(SUM(Temp_blks_written_sum), 0) / :interval_ts AS temp_blks_written_sum_per_sec,
+	COALESCE(SUM(Wal_bytes_sum), 0) / :interval_ts AS wal_bytes_sum_per_sec,
+	COALESCE(SUM(Plan_time_sum), 0) / :interval_ts AS plan_time_sum_per_sec
+	{{ end }}
+	{{ if .Mongo }}
+	/* MongoDB */
+	, /* <-- final comma for basic metrics */
+	COALESCE(SUM(Docs_examined_sum), 0) / :interval_ts AS docs_examined_sum_per_sec,
+	COALESCE(SUM(Keys_examined_sum), 0) / :interval_ts AS keys_examined_sum_per_sec,
+	COALESCE(SUM(Response_length_sum), 0) / :interval_ts AS response_length_sum_per_sec
+	{{ end }}
 	{{ if or .PerconaServer .PerformanceSchema }}
  	/* Perf Schema or Percona Server */
  	, /* <-- final comma for basic metrics */
@@ -726,7 +1092,7 @@ SELECT
 	COALESCE(SUM(No_good_index_used_sum), 0) / :interval_ts AS no_good_index_used_sum_per_sec
 
 {{ end }}
-FROM {{if .ServerSummary }} query_global_metrics {{ else }} query_class_metrics {{ end }}
+FROM {{if .ServerSummary }} {{ .GlobalMetrics }} AS qgm {{ else }} {{ .ClassMetrics }} AS qcm {{ end }}
 WHERE {{if not .ServerSummary }} query_class_id = :class_id AND {{ end }}
     instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end)
 GROUP BY point;
@@ -0,0 +1,111 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package models
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/shared"
+	"github.com/shatteredsilicon/qan-api/app/sketch"
+)
+
+// querySketches returns the merged Query_time sketches of the given query
+// classes keyed on query_class_id, or of all queries keyed on 0 if classIDs
+// is nil. table is a table expression from source. The global metrics are
+// reported with the end inclusive, see queryReportTotalTemplate, so pass
+// inclusiveEnd to match their query count.
+func querySketches(ctx context.Context, table string, classIDs []uint, instanceIDs string, begin, end time.Time, inclusiveEnd bool) (map[uint]*sketch.Sketch, error) {
+	classCol := "query_class_id"
+	classFilter := ""
+	if classIDs == nil {
+		classCol = "0"
+	} else {
+		if len(classIDs) == 0 {
+			return map[uint]*sketch.Sketch{}, nil
+		}
+		classFilter = " AND query_class_id IN (" + shared.UintList(classIDs) + ")"
+	}
+	endOp := "<"
+	if inclusiveEnd {
+		endOp = "<="
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s, Query_time_sketch FROM %s AS qcm"+
+			" WHERE instance_id IN (%s) AND start_ts >= ? AND start_ts %s ?%s"+
+			" AND Query_time_sketch IS NOT NULL",
+		classCol, table, instanceIDs, endOp, classFilter), begin, end)
+	if err != nil {
+		return nil, queryError(err, "querySketches: SELECT Query_time_sketch")
+	}
+	defer rows.Close()
+
+	sketches := map[uint]*sketch.Sketch{}
+	for rows.Next() {
+		var id uint
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, queryError(err, "querySketches: rows.Scan")
+		}
+		s, err := sketch.Unmarshal(data)
+		if err != nil {
+			log.Printf("WARNING: invalid Query_time_sketch for query class %d: %s", id, err)
+			continue
+		}
+		if sketches[id] == nil {
+			sketches[id] = s
+		} else {
+			sketches[id].Merge(s)
+		}
+	}
+	return sketches, queryError(rows.Err(), "querySketches: rows.Next")
+}
+
+// sketchHasAll returns true if the sketch has all cnt queries. Rows written
+// before sketches were stored, or by agents that don't report the median
+// and p95, don't have one, and percentiles from a sketch of only some of
+// the queries would be misleading.
+func sketchHasAll(s *sketch.Sketch, cnt float64) bool {
+	return s != nil && cnt > 0 && math.Abs(s.Count()-cnt) <= 0.5+cnt*1e-6
+}
+
+// setPercentiles replaces the averaged median and p95 with those of the
+// sketch, and sets p99, if the sketch has all the queries. Agents don't
+// report p99, so it's an estimate from the knot sketch.FromStats places
+// between p95 and max, not a true percentile like the median and p95.
+func (s *Stats) setPercentiles(sk *sketch.Sketch) {
+	if !sketchHasAll(sk, float64(s.Cnt)) {
+		return
+	}
+	s.Med = sk.Quantile(0.5)
+	s.P95 = sk.Quantile(0.95)
+	s.P99 = sk.Quantile(0.99)
+}
+
+func (g *generalMetrics) setPercentiles(sk *sketch.Sketch) {
+	if !sketchHasAll(sk, float64(g.Query_count)) {
+		return
+	}
+	g.Query_time_med = float32(sk.Quantile(0.5))
+	g.Query_time_p95 = float32(sk.Quantile(0.95))
+	g.Query_time_p99 = float32(sk.Quantile(0.99))
+}
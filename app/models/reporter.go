@@ -18,14 +18,15 @@
 package models
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"log"
 	"strings"
 	"text/template"
 	"time"
 
-	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	appMetrics "github.com/shatteredsilicon/qan-api/app/metrics"
+	"github.com/shatteredsilicon/qan-api/app/query"
+	mp "github.com/shatteredsilicon/ssm/proto/metrics"
 )
 
 // report provide methods to works with query report
@@ -34,18 +35,24 @@ type report struct{}
 // Report instance of report model
 var Report = report{}
 
-// QueryRank - represents a row of query profile
+// QueryRank - represents a row of query profile. Only Rank, RankValue and
+// RankPercentage follow Profile.RankBy; Percentage, Load and Stats are
+// always Query_time values.
 type QueryRank struct {
-	Rank        uint    // compared to global, same as Profile.Ranks index
-	Percentage  float64 // of global value
-	ID          string  `json:"Id"` // hex checksum
-	Abstract    string  // e.g. SELECT tbl
-	Fingerprint string  // e.g. SELECT tbl
-	QPS         float64 // ResponseTime.Cnt / Profile.TotalTime
-	Load        float64 // Query_time_sum / (Profile.End - Profile.Begin)
-	FirstSeen   time.Time
-	Log         []QueryLog
-	Stats       Stats // this query's Profile.Metric stats
+	Rank           uint    // compared to global, same as Profile.Ranks index
+	RankValue      float64 // this query's Profile.RankBy value, e.g. Rows_examined p95
+	RankPercentage float64 // RankValue / the global RankValue, a share only for sum
+	Percentage     float64 // Query_time sum / global Query_time sum
+	ID             string  `json:"Id"` // hex checksum
+	Abstract       string  // e.g. SELECT tbl
+	Fingerprint    string  // e.g. SELECT tbl
+	QPS            float64 // ResponseTime.Cnt / Profile.TotalTime
+	Load           float64 // Query_time_sum / (Profile.End - Profile.Begin)
+	FirstSeen      time.Time
+	Log            []QueryLog
+	Stats          Stats // this query's Query_time stats
+	Anomaly        bool  `json:",omitempty"` // deviated from its baseline in the time range, see anomaly.Analyzer
+	classID        uint  // query_class_id, 0 for the total
 }
 
 // QueryLog - a point of sparkline
@@ -65,15 +72,83 @@ type RankBy struct {
 	Limit  uint   // default: 10
 }
 
+const (
+	defaultRankMetric = "Query_time"
+	defaultRankStat   = "sum"
+	defaultRankLimit  = 10
+	maxRankLimit      = 1000
+)
+
+// rankStats are the stats stored per metric in query_class_metrics
+// that a profile can be ranked by. Counter metrics only have sum.
+var rankStats = map[string]bool{
+	"sum": true,
+	"min": true,
+	"avg": true,
+	"med": true,
+	"p95": true,
+	"max": true,
+}
+
+// NewRankBy returns a RankBy for the given metric, stat and limit, using the
+// defaults for empty values, or an error if the values don't correspond to
+// a metric column in query_class_metrics.
+func NewRankBy(metric, stat string, limit uint) (RankBy, error) {
+	r := RankBy{
+		Metric: metric,
+		Stat:   stat,
+		Limit:  limit,
+	}
+	if r.Metric == "" {
+		r.Metric = defaultRankMetric
+	}
+	if r.Stat == "" {
+		r.Stat = defaultRankStat
+	}
+	if r.Limit == 0 {
+		r.Limit = defaultRankLimit
+	}
+	return r, r.Validate()
+}
+
+// Validate checks that the metric and stat are real metric columns. This is
+// required because they're put into the SQL as-is, they cannot be bound.
+func (r RankBy) Validate() error {
+	if r.Limit == 0 || r.Limit > maxRankLimit {
+		return fmt.Errorf("invalid limit: %d: must be between 1 and %d", r.Limit, maxRankLimit)
+	}
+	if !rankStats[r.Stat] {
+		return fmt.Errorf("invalid stat: %s", r.Stat)
+	}
+	for _, m := range appMetrics.Query {
+		if m.Name != r.Metric {
+			continue
+		}
+		if (m.Flags&mp.COUNTER) != 0 && r.Stat != "sum" {
+			return fmt.Errorf("invalid stat for counter metric %s: %s: only sum is stored", r.Metric, r.Stat)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid metric: %s", r.Metric)
+}
+
+// aggregate returns the aggregate expression to rank by for the metrics
+// table alias and its query count column, e.g. SUM(qcm.Query_time_sum).
+// The RankBy must be valid.
+func (r RankBy) aggregate(alias, cntCol string) string {
+	return mp.AggregateFunction(alias+"."+r.Metric, r.Stat, alias+"."+cntCol)
+}
+
 // Profile - container for query profile
 type Profile struct {
-	InstanceID   string      `json:"InstanceId"` // UUID of MySQL instance
-	Begin        time.Time   // time range [Begin, End)
-	End          time.Time   // time range [Being, End)
-	TotalTime    uint        // total seconds in time range minus gaps (missing periods)
-	TotalQueries uint        // total unique class queries in time range
-	RankBy       RankBy      // criteria for ranking queries compared to global
-	Query        []QueryRank // 0=global, 1..N=queries
+	InstanceID   string       `json:"InstanceId"` // UUID of MySQL instance
+	Begin        time.Time    // time range [Begin, End)
+	End          time.Time    // time range [Being, End)
+	TotalTime    uint         // total seconds in time range minus gaps (missing periods)
+	TotalQueries uint         // total unique class queries in time range
+	RankBy       RankBy       // criteria for ranking queries compared to global
+	Query        []QueryRank  // 0=global, 1..N=queries
+	Events       []SparkEvent `json:",omitempty"` // events in time range, see Events
 }
 
 // Stats - perquery statistics
@@ -85,74 +160,75 @@ type Stats struct {
 	Avg float64 `db:"query_time_avg"`
 	Med float64 `db:"query_time_med"`
 	P95 float64 `db:"query_time_p95"`
+	P99 float64 // only from sketches and an estimate, see setPercentiles
 	Max float64 `db:"query_time_max"`
 }
 
 // get data for spark-lines at query profile
+var sparkLinesQueryClassTmpl = template.Must(template.New("sparkLinesQueryClassSQL").Parse(sparkLinesQueryClassTemplate))
+
 const sparkLinesQueryClassTemplate = `
 	SELECT (:end_ts - UNIX_TIMESTAMP(start_ts)) DIV :interval_ts AS Point,
 	FROM_UNIXTIME(:end_ts - (SELECT point) * :interval_ts) AS Start_ts,
 	COALESCE(SUM(query_count), 0) AS Query_count,
 	COALESCE(SUM(Query_time_sum)/:interval_ts, 0) AS Query_load,
 	COALESCE(AVG(Query_time_avg), 0) AS Query_time_avg
-	FROM query_class_metrics
+	FROM {{ .ClassMetrics }} AS qcm
 	WHERE query_class_id = :query_class_id AND instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end) GROUP BY point;
 	`
 
+var sparkLinesQueryGlobalTmpl = template.Must(template.New("sparkLinesQueryGlobalSQL").Parse(sparkLinesQueryGlobalTemplate))
+
 const sparkLinesQueryGlobalTemplate = `
 	SELECT (:end_ts - UNIX_TIMESTAMP(start_ts)) DIV :interval_ts AS Point,
 	FROM_UNIXTIME(:end_ts - (SELECT point) * :interval_ts) AS Start_ts,
 	COALESCE(SUM(total_query_count), 0) AS Query_count,
 	COALESCE(SUM(Query_time_sum)/:interval_ts, 0) AS Query_load,
 	COALESCE(AVG(Query_time_avg), 0) AS Query_time_avg
-	FROM query_global_metrics
+	FROM {{ .GlobalMetrics }} AS qgm
 	WHERE instance_id IN ({{ .InstanceIDs }}) AND (start_ts >= :begin AND start_ts < :end) GROUP BY point;
 	`
 
 // get data for spark-lines at query profile
-func (r report) SparklineData(endTs int64, intervalTs int64, queryClassID uint, instanceIDs string, begin, end time.Time) []QueryLog {
+func (r report) SparklineData(ctx context.Context, endTs int64, intervalTs int64, queryClassID uint, instanceIDs string, begin, end time.Time, src source) ([]QueryLog, error) {
 
 	queryLogArrRaw := make(map[int64]QueryLog)
 	queryLogArr := []QueryLog{}
 
 	args := struct {
-		EndTS        int64 `db:"end_ts"`
-		IntervalTS   int64 `db:"interval_ts"`
-		QueryClassID uint  `db:"query_class_id"`
-		InstanceIDs  string
-		Begin        time.Time `db:"begin"`
-		End          time.Time `db:"end"`
-	}{endTs, intervalTs, queryClassID, instanceIDs, begin, end}
-
-	var sparkLinesQueryClassBuffer bytes.Buffer
-	if tmpl, err := template.New("sparkLinesQueryClassSQL").Parse(sparkLinesQueryClassTemplate); err != nil {
-		log.Fatalln(err)
-	} else if err = tmpl.Execute(&sparkLinesQueryClassBuffer, args); err != nil {
-		log.Fatalln(err)
-	}
-
-	var sparkLinesQueryGlobalBuffer bytes.Buffer
-	if tmpl, err := template.New("sparkLinesQueryGlobalSQL").Parse(sparkLinesQueryGlobalTemplate); err != nil {
-		log.Fatalln(err)
-	} else if err = tmpl.Execute(&sparkLinesQueryGlobalBuffer, args); err != nil {
-		log.Fatalln(err)
+		EndTS         int64 `db:"end_ts"`
+		IntervalTS    int64 `db:"interval_ts"`
+		QueryClassID  uint  `db:"query_class_id"`
+		InstanceIDs   string
+		Begin         time.Time `db:"begin"`
+		End           time.Time `db:"end"`
+		ClassMetrics  string
+		GlobalMetrics string
+	}{
+		endTs, intervalTs, queryClassID, instanceIDs, begin, end,
+		src.ClassMetrics(instanceIDs, begin, end),
+		src.GlobalMetrics(instanceIDs, begin, end),
 	}
 
-	query := sparkLinesQueryClassBuffer.String()
+	tmpl := sparkLinesQueryClassTmpl
 	// if for sparklines for total
 	if queryClassID == 0 {
-		query = sparkLinesQueryGlobalBuffer.String()
+		tmpl = sparkLinesQueryGlobalTmpl
+	}
+	query, err := execTemplate(tmpl, args, "Reporter.SparklineData")
+	if err != nil {
+		return nil, err
 	}
 
 	ql := []QueryLog{}
-	nstmtQuery, err := db.PrepareNamed(query)
+	nstmtQuery, err := db.PrepareNamedContext(ctx, query)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, queryError(err, "Reporter.SparklineData: db.PrepareNamed")
 	}
 	defer nstmtQuery.Close()
-	err = nstmtQuery.Select(&ql, args)
+	err = nstmtQuery.SelectContext(ctx, &ql, args)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, queryError(err, "Reporter.SparklineData: nstmt.Select")
 	}
 
 	for _, row := range ql {
@@ -186,19 +262,25 @@ func (r report) SparklineData(endTs int64, intervalTs int64, queryClassID uint,
 		}
 		queryLogArr = append(queryLogArr, val)
 	}
-	return queryLogArr
+	return queryLogArr, nil
 }
 
+var queryReportCountUniqueTmpl = template.Must(template.New("queryReportCountUniqueSQL").Parse(queryReportCountUniqueTemplate))
+
 const queryReportCountUniqueTemplate = `
 	SELECT
 		COUNT(DISTINCT qcm.query_class_id)
-	FROM query_class_metrics AS qcm
+	FROM {{ .ClassMetrics }} AS qcm
 	JOIN query_classes AS qc ON qcm.query_class_id = qc.query_class_id
 	WHERE qcm.instance_id IN ({{ .InstanceIDs }}) AND (qcm.start_ts >= :begin AND qcm.start_ts < :end)
 		{{ if .FirstSeen }} AND qc.first_seen >= :begin {{ end }}
+		{{ if .Statuses }} AND qc.status IN ({{ .Statuses }}) {{ end }}
+		{{ if .Tags }} AND qc.query_class_id IN (SELECT query_class_id FROM query_note_tags WHERE tag IN ({{ .Tags }})) {{ end }}
 		{{ if .Keyword }} AND (qc.checksum = :keyword OR qc.abstract LIKE :start_keyword OR qc.fingerprint LIKE :start_keyword) {{ end }};
 `
 
+var queryReportTotalTmpl = template.Must(template.New("queryReportTotalSQL").Parse(queryReportTotalTemplate))
+
 const queryReportTotalTemplate = `
 	SELECT
 		COALESCE(SUM(IF(start_ts = end_ts, 1, TIMESTAMPDIFF(SECOND, start_ts, end_ts))), 0) AS total_time,
@@ -208,11 +290,14 @@ const queryReportTotalTemplate = `
 		COALESCE(SUM(Query_time_sum)/SUM(total_query_count), 0) AS query_time_avg,
 		COALESCE(AVG(Query_time_med), 0) AS query_time_med,
 		COALESCE(AVG(Query_time_p95), 0) AS query_time_p95,
-		COALESCE(MAX(Query_time_max), 0) AS query_time_max
-	FROM query_global_metrics
+		COALESCE(MAX(Query_time_max), 0) AS query_time_max,
+		COALESCE({{ .GlobalRankBy }}, 0) AS rank_value
+	FROM {{ .GlobalMetrics }} AS qgm
 	WHERE instance_id IN ({{ .InstanceIDs }}) AND start_ts BETWEEN :begin AND :end
 `
 
+var queryReportTmpl = template.Must(template.New("queryReportSQL").Parse(queryReportTemplate))
+
 const queryReportTemplate = `
 	SELECT
 		qcm.query_class_id AS query_class_id,
@@ -223,23 +308,53 @@ const queryReportTemplate = `
 		COALESCE(AVG(qcm.Query_time_med), 0) AS query_time_med,
 		COALESCE(AVG(qcm.Query_time_p95), 0) AS query_time_p95,
 		COALESCE(MAX(qcm.Query_time_max), 0) AS query_time_max,
+		COALESCE({{ .OrderBy }}, 0) AS rank_value,
 		qc.checksum AS checksum,
 		qc.abstract AS abstract,
 		qc.fingerprint AS fingerprint,
 		qc.first_seen AS first_seen
-	FROM query_class_metrics AS qcm
+	FROM {{ .ClassMetrics }} AS qcm
 	JOIN query_classes AS qc ON qcm.query_class_id = qc.query_class_id
 	WHERE qcm.instance_id IN ({{ .InstanceIDs }}) AND (qcm.start_ts >= :begin AND qcm.start_ts < :end)
 		{{ if .FirstSeen }} AND qc.first_seen >= :begin {{ end }}
+		{{ if .Statuses }} AND qc.status IN ({{ .Statuses }}) {{ end }}
+		{{ if .Tags }} AND qc.query_class_id IN (SELECT query_class_id FROM query_note_tags WHERE tag IN ({{ .Tags }})) {{ end }}
 		{{ if .Keyword }} AND (qc.checksum = :keyword OR qc.abstract LIKE :start_keyword OR qc.fingerprint LIKE :start_keyword) {{ end }}
 	GROUP BY qcm.query_class_id
 	{{ if eq .SortBy "latency" }} ORDER BY SUM(qcm.Query_time_sum)/SUM(qcm.query_count) DESC
 	{{ else if eq .SortBy "count" }} ORDER BY SUM(qcm.query_count) DESC
-	{{ else }} ORDER BY SUM(qcm.Query_time_sum) DESC {{ end }}
+	{{ else }} ORDER BY {{ .OrderBy }} DESC {{ end }}
 	LIMIT :limit OFFSET :offset;
 `
 
-func (r report) Profile(instanceIDs []uint, begin, end time.Time, rank RankBy, offset int, search string, firstSeen bool, sortBy string) (Profile, error) {
+func (r report) Profile(ctx context.Context, instanceIDs []uint, begin, end time.Time, rank RankBy, offset int, search string, firstSeen bool, sortBy string, statuses, tags []string) (Profile, error) {
+	return r.profile(ctx, instanceIDs, begin, end, rank, offset, search, firstSeen, sortBy, statuses, tags, true)
+}
+
+// ProfileRanks is Profile without the sparklines (QueryRank.Log) and Events,
+// for callers that only read the ranked queries, e.g. alert rules.
+func (r report) ProfileRanks(ctx context.Context, instanceIDs []uint, begin, end time.Time, rank RankBy, firstSeen bool) (Profile, error) {
+	return r.profile(ctx, instanceIDs, begin, end, rank, 0, "", firstSeen, "", nil, nil, false)
+}
+
+func (r report) profile(ctx context.Context, instanceIDs []uint, begin, end time.Time, rank RankBy, offset int, search string, firstSeen bool, sortBy string, statuses, tags []string, sparklines bool) (Profile, error) {
+	if err := rank.Validate(); err != nil {
+		return Profile{}, err
+	}
+	quotedStatuses := make([]string, len(statuses))
+	for i, status := range statuses {
+		if !query.ValidStatus(status) {
+			return Profile{}, fmt.Errorf("invalid status: %s", status)
+		}
+		quotedStatuses[i] = "'" + status + "'"
+	}
+	quotedTags := make([]string, len(tags))
+	for i, tag := range tags {
+		if !query.ValidTag(tag) {
+			return Profile{}, fmt.Errorf("invalid tag: %s", tag)
+		}
+		quotedTags[i] = "'" + tag + "'"
+	}
 	instanceIDStrs := make([]string, len(instanceIDs))
 	for i := range instanceIDs {
 		instanceIDStrs[i] = fmt.Sprintf("%d", instanceIDs[i])
@@ -254,6 +369,13 @@ func (r report) Profile(instanceIDs []uint, begin, end time.Time, rank RankBy, o
 		StartKeyword string `db:"start_keyword"`
 		FirstSeen    bool
 		SortBy       string
+		OrderBy      string // RankBy of query classes
+		GlobalRankBy string // RankBy of the global metrics
+		Statuses     string // quoted, comma-separated
+		Tags         string // quoted, comma-separated
+		// Set after picking the source, see pickSource.
+		ClassMetrics  string
+		GlobalMetrics string
 	}{
 		InstanceIDs:  strings.Join(instanceIDStrs, ","),
 		Begin:        begin,
@@ -264,6 +386,10 @@ func (r report) Profile(instanceIDs []uint, begin, end time.Time, rank RankBy, o
 		StartKeyword: search + "%",
 		FirstSeen:    firstSeen,
 		SortBy:       sortBy,
+		OrderBy:      rank.aggregate("qcm", "query_count"),
+		GlobalRankBy: rank.aggregate("qgm", "total_query_count"),
+		Statuses:     strings.Join(quotedStatuses, ","),
+		Tags:         strings.Join(quotedTags, ","),
 	}
 	p := Profile{
 		// caller sets InstanceId (MySQL instance UUID)
@@ -288,48 +414,54 @@ func (r report) Profile(instanceIDs []uint, begin, end time.Time, rank RankBy, o
 		intervalTs = int64(end.Sub(begin).Seconds()) / amountOfPoints
 	}
 
+	// Long ranges are read from the hourly or daily rollups.
+	src, err := pickSource(begin, end, intervalTs)
+	if err != nil {
+		return p, queryError(err, "Reporter.Profile: pickSource")
+	}
+	args.ClassMetrics = src.ClassMetrics(args.InstanceIDs, begin, end)
+	args.GlobalMetrics = src.GlobalMetrics(args.InstanceIDs, begin, end)
+
 	// get count of all rows - to calculate pagination.
-	var queryReportCountUniqueBuffer bytes.Buffer
-	if tmpl, err := template.New("queryReportCountUniqueSQL").Parse(queryReportCountUniqueTemplate); err != nil {
-		log.Fatalln(err)
-	} else if err = tmpl.Execute(&queryReportCountUniqueBuffer, args); err != nil {
-		log.Fatalln(err)
+	queryReportCountUniqueSQL, err := execTemplate(queryReportCountUniqueTmpl, args, "Reporter.Profile")
+	if err != nil {
+		return p, err
 	}
 
-	nstmtQueryReportCountUnique, err := db.PrepareNamed(queryReportCountUniqueBuffer.String())
+	nstmtQueryReportCountUnique, err := db.PrepareNamedContext(ctx, queryReportCountUniqueSQL)
 	if err != nil {
-		return p, mysql.Error(err, "Reporter.Profile: db.PrepareNamed: SELECT COUNT(DISTINCT query_class_id)")
+		return p, queryError(err, "Reporter.Profile: db.PrepareNamed: SELECT COUNT(DISTINCT query_class_id)")
 	}
 	defer nstmtQueryReportCountUnique.Close()
-	err = nstmtQueryReportCountUnique.Get(&p.TotalQueries, args)
+	err = nstmtQueryReportCountUnique.GetContext(ctx, &p.TotalQueries, args)
 	if err != nil {
-		return p, mysql.Error(err, "Reporter.Profile: nstmt.Get: SELECT COUNT(DISTINCT query_class_id)")
+		return p, queryError(err, "Reporter.Profile: nstmt.Get: SELECT COUNT(DISTINCT query_class_id)")
 	}
 
-	var queryReportTotalBuffer bytes.Buffer
-	if tmpl, err := template.New("queryReportTotalSQL").Parse(queryReportTotalTemplate); err != nil {
-		log.Fatalln(err)
-	} else if err = tmpl.Execute(&queryReportTotalBuffer, args); err != nil {
-		log.Fatalln(err)
+	queryReportTotalSQL, err := execTemplate(queryReportTotalTmpl, args, "Reporter.Profile")
+	if err != nil {
+		return p, err
 	}
 
 	totalValues := struct {
-		TotalTime uint `db:"total_time"`
+		TotalTime uint    `db:"total_time"`
+		RankValue float64 `db:"rank_value"`
 		Stats
 	}{}
-	nstmtQueryReportTotal, err := db.PrepareNamed(queryReportTotalBuffer.String())
+	nstmtQueryReportTotal, err := db.PrepareNamedContext(ctx, queryReportTotalSQL)
 	if err != nil {
-		return p, mysql.Error(err, "Reporter.Profile: db.PrepareNamed: queryReportTotal")
+		return p, queryError(err, "Reporter.Profile: db.PrepareNamed: queryReportTotal")
 	}
 	defer nstmtQueryReportTotal.Close()
-	err = nstmtQueryReportTotal.Get(&totalValues, args)
+	err = nstmtQueryReportTotal.GetContext(ctx, &totalValues, args)
 	if err != nil {
-		return p, mysql.Error(err, "Reporter.Profile: nstmt.Get: queryReportTotal")
+		return p, queryError(err, "Reporter.Profile: nstmt.Get: queryReportTotal")
 	}
 
 	p.TotalTime = totalValues.TotalTime
 	s := totalValues.Stats
-	globalSum := s.Sum // to calculate Percentage
+	globalSum := s.Sum                  // to calculate Percentage
+	globalRank := totalValues.RankValue // to calculate RankPercentage
 
 	// There's always a row because of the aggregate functions, but if there's
 	// no data then COALESCE will cause zero time. In this case, return an empty
@@ -340,11 +472,9 @@ func (r report) Profile(instanceIDs []uint, begin, end time.Time, rank RankBy, o
 	}
 
 	// Select query profile
-	var queryReportBuffer bytes.Buffer
-	if tmpl, err := template.New("queryReportSQL").Parse(queryReportTemplate); err != nil {
-		log.Fatalln(err)
-	} else if err = tmpl.Execute(&queryReportBuffer, args); err != nil {
-		log.Fatalln(err)
+	queryReportSQL, err := execTemplate(queryReportTmpl, args, "Reporter.Profile")
+	if err != nil {
+		return p, err
 	}
 
 	type QueryValue struct {
@@ -353,46 +483,91 @@ func (r report) Profile(instanceIDs []uint, begin, end time.Time, rank RankBy, o
 		Abstract     string    `db:"abstract"`
 		Fingerprint  string    `db:"fingerprint"`
 		FirstSeen    time.Time `db:"first_seen"`
+		RankValue    float64   `db:"rank_value"`
 		Stats
 	}
 	queriesValues := []QueryValue{}
-	nstmtQueryReport, err := db.PrepareNamed(queryReportBuffer.String())
+	nstmtQueryReport, err := db.PrepareNamedContext(ctx, queryReportSQL)
 	if err != nil {
-		return p, mysql.Error(err, "Reporter.Profile: db.PrepareNamed: queryReport")
+		return p, queryError(err, "Reporter.Profile: db.PrepareNamed: queryReport")
 	}
 	defer nstmtQueryReport.Close()
-	err = nstmtQueryReport.Select(&queriesValues, args)
+	err = nstmtQueryReport.SelectContext(ctx, &queriesValues, args)
 	if err != nil {
-		return p, mysql.Error(err, "Reporter.Profile: nstmt.Select: queryReport")
+		return p, queryError(err, "Reporter.Profile: nstmt.Select: queryReport")
+	}
+
+	// True percentiles from the Query_time sketches instead of averages.
+	globalSketch, err := querySketches(ctx, args.GlobalMetrics, nil, args.InstanceIDs, begin, end, true)
+	if err != nil {
+		return p, err
+	}
+	s.setPercentiles(globalSketch[0])
+	classIDs := make([]uint, len(queriesValues))
+	for i, row := range queriesValues {
+		classIDs[i] = row.QueryClassID
+	}
+	classSketches, err := querySketches(ctx, args.ClassMetrics, classIDs, args.InstanceIDs, begin, end, false)
+	if err != nil {
+		return p, err
+	}
+	for i := range queriesValues {
+		queriesValues[i].Stats.setPercentiles(classSketches[queriesValues[i].QueryClassID])
+	}
+	anomalous, err := Anomalies.classes(ctx, classIDs, args.InstanceIDs, begin, end)
+	if err != nil {
+		return p, err
 	}
 
 	qr := QueryRank{
-		Percentage: 1, // 100%
-		Stats:      s,
-		QPS:        float64(s.Cnt) / intervalTime,
-		Load:       globalSum / intervalTime,
+		RankValue:      globalRank,
+		RankPercentage: 1, // 100%
+		Percentage:     1, // 100%
+		Stats:          s,
+		QPS:            float64(s.Cnt) / intervalTime,
+		Load:           globalSum / intervalTime,
 	}
-	if intervalTs > 0 {
-		qr.Log = r.SparklineData(endTs, intervalTs, 0, args.InstanceIDs, begin, end)
+	if sparklines && intervalTs > 0 {
+		if qr.Log, err = r.SparklineData(ctx, endTs, intervalTs, 0, args.InstanceIDs, begin, end, src); err != nil {
+			return p, err
+		}
+		if p.Events, err = Events.sparkline(ctx, instanceIDs, begin, end, endTs, intervalTs); err != nil {
+			return p, err
+		}
 	}
 	p.Query = append(p.Query, qr)
 	for i, row := range queriesValues {
 		i++
 		qrank := QueryRank{
-			Rank:        uint(i) + uint(offset),
-			Percentage:  row.Stats.Sum / globalSum,
-			ID:          row.Checksum,
-			Abstract:    row.Abstract,
-			Fingerprint: row.Fingerprint,
-			FirstSeen:   row.FirstSeen,
-			QPS:         float64(row.Stats.Cnt) / intervalTime,
-			Load:        row.Stats.Sum / intervalTime,
-			Stats:       row.Stats,
+			Rank:           uint(i) + uint(offset),
+			RankValue:      row.RankValue,
+			RankPercentage: rankPercentage(row.RankValue, globalRank),
+			Percentage:     row.Stats.Sum / globalSum,
+			ID:             row.Checksum,
+			Abstract:       row.Abstract,
+			Fingerprint:    row.Fingerprint,
+			FirstSeen:      row.FirstSeen,
+			QPS:            float64(row.Stats.Cnt) / intervalTime,
+			Load:           row.Stats.Sum / intervalTime,
+			Stats:          row.Stats,
+			Anomaly:        anomalous[row.QueryClassID],
+			classID:        row.QueryClassID,
 		}
-		if intervalTs > 0 {
-			qrank.Log = r.SparklineData(endTs, intervalTs, row.QueryClassID, args.InstanceIDs, begin, end)
+		if sparklines && intervalTs > 0 {
+			if qrank.Log, err = r.SparklineData(ctx, endTs, intervalTs, row.QueryClassID, args.InstanceIDs, begin, end, src); err != nil {
+				return p, err
+			}
 		}
 		p.Query = append(p.Query, qrank)
 	}
 	return p, nil
 }
+
+// rankPercentage returns the query's rank value of the global one, or 0 if
+// the global value is 0, e.g. no Rows_examined in the time range.
+func rankPercentage(value, global float64) float64 {
+	if global == 0 {
+		return 0
+	}
+	return value / global
+}
@@ -18,14 +18,22 @@
 package models_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"time"
 
+	"github.com/shatteredsilicon/qan-api/app/db"
 	"github.com/shatteredsilicon/qan-api/app/models"
+	"github.com/shatteredsilicon/qan-api/app/query"
+	"github.com/shatteredsilicon/qan-api/app/rollup"
+	"github.com/shatteredsilicon/qan-api/app/shared"
 	"github.com/shatteredsilicon/qan-api/config"
+	"github.com/shatteredsilicon/qan-api/stats"
 	"github.com/shatteredsilicon/qan-api/test"
 	testDb "github.com/shatteredsilicon/qan-api/tests/setup/db"
 	"github.com/stretchr/testify/assert"
@@ -39,6 +47,8 @@ type ReporterTestSuite struct {
 
 var _ = Suite(&ReporterTestSuite{})
 
+var ctx = context.Background()
+
 func (s *ReporterTestSuite) SetUpSuite(t *C) {
 	// Create test_o1 database.
 	dsn := config.Get("mysql.dsn")
@@ -53,6 +63,7 @@ func (s *ReporterTestSuite) SetUpSuite(t *C) {
 
 func (s *ReporterTestSuite) SetUpTest(t *C) {
 	s.testDb.TruncateDataTables()
+	s.testDb.TruncateTables([]string{"events"})
 }
 
 func (s *ReporterTestSuite) TearDownTest(t *C) {
@@ -83,7 +94,7 @@ func (s *ReporterTestSuite) TestSimple(t *C) {
 		Limit:  5,
 	}
 
-	got, err := models.Report.Profile([]uint{s.mysqlId}, begin, end, r, 0, "", false, "")
+	got, err := models.Report.Profile(ctx, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", nil, nil)
 	t.Check(err, IsNil)
 
 	expectedFile := config.TestDir + "/qan/profile/may-2015-01.json"
@@ -113,7 +124,7 @@ func (s *ReporterTestSuite) Test003(t *C) {
 		Limit:  5,
 	}
 
-	got, err := models.Report.Profile([]uint{3}, begin, end, r, 0, "", false, "")
+	got, err := models.Report.Profile(ctx, []uint{3}, begin, end, r, 0, "", false, "", nil, nil)
 	t.Check(err, IsNil)
 
 	expectedFile := config.TestDir + "/qan/profile/003-01.json"
@@ -132,3 +143,295 @@ func (s *ReporterTestSuite) Test003(t *C) {
 
 	assert.JSONEq(t, string(expectData), string(gotData))
 }
+
+func (s *ReporterTestSuite) TestRankBy(t *C) {
+	// Defaults
+	r, err := models.NewRankBy("", "", 0)
+	t.Check(err, IsNil)
+	t.Check(r, Equals, models.RankBy{Metric: "Query_time", Stat: "sum", Limit: 10})
+
+	r, err = models.NewRankBy("Rows_examined", "p95", 25)
+	t.Check(err, IsNil)
+	t.Check(r, Equals, models.RankBy{Metric: "Rows_examined", Stat: "p95", Limit: 25})
+
+	_, err = models.NewRankBy("Tmp_table_on_disk", "sum", 0)
+	t.Check(err, IsNil)
+
+	// Counter metrics only have sum.
+	_, err = models.NewRankBy("Tmp_table_on_disk", "max", 0)
+	t.Check(err, NotNil)
+
+	// Anything that isn't a real column is rejected because it's put into the SQL as-is.
+	_, err = models.NewRankBy("Query_time_sum) DESC; DROP TABLE query_classes; --", "sum", 0)
+	t.Check(err, NotNil)
+	_, err = models.NewRankBy("Lock_time", "stddev", 0)
+	t.Check(err, NotNil)
+	_, err = models.NewRankBy("Lock_time", "sum", 1001)
+	t.Check(err, NotNil)
+
+	_, err = models.Report.Profile(ctx, []uint{s.mysqlId}, time.Now(), time.Now(), models.RankBy{Metric: "foo", Stat: "sum", Limit: 10}, 0, "", false, "", nil, nil)
+	t.Check(err, NotNil)
+}
+
+func (s *ReporterTestSuite) TestRankByRowsExamined(t *C) {
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/01")
+
+	begin := time.Date(2015, time.May, 01, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+	r := models.RankBy{
+		Metric: "Rows_examined",
+		Stat:   "sum",
+		Limit:  5,
+	}
+
+	got, err := models.Report.Profile(ctx, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", nil, nil)
+	t.Assert(err, IsNil)
+	t.Check(got.RankBy, Equals, r)
+	t.Assert(len(got.Query) > 1, Equals, true)
+	t.Check(len(got.Query) <= 6, Equals, true) // global + limit
+
+	// Rows are ranked by the Rows_examined sums, Percentage and Stats are
+	// still the Query_time values.
+	global := got.Query[0]
+	t.Check(global.RankPercentage, Equals, float64(1))
+	for i, q := range got.Query[1:] {
+		t.Check(q.RankPercentage, Equals, q.RankValue/global.RankValue)
+		t.Check(q.Percentage, Equals, q.Stats.Sum/global.Stats.Sum)
+		if i > 0 {
+			t.Check(q.RankValue <= got.Query[i].RankValue, Equals, true)
+		}
+	}
+}
+
+func (s *ReporterTestSuite) TestDeadline(t *C) {
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/01")
+
+	begin := time.Date(2015, time.May, 01, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+	r := models.RankBy{
+		Metric: "Query_time",
+		Stat:   "sum",
+		Limit:  5,
+	}
+
+	expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+	_, err := models.Report.Profile(expired, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", nil, nil)
+	t.Check(errors.Is(err, shared.ErrQueryTimeout), Equals, true)
+	_, _, err = models.Metrics.GetGlobalMetrics(expired, []uint{s.mysqlId}, begin, end)
+	t.Check(errors.Is(err, shared.ErrQueryTimeout), Equals, true)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = models.Metrics.GetClassMetrics(canceled, 1, []uint{s.mysqlId}, begin, end)
+	t.Check(errors.Is(err, shared.ErrQueryCanceled), Equals, true)
+}
+
+func (s *ReporterTestSuite) TestClassInstances(t *C) {
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/01")
+
+	begin := time.Date(2015, time.May, 01, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+
+	got, err := models.Metrics.GetClassInstances(ctx, 141, []uint{s.mysqlId}, begin, end)
+	t.Assert(err, IsNil)
+	t.Assert(got, HasLen, 1)
+	t.Check(got[0].UUID, Equals, "BBB")
+	t.Check(got[0].Name, Equals, "db01")
+	t.Check(got[0].Query_count, Equals, float32(112737))
+	t.Check(got[0].Query_time_of_sum, Equals, float32(1))
+	t.Check(got[0].Query_load, Equals, got[0].Query_time_sum/86400)
+
+	// Not in the time range.
+	got, err = models.Metrics.GetClassInstances(ctx, 141, []uint{s.mysqlId}, end, end.Add(time.Hour))
+	t.Assert(err, IsNil)
+	t.Check(got, HasLen, 0)
+}
+
+func (s *ReporterTestSuite) TestProfileFilters(t *C) {
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/01")
+
+	begin := time.Date(2015, time.May, 01, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+	r := models.RankBy{
+		Metric: "Query_time",
+		Stat:   "sum",
+		Limit:  5,
+	}
+	all, err := models.Report.Profile(ctx, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", nil, nil)
+	t.Assert(err, IsNil)
+	t.Assert(len(all.Query) > 2, Equals, true)
+
+	// Tag the 2nd query and mark it reviewed.
+	id := all.Query[2].ID
+	classId, err := query.GetClassId(ctx, s.testDb.DB(), id)
+	t.Assert(err, IsNil)
+	qh := query.NewMySQLHandler(db.DBManager, stats.NullStats())
+	note := query.Note{User: "dba", Body: "ORM lazy loading", Tags: []string{"orm"}}
+	t.Assert(note.Validate(), IsNil)
+	_, err = qh.CreateNote(classId, note)
+	t.Assert(err, IsNil)
+	t.Assert(qh.SetStatus(classId, query.StatusReviewed, "dba", ""), IsNil)
+
+	got, err := models.Report.Profile(ctx, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", nil, []string{"orm", "other"})
+	t.Assert(err, IsNil)
+	t.Check(got.TotalQueries, Equals, uint(1))
+	t.Assert(got.Query, HasLen, 2) // total + 1
+	t.Check(got.Query[1].ID, Equals, id)
+
+	got, err = models.Report.Profile(ctx, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", []string{query.StatusReviewed}, nil)
+	t.Assert(err, IsNil)
+	t.Assert(got.Query, HasLen, 2)
+	t.Check(got.Query[1].ID, Equals, id)
+
+	got, err = models.Report.Profile(ctx, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", []string{query.StatusNew}, nil)
+	t.Assert(err, IsNil)
+	t.Check(got.TotalQueries, Equals, all.TotalQueries-1)
+
+	_, err = models.Report.Profile(ctx, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", nil, []string{"x' OR 1"})
+	t.Check(err, NotNil)
+}
+
+func (s *ReporterTestSuite) TestEvents(t *C) {
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/01")
+
+	begin := time.Date(2015, time.May, 01, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+
+	deploy := models.Event{Type: models.EventDeploy, Label: "app v1.2.3", Ts: end.Add(-90 * time.Minute)}
+	t.Assert(deploy.Validate(), IsNil)
+	_, err := models.Events.Create(ctx, []uint{s.mysqlId}, deploy)
+	t.Assert(err, IsNil)
+	other := models.Event{Type: models.EventFailover, Label: "other instance", Ts: end.Add(-time.Hour)}
+	t.Assert(other.Validate(), IsNil)
+	_, err = models.Events.Create(ctx, []uint{1}, other)
+	t.Assert(err, IsNil)
+	late := models.Event{Type: models.EventMigration, Label: "after end", Ts: end}
+	t.Assert(late.Validate(), IsNil)
+	_, err = models.Events.Create(ctx, []uint{s.mysqlId}, late)
+	t.Assert(err, IsNil)
+
+	r := models.RankBy{
+		Metric: "Query_time",
+		Stat:   "sum",
+		Limit:  5,
+	}
+	got, err := models.Report.Profile(ctx, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", nil, nil)
+	t.Assert(err, IsNil)
+	t.Assert(got.Events, HasLen, 1)
+	t.Check(got.Events[0].Label, Equals, "app v1.2.3")
+	// 60 points of 1440s each, point 0 ends at end: 5400s / 1440s = point 3.
+	t.Check(got.Events[0].Point, Equals, int64(3))
+
+	events, err := models.Metrics.GetEvents(ctx, []uint{s.mysqlId}, begin, end)
+	t.Assert(err, IsNil)
+	t.Assert(events, HasLen, 1)
+	t.Check(events[0].Point, Equals, int64(3))
+
+	bad := models.Event{Type: "outage", Label: "x"}
+	t.Check(bad.Validate(), NotNil)
+	bad = models.Event{Type: models.EventOther}
+	t.Check(bad.Validate(), NotNil)
+}
+
+func (s *ReporterTestSuite) TestCompare(t *C) {
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/01")
+
+	day1 := time.Date(2015, time.May, 01, 0, 0, 0, 0, time.UTC)
+	day2 := time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+	day3 := time.Date(2015, time.May, 03, 0, 0, 0, 0, time.UTC)
+	r := models.RankBy{
+		Metric: "Query_time",
+		Stat:   "sum",
+		Limit:  5,
+	}
+
+	// Same time range: no change.
+	got, err := models.Report.Compare(ctx, []uint{s.mysqlId}, day1, day2, day1, day2, r)
+	t.Assert(err, IsNil)
+	t.Assert(got.Query, Not(HasLen), 0)
+	for _, q := range got.Query {
+		t.Check(q.New, Equals, false)
+		t.Check(q.Gone, Equals, false)
+		t.Check(q.Stats1, Equals, q.Stats2)
+		t.Check(q.Delta.Load.Abs, Equals, 0.0)
+		t.Assert(q.Delta.Count.Rel, NotNil)
+		t.Check(*q.Delta.Count.Rel, Equals, 0.0)
+	}
+
+	// Only the first time range has data: all queries are gone.
+	got, err = models.Report.Compare(ctx, []uint{s.mysqlId}, day1, day2, day2, day3, r)
+	t.Assert(err, IsNil)
+	t.Assert(got.Query, Not(HasLen), 0)
+	t.Check(got.Total.Gone, Equals, true)
+	for _, q := range got.Query {
+		t.Check(q.Gone, Equals, true)
+		t.Check(q.New, Equals, false)
+		t.Check(q.Stats2.Count, Equals, 0.0)
+		t.Check(q.Delta.Count.Abs, Equals, -q.Stats1.Count)
+		t.Assert(q.Delta.Count.Rel, NotNil)
+		t.Check(*q.Delta.Count.Rel, Equals, -1.0)
+	}
+	for i := 1; i < len(got.Query); i++ {
+		t.Check(math.Abs(got.Query[i-1].Delta.Load.Abs) >= math.Abs(got.Query[i].Delta.Load.Abs), Equals, true)
+	}
+
+	// Reversed: all queries are new and have no relative change.
+	got, err = models.Report.Compare(ctx, []uint{s.mysqlId}, day2, day3, day1, day2, r)
+	t.Assert(err, IsNil)
+	for _, q := range got.Query {
+		t.Check(q.New, Equals, true)
+		t.Check(q.Delta.Count.Rel, IsNil)
+	}
+
+	r.Limit = models.MaxCompareLimit + 1
+	_, err = models.Report.Compare(ctx, []uint{s.mysqlId}, day1, day2, day2, day3, r)
+	t.Check(err, NotNil)
+}
+
+func (s *ReporterTestSuite) TestProfileRollup(t *C) {
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/01")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/02")
+
+	// 3 days = 72m per sparkline point, long enough for the hourly rollup.
+	begin := time.Date(2015, time.May, 01, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2015, time.May, 04, 0, 0, 0, 0, time.UTC)
+	r := models.RankBy{
+		Metric: "Query_time",
+		Stat:   "sum",
+		Limit:  5,
+	}
+
+	raw, err := models.Report.Profile(ctx, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", nil, nil)
+	t.Assert(err, IsNil)
+	t.Assert(len(raw.Query) > 1, Equals, true)
+
+	cfg := rollup.Config{
+		Lookback: map[string]time.Duration{
+			rollup.Hourly.Name: 3 * time.Hour,
+			rollup.Daily.Name:  48 * time.Hour,
+		},
+	}
+	// Roll up only May 1 so the profile reads the rollup and raw data.
+	a := rollup.NewAggregator(db.DBManager, cfg, stats.NullStats())
+	err = a.Aggregate(time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC))
+	t.Assert(err, IsNil)
+
+	got, err := models.Report.Profile(ctx, []uint{s.mysqlId}, begin, end, r, 0, "", false, "", nil, nil)
+	t.Assert(err, IsNil)
+	t.Check(got.TotalQueries, Equals, raw.TotalQueries)
+	t.Assert(len(got.Query), Equals, len(raw.Query))
+	for i := range raw.Query {
+		t.Check(got.Query[i].ID, Equals, raw.Query[i].ID)
+		t.Check(got.Query[i].Stats.Cnt, Equals, raw.Query[i].Stats.Cnt)
+		// Sums are FLOAT so rounding differs a little.
+		t.Check(math.Abs(got.Query[i].Stats.Sum-raw.Query[i].Stats.Sum) < 0.001*raw.Query[i].Stats.Sum, Equals, true)
+	}
+}
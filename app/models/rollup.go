@@ -0,0 +1,118 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/rollup"
+)
+
+// source is where metrics for a time range are read from: the raw metrics
+// tables or a rollup level, plus the raw tables for the parts of the range
+// that aren't whole rolled up periods.
+type source struct {
+	level      *rollup.Level
+	rolledUpTo time.Time
+}
+
+// rawSource reads only query_class_metrics and query_global_metrics.
+var rawSource = source{}
+
+// pickSource returns the coarsest rollup level that has data for the range
+// and whose period fits in one sparkline point of intervalTs seconds, or the
+// raw tables if there is none. Rollup periods aren't split, so the parts
+// of the range that aren't whole periods are read from the raw tables, see
+// table.
+func pickSource(begin, end time.Time, intervalTs int64) (source, error) {
+	for i := len(rollup.Levels) - 1; i >= 0; i-- {
+		l := rollup.Levels[i]
+		if intervalTs < int64(l.Period.Seconds()) {
+			continue
+		}
+		rolledUpTo, err := rollup.RolledUpTo(db, l)
+		if err != nil {
+			return rawSource, err
+		}
+		if !rolledUpTo.After(begin) {
+			continue // no rollup data in range
+		}
+		return source{level: &l, rolledUpTo: rolledUpTo}, nil
+	}
+	return rawSource, nil
+}
+
+// ClassMetrics returns the table expression for query class metrics between
+// begin and end. It's used in FROM and must be aliased.
+func (s source) ClassMetrics(instanceIDs string, begin, end time.Time) string {
+	if s.level == nil {
+		return "query_class_metrics"
+	}
+	return s.table(s.level.ClassTable, "query_class_metrics", instanceIDs, begin, end)
+}
+
+// GlobalMetrics is like ClassMetrics for the global metrics.
+func (s source) GlobalMetrics(instanceIDs string, begin, end time.Time) string {
+	if s.level == nil {
+		return "query_global_metrics"
+	}
+	return s.table(s.level.GlobalTable, "query_global_metrics", instanceIDs, begin, end)
+}
+
+// table reads the rollup for the whole periods in the range up to
+// rolledUpTo and the raw table for the rest: before the first whole period
+// if begin isn't period-aligned, and after the last one. Rollup periods
+// aren't split, and the outer query filters on start_ts, so reading a
+// partial period from the rollup would drop or add up to a whole period.
+// The range and instance filters are repeated in each part of the union so
+// they use the indexes; the outer query still filters too.
+func (s source) table(rollupTable, rawTable, instanceIDs string, begin, end time.Time) string {
+	first := begin.Truncate(s.level.Period)
+	if first.Before(begin) {
+		first = first.Add(s.level.Period)
+	}
+	last := end.Truncate(s.level.Period)
+	if s.rolledUpTo.Before(last) {
+		last = s.rolledUpTo
+	}
+	if !first.Before(last) {
+		return rawTable // no whole rolled up period in range
+	}
+	if first.Equal(begin) && !end.After(last) {
+		return rollupTable
+	}
+	// FROM_UNIXTIME() instead of quoted datetimes because the ':' in them
+	// would be taken for named parameters.
+	parts := []string{}
+	if begin.Before(first) {
+		parts = append(parts, fmt.Sprintf(
+			"SELECT * FROM %s WHERE instance_id IN (%s) AND start_ts >= FROM_UNIXTIME(%d) AND start_ts < FROM_UNIXTIME(%d)",
+			rawTable, instanceIDs, begin.Unix(), first.Unix()))
+	}
+	parts = append(parts, fmt.Sprintf(
+		"SELECT * FROM %s WHERE instance_id IN (%s) AND start_ts >= FROM_UNIXTIME(%d) AND start_ts < FROM_UNIXTIME(%d)",
+		rollupTable, instanceIDs, first.Unix(), last.Unix()))
+	if end.After(last) {
+		parts = append(parts, fmt.Sprintf(
+			"SELECT * FROM %s WHERE instance_id IN (%s) AND start_ts >= FROM_UNIXTIME(%d) AND start_ts <= FROM_UNIXTIME(%d)",
+			rawTable, instanceIDs, last.Unix(), end.Unix()))
+	}
+	return "(" + strings.Join(parts, " UNION ALL ") + ")"
+}
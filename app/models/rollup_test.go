@@ -0,0 +1,56 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package models_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/models"
+	. "gopkg.in/check.v1"
+)
+
+type RollupTestSuite struct{}
+
+var _ = Suite(&RollupTestSuite{})
+
+func (s *RollupTestSuite) TestTable(t *C) {
+	ts := func(h, m int) time.Time { return time.Date(2015, time.May, 1, h, m, 0, 0, time.UTC) }
+	part := func(table string, begin, end time.Time, op string) string {
+		return fmt.Sprintf("SELECT * FROM %s WHERE instance_id IN (1) AND start_ts >= FROM_UNIXTIME(%d) AND start_ts %s FROM_UNIXTIME(%d)",
+			table, begin.Unix(), op, end.Unix())
+	}
+
+	// Whole periods, all rolled up.
+	t.Check(models.RollupTable(time.Hour, ts(12, 0), ts(1, 0), ts(10, 0)), Equals, "rollup")
+
+	// The partial first hour and the hours after rolledUpTo are read raw,
+	// not dropped by start_ts >= begin.
+	t.Check(models.RollupTable(time.Hour, ts(8, 0), ts(1, 30), ts(10, 0)), Equals,
+		"("+part("raw", ts(1, 30), ts(2, 0), "<")+
+			" UNION ALL "+part("rollup", ts(2, 0), ts(8, 0), "<")+
+			" UNION ALL "+part("raw", ts(8, 0), ts(10, 0), "<=")+")")
+
+	// The partial last hour too.
+	t.Check(models.RollupTable(time.Hour, ts(12, 0), ts(1, 0), ts(9, 45)), Equals,
+		"("+part("rollup", ts(1, 0), ts(9, 0), "<")+
+			" UNION ALL "+part("raw", ts(9, 0), ts(9, 45), "<=")+")")
+
+	// No whole hour in the range.
+	t.Check(models.RollupTable(time.Hour, ts(12, 0), ts(1, 10), ts(1, 50)), Equals, "raw")
+}
@@ -0,0 +1,282 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package purge
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/revel/revel"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+	"github.com/shatteredsilicon/qan-api/stats"
+)
+
+const (
+	TableClassMetrics  = "query_class_metrics"
+	TableGlobalMetrics = "query_global_metrics"
+	TableExamples      = "query_examples"
+	TableUserSources   = "query_user_sources"
+	TableAgentLog      = "agent_log"
+	TableClasses       = "query_classes" // orphaned classes, see purgeClasses
+
+	TableClassMetricsHourly  = "query_class_metrics_hourly"
+	TableGlobalMetricsHourly = "query_global_metrics_hourly"
+	TableClassMetricsDaily   = "query_class_metrics_daily"
+	TableGlobalMetricsDaily  = "query_global_metrics_daily"
+
+	TableAnomalies          = "query_anomalies"
+	TableAlertNotifications = "alert_notifications"
+	TableEvents             = "events"
+	TableReports            = "query_reports"
+)
+
+// classMetricsTables are the tables that reference query_classes. A class is
+// orphaned only when it has no metrics left in any of them.
+var classMetricsTables = []string{
+	TableClassMetrics,
+	TableClassMetricsHourly,
+	TableClassMetricsDaily,
+}
+
+// A table is purged by deleting rows with tsCol older than the retention.
+// unixTs is true if tsCol is a Unix timestamp instead of a TIMESTAMP.
+type table struct {
+	name   string
+	tsCol  string
+	unixTs bool
+}
+
+var tables = []table{
+	{name: TableClassMetrics, tsCol: "start_ts"},
+	{name: TableGlobalMetrics, tsCol: "start_ts"},
+	{name: TableClassMetricsHourly, tsCol: "start_ts"},
+	{name: TableGlobalMetricsHourly, tsCol: "start_ts"},
+	{name: TableClassMetricsDaily, tsCol: "start_ts"},
+	{name: TableGlobalMetricsDaily, tsCol: "start_ts"},
+	{name: TableAnomalies, tsCol: "start_ts"},
+	{name: TableAlertNotifications, tsCol: "fired_at"},
+	{name: TableEvents, tsCol: "ts"},
+	{name: TableReports, tsCol: "written"},
+	{name: TableExamples, tsCol: "period"},
+	{name: TableUserSources, tsCol: "ts"},
+	{name: TableAgentLog, tsCol: "sec", unixTs: true},
+}
+
+type Config struct {
+	Interval   time.Duration            // how often to purge
+	BatchSize  uint                     // max rows deleted per statement
+	BatchPause time.Duration            // pause between batches to let ingestion through
+	Retention  map[string]time.Duration // keyed on table name, zero = keep forever
+}
+
+// LoadConfig reads the purge config from app.conf:
+//
+//	purge.interval                       = 1h
+//	purge.batch.size                     = 5000
+//	purge.batch.pause                    = 100ms
+//	purge.retention.query_class_metrics  = 30  # days, 0 = keep forever
+//	...
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		BatchSize: uint(revel.Config.IntDefault("purge.batch.size", 5000)),
+		Retention: map[string]time.Duration{},
+	}
+	var err error
+	if cfg.Interval, err = time.ParseDuration(revel.Config.StringDefault("purge.interval", "1h")); err != nil {
+		return cfg, fmt.Errorf("invalid purge.interval: %s", err)
+	}
+	if cfg.BatchPause, err = time.ParseDuration(revel.Config.StringDefault("purge.batch.pause", "100ms")); err != nil {
+		return cfg, fmt.Errorf("invalid purge.batch.pause: %s", err)
+	}
+	for _, t := range tables {
+		days := revel.Config.IntDefault("purge.retention."+t.name, 0)
+		if days < 0 {
+			return cfg, fmt.Errorf("invalid purge.retention.%s: %d", t.name, days)
+		}
+		cfg.Retention[t.name] = time.Duration(days) * 24 * time.Hour
+	}
+	return cfg, nil
+}
+
+// Purger periodically deletes QAN data older than the configured retention.
+// Rows are deleted in small batches with a pause between them so the purge
+// doesn't hold locks that block qan.MySQLMetricWriter.
+type Purger struct {
+	dbm   db.Manager
+	cfg   Config
+	stats *stats.Stats
+}
+
+func NewPurger(dbm db.Manager, cfg Config, stats *stats.Stats) *Purger {
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 5000
+	}
+	p := &Purger{
+		dbm:   dbm,
+		cfg:   cfg,
+		stats: stats,
+	}
+	return p
+}
+
+func (p *Purger) Run() {
+	if p.cfg.Interval <= 0 {
+		revel.WARN.Printf("Purger disabled: purge.interval=%s", p.cfg.Interval)
+		return
+	}
+	t := time.NewTicker(p.cfg.Interval)
+	defer t.Stop()
+	for now := range t.C {
+		if _, err := p.Purge(now); err != nil {
+			revel.ERROR.Printf("Purger: %s", err)
+		}
+	}
+}
+
+// Purge deletes all data older than the retention relative to now, and
+// returns the number of rows removed per table.
+func (p *Purger) Purge(now time.Time) (map[string]uint64, error) {
+	if err := p.dbm.Open(); err != nil {
+		return nil, fmt.Errorf("dbm.Open: %s", err)
+	}
+
+	removed := map[string]uint64{}
+	for _, t := range tables {
+		retention := p.cfg.Retention[t.name]
+		if retention <= 0 {
+			continue
+		}
+		cutoff := now.Add(-retention).UTC()
+		n, err := p.purgeTable(t, cutoff)
+		p.record(t.name, n)
+		removed[t.name] = n
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	// Purge classes after all their metrics tables, using the retention of
+	// the raw metrics to decide which classes are old.
+	if retention := p.cfg.Retention[TableClassMetrics]; retention > 0 {
+		n, err := p.purgeClasses(now.Add(-retention).UTC())
+		p.record(TableClasses, n)
+		removed[TableClasses] = n
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	for table, n := range removed {
+		if n > 0 {
+			revel.INFO.Printf("Purger: removed %d rows from %s", n, table)
+		}
+	}
+	return removed, nil
+}
+
+func (p *Purger) purgeTable(t table, cutoff time.Time) (uint64, error) {
+	var arg interface{} = cutoff
+	if t.unixTs {
+		arg = cutoff.Unix()
+	}
+	q := fmt.Sprintf("DELETE FROM %s WHERE %s < ? LIMIT %d", t.name, t.tsCol, p.cfg.BatchSize)
+	return p.deleteInBatches(q, arg)
+}
+
+// purgeClasses deletes query classes that were last seen before the cutoff
+// and have no metrics or notes left. The metric writer re-creates a class if it's
+// purged while an agent is still sending data for it.
+func (p *Purger) purgeClasses(cutoff time.Time) (uint64, error) {
+	orphaned := make([]string, len(classMetricsTables))
+	for i, t := range classMetricsTables {
+		orphaned[i] = fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s qcm WHERE qcm.query_class_id = query_classes.query_class_id)", t)
+	}
+	// Keep classes with notes, the notes are still useful if the query comes back.
+	orphaned = append(orphaned, "NOT EXISTS (SELECT 1 FROM query_notes n WHERE n.query_class_id = query_classes.query_class_id)")
+	var total uint64
+	for {
+		rows, err := p.dbm.DB().Query(
+			"SELECT query_class_id FROM query_classes"+
+				" WHERE last_seen < ?"+
+				" AND "+strings.Join(orphaned, " AND ")+
+				fmt.Sprintf(" LIMIT %d", p.cfg.BatchSize),
+			cutoff)
+		if err != nil {
+			return total, mysql.Error(err, "purgeClasses: SELECT query_classes")
+		}
+		ids := []interface{}{}
+		for rows.Next() {
+			var id uint
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return total, mysql.Error(err, "purgeClasses: rows.Scan")
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			return total, nil
+		}
+
+		// Check again that the classes are orphaned in case metrics were
+		// written since the SELECT.
+		res, err := p.dbm.DB().Exec(
+			"DELETE FROM query_classes"+
+				" WHERE query_class_id IN ("+shared.Placeholders(len(ids))+")"+
+				" AND "+strings.Join(orphaned, " AND "),
+			ids...)
+		if err != nil {
+			return total, mysql.Error(err, "purgeClasses: DELETE query_classes")
+		}
+		n, _ := res.RowsAffected()
+		total += uint64(n)
+		if uint(len(ids)) < p.cfg.BatchSize {
+			return total, nil
+		}
+		time.Sleep(p.cfg.BatchPause)
+	}
+}
+
+func (p *Purger) deleteInBatches(q string, args ...interface{}) (uint64, error) {
+	var total uint64
+	op := strings.Fields(q)[2] // DELETE FROM <table>
+	for {
+		t := time.Now()
+		res, err := p.dbm.DB().Exec(q, args...)
+		if err != nil {
+			return total, mysql.Error(err, "Purger: DELETE "+op)
+		}
+		p.stats.TimingDuration(p.stats.System("purge-"+op), time.Now().Sub(t), p.stats.SampleRate)
+		n, _ := res.RowsAffected()
+		total += uint64(n)
+		if uint(n) < p.cfg.BatchSize {
+			return total, nil
+		}
+		time.Sleep(p.cfg.BatchPause)
+	}
+}
+
+func (p *Purger) record(table string, n uint64) {
+	if n == 0 {
+		return
+	}
+	p.stats.Inc(p.stats.System(table+".rows-removed"), int64(n), p.stats.SampleRate)
+}
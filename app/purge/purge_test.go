@@ -0,0 +1,99 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package purge_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/purge"
+	"github.com/shatteredsilicon/qan-api/config"
+	"github.com/shatteredsilicon/qan-api/stats"
+	testDb "github.com/shatteredsilicon/qan-api/tests/setup/db"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type PurgeTestSuite struct {
+	testDb *testDb.Db
+}
+
+var _ = Suite(&PurgeTestSuite{})
+
+func (s *PurgeTestSuite) SetUpSuite(t *C) {
+	dsn := config.Get("mysql.dsn")
+	s.testDb = testDb.NewDb(dsn, config.SchemaDir, config.TestDir)
+	if err := s.testDb.Start(); err != nil {
+		t.Fatalf("Could not prepare org db for %s: %s", dsn, err)
+	}
+}
+
+func (s *PurgeTestSuite) SetUpTest(t *C) {
+	s.testDb.TruncateDataTables()
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/01")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/02")
+}
+
+func (s *PurgeTestSuite) count(t *C, q string, args ...interface{}) uint64 {
+	var n uint64
+	err := s.testDb.DB().QueryRow(q, args...).Scan(&n)
+	t.Assert(err, IsNil)
+	return n
+}
+
+// --------------------------------------------------------------------------
+
+func (s *PurgeTestSuite) TestPurge(t *C) {
+	cutoff := time.Date(2015, time.May, 02, 0, 0, 0, 0, time.UTC)
+	before := s.count(t, "SELECT COUNT(*) FROM query_class_metrics WHERE start_ts < ?", cutoff)
+	t.Assert(before > 0, Equals, true)
+	kept := s.count(t, "SELECT COUNT(*) FROM query_class_metrics WHERE start_ts >= ?", cutoff)
+
+	cfg := purge.Config{
+		BatchSize: 100, // force several batches
+		Retention: map[string]time.Duration{
+			purge.TableClassMetrics:  24 * time.Hour,
+			purge.TableGlobalMetrics: 24 * time.Hour,
+		},
+	}
+	p := purge.NewPurger(db.DBManager, cfg, stats.NullStats())
+	removed, err := p.Purge(cutoff.Add(24 * time.Hour))
+	t.Assert(err, IsNil)
+	t.Check(removed[purge.TableClassMetrics], Equals, before)
+	t.Check(removed[purge.TableGlobalMetrics] > 0, Equals, true)
+
+	t.Check(s.count(t, "SELECT COUNT(*) FROM query_class_metrics WHERE start_ts < ?", cutoff), Equals, uint64(0))
+	t.Check(s.count(t, "SELECT COUNT(*) FROM query_class_metrics WHERE start_ts >= ?", cutoff), Equals, kept)
+	t.Check(s.count(t, "SELECT COUNT(*) FROM query_global_metrics WHERE start_ts < ?", cutoff), Equals, uint64(0))
+
+	// Tables without retention are not purged.
+	_, ok := removed[purge.TableExamples]
+	t.Check(ok, Equals, false)
+
+	// Every class left has metrics.
+	t.Check(s.count(t, "SELECT COUNT(*) FROM query_classes qc WHERE last_seen < ? AND NOT EXISTS"+
+		" (SELECT 1 FROM query_class_metrics qcm WHERE qcm.query_class_id = qc.query_class_id)", cutoff), Equals, uint64(0))
+
+	// Purging again removes nothing.
+	removed, err = p.Purge(cutoff.Add(24 * time.Hour))
+	t.Assert(err, IsNil)
+	t.Check(removed[purge.TableClassMetrics], Equals, uint64(0))
+}
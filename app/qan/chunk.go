@@ -0,0 +1,182 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shatteredsilicon/ssm/proto"
+)
+
+// Response codes of the data websocket other than 200 (report spooled) and
+// 400 (bad data, the agent drops the report).
+const (
+	CodePartOK       = 202 // part received, send the next one
+	CodeChunkTimeout = 408 // parts too far apart, resend all the parts
+	CodeTooLarge     = 413 // report Data > proto.MAX_DATA_SIZE, send it in parts
+	CodeBadChunk     = 422 // part out of order or report checksum mismatch, resend all the parts
+)
+
+const (
+	// MaxChunkedSize is the max size of the Data of a report sent in parts.
+	MaxChunkedSize = maxDecodedSize
+
+	// ChunkTimeout is the max time between two parts of a report.
+	ChunkTimeout = 2 * time.Minute
+)
+
+// Chunk is set in a data msg that is a part of a report. The agent splits the
+// Data of a report larger than proto.MAX_DATA_SIZE into parts and sends each
+// in a msg with the same ProtocolVersion, ContentType and ContentEncoding as
+// the report. The API replies CodePartOK to all but the last part, which it
+// replies to like a report once the parts are assembled.
+type Chunk struct {
+	Id     string // unique per report, e.g. the agent's spool file name
+	Part   uint   // 0 to Parts-1, sent in order
+	Parts  uint   // number of parts
+	Size   int    // bytes of the report Data
+	SHA256 string // hex SHA256 of the report Data
+}
+
+// dataMsg is a msg on the data websocket: a proto.Data, or a part of one.
+type dataMsg struct {
+	proto.Data
+	Chunk *Chunk `json:",omitempty"`
+}
+
+// chunkError is a part that can't be assembled. The agent must send all the
+// parts again.
+type chunkError struct {
+	code uint
+	msg  string
+}
+
+func (e *chunkError) Error() string {
+	return e.msg
+}
+
+// chunkErrorCode returns the response code of an error from assembler.add,
+// 400 if it isn't a chunkError.
+func chunkErrorCode(err error) uint {
+	var cerr *chunkError
+	if errors.As(err, &cerr) {
+		return cerr.code
+	}
+	return 400
+}
+
+// assembler assembles the parts of one report at a time sent on a data
+// websocket.
+type assembler struct {
+	timeout time.Duration
+	maxSize int
+	// --
+	chunk Chunk
+	data  proto.Data
+	buf   *bytes.Buffer
+	last  time.Time
+}
+
+func newAssembler(timeout time.Duration, maxSize int) *assembler {
+	return &assembler{
+		timeout: timeout,
+		maxSize: maxSize,
+	}
+}
+
+// add adds the part. It returns the report Data after its last part, or nil
+// and an error if the part can't be assembled. In that case the parts
+// received so far are discarded.
+func (a *assembler) add(msg dataMsg, now time.Time) (*proto.Data, error) {
+	c := *msg.Chunk
+	if len(msg.Data.Data) > proto.MAX_DATA_SIZE {
+		a.reset()
+		return nil, &chunkError{CodeTooLarge, fmt.Sprintf("part %d of %s too large: %d > %d", c.Part, c.Id, len(msg.Data.Data), proto.MAX_DATA_SIZE)}
+	}
+	if c.Part == 0 {
+		// First part of a new report; drop the parts of the last one if the
+		// agent gave up on it.
+		if err := a.start(msg, now); err != nil {
+			return nil, err
+		}
+	} else {
+		if a.buf == nil || c.Id != a.chunk.Id {
+			a.reset()
+			return nil, &chunkError{CodeBadChunk, fmt.Sprintf("part %d of %s without part 0", c.Part, c.Id)}
+		}
+		if now.Sub(a.last) > a.timeout {
+			a.reset()
+			return nil, &chunkError{CodeChunkTimeout, fmt.Sprintf("part %d of %s more than %s after the last part", c.Part, c.Id, a.timeout)}
+		}
+		if c.Part != a.chunk.Part+1 || c.Parts != a.chunk.Parts || c.Size != a.chunk.Size || c.SHA256 != a.chunk.SHA256 {
+			err := &chunkError{CodeBadChunk, fmt.Sprintf("got part %d/%d of %s, expected part %d/%d", c.Part, c.Parts, c.Id, a.chunk.Part+1, a.chunk.Parts)}
+			a.reset()
+			return nil, err
+		}
+		a.chunk.Part = c.Part
+	}
+
+	if a.buf.Len()+len(msg.Data.Data) > a.chunk.Size {
+		a.reset()
+		return nil, &chunkError{CodeBadChunk, fmt.Sprintf("parts of %s larger than Size %d", c.Id, c.Size)}
+	}
+	a.buf.Write(msg.Data.Data)
+	a.last = now
+
+	if c.Part < c.Parts-1 {
+		return nil, nil // more parts to come
+	}
+
+	defer a.reset()
+	if a.buf.Len() != a.chunk.Size {
+		return nil, &chunkError{CodeBadChunk, fmt.Sprintf("parts of %s are %d bytes, expected Size %d", c.Id, a.buf.Len(), c.Size)}
+	}
+	if sum := fmt.Sprintf("%x", sha256.Sum256(a.buf.Bytes())); sum != a.chunk.SHA256 {
+		return nil, &chunkError{CodeBadChunk, fmt.Sprintf("SHA256 of %s is %s, expected %s", c.Id, sum, a.chunk.SHA256)}
+	}
+	data := a.data
+	data.Data = a.buf.Bytes()
+	return &data, nil
+}
+
+func (a *assembler) start(msg dataMsg, now time.Time) error {
+	a.reset()
+	c := *msg.Chunk
+	if c.Id == "" || c.Parts == 0 || c.Size <= 0 || c.SHA256 == "" {
+		return &chunkError{CodeBadChunk, "Chunk requires Id, Parts, Size and SHA256"}
+	}
+	if c.Size > a.maxSize {
+		return &chunkError{CodeTooLarge, fmt.Sprintf("report %s too large: %d > %d", c.Id, c.Size, a.maxSize)}
+	}
+	a.chunk = c
+	a.data = msg.Data
+	a.data.Data = nil
+	a.buf = bytes.NewBuffer(make([]byte, 0, c.Size))
+	a.last = now
+	return nil
+}
+
+func (a *assembler) reset() {
+	a.chunk = Chunk{}
+	a.data = proto.Data{}
+	a.buf = nil
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan_test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/qan"
+	"github.com/shatteredsilicon/qan-api/config"
+	"github.com/shatteredsilicon/ssm/proto"
+	qp "github.com/shatteredsilicon/ssm/proto/qan"
+	. "gopkg.in/check.v1"
+)
+
+type ChunkTestSuite struct {
+	data proto.Data // zstd msgpack report
+	now  time.Time
+}
+
+var _ = Suite(&ChunkTestSuite{})
+
+func (s *ChunkTestSuite) SetUpSuite(t *C) {
+	bytes, err := ioutil.ReadFile(config.ApiRootDir + "/test/qan/001/data1_v3.json")
+	t.Assert(err, IsNil)
+	report := qp.Report{}
+	err = json.Unmarshal(bytes, &report)
+	t.Assert(err, IsNil)
+	s.data, err = qan.EncodeReport(report, qan.ContentTypeMsgpack, qan.EncodingZstd)
+	t.Assert(err, IsNil)
+	s.now = time.Now()
+}
+
+// parts splits s.data into msgs of at most size bytes.
+func (s *ChunkTestSuite) parts(size int) []qan.DataMsg {
+	chunk := qan.Chunk{
+		Id:     "report1",
+		Size:   len(s.data.Data),
+		SHA256: fmt.Sprintf("%x", sha256.Sum256(s.data.Data)),
+		Parts:  uint((len(s.data.Data) + size - 1) / size),
+	}
+	msgs := []qan.DataMsg{}
+	for i := uint(0); i < chunk.Parts; i++ {
+		end := int(i+1) * size
+		if end > len(s.data.Data) {
+			end = len(s.data.Data)
+		}
+		msg := qan.DataMsg{Data: s.data}
+		msg.Data.Data = s.data.Data[int(i)*size : end]
+		c := chunk
+		c.Part = i
+		msg.Chunk = &c
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// --------------------------------------------------------------------------
+
+func (s *ChunkTestSuite) TestAssemble(t *C) {
+	a := qan.NewAssembler(time.Minute, 1024*1024)
+	msgs := s.parts(100)
+	t.Assert(len(msgs) > 2, Equals, true)
+
+	// Twice to check the assembler is reset after a report.
+	for n := 0; n < 2; n++ {
+		for i, msg := range msgs {
+			data, code, err := a.AddPart(msg, s.now)
+			t.Assert(err, IsNil)
+			t.Check(code, Equals, uint(0))
+			if i < len(msgs)-1 {
+				t.Check(data, IsNil)
+				continue
+			}
+			t.Assert(data, NotNil)
+			t.Check(data.Data, DeepEquals, s.data.Data)
+			t.Check(data.ProtocolVersion, Equals, qan.ProtocolVersion2)
+			t.Check(data.ContentEncoding, Equals, qan.EncodingZstd)
+
+			report, err := qan.DecodeReport(*data)
+			t.Assert(err, IsNil)
+			expect, _ := qan.DecodeReport(s.data)
+			t.Check(report, DeepEquals, expect)
+		}
+	}
+}
+
+func (s *ChunkTestSuite) TestBadParts(t *C) {
+	a := qan.NewAssembler(time.Minute, 1024*1024)
+	msgs := s.parts(100)
+
+	// Out of order.
+	_, _, err := a.AddPart(msgs[0], s.now)
+	t.Assert(err, IsNil)
+	_, code, err := a.AddPart(msgs[2], s.now)
+	t.Check(err, NotNil)
+	t.Check(code, Equals, uint(qan.CodeBadChunk))
+
+	// Without part 0: the assembly was discarded.
+	_, code, _ = a.AddPart(msgs[1], s.now)
+	t.Check(code, Equals, uint(qan.CodeBadChunk))
+
+	// Corrupt part.
+	bad := make([]qan.DataMsg, len(msgs))
+	copy(bad, msgs)
+	bad[1].Data.Data = append([]byte{}, msgs[1].Data.Data...)
+	bad[1].Data.Data[0]++
+	for i, msg := range bad {
+		_, code, err = a.AddPart(msg, s.now)
+		if i < len(bad)-1 {
+			t.Assert(err, IsNil)
+		}
+	}
+	t.Check(err, ErrorMatches, "SHA256 of report1 is .*")
+	t.Check(code, Equals, uint(qan.CodeBadChunk))
+
+	// Timeout.
+	_, _, err = a.AddPart(msgs[0], s.now)
+	t.Assert(err, IsNil)
+	_, code, err = a.AddPart(msgs[1], s.now.Add(2*time.Minute))
+	t.Check(err, NotNil)
+	t.Check(code, Equals, uint(qan.CodeChunkTimeout))
+
+	// Too large.
+	a = qan.NewAssembler(time.Minute, 100)
+	_, code, err = a.AddPart(msgs[0], s.now)
+	t.Check(err, NotNil)
+	t.Check(code, Equals, uint(qan.CodeTooLarge))
+}
+
+func (s *ChunkTestSuite) TestChunkErrorCode(t *C) {
+	// Any other error is bad data, not a reason to resend the parts.
+	t.Check(qan.ChunkErrorCode(fmt.Errorf("decode: %s", "EOF")), Equals, uint(400))
+}
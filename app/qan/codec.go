@@ -0,0 +1,219 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/shatteredsilicon/ssm/proto"
+	qp "github.com/shatteredsilicon/ssm/proto/qan"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Data protocol versions. 1.0 is a JSON qp.Report. 2.0 is a qp.Report
+// encoded as ContentType, MessagePack by default. Both can be compressed
+// with ContentEncoding.
+const (
+	ProtocolVersion1 = "1.0"
+	ProtocolVersion2 = "2.0"
+)
+
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeMsgpack = "application/msgpack"
+
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// Supported by decode, see Home.Ping.
+var (
+	ProtocolVersions = []string{ProtocolVersion1, ProtocolVersion2}
+	ContentEncodings = []string{EncodingGzip, EncodingZstd}
+)
+
+// maxDecodedSize limits decompression so a corrupt or malicious msg can't
+// use all the memory. Reports compress about 10x.
+const maxDecodedSize = proto.MAX_DATA_SIZE * 10
+
+// EncodeReport returns the report as data protocol 2.0 encoded as
+// contentType and compressed with contentEncoding, if not empty.
+func EncodeReport(report qp.Report, contentType, contentEncoding string) (proto.Data, error) {
+	data := proto.Data{
+		ProtocolVersion: ProtocolVersion2,
+		Created:         time.Now().UTC(),
+		Service:         "qan",
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+	}
+
+	var b []byte
+	var err error
+	switch contentType {
+	case ContentTypeJSON:
+		b, err = json.Marshal(report)
+	case ContentTypeMsgpack:
+		b, err = marshalMsgpack(report)
+	default:
+		return data, fmt.Errorf("content type %s not supported", contentType)
+	}
+	if err != nil {
+		return data, err
+	}
+
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch contentEncoding {
+	case "":
+		data.Data = b
+		return data, nil
+	case EncodingGzip:
+		w = gzip.NewWriter(buf)
+	case EncodingZstd:
+		if w, err = zstd.NewWriter(buf); err != nil {
+			return data, err
+		}
+	default:
+		return data, fmt.Errorf("content encoding %s not supported", contentEncoding)
+	}
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return data, err
+	}
+	if err := w.Close(); err != nil {
+		return data, err
+	}
+	data.Data = buf.Bytes()
+	return data, nil
+}
+
+// decodeReport returns the report in the data.
+func decodeReport(data proto.Data) (qp.Report, error) {
+	var report qp.Report
+
+	b, err := decompress(data.Data, data.ContentEncoding)
+	if err != nil {
+		return report, fmt.Errorf("decompress(%s): %s", data.ContentEncoding, err)
+	}
+
+	// Deserialize QAN report based on ProtocolVersion
+	switch data.ProtocolVersion {
+	case ProtocolVersion1:
+		if err := json.Unmarshal(b, &report); err != nil {
+			return report, fmt.Errorf("json.Unmarshal(report): %s", err)
+		}
+	case ProtocolVersion2:
+		switch data.ContentType {
+		case ContentTypeMsgpack, "":
+			if err := unmarshalMsgpack(b, &report); err != nil {
+				return report, fmt.Errorf("msgpack.Unmarshal(report): %s", err)
+			}
+		case ContentTypeJSON:
+			if err := json.Unmarshal(b, &report); err != nil {
+				return report, fmt.Errorf("json.Unmarshal(report): %s", err)
+			}
+		default:
+			return report, fmt.Errorf("content type %s not supported", data.ContentType)
+		}
+	default:
+		return report, fmt.Errorf("protocol version %s not supported", data.ProtocolVersion)
+	}
+
+	return report, nil
+}
+
+// decompress is like proto.Data.GetData but supports zstd, and returns an
+// error instead of truncating data larger than maxDecodedSize.
+func decompress(b []byte, contentEncoding string) ([]byte, error) {
+	var r io.Reader
+	switch contentEncoding {
+	case "":
+		return b, nil
+	case EncodingGzip:
+		g, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer g.Close()
+		r = g
+	case EncodingZstd:
+		z, err := zstd.NewReader(bytes.NewReader(b), zstd.WithDecoderMaxMemory(maxDecodedSize))
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		r = z
+	default:
+		return nil, fmt.Errorf("content encoding %s not supported", contentEncoding)
+	}
+	decoded, err := ioutil.ReadAll(io.LimitReader(r, maxDecodedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > maxDecodedSize {
+		return nil, fmt.Errorf("decompressed data larger than %d bytes", maxDecodedSize)
+	}
+	return decoded, nil
+}
+
+// The MessagePack encoding uses the json struct tags of qp.Report so the
+// fields that are not sent as JSON, e.g. TimeStats.Vals, are not sent either.
+
+func marshalMsgpack(report qp.Report) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+	if err := enc.Encode(report); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshalMsgpack(b []byte, report *qp.Report) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(report); err != nil {
+		return err
+	}
+
+	// MessagePack timestamps have no time zone, and are decoded as local
+	// times. Report times are UTC.
+	report.StartTs = report.StartTs.UTC()
+	report.EndTs = report.EndTs.UTC()
+	classes := report.Class
+	if report.Global != nil {
+		classes = append([]*qp.Class{report.Global}, classes...)
+	}
+	for _, c := range classes {
+		c.StartAt = c.StartAt.UTC()
+		c.EndAt = c.EndAt.UTC()
+		for i := range c.UserSources {
+			c.UserSources[i].Ts = c.UserSources[i].Ts.UTC()
+		}
+	}
+	return nil
+}
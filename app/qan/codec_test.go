@@ -0,0 +1,135 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/shatteredsilicon/qan-api/app/qan"
+	"github.com/shatteredsilicon/qan-api/config"
+	"github.com/shatteredsilicon/ssm/proto"
+	qp "github.com/shatteredsilicon/ssm/proto/qan"
+	. "gopkg.in/check.v1"
+)
+
+type CodecTestSuite struct {
+	files []string
+}
+
+var _ = Suite(&CodecTestSuite{})
+
+func (s *CodecTestSuite) SetUpSuite(t *C) {
+	var err error
+	s.files, err = filepath.Glob(config.ApiRootDir + "/test/qan/*/*_v3.json")
+	t.Assert(err, IsNil)
+	t.Assert(len(s.files) > 0, Equals, true)
+}
+
+func (s *CodecTestSuite) load(t *C, file string) (qp.Report, []byte) {
+	bytes, err := ioutil.ReadFile(file)
+	t.Assert(err, IsNil)
+	report := qp.Report{}
+	err = json.Unmarshal(bytes, &report)
+	t.Assert(err, IsNil, Commentf(file))
+	return report, bytes
+}
+
+// --------------------------------------------------------------------------
+
+func (s *CodecTestSuite) TestRoundTrip(t *C) {
+	contentTypes := []string{qan.ContentTypeMsgpack, qan.ContentTypeJSON}
+	encodings := []string{"", qan.EncodingGzip, qan.EncodingZstd}
+	for _, file := range s.files {
+		expect, _ := s.load(t, file)
+		for _, contentType := range contentTypes {
+			for _, encoding := range encodings {
+				comment := Commentf("%s %s %s", file, contentType, encoding)
+				data, err := qan.EncodeReport(expect, contentType, encoding)
+				t.Assert(err, IsNil, comment)
+				t.Check(data.ProtocolVersion, Equals, qan.ProtocolVersion2)
+
+				// proto.Data is sent as JSON.
+				bytes, err := json.Marshal(data)
+				t.Assert(err, IsNil, comment)
+				data = proto.Data{}
+				err = json.Unmarshal(bytes, &data)
+				t.Assert(err, IsNil, comment)
+
+				got, err := qan.DecodeReport(data)
+				t.Assert(err, IsNil, comment)
+				t.Check(got, DeepEquals, expect, comment)
+			}
+		}
+	}
+}
+
+func (s *CodecTestSuite) TestCompact(t *C) {
+	for _, file := range s.files {
+		report, bytes := s.load(t, file)
+		data, err := qan.EncodeReport(report, qan.ContentTypeMsgpack, "")
+		t.Assert(err, IsNil)
+		t.Check(len(data.Data) < len(bytes), Equals, true, Commentf("%s: msgpack %d bytes, JSON %d bytes", file, len(data.Data), len(bytes)))
+	}
+}
+
+func (s *CodecTestSuite) TestVersion1(t *C) {
+	for _, file := range s.files {
+		expect, bytes := s.load(t, file)
+		data := proto.Data{
+			ProtocolVersion: qan.ProtocolVersion1,
+			ContentType:     qan.ContentTypeJSON,
+			Data:            bytes,
+		}
+		got, err := qan.DecodeReport(data)
+		t.Assert(err, IsNil, Commentf(file))
+		t.Check(got, DeepEquals, expect, Commentf(file))
+
+		// Version 1.0 is always JSON, but it can be compressed.
+		gzipped, err := proto.NewJsonGzipSerializer().ToBytes(expect)
+		t.Assert(err, IsNil)
+		data.ContentEncoding = qan.EncodingGzip
+		data.Data = gzipped
+		got, err = qan.DecodeReport(data)
+		t.Assert(err, IsNil, Commentf(file))
+		t.Check(got, DeepEquals, expect, Commentf(file))
+	}
+}
+
+func (s *CodecTestSuite) TestErrors(t *C) {
+	report, _ := s.load(t, s.files[0])
+
+	data, err := qan.EncodeReport(report, qan.ContentTypeMsgpack, qan.EncodingZstd)
+	t.Assert(err, IsNil)
+	data.ProtocolVersion = "3.0"
+	_, err = qan.DecodeReport(data)
+	t.Check(err, ErrorMatches, "protocol version 3.0 not supported")
+
+	data.ProtocolVersion = qan.ProtocolVersion2
+	data.ContentEncoding = "br"
+	_, err = qan.DecodeReport(data)
+	t.Check(err, ErrorMatches, ".*content encoding br not supported")
+
+	data.ContentEncoding = qan.EncodingGzip // but it's zstd
+	_, err = qan.DecodeReport(data)
+	t.Check(err, NotNil)
+
+	_, err = qan.EncodeReport(report, "application/xml", "")
+	t.Check(err, ErrorMatches, "content type application/xml not supported")
+}
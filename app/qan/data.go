@@ -25,36 +25,23 @@ import (
 	"time"
 
 	"github.com/shatteredsilicon/qan-api/app/instance"
-	"github.com/shatteredsilicon/qan-api/app/shared"
 	"github.com/shatteredsilicon/qan-api/app/ws"
 	"github.com/shatteredsilicon/qan-api/stats"
 	"github.com/shatteredsilicon/ssm/proto"
-	qp "github.com/shatteredsilicon/ssm/proto/qan"
 )
 
-const (
-	MAX_DATA_MSG  = 100
-	THROTTLE_CODE = 299
-)
-
-func SaveData(wsConn ws.Connector, agentId uint, dbh *MySQLMetricWriter, stats *stats.Stats) error {
+// SaveData receives reports from the agent and adds them to the queue. A
+// report is acked once it's spooled, not when it's written to MySQL. If the
+// queue is full, it returns ErrQueueFull without acking the report.
+func SaveData(wsConn ws.Connector, agentId uint, ih instance.DbHandler, q *Queue, stats *stats.Stats) error {
 	prefix := fmt.Sprintf("[qan.SaveData] agent_id=%d", agentId)
 
-	// get all existing instances
-	instances, err := dbh.ih.GetAll(false)
+	existMap, err := dataInstances(ih)
 	if err != nil {
 		return err
 	}
 
-	existMap := make(map[string]struct{})
-	for i := range instances {
-		if instances[i].Subsystem != instance.SubsystemNameMySQL && instances[i].Subsystem != instance.SubsystemNameMongo {
-			continue
-		}
-		existMap[instances[i].UUID] = struct{}{}
-	}
-
-	nMsgs := 0
+	chunks := newAssembler(ChunkTimeout, MaxChunkedSize)
 	for {
 		// Agent send proto.Data as []byte.
 		bytes, err := wsConn.RecvBytes(20)
@@ -71,110 +58,118 @@ func SaveData(wsConn ws.Connector, agentId uint, dbh *MySQLMetricWriter, stats *
 		// Decode bytes back to proto.Data so we can determine which
 		// type of data this is. proto.Data is backwards compatible with proto.Data
 
-		tDecode := time.Now()
-		data, report, err := decode(bytes)
-		stats.TimingDuration(stats.System("decode"), time.Now().Sub(tDecode), stats.SampleRate)
-		if err != nil {
+		var msg dataMsg
+		if err := json.Unmarshal(bytes, &msg); err != nil {
 			stats.SetComponent("bad-data.msg")
 			stats.Inc(stats.System("bytes"), nBytes, stats.SampleRate)
 			stats.Inc(stats.System("in"), 1, stats.SampleRate)
-
-			// Agent removes file from its spool on code >= 400.
-			resp := proto.Response{
-				Code:  400,
-				Error: err.Error(),
-			}
-			if err := wsConn.Send(resp, 5); err != nil {
-				return fmt.Errorf("ww.Send: %s", err)
+			if err := reply(wsConn, 400, fmt.Errorf("json.Unmarshal(data): %s", err)); err != nil {
+				return err
 			}
 			continue // next report
 		}
 
-		stats.SetComponent(data.Service + ".msg")
+		stats.SetComponent(msg.Service + ".msg")
 		stats.Inc(stats.System("bytes"), nBytes, stats.SampleRate)
 		stats.Inc(stats.System("in"), 1, stats.SampleRate)
 
-		if len(data.Data) > proto.MAX_DATA_SIZE {
-			stats.Inc(stats.System("too-large"), 1, stats.SampleRate)
-			log.Printf("WARN: %s: %s msg too large, dropping: %d > %d\n", prefix, data.Service, len(data.Data), proto.MAX_DATA_SIZE)
-			continue // next report
-		}
-
-		// check if instance exists first
-		if _, ok := existMap[report.UUID]; ok {
-			// Queue the data in a per-service queue.
-			tDb := time.Now()
-			err = dbh.Write(report)
-			stats.TimingDuration(stats.System("db"), time.Now().Sub(tDb), stats.SampleRate)
+		data := &msg.Data
+		if msg.Chunk != nil {
+			// Part of a report larger than proto.MAX_DATA_SIZE.
+			stats.Inc(stats.System("parts"), 1, stats.SampleRate)
+			data, err = chunks.add(msg, time.Now())
 			if err != nil {
-				if shared.IsNetworkError(err) {
-					// This is usually due to losing connection to MySQL. Return an error
-					// so the caller will restart the consumer.
-					return fmt.Errorf("dbh.Write: %s", err)
-				} else if err == shared.ErrReadOnlyDb {
-					return fmt.Errorf("dbh.Write: %s", err)
-				} else {
-					// This is usually duplicate key errors, stuff we can't recover
-					// from, so we just have to drop the data and move on. If it happens
-					// a lot for many orgs, then maybe there's a real db problem, but
-					// usually it's very random.
-					log.Printf("WARN: %s: dbh.Write: %s", prefix, err)
-					stats.Inc(stats.System("err-db"), 1, stats.SampleRate)
-					stats.Inc(stats.Agent("err-db"), 1, stats.SampleRate)
-					return nil
+				stats.Inc(stats.System("bad-parts"), 1, stats.SampleRate)
+				log.Printf("WARN: %s: %s", prefix, err)
+				if err := reply(wsConn, chunkErrorCode(err), err); err != nil {
+					return err
 				}
+				continue // next report
 			}
+			if data == nil {
+				if err := reply(wsConn, CodePartOK, nil); err != nil {
+					return err
+				}
+				continue // next part
+			}
+		} else if len(data.Data) > proto.MAX_DATA_SIZE {
+			// The agent should send the report in parts, see Chunk.
+			stats.Inc(stats.System("too-large"), 1, stats.SampleRate)
+			log.Printf("WARN: %s: %s msg too large: %d > %d\n", prefix, data.Service, len(data.Data), proto.MAX_DATA_SIZE)
+			err := fmt.Errorf("report too large: %d > %d bytes, send it in parts", len(data.Data), proto.MAX_DATA_SIZE)
+			if err := reply(wsConn, CodeTooLarge, err); err != nil {
+				return err
+			}
+			continue // next report
 		}
 
-		resp := proto.Response{Code: 200}
+		tDecode := time.Now()
+		report, err := decodeReport(*data)
+		stats.TimingDuration(stats.System("decode"), time.Now().Sub(tDecode), stats.SampleRate)
+		if err != nil {
+			// Errors here are not critical, we can log a warning and move on
+			// because there's nothing else we can do about bad data. Usually
+			// these errors are random and one-off, but if they become frequent
+			// then maybe there's a system bug.
+			stats.Inc(stats.System("bad-data"), 1, stats.SampleRate)
 
-		// Don't let agent send too much data at once.
-		nMsgs++
-		if nMsgs >= MAX_DATA_MSG {
-			resp.Code = THROTTLE_CODE
+			// Agent removes file from its spool on code >= 400.
+			if err := reply(wsConn, 400, err); err != nil {
+				return err
+			}
+			continue // next report
 		}
 
-		// Ack the data msg to the agent so it will remove it from its spool.
-		if err := wsConn.Send(resp, 5); err != nil {
-			return fmt.Errorf("wsConn.Send: %s", err)
+		// Reports of unknown instances are acked and dropped.
+		if _, ok := existMap[report.UUID]; ok {
+			// Spool the report, a queue worker writes it to MySQL.
+			tQueue := time.Now()
+			err = q.Add(report)
+			stats.TimingDuration(stats.System("queue"), time.Now().Sub(tQueue), stats.SampleRate)
+			if err == ErrQueueFull {
+				// Don't ack the report so the agent keeps it in its spool and
+				// sends it again on its next upload, after the queue drains.
+				stats.Inc(stats.System("queue-full"), 1, stats.SampleRate)
+				log.Printf("WARN: %s: QAN data queue is full: %d reports, disconnecting agent."+
+					" Check MySQL and the qan.queue stats.", prefix, q.Depth())
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("q.Add: %s", err)
+			}
 		}
 
-		if resp.Code == THROTTLE_CODE {
-			log.Printf("%s: WARN: throttling agent because it has sent the max number of messages for one upload: %d."+
-				" Check the agent's status to see its data spool size.", prefix, MAX_DATA_MSG)
-			return nil
+		// Ack the data msg to the agent so it will remove it from its spool.
+		if err := reply(wsConn, 200, nil); err != nil {
+			return err
 		}
 	}
-
 }
 
-func decode(bytes []byte) (proto.Data, qp.Report, error) {
-	var data proto.Data
-	var report qp.Report
-
-	// Errors in this func are not critical, we can log a warning and move on
-	// because there's nothing else we can do about bad data. Usually these
-	// errors are random and one-off, but if they become frequent then maybe
-	// there's a system bug.
-
-	if err := json.Unmarshal(bytes, &data); err != nil {
-		return data, report, fmt.Errorf("json.Unmarshal(data): %s", err)
-	}
-
-	reportBytes, err := data.GetData()
+// dataInstances returns the UUIDs of the instances that have QAN data.
+func dataInstances(ih instance.DbHandler) (map[string]struct{}, error) {
+	instances, err := ih.GetAll(false)
 	if err != nil {
-		return data, report, fmt.Errorf("data.GetData: %s", err)
+		return nil, err
 	}
-
-	// Deserialize QAN report based on ProtocolVersion
-	switch data.ProtocolVersion {
-	case "1.0":
-		if err := json.Unmarshal(reportBytes, &report); err != nil {
-			return data, report, fmt.Errorf("json.Unmarshal(report): %s", err)
+	existMap := make(map[string]struct{})
+	for i := range instances {
+		if !instance.HasQueryClasses(instances[i].Subsystem) {
+			continue
 		}
-	default:
-		return data, report, fmt.Errorf("protocol version %s not supported", data.ProtocolVersion)
+		existMap[instances[i].UUID] = struct{}{}
 	}
+	return existMap, nil
+}
 
-	return data, report, nil
+// reply sends the response to a data msg.
+func reply(wsConn ws.Connector, code uint, err error) error {
+	resp := proto.Response{Code: code}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if err := wsConn.Send(resp, 5); err != nil {
+		return fmt.Errorf("wsConn.Send: %s", err)
+	}
+	return nil
 }
@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"os"
 	"time"
 
 	"github.com/shatteredsilicon/qan-api/app/db"
@@ -40,6 +41,9 @@ import (
 
 type DataTestSuite struct {
 	dbh           *qan.MySQLMetricWriter
+	ih            instance.DbHandler
+	spoolDir      string
+	queue         *qan.Queue
 	db            *sql.DB
 	testDb        *testDb.Db
 	mini          *query.Mini
@@ -62,10 +66,10 @@ func (s *DataTestSuite) SetUpSuite(t *C) {
 	go s.mini.Run()
 
 	// Create instance handler
-	ih := instance.NewMySQLHandler(db.DBManager)
+	s.ih = instance.NewMySQLHandler(db.DBManager)
 
 	// Make real dbh.
-	s.dbh = qan.NewMySQLMetricWriter(db.DBManager, ih, s.mini, stats.NullStats())
+	s.dbh = qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.mini, stats.NullStats())
 
 	// Make aux MySQL connection.
 	s.db, err = sql.Open("mysql", dsn)
@@ -81,6 +85,28 @@ func (s *DataTestSuite) SetUpSuite(t *C) {
 
 func (s *DataTestSuite) SetUpTest(t *C) {
 	s.testDb.TruncateDataTables()
+
+	var err error
+	s.spoolDir, err = ioutil.TempDir("", "qan-spool")
+	t.Assert(err, IsNil)
+	cfg := qan.QueueConfig{
+		Depth:    10,
+		Workers:  1,
+		SpoolDir: s.spoolDir,
+		Retry:    100 * time.Millisecond,
+	}
+	s.queue = qan.NewQueue(cfg, func() qan.MetricWriter { return s.dbh }, stats.NullStats())
+	err = s.queue.Start()
+	t.Assert(err, IsNil)
+}
+
+func (s *DataTestSuite) TearDownTest(t *C) {
+	s.queue.Stop()
+	os.RemoveAll(s.spoolDir)
+}
+
+func (s *DataTestSuite) TearDownSuite(t *C) {
+	s.dbh.Close()
 }
 
 // --------------------------------------------------------------------------
@@ -110,7 +136,7 @@ func (s *DataTestSuite) TestSaveData(t *C) {
 	// Call SaveData which will wait on wsConn.RecvBytes().
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- qan.SaveData(s.wsConn, 2, s.dbh, stats.NullStats())
+		errChan <- qan.SaveData(s.wsConn, 2, s.ih, s.queue, stats.NullStats())
 	}()
 
 	// Send data, wait for a response.
@@ -128,6 +154,12 @@ func (s *DataTestSuite) TestSaveData(t *C) {
 	err = <-errChan
 	t.Check(err, Equals, io.EOF)
 
+	// The report was acked once spooled, wait for the worker to write it.
+	for i := 0; i < 50 && s.queue.Depth() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Assert(s.queue.Depth(), Equals, 0)
+
 	if diff := test.TableDiff(s.testDb.DB(), "query_class_metrics", "query_class_id,instance_id", config.TestDir+"/qan/002/qcm.tab"); diff != "" {
 		t.Error(diff)
 	}
@@ -0,0 +1,43 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"time"
+
+	"github.com/shatteredsilicon/ssm/proto"
+)
+
+var DecodeReport = decodeReport
+
+type DataMsg = dataMsg
+
+type Assembler = assembler
+
+var NewAssembler = newAssembler
+
+var ChunkErrorCode = chunkErrorCode
+
+// AddPart is assembler.add that also returns the response code of the error.
+func (a *Assembler) AddPart(msg DataMsg, now time.Time) (*proto.Data, uint, error) {
+	data, err := a.add(msg, now)
+	if err != nil {
+		return nil, chunkErrorCode(err), err
+	}
+	return data, 0, nil
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/shatteredsilicon/qan-api/app/instance"
+	"github.com/shatteredsilicon/ssm/proto"
+)
+
+// ErrInvalidBody is returned by WriteReports if the body can't be read.
+var ErrInvalidBody = errors.New("invalid body")
+
+// Status of a ReportResult.
+const (
+	ReportWritten   = "written"
+	ReportDuplicate = "duplicate" // already written, see Ledger
+	ReportError     = "error"     // not written, see Error
+)
+
+// ReportResult is the result of a report posted to POST /qan/reports.
+type ReportResult struct {
+	Line        uint   // of the report in the body, from 1
+	UUID        string `json:",omitempty"` // of the instance
+	Fingerprint string `json:",omitempty"` // see ReportFingerprint
+	Status      string
+	Error       string `json:",omitempty"`
+}
+
+// WriteReports writes the reports in body, one JSON qp.Report per line, in
+// order, and returns the result of each. body is compressed with
+// contentEncoding, if not empty. A report that can't be decoded or written
+// is skipped, but if MySQL is unavailable or a line can't be read,
+// WriteReports stops and returns the results so far, the last one being
+// the error, and the error. The reports can be posted again: reports
+// already written are duplicates.
+func WriteReports(body []byte, contentEncoding string, ih instance.DbHandler, h *MySQLMetricWriter) ([]ReportResult, error) {
+	b, err := decompress(body, contentEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decompress(%s): %s", ErrInvalidBody, contentEncoding, err)
+	}
+
+	existMap, err := dataInstances(ih)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ReportResult{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(nil, maxDecodedSize)
+	line := uint(0)
+	for s.Scan() {
+		line++
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		res := ReportResult{Line: line}
+		err := h.writeReport(&res, s.Bytes(), existMap)
+		if err != nil {
+			res.Status = ReportError
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+		if err != nil && retryable(err) {
+			return results, err
+		}
+	}
+	if err := s.Err(); err != nil {
+		err = fmt.Errorf("%w: line %d: %s", ErrInvalidBody, line+1, err)
+		results = append(results, ReportResult{Line: line + 1, Status: ReportError, Error: err.Error()})
+		return results, err
+	}
+	return results, nil
+}
+
+func (h *MySQLMetricWriter) writeReport(res *ReportResult, line []byte, existMap map[string]struct{}) error {
+	// Same as a data protocol 1.0 msg from an agent, see SaveData.
+	report, err := decodeReport(proto.Data{ProtocolVersion: ProtocolVersion1, Data: line})
+	if err != nil {
+		return err
+	}
+	res.UUID = report.UUID
+	if _, ok := existMap[report.UUID]; !ok {
+		return fmt.Errorf("instance not found: %s", report.UUID)
+	}
+	if report.Global == nil {
+		return fmt.Errorf("missing report.Global")
+	}
+
+	res.Fingerprint = ReportFingerprint(report)
+	written, err := h.written(res.Fingerprint)
+	if err != nil {
+		return err
+	}
+	if err := h.Write(report); err != nil {
+		return err
+	}
+	if written {
+		res.Status = ReportDuplicate
+	} else {
+		res.Status = ReportWritten
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+	qp "github.com/shatteredsilicon/ssm/proto/qan"
+)
+
+// errDuplicateReport is returned by write when the report is already in the
+// ledger. Write doesn't return it: a resent report is not an error.
+var errDuplicateReport = errors.New("duplicate report")
+
+// LedgerEntry is a report written to MySQL. Agents resend a report when they
+// don't get its ack, e.g. on network errors, so its metrics are written only
+// once and later copies are counted in Duplicates.
+type LedgerEntry struct {
+	Fingerprint   string
+	InstanceUUID  string
+	StartTs       time.Time
+	EndTs         time.Time
+	StartOffset   int64
+	EndOffset     int64
+	Written       time.Time
+	Duplicates    uint
+	LastDuplicate *time.Time `json:",omitempty"`
+}
+
+// ReportFingerprint returns the SHA1 of the instance UUID, interval and slow
+// log offsets of the report. Other fields can change when the agent resends
+// the report, e.g. RunTime, so they're not part of the fingerprint. The
+// interval is that of reportInterval because old agents don't set StartTs
+// and EndTs, and Performance Schema reports have no offsets.
+func ReportFingerprint(report qp.Report) string {
+	start, end := reportInterval(report)
+	s := fmt.Sprintf("%s|%d|%d|%d|%d",
+		report.UUID,
+		start.UTC().UnixNano(),
+		end.UTC().UnixNano(),
+		report.StartOffset,
+		report.EndOffset,
+	)
+	return fmt.Sprintf("%x", sha1.Sum([]byte(s)))
+}
+
+// reportInterval returns the interval of the report. Old agents only set
+// it in the global metrics.
+func reportInterval(report qp.Report) (time.Time, time.Time) {
+	start, end := report.StartTs, report.EndTs
+	if report.Global == nil {
+		return start, end
+	}
+	if start.IsZero() {
+		start = report.Global.StartAt
+	}
+	if end.IsZero() {
+		end = report.Global.EndAt
+	}
+	return start, end
+}
+
+// written returns true if the report is in the ledger.
+func (h *MySQLMetricWriter) written(fingerprint string) (bool, error) {
+	var n int
+	err := h.dbm.DB().QueryRowContext(h.dbm.Context(),
+		"SELECT 1 FROM query_reports WHERE fingerprint = ?", fingerprint).Scan(&n)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, mysql.Error(err, "Write: SELECT query_reports")
+	}
+	return true, nil
+}
+
+// record adds the report to the ledger in the transaction that writes its
+// metrics, so the report is in the ledger if and only if its metrics are
+// written. If another writer is writing the same report, the INSERT waits
+// for its transaction and returns errDuplicateReport if it commits.
+func (h *MySQLMetricWriter) record(tx *sql.Tx, instanceId uint, report qp.Report, fingerprint string) error {
+	start, end := reportInterval(report)
+	_, err := tx.ExecContext(h.dbm.Context(),
+		"INSERT INTO query_reports"+
+			" (fingerprint, instance_id, start_ts, end_ts, start_offset, end_offset, written)"+
+			" VALUES (?, ?, ?, ?, ?, ?, ?)",
+		fingerprint, instanceId, start, end, report.StartOffset, report.EndOffset, time.Now().UTC())
+	if mysql.ErrorCode(err) == mysql.ER_DUP_ENTRY {
+		return errDuplicateReport
+	}
+	return mysql.Error(err, "Write: INSERT query_reports")
+}
+
+// duplicate counts a resent report in the ledger.
+func (h *MySQLMetricWriter) duplicate(fingerprint string) error {
+	_, err := h.dbm.DB().ExecContext(h.dbm.Context(),
+		"UPDATE query_reports SET duplicates = duplicates + 1, last_duplicate = ? WHERE fingerprint = ?",
+		time.Now().UTC(), fingerprint)
+	return mysql.Error(err, "Write: UPDATE query_reports")
+}
+
+// Ledger returns the reports of the instances with an interval starting in
+// [begin, end), the latest first, at most limit.
+func Ledger(dbm db.Manager, instanceIds []uint, begin, end time.Time, limit uint) ([]LedgerEntry, error) {
+	if len(instanceIds) == 0 {
+		return []LedgerEntry{}, nil
+	}
+	in := shared.Placeholders(len(instanceIds))
+	args := make([]interface{}, 0, len(instanceIds)+3)
+	for _, id := range instanceIds {
+		args = append(args, id)
+	}
+	args = append(args, begin, end, limit)
+	rows, err := dbm.DB().QueryContext(dbm.Context(),
+		"SELECT r.fingerprint, i.uuid, r.start_ts, r.end_ts, r.start_offset, r.end_offset, r.written, r.duplicates, r.last_duplicate"+
+			" FROM query_reports r JOIN instances i USING (instance_id)"+
+			" WHERE r.instance_id IN ("+in+") AND r.start_ts >= ? AND r.start_ts < ?"+
+			" ORDER BY r.start_ts DESC, r.fingerprint"+
+			" LIMIT ?",
+		args...)
+	if err != nil {
+		return nil, mysql.Error(err, "Ledger: SELECT query_reports")
+	}
+	defer rows.Close()
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		e := LedgerEntry{}
+		var lastDuplicate sql.NullTime
+		err := rows.Scan(&e.Fingerprint, &e.InstanceUUID, &e.StartTs, &e.EndTs, &e.StartOffset, &e.EndOffset,
+			&e.Written, &e.Duplicates, &lastDuplicate)
+		if err != nil {
+			return nil, mysql.Error(err, "Ledger: rows.Scan")
+		}
+		if lastDuplicate.Valid {
+			e.LastDuplicate = &lastDuplicate.Time
+		}
+		entries = append(entries, e)
+	}
+	return entries, mysql.Error(rows.Err(), "Ledger: rows.Next")
+}
@@ -21,14 +21,18 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/shatteredsilicon/qan-api/app/db"
 	"github.com/shatteredsilicon/qan-api/app/db/mysql"
 	"github.com/shatteredsilicon/qan-api/app/instance"
+	appMetrics "github.com/shatteredsilicon/qan-api/app/metrics"
 	"github.com/shatteredsilicon/qan-api/app/shared"
+	"github.com/shatteredsilicon/qan-api/app/sketch"
 	"github.com/shatteredsilicon/qan-api/service/query"
 	"github.com/shatteredsilicon/qan-api/stats"
 	"github.com/shatteredsilicon/ssm/proto/metrics"
@@ -39,23 +43,29 @@ import (
 const (
 	MAX_ABSTRACT    = 100  // query_classes.abstract
 	MAX_FINGERPRINT = 5000 // query_classes.fingerprint
+	MAX_USER        = 80   // user_classes.user
+	MAX_HOST        = 60   // user_classes.host
 )
 
+const (
+	maxBatchRows       = 100   // rows per multi-row statement, less if they have many columns
+	maxPlaceholders    = 65535 // per statement, a MySQL limit
+	maxDeadlockRetries = 3     // of a report deadlocked with another agent's
+)
+
+// MySQLMetricWriter writes QAN reports. A report is written in one
+// transaction with multi-row statements, so an agent with thousands of
+// query classes per interval needs a few round trips, not a few per class.
+// The statements used for every report are prepared once and cached until
+// Close.
 type MySQLMetricWriter struct {
 	dbm   db.Manager
 	ih    instance.DbHandler
 	m     *query.Mini
 	stats *stats.Stats
 	// --
-	stmtSelectClassId             *sql.Stmt
-	stmtInsertGlobalMetrics       *sql.Stmt
-	stmtInsertClassMetrics        *sql.Stmt
-	stmtInsertQueryExample        *sql.Stmt
-	stmtInsertQueryUserSource     *sql.Stmt
-	stmtInsertUserClass           *sql.Stmt
-	stmtInsertQueryClass          *sql.Stmt
-	stmtUpdateQueryClass          *sql.Stmt
-	stmtUpdateQueryClassWithoutTP *sql.Stmt
+	mux   *sync.Mutex
+	stmts map[string]*sql.Stmt // keyed on SQL
 }
 
 func NewMySQLMetricWriter(
@@ -69,16 +79,28 @@ func NewMySQLMetricWriter(
 		ih:    ih,
 		m:     m,
 		stats: stats,
+		mux:   &sync.Mutex{},
+		stmts: map[string]*sql.Stmt{},
 	}
 	return h
 }
 
-func (h *MySQLMetricWriter) Write(report qp.Report) error {
-	var err error
+// classRow is a query class of a report and what to write for it.
+type classRow struct {
+	class       *qp.Class
+	id          uint // query_class_id, 0 if new
+	lastSeen    string
+	abstract    string
+	fingerprint string
+	tables      interface{} // JSON, nil to keep the current tables
+	procedures  interface{} // JSON, nil to keep the current procedures
+	newExample  bool        // example has a greater Query_time than the current one
+}
 
+func (h *MySQLMetricWriter) Write(report qp.Report) error {
 	instanceId, in, err := h.ih.Get(report.UUID)
 	if err != nil {
-		return fmt.Errorf("cannot get instance of %s: %s", report.UUID, err)
+		return fmt.Errorf("cannot get instance of %s: %w", report.UUID, err)
 	}
 
 	if report.Global == nil {
@@ -89,55 +111,59 @@ func (h *MySQLMetricWriter) Write(report qp.Report) error {
 		return fmt.Errorf("missing report.Global.Metrics")
 	}
 
-	trace := fmt.Sprintf("MySQL %s", report.UUID)
-
-	h.prepareStatements()
-	defer h.closeStatements()
-
-	// Default last_seen if no example query ts.
-	var reportStartTs string
-	if !report.StartTs.IsZero() {
-		reportStartTs = report.StartTs.Format(shared.MYSQL_DATETIME_LAYOUT)
+	subsystem, err := instance.Lookup(in.Subsystem)
+	if err != nil {
+		return fmt.Errorf("cannot get subsystem %s of %s: %w", in.Subsystem, report.UUID, err)
 	}
+	metricAliases(subsystem, report)
+
+	trace := fmt.Sprintf("MySQL %s", report.UUID)
 
 	// Internal metrics
 	h.stats.SetComponent("db")
-	t := time.Now()
 
-	handleClass := func(id uint, class *qp.Class, lastSeen string) (uint, int64, int64, error) {
-		if id == 0 {
-			// New class, create it.
-			id, err = h.newClass(instanceId, in.Subsystem, class, lastSeen)
-			if err != nil {
-				log.Printf("WARNING: cannot create new query class, skipping: %s: %#v: %s", err, class, trace)
-				return 0, 0, 0, err
-			}
-		}
+	// Agents resend reports they didn't get an ack for. Don't add their
+	// metrics again, see record.
+	fingerprint := ReportFingerprint(report)
+	written, err := h.written(fingerprint)
+	if err != nil {
+		return err
+	}
+	if written {
+		return h.resent(fingerprint, trace)
+	}
 
-		// Update query example if this example has a greater Query_time.
-		// The "!= nil" is for agent >= v1.0.11 which use *event.Class.Example,
-		// but agent <= v1.0.10 don't use a pointer so the struct is always
-		// present, so "class.Example.Query != """ filters out empty examples.
-		var lastExampleId, exampleRowsAffected int64
-		if class.Example != nil && class.Example.Query != "" {
-			if lastExampleId, exampleRowsAffected, err = h.updateQueryExample(instanceId, class, id, lastSeen); err != nil {
-				log.Printf("WARNING: cannot update query example: %s: %#v: %s", err, class, trace)
-			}
-		}
+	// Resolve the classes and parse their queries before the transaction
+	// to keep it short.
+	classes, err := h.classRows(instanceId, subsystem, report, trace)
+	if err != nil {
+		return err
+	}
 
-		for i := range class.UserSources {
-			if err := h.insertUserSource(id, instanceId, class.UserSources[i]); err != nil {
-				log.Printf("WARNING: cannot insert query user source: %s: %#v", err, class.UserSources[i])
-			}
+	for try := 1; ; try++ {
+		err = h.write(instanceId, report, fingerprint, classes, trace)
+		if err == errDuplicateReport {
+			return h.resent(fingerprint, trace)
+		}
+		if mysql.ErrorCode(err) != mysql.ER_LOCK_DEADLOCK || try > maxDeadlockRetries {
+			return err
 		}
+		log.Printf("WARNING: deadlock writing report, retrying: %s", trace)
+	}
+}
 
-		return id, lastExampleId, exampleRowsAffected, nil
+// classRows returns the classes of the report to write, sorted on checksum
+// so concurrent reports lock query classes in the same order. Classes whose
+// query can't be parsed are skipped.
+func (h *MySQLMetricWriter) classRows(instanceId uint, subsystem instance.Subsystem, report qp.Report, trace string) ([]*classRow, error) {
+	// Default last_seen if no example query ts.
+	var reportStartTs string
+	if !report.StartTs.IsZero() {
+		reportStartTs = report.StartTs.Format(shared.MYSQL_DATETIME_LAYOUT)
 	}
 
-	// //////////////////////////////////////////////////////////////////////
-	// Insert class metrics into query_class_metrics
-	// //////////////////////////////////////////////////////////////////////
-	classDupes := 0
+	classes := make([]*classRow, 0, len(report.Class))
+	checksums := make([]string, 0, len(report.Class))
 	for _, class := range report.Class {
 		lastSeen := ""
 		if class.Example != nil {
@@ -150,108 +176,223 @@ func (h *MySQLMetricWriter) Write(report qp.Report) error {
 				lastSeen = class.StartAt.Format(shared.MYSQL_DATETIME_LAYOUT)
 			}
 		}
+		classes = append(classes, &classRow{class: class, lastSeen: lastSeen})
+		checksums = append(checksums, class.Id)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		return classes[i].class.Id < classes[j].class.Id
+	})
 
-		id, err := h.getClassId(class.Id)
-		if err != nil && err != sql.ErrNoRows {
-			log.Printf("WARNING: cannot get query class ID, skipping: %s: %#v: %s", err, class, trace)
-			continue
-		}
+	t := time.Now()
+	ids, err := h.classIds(nil, checksums)
+	h.stats.TimingDuration(h.stats.System("select-class-ids"), time.Now().Sub(t), h.stats.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range classes {
+		c.id = ids[c.class.Id]
+	}
 
-		classExists := id != 0
-		var lastExampleId, exampleRowsAffected int64
+	t = time.Now()
+	exampleTimes, err := h.exampleTimes(instanceId, classes)
+	h.stats.TimingDuration(h.stats.System("select-query-examples"), time.Now().Sub(t), h.stats.SampleRate)
+	if err != nil {
+		return nil, err
+	}
 
-		id, lastExampleId, exampleRowsAffected, err = handleClass(id, class, lastSeen)
-		if err != nil {
-			continue
+	valid := classes[:0]
+	for _, c := range classes {
+		// The "!= nil" is for agent >= v1.0.11 which use *event.Class.Example,
+		// but agent <= v1.0.10 don't use a pointer so the struct is always
+		// present, so "class.Example.Query != """ filters out empty examples.
+		if c.class.Example != nil && c.class.Example.Query != "" {
+			cur, ok := exampleTimes[exampleKey{c.id, period(c.lastSeen)}]
+			c.newExample = !ok || float32(c.class.Example.QueryTime) > cur
 		}
+		if c.id == 0 {
+			if err := h.newClass(subsystem, c); err != nil {
+				log.Printf("WARNING: cannot create new query class, skipping: %s: %#v: %s", err, c.class, trace)
+				continue
+			}
+		} else {
+			h.existingClass(subsystem, c)
+		}
+		valid = append(valid, c)
+	}
+	return valid, nil
+}
 
-		if classExists {
-			// Existing class, update it.  These update aren't fatal, but they shouldn't fail.
-			var q query.QueryInfo
-			var err error
+// newClass sets the abstract, fingerprint, tables and procedures of a new
+// query class.
+func (h *MySQLMetricWriter) newClass(subsystem instance.Subsystem, c *classRow) error {
+	t := time.Now()
+	query, err := h.getQuery(subsystem, c.class)
+	if err != nil {
+		return err
+	}
+	c.tables, c.procedures = query.TableJSON(), query.ProcedureJSON()
 
-			// Parse the tables/procedures only if the query example gets updated,
-			// so the tables/procedures column in query_classes table are in sync
-			// with the db/query column in query_examples table
-			if in.Subsystem == instance.SubsystemNameMySQL && (lastExampleId > 0 || exampleRowsAffected > 0) {
-				q, err = h.getQuery(class)
-				if err != nil {
-					log.Printf("WARNING: cannot parse query to update: %s", err)
-				}
-			}
+	h.stats.TimingDuration(h.stats.System("abstract-fingerprint"), time.Now().Sub(t), h.stats.SampleRate)
 
-			// Update the table/procedures column only if query example gets updated
-			if lastExampleId > 0 || exampleRowsAffected > 0 {
-				err = h.updateQueryClass(id, lastSeen, q.TableJSON(), q.ProcedureJSON())
-			} else {
-				err = h.updateQueryClassWithoutTP(id, lastSeen)
-			}
+	// Truncate long fingerprints and abstracts to avoid MySQL warning 1265:
+	// Data truncated for column 'abstract'
+	c.abstract = truncate(query.Abstract, MAX_ABSTRACT)
+	c.fingerprint = truncate(query.Fingerprint, MAX_FINGERPRINT)
+	return nil
+}
 
-			// it existed previously but non-exist now, could be just deleted
-			// by another process (most likely the auto-purge process), we re-create
-			// it in this case
-			if err == shared.ErrNotFound {
-				id, _, _, err = handleClass(0, class, lastSeen)
-				if err != nil {
-					continue
-				}
-			} else if err != nil {
-				log.Printf("WARNING: cannot update query class, skipping: %s: %#v: %s", err, class, trace)
-				continue
+// existingClass sets the tables and procedures of an existing query class
+// if its example is replaced, so they stay in sync with the db and query of
+// the example. The abstract and fingerprint are only used if the class was
+// purged since it was resolved; parsing the query again isn't worth it.
+func (h *MySQLMetricWriter) existingClass(subsystem instance.Subsystem, c *classRow) {
+	c.abstract = truncate(c.class.Fingerprint, MAX_ABSTRACT)
+	c.fingerprint = truncate(c.class.Fingerprint, MAX_FINGERPRINT)
+	if !c.newExample {
+		return
+	}
+	q, err := h.getQuery(subsystem, c.class)
+	if err != nil {
+		log.Printf("WARNING: cannot parse query to update: %s", err)
+		return
+	}
+	c.tables, c.procedures = q.TableJSON(), q.ProcedureJSON()
+}
+
+// write writes the report in one transaction.
+func (h *MySQLMetricWriter) write(instanceId uint, report qp.Report, fingerprint string, classes []*classRow, trace string) error {
+	tx, err := h.dbm.DB().BeginTx(h.dbm.Context(), nil)
+	if err != nil {
+		return mysql.Error(err, "Write: Begin")
+	}
+	defer tx.Rollback()
+
+	if err := h.record(tx, instanceId, report, fingerprint); err != nil {
+		return err
+	}
+
+	// //////////////////////////////////////////////////////////////////////
+	// Insert new query classes and update existing ones in query_classes
+	// //////////////////////////////////////////////////////////////////////
+
+	// Existing classes are inserted with their query_class_id, so they are
+	// updated, or re-created with the same ID if they were just purged.
+	t := time.Now()
+	classVals := make([][]interface{}, len(classes))
+	newChecksums := []string{}
+	for i, c := range classes {
+		var id interface{} // NULL = AUTO_INCREMENT
+		if c.id != 0 {
+			id = c.id
+		} else {
+			newChecksums = append(newChecksums, c.class.Id)
+		}
+		classVals[i] = []interface{}{id, c.class.Id, c.abstract, c.fingerprint, c.tables, c.procedures, c.lastSeen, c.lastSeen}
+	}
+	if err := h.execRows(tx, insertQueryClasses, queryClassesRow, updateQueryClasses, classVals); err != nil {
+		return mysql.Error(err, "Write: INSERT query_classes")
+	}
+	newIds, err := h.classIds(tx, newChecksums)
+	if err != nil {
+		return err
+	}
+	ids := make([]uint, len(classes))
+	for i, c := range classes {
+		if ids[i] = c.id; ids[i] == 0 {
+			ids[i] = newIds[c.class.Id]
+		}
+	}
+	h.stats.TimingDuration(h.stats.System("insert-query-classes"), time.Now().Sub(t), h.stats.SampleRate)
+
+	// //////////////////////////////////////////////////////////////////////
+	// Insert query examples with a greater Query_time into query_examples
+	// //////////////////////////////////////////////////////////////////////
+	t = time.Now()
+	exampleVals := [][]interface{}{}
+	for i, c := range classes {
+		if !c.newExample {
+			continue
+		}
+		e := c.class.Example
+		exampleVals = append(exampleVals, []interface{}{instanceId, ids[i], c.lastSeen, c.lastSeen, e.Db, e.QueryTime, e.Query, e.Explain})
+	}
+	if err := h.execRows(tx, insertQueryExamples, queryExamplesRow, updateQueryExamples, exampleVals); err != nil {
+		return mysql.Error(err, "Write: INSERT query_examples")
+	}
+	h.stats.TimingDuration(h.stats.System("insert-query-examples"), time.Now().Sub(t), h.stats.SampleRate)
+
+	// //////////////////////////////////////////////////////////////////////
+	// Insert user sources into user_classes and query_user_sources
+	// //////////////////////////////////////////////////////////////////////
+	t = time.Now()
+	userVals := [][]interface{}{}
+	sourceVals := [][]interface{}{}
+	seen := map[[2]string]bool{}
+	for i, c := range classes {
+		for _, source := range c.class.UserSources {
+			user, host := truncate(source.User, MAX_USER), truncate(source.Host, MAX_HOST)
+			if key := [2]string{user, host}; !seen[key] {
+				seen[key] = true
+				userVals = append(userVals, []interface{}{user, host})
 			}
+			sourceVals = append(sourceVals, []interface{}{ids[i], instanceId, user, host, source.Ts, source.Count})
 		}
+	}
+	sort.Slice(userVals, func(i, j int) bool {
+		return userVals[i][0].(string)+"@"+userVals[i][1].(string) < userVals[j][0].(string)+"@"+userVals[j][1].(string)
+	})
+	if err := h.execRows(tx, "INSERT IGNORE INTO user_classes (user, host)", "(?, ?)", "", userVals); err != nil {
+		return mysql.Error(err, "Write: INSERT user_classes")
+	}
+	if err := h.execRows(tx, insertQueryUserSources, queryUserSourcesRow, updateQueryUserSources, sourceVals); err != nil {
+		return mysql.Error(err, "Write: INSERT query_user_sources")
+	}
+	h.stats.TimingDuration(h.stats.System("insert-user-sources"), time.Now().Sub(t), h.stats.SampleRate)
 
+	// //////////////////////////////////////////////////////////////////////
+	// Insert class metrics into query_class_metrics
+	// //////////////////////////////////////////////////////////////////////
+	t = time.Now()
+	metricVals := make([][]interface{}, len(classes))
+	for i, c := range classes {
 		var classStartTs, classEndTs time.Time
 		if report.StartTs.IsZero() {
-			classStartTs = class.StartAt
+			classStartTs = c.class.StartAt
 		} else {
 			classStartTs = report.StartTs
 		}
 		if report.EndTs.IsZero() {
-			classEndTs = class.EndAt
+			classEndTs = c.class.EndAt
 		} else {
 			classEndTs = report.EndTs
 		}
 
-		vals := h.getMetricValues(class.Metrics)
+		vals := h.getMetricValues(c.class.Metrics)
 		classVals := []interface{}{
-			id,
+			ids[i],
 			instanceId,
 			classStartTs,
 			classEndTs,
-			class.TotalQueries,
+			c.class.TotalQueries,
 			0, // todo: `lrq_count`,
 		}
 		classVals = append(classVals, vals...)
-
-		// INSERT query_class_metrics
-		_, err = h.stmtInsertClassMetrics.Exec(classVals...)
-		if err != nil {
-			if mysql.ErrorCode(err) == mysql.ER_DUP_ENTRY {
-				classDupes++
-				// warn below
-			} else {
-				log.Printf("WARNING: cannot insert query class metrics: %s: %#v: %s", err, class, trace)
-			}
-		}
+		classVals = append(classVals, h.getSketch(c.class.Metrics, c.class.TotalQueries))
+		metricVals[i] = classVals
 	}
-
-	h.stats.TimingDuration(h.stats.System("insert-class-metrics"), time.Now().Sub(t), h.stats.SampleRate)
-
-	if classDupes > 0 {
-		log.Printf("WARNING: %d duplicate query class metrics: start_ts='%s': %s", classDupes, report.StartTs, trace)
+	if err := h.execRows(tx, insertClassMetrics, classMetricsRow, updateClassMetrics, metricVals); err != nil {
+		return mysql.Error(err, "Write: INSERT query_class_metrics")
 	}
+	h.stats.TimingDuration(h.stats.System("insert-class-metrics"), time.Now().Sub(t), h.stats.SampleRate)
 
 	// //////////////////////////////////////////////////////////////////////
 	// Insert global metrics into query_global_metrics.
 	// //////////////////////////////////////////////////////////////////////
 
-	// It's important to do this after class metics to avoid a race condition:
-	// QAN profile looks first at global metrics, then gets corresponding class
-	// metrics. If we insert global metrics first, QAN might might get global
-	// metrics then class metrics before we've inserted the class metrics for
-	// the global metrics. This makes QAN show data for the time range but no
-	// queries.
+	// The class and global metrics become visible together on commit, so
+	// QAN profile, which looks first at global metrics, then gets the
+	// corresponding class metrics, never shows data for the time range but
+	// no queries.
 
 	vals := h.getMetricValues(report.Global.Metrics)
 
@@ -281,17 +422,7 @@ func (h *MySQLMetricWriter) Write(report qp.Report) error {
 		stopOffset = report.StopOffset
 	}
 
-	var globalStartTs, globalEndTs time.Time
-	if report.StartTs.IsZero() {
-		globalStartTs = report.Global.StartAt
-	} else {
-		globalStartTs = report.StartTs
-	}
-	if report.EndTs.IsZero() {
-		globalEndTs = report.Global.EndAt
-	} else {
-		globalEndTs = report.EndTs
-	}
+	globalStartTs, globalEndTs := reportInterval(report)
 
 	globalVals := []interface{}{
 		instanceId,
@@ -310,8 +441,9 @@ func (h *MySQLMetricWriter) Write(report qp.Report) error {
 	}
 
 	globalVals = append(globalVals, vals...)
+	globalVals = append(globalVals, h.getSketch(report.Global.Metrics, report.Global.TotalQueries))
 	t = time.Now()
-	_, err = h.stmtInsertGlobalMetrics.Exec(globalVals...)
+	err = h.execRows(tx, insertGlobalMetrics, globalMetricsRow, updateGlobalMetrics, [][]interface{}{globalVals})
 	h.stats.TimingDuration(h.stats.System("insert-global-metrics"), time.Now().Sub(t), h.stats.SampleRate)
 	if err != nil {
 		if mysql.ErrorCode(err) == mysql.ER_DUP_ENTRY {
@@ -321,75 +453,276 @@ func (h *MySQLMetricWriter) Write(report qp.Report) error {
 		}
 	}
 
-	return nil
+	t = time.Now()
+	err = tx.Commit()
+	h.stats.TimingDuration(h.stats.System("commit"), time.Now().Sub(t), h.stats.SampleRate)
+	return mysql.Error(err, "Write: Commit")
 }
 
-func (h *MySQLMetricWriter) getClassId(checksum string) (uint, error) {
-	var classId uint
-	if err := h.stmtSelectClassId.QueryRow(checksum).Scan(&classId); err != nil {
-		return 0, err
+// resent counts the report in the ledger instead of writing it again.
+func (h *MySQLMetricWriter) resent(fingerprint, trace string) error {
+	log.Printf("INFO: report already written, ignoring: %s: %s", fingerprint, trace)
+	h.stats.Inc(h.stats.System("duplicate-report"), 1, h.stats.SampleRate)
+	return h.duplicate(fingerprint)
+}
+
+// SlowLogOffset returns the greatest end offset of the reports of the slow
+// log file written for the instance, or -1 if there are none. Parsing the
+// file resumes there.
+func (h *MySQLMetricWriter) SlowLogOffset(uuid, slowLogFile string) (int64, error) {
+	instanceId, _, err := h.ih.Get(uuid)
+	if err != nil {
+		return -1, fmt.Errorf("cannot get instance of %s: %w", uuid, err)
+	}
+	var offset sql.NullInt64
+	err = h.dbm.DB().QueryRowContext(h.dbm.Context(),
+		"SELECT MAX(end_offset) FROM query_global_metrics WHERE instance_id = ? AND log_file = ?",
+		instanceId, slowLogFile).Scan(&offset)
+	if err != nil {
+		return -1, mysql.Error(err, "SlowLogOffset: SELECT query_global_metrics")
+	}
+	if !offset.Valid {
+		return -1, nil
 	}
-	return classId, nil
+	return offset.Int64, nil
 }
 
-func (h *MySQLMetricWriter) newClass(instanceId uint, subsystem string, class *qan.Class, lastSeen string) (uint, error) {
-	var queryAbstract, queryFingerprint string
-	var tables, procedures interface{}
+// Close closes the cached statements.
+func (h *MySQLMetricWriter) Close() error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for q, stmt := range h.stmts {
+		stmt.Close()
+		delete(h.stmts, q)
+	}
+	return nil
+}
 
-	switch subsystem {
-	case instance.SubsystemNameMySQL:
-		t := time.Now()
-		var query query.QueryInfo
-		var err error
-		query, err = h.getQuery(class)
+// classIds returns the IDs of the query classes keyed on checksum, in tx or
+// outside a transaction if tx is nil. Unknown checksums aren't in the map.
+func (h *MySQLMetricWriter) classIds(tx *sql.Tx, checksums []string) (map[string]uint, error) {
+	ids := make(map[string]uint, len(checksums))
+	for len(checksums) > 0 {
+		n := len(checksums)
+		if n > maxBatchRows {
+			n = maxBatchRows
+		}
+		rows, err := h.query(tx,
+			"SELECT checksum, query_class_id FROM query_classes WHERE checksum IN ("+shared.Placeholders(n)+")",
+			n == maxBatchRows || n == 1,
+			shared.GenericStringList(checksums[:n])...)
 		if err != nil {
-			return 0, err
+			return nil, mysql.Error(err, "classIds: SELECT query_classes")
+		}
+		for rows.Next() {
+			var checksum string
+			var id uint
+			if err := rows.Scan(&checksum, &id); err != nil {
+				rows.Close()
+				return nil, mysql.Error(err, "classIds: rows.Scan")
+			}
+			ids[checksum] = id
 		}
-		tables, procedures = query.TableJSON(), query.ProcedureJSON()
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, mysql.Error(err, "classIds: rows.Next")
+		}
+		checksums = checksums[n:]
+	}
+	return ids, nil
+}
 
-		h.stats.TimingDuration(h.stats.System("abstract-fingerprint"), time.Now().Sub(t), h.stats.SampleRate)
+type exampleKey struct {
+	classId uint
+	period  string // YYYY-MM-DD
+}
 
-		// Truncate long fingerprints and abstracts to avoid MySQL warning 1265:
-		// Data truncated for column 'abstract'
-		if len(query.Fingerprint) > MAX_FINGERPRINT {
-			query.Fingerprint = query.Fingerprint[0:MAX_FINGERPRINT-3] + "..."
+// period returns query_examples.period of the lastSeen datetime.
+func period(lastSeen string) string {
+	if len(lastSeen) < 10 {
+		return lastSeen
+	}
+	return lastSeen[:10]
+}
+
+// exampleTimes returns the Query_time of the current examples of the
+// existing classes with an example, since the first lastSeen.
+func (h *MySQLMetricWriter) exampleTimes(instanceId uint, classes []*classRow) (map[exampleKey]float32, error) {
+	times := map[exampleKey]float32{}
+	ids := []interface{}{}
+	since := ""
+	for _, c := range classes {
+		if c.id == 0 || c.class.Example == nil || c.class.Example.Query == "" {
+			continue
 		}
-		if len(query.Abstract) > MAX_ABSTRACT {
-			query.Abstract = query.Abstract[0:MAX_ABSTRACT-3] + "..."
+		ids = append(ids, c.id)
+		if since == "" || c.lastSeen < since {
+			since = c.lastSeen
 		}
-		queryAbstract = query.Abstract
-		queryFingerprint = query.Fingerprint
-	case instance.SubsystemNameMongo:
-		queryAbstract = class.Fingerprint
-		queryFingerprint = class.Fingerprint
 	}
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxBatchRows {
+			n = maxBatchRows
+		}
+		args := append([]interface{}{instanceId, period(since)}, ids[:n]...)
+		rows, err := h.query(nil,
+			"SELECT query_class_id, DATE_FORMAT(period, '%Y-%m-%d'), Query_time FROM query_examples"+
+				" WHERE instance_id = ? AND period >= ? AND query_class_id IN ("+shared.Placeholders(n)+")",
+			n == maxBatchRows || n == 1,
+			args...)
+		if err != nil {
+			return nil, mysql.Error(err, "exampleTimes: SELECT query_examples")
+		}
+		for rows.Next() {
+			var k exampleKey
+			var queryTime float32
+			if err := rows.Scan(&k.classId, &k.period, &queryTime); err != nil {
+				rows.Close()
+				return nil, mysql.Error(err, "exampleTimes: rows.Scan")
+			}
+			times[k] = queryTime
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, mysql.Error(err, "exampleTimes: rows.Next")
+		}
+		ids = ids[n:]
+	}
+	return times, nil
+}
 
-	// Create the query class which is internally identified by its query_class_id.
-	// The query checksum is the class is identified externally (in a QAN report).
-	// Since this is the first time we've seen the query, firstSeen=lastSeen.
-	t := time.Now()
-	res, err := h.stmtInsertQueryClass.Exec(class.Id, queryAbstract, queryFingerprint, tables, procedures, lastSeen, lastSeen)
+// execRows inserts rows in tx with one multi-row statement per batch of up
+// to maxBatchRows rows. insert is the statement up to VALUES, row the values
+// of one row, e.g. "(?, ?)", and update the ON DUPLICATE KEY UPDATE clause,
+// if any.
+func (h *MySQLMetricWriter) execRows(tx *sql.Tx, insert, row, update string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	batchRows := maxBatchRows
+	if n := maxPlaceholders / len(rows[0]); n < batchRows {
+		batchRows = n
+	}
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > batchRows {
+			n = batchRows
+		}
+		values := make([]string, n)
+		args := make([]interface{}, 0, n*len(rows[0]))
+		for i := 0; i < n; i++ {
+			values[i] = row
+			args = append(args, rows[i]...)
+		}
+		q := insert + " VALUES " + strings.Join(values, ", ") + update
+		if err := h.exec(tx, q, n == batchRows || n == 1, args...); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
 
-	h.stats.TimingDuration(h.stats.System("insert-query-class"), time.Now().Sub(t), h.stats.SampleRate)
+// exec runs q in tx. If cache is true, q is prepared once and cached, which
+// is worth it for statements run for every report, like single rows and
+// full batches, but not for the last partial batch.
+func (h *MySQLMetricWriter) exec(tx *sql.Tx, q string, cache bool, args ...interface{}) error {
+	ctx := h.dbm.Context()
+	if !cache {
+		_, err := tx.ExecContext(ctx, q, args...)
+		return err
+	}
+	stmt, err := h.stmt(q)
 	if err != nil {
-		if mysql.ErrorCode(err) == mysql.ER_DUP_ENTRY {
-			// Duplicate entry; someone else inserted the same server
-			// (or caller didn't check first).  Return its server_id.
-			return h.getClassId(class.Id)
-		} else {
-			// Other error, let caller handle.
-			return 0, mysql.Error(err, "newClass INSERT query_classes")
+		return err
+	}
+	_, err = tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+	return err
+}
+
+// query is like exec for a SELECT, in tx or outside a transaction if tx
+// is nil.
+func (h *MySQLMetricWriter) query(tx *sql.Tx, q string, cache bool, args ...interface{}) (*sql.Rows, error) {
+	ctx := h.dbm.Context()
+	if !cache {
+		if tx == nil {
+			return h.dbm.DB().QueryContext(ctx, q, args...)
 		}
+		return tx.QueryContext(ctx, q, args...)
 	}
-	classId, err := res.LastInsertId()
+	stmt, err := h.stmt(q)
 	if err != nil {
-		return 0, mysql.Error(err, "newClass res.LastInsertId")
+		return nil, err
 	}
+	if tx != nil {
+		stmt = tx.StmtContext(ctx, stmt)
+	}
+	return stmt.QueryContext(ctx, args...)
+}
 
-	return uint(classId), nil // success
+// stmt returns the cached prepared statement of q.
+func (h *MySQLMetricWriter) stmt(q string) (*sql.Stmt, error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if stmt, ok := h.stmts[q]; ok {
+		return stmt, nil
+	}
+	t := time.Now()
+	stmt, err := h.dbm.DB().PrepareContext(h.dbm.Context(), q)
+	h.stats.TimingDuration(h.stats.System("prepare-stmts"), time.Now().Sub(t), h.stats.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	h.stmts[q] = stmt
+	return stmt, nil
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[0:max-3] + "..."
 }
 
-func (h *MySQLMetricWriter) getQuery(class *qan.Class) (query.QueryInfo, error) {
+// Why use LEAST and GREATEST and update first_seen? Because of the
+// asynchronous nature of agents communication, we can receive the same query
+// from 2 different agents but it isn't madatory that the first one we
+// receive, is the older one. There could have been a network error on the
+// agent having the oldest data.
+const insertQueryClasses = "INSERT INTO query_classes" +
+	" (query_class_id, checksum, abstract, fingerprint, tables, procedures, first_seen, last_seen)"
+
+const queryClassesRow = "(?, ?, ?, ?, ?, ?, COALESCE(?, NOW()), ?)"
+
+const updateQueryClasses = " ON DUPLICATE KEY UPDATE" +
+	" first_seen = LEAST(first_seen, VALUES(first_seen))," +
+	" last_seen = GREATEST(last_seen, VALUES(last_seen))," +
+	" tables = COALESCE(VALUES(tables), tables)," +
+	" procedures = COALESCE(VALUES(procedures), procedures)"
+
+const insertQueryExamples = "INSERT INTO query_examples" +
+	" (instance_id, query_class_id, period, ts, db, Query_time, query, `explain`)"
+
+const queryExamplesRow = "(?, ?, DATE(?), ?, ?, ?, ?, ?)"
+
+// Query_time last because the assignments are evaluated in order.
+const updateQueryExamples = " ON DUPLICATE KEY UPDATE" +
+	" query=IF(VALUES(Query_time) > COALESCE(Query_time, 0), VALUES(query), query)," +
+	" ts=IF(VALUES(Query_time) > COALESCE(Query_time, 0), VALUES(ts), ts)," +
+	" db=IF(VALUES(Query_time) > COALESCE(Query_time, 0), VALUES(db), db)," +
+	" Query_time=IF(VALUES(Query_time) > COALESCE(Query_time, 0), VALUES(Query_time), Query_time)"
+
+const insertQueryUserSources = "INSERT INTO query_user_sources" +
+	" (query_class_id, instance_id, user_class_id, ts, `count`)"
+
+const queryUserSourcesRow = "(?, ?, (SELECT id FROM user_classes WHERE user = ? AND host = ?), ?, ?)"
+
+const updateQueryUserSources = " ON DUPLICATE KEY UPDATE" +
+	" `count`=VALUES(`count`)+`count`," +
+	" ts=ts"
+
+func (h *MySQLMetricWriter) getQuery(subsystem instance.Subsystem, class *qan.Class) (query.QueryInfo, error) {
 	var schema string
 	var queryInfo query.QueryInfo
 	// Default schema to add to the tables if there is no schema in the query like:
@@ -405,7 +738,7 @@ func (h *MySQLMetricWriter) getQuery(class *qan.Class) (query.QueryInfo, error)
 	if class.Example != nil && class.Example.Query != "" {
 		queryExample = class.Example.Query
 	}
-	query, err := h.m.Parse(class.Fingerprint, queryExample, schema)
+	query, err := subsystem.Parse(h.m, class.Fingerprint, queryExample, schema)
 	if err != nil {
 		return queryInfo, err
 	}
@@ -413,41 +746,29 @@ func (h *MySQLMetricWriter) getQuery(class *qan.Class) (query.QueryInfo, error)
 	return query, nil
 }
 
-func (h *MySQLMetricWriter) updateQueryClass(queryClassId uint, lastSeen, tables, procedures string) error {
-	t := time.Now()
-	_, err := h.stmtUpdateQueryClass.Exec(lastSeen, lastSeen, tables, procedures, queryClassId)
-	h.stats.TimingDuration(h.stats.System("update-query-class"), time.Now().Sub(t), h.stats.SampleRate)
-	return mysql.Error(err, "updateQueryClass UPDATE query_classes")
-}
-
-func (h *MySQLMetricWriter) updateQueryClassWithoutTP(queryClassId uint, lastSeen string) error {
-	t := time.Now()
-	_, err := h.stmtUpdateQueryClassWithoutTP.Exec(lastSeen, lastSeen, queryClassId)
-	h.stats.TimingDuration(h.stats.System("update-query-class-without-tables-procedures"), time.Now().Sub(t), h.stats.SampleRate)
-	return mysql.Error(err, "updateQueryClassWithoutTP UPDATE query_classes")
-}
-
-func (h *MySQLMetricWriter) updateQueryExample(instanceId uint, class *qan.Class, classId uint, lastSeen string) (int64, int64, error) {
-	var lastInsertId, rowsAffected int64
-
-	// INSERT ON DUPLICATE KEY UPDATE
-	t := time.Now()
-	res, err := h.stmtInsertQueryExample.Exec(instanceId, classId, lastSeen, lastSeen, class.Example.Db, class.Example.QueryTime, class.Example.Query, class.Example.Explain)
-	if err == nil {
-		lastInsertId, _ = res.LastInsertId()
-		rowsAffected, _ = res.RowsAffected()
-	}
-	h.stats.TimingDuration(h.stats.System("update-query-example"), time.Now().Sub(t), h.stats.SampleRate)
-	return lastInsertId, rowsAffected, mysql.Error(err, "updateQueryExample INSERT query_examples")
-}
-
-func (h *MySQLMetricWriter) insertUserSource(classID, instanceID uint, source qp.UserSource) error {
-	if _, err := h.stmtInsertUserClass.Exec(source.User, source.Host); err != nil {
-		return err
+// metricAliases adds the metrics of the subsystem that agents send as other
+// metrics, e.g. Docs_examined as Rows_examined for MongoDB, to the classes
+// of the report, see Subsystem.MetricAliases.
+func metricAliases(subsystem instance.Subsystem, report qp.Report) {
+	aliases := subsystem.MetricAliases()
+	if len(aliases) == 0 {
+		return
+	}
+	classes := append([]*qan.Class{report.Global}, report.Class...)
+	for _, c := range classes {
+		if c == nil || c.Metrics == nil {
+			continue
+		}
+		for alias, name := range aliases {
+			stats, ok := c.Metrics.NumberMetrics[alias]
+			if !ok {
+				continue
+			}
+			if _, ok := c.Metrics.NumberMetrics[name]; !ok {
+				c.Metrics.NumberMetrics[name] = stats
+			}
+		}
 	}
-
-	_, err := h.stmtInsertQueryUserSource.Exec(classID, instanceID, source.User, source.Host, source.Ts, source.Count)
-	return err
 }
 
 func (h *MySQLMetricWriter) getMetricValues(e *qan.Metrics) []interface{} {
@@ -458,7 +779,7 @@ func (h *MySQLMetricWriter) getMetricValues(e *qan.Metrics) []interface{} {
 
 	vals := make([]interface{}, len(metricColumns))
 	i := 0
-	for _, m := range metrics.Query {
+	for _, m := range appMetrics.Query {
 
 		// Counter/bools
 		if (m.Flags & metrics.COUNTER) != 0 {
@@ -535,115 +856,23 @@ func (h *MySQLMetricWriter) getMetricValues(e *qan.Metrics) []interface{} {
 	return vals
 }
 
-func (h *MySQLMetricWriter) prepareStatements() {
-	t := time.Now()
-	defer func() {
-		h.stats.TimingDuration(h.stats.System("prepare-stmts"), time.Now().Sub(t), h.stats.SampleRate)
-	}()
-
-	var err error
-
-	// SELECT
-	h.stmtSelectClassId, err = h.dbm.DB().Prepare(
-		"SELECT query_class_id" +
-			" FROM query_classes" +
-			" WHERE checksum = ?")
-	if err != nil {
-		panic("Failed to prepare stmtSelectClassId:" + err.Error())
-	}
-
-	// INSERT
-	h.stmtInsertGlobalMetrics, err = h.dbm.DB().Prepare(insertGlobalMetrics)
-	if err != nil {
-		panic("Failed to prepare stmtInsertGlobalMetrics: " + err.Error())
-	}
-
-	h.stmtInsertClassMetrics, err = h.dbm.DB().Prepare(insertClassMetrics)
-	if err != nil {
-		panic("Failed to prepare stmtInsertClassMetrics: " + err.Error())
-	}
-
-	h.stmtInsertQueryExample, err = h.dbm.DB().Prepare(
-		"INSERT INTO query_examples" +
-			" (instance_id, query_class_id, period, ts, db, Query_time, query, `explain`)" +
-			" VALUES (?, ?, DATE(?), ?, ?, ?, ?, ?)" +
-			" ON DUPLICATE KEY UPDATE" +
-			" query=IF(VALUES(Query_time) > COALESCE(Query_time, 0), VALUES(query), query)," +
-			" ts=IF(VALUES(Query_time) > COALESCE(Query_time, 0), VALUES(ts), ts)," +
-			" db=IF(VALUES(Query_time) > COALESCE(Query_time, 0), VALUES(db), db)," +
-			" Query_time=IF(VALUES(Query_time) > COALESCE(Query_time, 0), VALUES(Query_time), Query_time)")
-	if err != nil {
-		panic("Failed to prepare stmtInsertQueryExample: " + err.Error())
-	}
-
-	h.stmtInsertUserClass, err = h.dbm.DB().Prepare(
-		"INSERT IGNORE INTO user_classes" +
-			" (user, host)" +
-			" VALUES(?, ?)",
-	)
-	if err != nil {
-		panic("Failed to prepare stmtInsertUserClass: " + err.Error())
+// getSketch returns the encoded Query_time sketch, or nil if the agent didn't
+// send the stats needed for one.
+func (h *MySQLMetricWriter) getSketch(e *qan.Metrics, n uint) interface{} {
+	stats, ok := e.TimeMetrics["Query_time"]
+	if !ok {
+		return nil
 	}
-
-	h.stmtInsertQueryUserSource, err = h.dbm.DB().Prepare(
-		"INSERT INTO query_user_sources" +
-			" (query_class_id, instance_id, user_class_id, ts, `count`)" +
-			" VALUES (?, ?, (SELECT id FROM user_classes WHERE user = ? AND host = ?), ?, ?)" +
-			" ON DUPLICATE KEY UPDATE" +
-			" `count`=VALUES(`count`)+`count`," +
-			" ts=ts",
-	)
-	if err != nil {
-		panic("Failed to prepare stmtInsertQueryUserSource: " + err.Error())
-	}
-
-	/* Why use LEAST and GREATEST and update first_seen?
-	   Because of the asynchronous nature of agents communication, we can receive
-	   the same query from 2 different agents but it isn't madatory that the first
-	   one we receive, is the older one. There could have been a network error on
-	   the agent having the oldest data
-	*/
-	h.stmtInsertQueryClass, err = h.dbm.DB().Prepare(
-		"INSERT INTO query_classes" +
-			" (checksum, abstract, fingerprint, tables, procedures, first_seen, last_seen)" +
-			" VALUES (?, ?, ?, ?, ?, COALESCE(?, NOW()), ?)")
-	if err != nil {
-		panic("Failed to prepare stmtInsertQueryClass: " + err.Error())
+	s := sketch.FromStats(uint64(n), stats.Min, stats.Avg, stats.Med, stats.P95, stats.Max)
+	if s == nil {
+		return nil
 	}
-
-	// UPDATE
-	h.stmtUpdateQueryClass, err = h.dbm.DB().Prepare(
-		"UPDATE query_classes" +
-			" SET first_seen = LEAST(first_seen, ?), " +
-			" last_seen = GREATEST(last_seen, ?), " +
-			" tables = ?, " +
-			" procedures = ? " +
-			" WHERE query_class_id = ?")
-	if err != nil {
-		panic("Failed to prepare stmtUpdateQueryClass: " + err.Error())
-	}
-
-	// UPDATE query_classes without tables and procedures
-	h.stmtUpdateQueryClassWithoutTP, err = h.dbm.DB().Prepare(
-		"UPDATE query_classes" +
-			" SET first_seen = LEAST(first_seen, ?), " +
-			" last_seen = GREATEST(last_seen, ?) " +
-			" WHERE query_class_id = ?")
+	data, err := s.MarshalBinary()
 	if err != nil {
-		panic("Failed to prepare stmtUpdateQueryClassWithoutTP: " + err.Error())
+		log.Printf("ERROR: cannot encode Query_time sketch: %s", err)
+		return nil
 	}
-}
-
-func (h *MySQLMetricWriter) closeStatements() {
-	h.stmtSelectClassId.Close()
-	h.stmtInsertGlobalMetrics.Close()
-	h.stmtInsertClassMetrics.Close()
-	h.stmtInsertQueryExample.Close()
-	h.stmtInsertQueryUserSource.Close()
-	h.stmtInsertUserClass.Close()
-	h.stmtInsertQueryClass.Close()
-	h.stmtUpdateQueryClass.Close()
-	h.stmtUpdateQueryClassWithoutTP.Close()
+	return data
 }
 
 // --------------------------------------------------------------------------
@@ -651,23 +880,26 @@ func (h *MySQLMetricWriter) closeStatements() {
 var metricColumns []string
 var metricDuplicateUpdates []string
 var globalMetricDuplicateUpdates []string
-var insertGlobalMetrics string
-var insertClassMetrics string
+
+// INSERT, values of one row and ON DUPLICATE KEY UPDATE of the metrics, see
+// MySQLMetricWriter.execRows.
+var insertGlobalMetrics, globalMetricsRow, updateGlobalMetrics string
+var insertClassMetrics, classMetricsRow, updateClassMetrics string
 
 func init() {
 	nCounters := 0
-	for _, m := range metrics.Query {
-		if (m.Flags & metrics.COUNTER) == 0 {
+	for _, m := range appMetrics.Query {
+		if (m.Flags & metrics.COUNTER) != 0 {
 			nCounters++
 		}
 	}
-	n := ((len(metrics.Query) - nCounters) * (len(metrics.StatNames) - 1)) + nCounters
+	n := ((len(appMetrics.Query) - nCounters) * (len(metrics.StatNames) - 1)) + nCounters
 	metricColumns = make([]string, n)
 	metricDuplicateUpdates = make([]string, n)
 	globalMetricDuplicateUpdates = make([]string, n)
 
 	i := 0
-	for _, m := range metrics.Query {
+	for _, m := range appMetrics.Query {
 		if (m.Flags & metrics.COUNTER) == 0 {
 			for _, stat := range metrics.StatNames {
 				if stat == "p5" {
@@ -703,23 +935,33 @@ func init() {
 	}
 
 	insertGlobalMetrics = "INSERT INTO query_global_metrics" +
-		" (" + strings.Join(GlobalCols, ",") + "," + strings.Join(metricColumns, ",") + ")" +
-		" VALUES (" + shared.Placeholders(len(GlobalCols)+len(metricColumns)) + ")" +
-		" ON DUPLICATE KEY UPDATE " +
+		" (" + strings.Join(GlobalCols, ",") + "," + strings.Join(metricColumns, ",") + "," + SketchCol + ")"
+	globalMetricsRow = "(" + shared.Placeholders(len(GlobalCols)+len(metricColumns)+1) + ")"
+	updateGlobalMetrics = " ON DUPLICATE KEY UPDATE " +
 		"	end_ts = IF(VALUES(end_ts) > end_ts, COALESCE(VALUES(end_ts), end_ts), COALESCE(end_ts, VALUES(end_ts))), " +
+		"	end_offset = IF(VALUES(end_offset) > end_offset, COALESCE(VALUES(end_offset), end_offset), COALESCE(end_offset, VALUES(end_offset))), " +
+		"	stop_offset = IF(VALUES(stop_offset) > stop_offset, COALESCE(VALUES(stop_offset), stop_offset), COALESCE(stop_offset, VALUES(stop_offset))), " +
 		"	run_time = COALESCE(VALUES(run_time) + run_time, run_time, VALUES(run_time)), " +
 		"	total_query_count = COALESCE(VALUES(total_query_count) + total_query_count, total_query_count, VALUES(total_query_count)), " +
-		strings.Join(globalMetricDuplicateUpdates, ", ")
+		strings.Join(globalMetricDuplicateUpdates, ", ") + ", " +
+		sketchDuplicateUpdate
 
 	insertClassMetrics = "INSERT INTO query_class_metrics" +
-		" (" + strings.Join(ClassCols, ",") + "," + strings.Join(metricColumns, ",") + ")" +
-		" VALUES (" + shared.Placeholders(len(ClassCols)+len(metricColumns)) + ")" +
-		" ON DUPLICATE KEY UPDATE " +
+		" (" + strings.Join(ClassCols, ",") + "," + strings.Join(metricColumns, ",") + "," + SketchCol + ")"
+	classMetricsRow = "(" + shared.Placeholders(len(ClassCols)+len(metricColumns)+1) + ")"
+	updateClassMetrics = " ON DUPLICATE KEY UPDATE " +
 		"	end_ts = IF(VALUES(end_ts) > end_ts, COALESCE(VALUES(end_ts), end_ts), COALESCE(end_ts, VALUES(end_ts))), " +
 		"	query_count = COALESCE(VALUES(query_count) + query_count, query_count, VALUES(query_count)), " +
-		strings.Join(metricDuplicateUpdates, ", ")
+		strings.Join(metricDuplicateUpdates, ", ") + ", " +
+		sketchDuplicateUpdate
 }
 
+// SketchCol is the encoded sketch.Sketch of Query_time. Encoded sketches
+// are merged by concatenating them.
+const SketchCol = "Query_time_sketch"
+
+var sketchDuplicateUpdate = fmt.Sprintf("%s = IF(%s IS NULL, VALUES(%s), CONCAT(%s, COALESCE(VALUES(%s), '')))", SketchCol, SketchCol, SketchCol, SketchCol, SketchCol)
+
 var GlobalCols []string = []string{
 	`instance_id`,
 	`start_ts`,
@@ -18,7 +18,11 @@
 package qan_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"reflect"
 	"time"
@@ -27,6 +31,7 @@ import (
 	"github.com/shatteredsilicon/qan-api/app/db"
 	"github.com/shatteredsilicon/qan-api/app/instance"
 	"github.com/shatteredsilicon/qan-api/app/qan"
+	"github.com/shatteredsilicon/qan-api/app/sketch"
 	"github.com/shatteredsilicon/qan-api/config"
 	"github.com/shatteredsilicon/qan-api/service/query"
 	"github.com/shatteredsilicon/qan-api/stats"
@@ -90,6 +95,7 @@ func (s *MySQLTestSuite) TestSimple(t *C) {
 	var err error
 
 	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
 
 	data1, err := ioutil.ReadFile(config.ApiRootDir + "/test/qan/001/data1_v3.json")
 	t.Assert(err, IsNil)
@@ -129,12 +135,65 @@ func (s *MySQLTestSuite) TestSimple(t *C) {
 	}
 }
 
+func (s *MySQLTestSuite) TestQueryTimeSketch(t *C) {
+	data1, err := ioutil.ReadFile(config.ApiRootDir + "/test/qan/001/data1_v3.json")
+	t.Assert(err, IsNil)
+	report1 := qp.Report{}
+	err = json.Unmarshal(data1, &report1)
+	t.Assert(err, IsNil)
+	t.Assert(len(report1.Class) > 0, Equals, true)
+
+	now, _ := time.Parse("2006-01-02T15:04:05", "2014-04-16T18:17:58")
+	report1.StartTs = now.Add(-1 * time.Minute)
+	report1.EndTs = now
+
+	f := func(v float64) *float64 { return &v }
+	class := report1.Class[0]
+	class.TotalQueries = 100
+	class.Metrics.TimeMetrics["Query_time"] = &qp.TimeStats{
+		Sum: 30,
+		Min: f(0.1),
+		Avg: f(0.3),
+		Med: f(0.2),
+		P95: f(0.9),
+		Max: f(2),
+	}
+
+	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
+	err = qanHandler.Write(report1)
+	t.Assert(err, IsNil)
+
+	getSketch := func() *sketch.Sketch {
+		var data []byte
+		err := s.testDb.DB().QueryRow(
+			"SELECT qcm.Query_time_sketch FROM query_class_metrics qcm JOIN query_classes qc USING (query_class_id)"+
+				" WHERE qc.checksum = ?", class.Id).Scan(&data)
+		t.Assert(err, IsNil)
+		sk, err := sketch.Unmarshal(data)
+		t.Assert(err, IsNil)
+		return sk
+	}
+	sk := getSketch()
+	t.Check(sk.Count(), Equals, float64(100))
+	t.Check(sk.Quantile(0.5), Equals, 0.2)
+	t.Check(sk.Quantile(0.95) > 0.89 && sk.Quantile(0.95) < 0.91, Equals, true)
+
+	// Same interval again, e.g. the agent resent it: the sketches are merged.
+	err = qanHandler.Write(report1)
+	t.Assert(err, IsNil)
+	sk = getSketch()
+	t.Check(sk.Count(), Equals, float64(200))
+	t.Check(sk.Quantile(0.5), Equals, 0.2)
+}
+
 func (s *MySQLTestSuite) TestQueryExample(t *C) {
 	var err error
 
 	now, _ := time.Parse("2006-01-02T15:04:05", "2014-04-16T18:17:58")
 
 	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
 
 	data1, err := ioutil.ReadFile(config.ApiRootDir + "/test/qan/001/slow001_v3.json")
 	t.Assert(err, IsNil)
@@ -170,6 +229,7 @@ func (s *MySQLTestSuite) TestUpdateTablesInClasses(t *C) {
 	now, _ := time.Parse("2006-01-02T15:04:05", "2014-04-16T18:17:58")
 
 	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
 
 	data1, err := ioutil.ReadFile(config.ApiRootDir + "/test/qan/001/slow001_v3.json")
 	t.Assert(err, IsNil)
@@ -238,6 +298,7 @@ func (s *MySQLTestSuite) TestQueryExampleUsesDefaultDb(t *C) {
 	report.Class[0].Example.Query = "select c from t where id=100"
 
 	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
 	err = qanHandler.Write(report)
 	t.Assert(err, IsNil)
 
@@ -266,6 +327,7 @@ func (s *MySQLTestSuite) TestLastSeen(t *C) {
 
 	// Create qanHandler
 	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
 
 	// Write metrics first time to set last seen.
 	err = qanHandler.Write(report1)
@@ -315,6 +377,7 @@ func (s *MySQLTestSuite) TestBadFingerprints(t *C) {
 
 	// Create qanHandler
 	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
 
 	// Write metrics first time to set last seen.
 	err = qanHandler.Write(report)
@@ -344,6 +407,7 @@ func (s *MySQLTestSuite) TestWorkaroundPSBug830286(t *C) {
 	report.EndOffset = 1000
 
 	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
 
 	err = qanHandler.Write(report)
 	t.Assert(err, IsNil)
@@ -377,6 +441,7 @@ func (s *MySQLTestSuite) TestRateLimit(t *C) {
 	report1.EndOffset = 1000
 
 	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
 
 	err = qanHandler.Write(report1)
 	t.Assert(err, IsNil)
@@ -484,3 +549,342 @@ func (s *MySQLTestSuite) Test009(t *C) {
 		}
 	*/
 }
+
+func (s *MySQLTestSuite) TestManyClasses(t *C) {
+	// More classes than fit in one multi-row INSERT, so Write has to batch
+	// them, and writing the same report again must update, not duplicate.
+	data, err := ioutil.ReadFile(config.ApiRootDir + "/test/qan/001/data1_v3.json")
+	t.Assert(err, IsNil)
+	report := qp.Report{}
+	err = json.Unmarshal(data, &report)
+	t.Assert(err, IsNil)
+
+	class := report.Class[0]
+	report.Class = nil
+	for i := 0; i < 250; i++ {
+		c := *class
+		c.Id = fmt.Sprintf("%016X", i+1)
+		c.Fingerprint = fmt.Sprintf("select c from t%d where id=?", i)
+		report.Class = append(report.Class, &c)
+	}
+
+	now, _ := time.Parse("2006-01-02T15:04:05", "2014-04-16T18:17:58")
+	report.StartTs = now.Add(-3 * time.Second)
+	report.EndTs = now.Add(-2 * time.Second)
+
+	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
+
+	for i := 0; i < 2; i++ {
+		err = qanHandler.Write(report)
+		t.Assert(err, IsNil)
+
+		var n int
+		s.testDb.DB().QueryRow("SELECT COUNT(*) FROM query_classes").Scan(&n)
+		t.Check(n, Equals, 250)
+		s.testDb.DB().QueryRow("SELECT COUNT(*) FROM query_class_metrics").Scan(&n)
+		t.Check(n, Equals, 250)
+		s.testDb.DB().QueryRow("SELECT COUNT(*) FROM query_global_metrics").Scan(&n)
+		t.Check(n, Equals, 1)
+	}
+}
+
+func (s *MySQLTestSuite) TestResentReport(t *C) {
+	data, err := ioutil.ReadFile(config.ApiRootDir + "/test/qan/001/data1_v3.json")
+	t.Assert(err, IsNil)
+	report := qp.Report{}
+	err = json.Unmarshal(data, &report)
+	t.Assert(err, IsNil)
+
+	now, _ := time.Parse("2006-01-02T15:04:05", "2014-04-16T18:17:58")
+	report.StartTs = now.Add(-3 * time.Second)
+	report.EndTs = now.Add(-2 * time.Second)
+	report.SlowLogFile = "slow.log"
+	report.StartOffset = 0
+	report.EndOffset = 1000
+
+	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
+
+	err = qanHandler.Write(report)
+	t.Assert(err, IsNil)
+	var queries uint
+	s.testDb.DB().QueryRow("SELECT SUM(query_count) FROM query_class_metrics").Scan(&queries)
+	t.Assert(queries > 0, Equals, true)
+
+	// The agent resends the report, e.g. because it didn't get the ack.
+	// It's not written again.
+	report.RunTime = 2
+	err = qanHandler.Write(report)
+	t.Assert(err, IsNil)
+	var n uint
+	s.testDb.DB().QueryRow("SELECT SUM(query_count) FROM query_class_metrics").Scan(&n)
+	t.Check(n, Equals, queries)
+
+	instanceId, _, err := s.ih.Get(report.UUID)
+	t.Assert(err, IsNil)
+	entries, err := qan.Ledger(db.DBManager, []uint{instanceId}, now.Add(-1*time.Hour), now, 100)
+	t.Assert(err, IsNil)
+	t.Assert(entries, HasLen, 1)
+	t.Check(entries[0].Fingerprint, Equals, qan.ReportFingerprint(report))
+	t.Check(entries[0].InstanceUUID, Equals, report.UUID)
+	t.Check(entries[0].EndOffset, Equals, int64(1000))
+	t.Check(entries[0].Duplicates, Equals, uint(1))
+	t.Check(entries[0].LastDuplicate, NotNil)
+
+	// A report for the next interval is a different report.
+	report.StartTs = now.Add(-2 * time.Second)
+	report.EndTs = now.Add(-1 * time.Second)
+	report.StartOffset = 1000
+	report.EndOffset = 2000
+	err = qanHandler.Write(report)
+	t.Assert(err, IsNil)
+	s.testDb.DB().QueryRow("SELECT SUM(query_count) FROM query_class_metrics").Scan(&n)
+	t.Check(n, Equals, 2*queries)
+}
+
+func (s *MySQLTestSuite) TestOldAgentReports(t *C) {
+	// Old agents only set the interval in the global metrics, and
+	// Performance Schema reports have no offsets: reports of different
+	// intervals are still different reports.
+	data, err := ioutil.ReadFile(config.ApiRootDir + "/test/qan/001/data1_v3.json")
+	t.Assert(err, IsNil)
+	report := qp.Report{}
+	err = json.Unmarshal(data, &report)
+	t.Assert(err, IsNil)
+
+	now, _ := time.Parse("2006-01-02T15:04:05", "2014-04-16T18:17:58")
+	report.StartTs = time.Time{}
+	report.EndTs = time.Time{}
+	report.StartOffset = 0
+	report.EndOffset = 0
+	report.Global.StartAt = now.Add(-3 * time.Second)
+	report.Global.EndAt = now.Add(-2 * time.Second)
+
+	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
+
+	err = qanHandler.Write(report)
+	t.Assert(err, IsNil)
+	var queries uint
+	s.testDb.DB().QueryRow("SELECT SUM(query_count) FROM query_class_metrics").Scan(&queries)
+	t.Assert(queries > 0, Equals, true)
+
+	next := report
+	global := *report.Global
+	global.StartAt = now.Add(-2 * time.Second)
+	global.EndAt = now.Add(-1 * time.Second)
+	next.Global = &global
+	t.Check(qan.ReportFingerprint(next), Not(Equals), qan.ReportFingerprint(report))
+	err = qanHandler.Write(next)
+	t.Assert(err, IsNil)
+	var n uint
+	s.testDb.DB().QueryRow("SELECT SUM(query_count) FROM query_class_metrics").Scan(&n)
+	t.Check(n, Equals, 2*queries)
+
+	instanceId, _, err := s.ih.Get(report.UUID)
+	t.Assert(err, IsNil)
+	entries, err := qan.Ledger(db.DBManager, []uint{instanceId}, now.Add(-1*time.Hour), now, 100)
+	t.Assert(err, IsNil)
+	t.Check(entries, HasLen, 2)
+}
+
+func (s *MySQLTestSuite) TestWriteReports(t *C) {
+	data, err := ioutil.ReadFile(config.ApiRootDir + "/test/qan/001/data1_v3.json")
+	t.Assert(err, IsNil)
+	report := qp.Report{}
+	err = json.Unmarshal(data, &report)
+	t.Assert(err, IsNil)
+	now, _ := time.Parse("2006-01-02T15:04:05", "2014-04-16T18:17:58")
+	report.StartTs = now.Add(-3 * time.Second)
+	report.EndTs = now.Add(-2 * time.Second)
+	line1, _ := json.Marshal(report)
+
+	unknown := report
+	unknown.UUID = "00000000000000000000000000000000"
+	line2, _ := json.Marshal(unknown)
+
+	// Report, blank line, unknown instance, invalid JSON, same report.
+	body := bytes.Join([][]byte{line1, {}, line2, []byte("{bad"), line1}, []byte("\n"))
+
+	gzipped := &bytes.Buffer{}
+	w := gzip.NewWriter(gzipped)
+	w.Write(body)
+	w.Close()
+
+	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
+
+	results, err := qan.WriteReports(gzipped.Bytes(), "gzip", s.ih, qanHandler)
+	t.Assert(err, IsNil)
+	t.Assert(results, HasLen, 4)
+	fingerprint := qan.ReportFingerprint(report)
+	t.Check(results[0], DeepEquals, qan.ReportResult{Line: 1, UUID: report.UUID, Fingerprint: fingerprint, Status: qan.ReportWritten})
+	t.Check(results[1].Line, Equals, uint(3))
+	t.Check(results[1].Status, Equals, qan.ReportError)
+	t.Check(results[1].Error, Equals, "instance not found: "+unknown.UUID)
+	t.Check(results[2].Line, Equals, uint(4))
+	t.Check(results[2].Status, Equals, qan.ReportError)
+	t.Check(results[3], DeepEquals, qan.ReportResult{Line: 5, UUID: report.UUID, Fingerprint: fingerprint, Status: qan.ReportDuplicate})
+
+	var n int
+	s.testDb.DB().QueryRow("SELECT COUNT(*) FROM query_global_metrics").Scan(&n)
+	t.Check(n, Equals, 1)
+
+	_, err = qan.WriteReports(body, "gzip", s.ih, qanHandler)
+	t.Check(errors.Is(err, qan.ErrInvalidBody), Equals, true)
+}
+
+func (s *MySQLTestSuite) TestSlowLogOffset(t *C) {
+	data, err := ioutil.ReadFile(config.ApiRootDir + "/test/qan/001/data1_v3.json")
+	t.Assert(err, IsNil)
+	report := qp.Report{}
+	err = json.Unmarshal(data, &report)
+	t.Assert(err, IsNil)
+	now, _ := time.Parse("2006-01-02T15:04:05", "2014-04-16T18:17:58")
+	report.StartTs = now.Add(-3 * time.Second)
+	report.EndTs = now.Add(-2 * time.Second)
+	report.SlowLogFile = "/tmp/slow.log"
+	report.StartOffset = 0
+	report.EndOffset = 1000
+	report.StopOffset = 1000
+
+	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
+
+	offset, err := qanHandler.SlowLogOffset(report.UUID, report.SlowLogFile)
+	t.Assert(err, IsNil)
+	t.Check(offset, Equals, int64(-1))
+
+	err = qanHandler.Write(report)
+	t.Assert(err, IsNil)
+	offset, err = qanHandler.SlowLogOffset(report.UUID, report.SlowLogFile)
+	t.Assert(err, IsNil)
+	t.Check(offset, Equals, int64(1000))
+
+	// The rest of the interval imported later is added to the same interval.
+	report.StartOffset = 1000
+	report.EndOffset = 1500
+	report.StopOffset = 1500
+	err = qanHandler.Write(report)
+	t.Assert(err, IsNil)
+	offset, err = qanHandler.SlowLogOffset(report.UUID, report.SlowLogFile)
+	t.Assert(err, IsNil)
+	t.Check(offset, Equals, int64(1500))
+
+	offset, err = qanHandler.SlowLogOffset(report.UUID, "/tmp/other.log")
+	t.Assert(err, IsNil)
+	t.Check(offset, Equals, int64(-1))
+}
+
+func (s *MySQLTestSuite) TestPostgreSQL(t *C) {
+	_, err := s.testDb.DB().Exec("INSERT INTO instances (subsystem_id, uuid, name) VALUES (?, ?, ?)",
+		instance.SubsystemPostgreSQL, "5a1ec7ed00000000000000000000000a", "pg1")
+	t.Assert(err, IsNil)
+	defer s.testDb.DB().Exec("DELETE FROM instances WHERE uuid = ?", "5a1ec7ed00000000000000000000000a")
+
+	queryTime, planTime := 0.5, 0.002
+	hit, read := uint64(100), uint64(4)
+	report := qp.Report{
+		UUID:    "5a1ec7ed00000000000000000000000a",
+		StartTs: time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC),
+		EndTs:   time.Date(2024, 1, 2, 3, 5, 0, 0, time.UTC),
+		Global: &qp.Class{
+			TotalQueries: 2,
+			Metrics: &qp.Metrics{
+				TimeMetrics: map[string]*qp.TimeStats{"Query_time": {Sum: 1, Max: &queryTime}},
+			},
+		},
+		Class: []*qp.Class{{
+			Id:           "-4127561830934128390",
+			Fingerprint:  "SELECT c FROM orders o JOIN shop.customers c ON c.id = o.customer_id WHERE o.id = $1",
+			TotalQueries: 2,
+			Example:      &qp.Example{Db: "app"},
+			Metrics: &qp.Metrics{
+				TimeMetrics: map[string]*qp.TimeStats{
+					"Query_time": {Sum: 1, Max: &queryTime},
+					"Plan_time":  {Sum: 0.004, Max: &planTime},
+				},
+				NumberMetrics: map[string]*qp.NumberStats{
+					"Rows_sent":        {Sum: 2},
+					"Shared_blks_hit":  {Sum: 200, Max: &hit},
+					"Shared_blks_read": {Sum: 8, Max: &read},
+				},
+			},
+		}},
+	}
+
+	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
+	err = qanHandler.Write(report)
+	t.Assert(err, IsNil)
+
+	var abstract, fingerprint, tables string
+	err = s.testDb.DB().QueryRow("SELECT abstract, fingerprint, tables FROM query_classes WHERE checksum = ?",
+		"-4127561830934128390").Scan(&abstract, &fingerprint, &tables)
+	t.Assert(err, IsNil)
+	t.Check(abstract, Equals, "SELECT orders shop.customers")
+	t.Check(fingerprint, Equals, "select c from orders o join shop.customers c on c.id = o.customer_id where o.id = ?")
+	t.Check(tables, Equals, `[{"Db":"app","Table":"orders"},{"Db":"shop","Table":"customers"}]`)
+
+	var hitSum, readMax uint64
+	var planTimeSum float64
+	err = s.testDb.DB().QueryRow("SELECT Shared_blks_hit_sum, Shared_blks_read_max, Plan_time_sum FROM query_class_metrics").Scan(&hitSum, &readMax, &planTimeSum)
+	t.Assert(err, IsNil)
+	t.Check(hitSum, Equals, uint64(200))
+	t.Check(readMax, Equals, uint64(4))
+	t.Check(planTimeSum, Equals, 0.004)
+}
+
+func (s *MySQLTestSuite) TestMongo(t *C) {
+	_, err := s.testDb.DB().Exec("INSERT INTO instances (subsystem_id, uuid, name) VALUES (?, ?, ?)",
+		instance.SubsystemMongo, "5a1ec7ed00000000000000000000000b", "mongo1")
+	t.Assert(err, IsNil)
+	defer s.testDb.DB().Exec("DELETE FROM instances WHERE uuid = ?", "5a1ec7ed00000000000000000000000b")
+
+	queryTime := 0.5
+	report := qp.Report{
+		UUID:    "5a1ec7ed00000000000000000000000b",
+		StartTs: time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC),
+		EndTs:   time.Date(2024, 1, 2, 3, 5, 0, 0, time.UTC),
+		Global: &qp.Class{
+			TotalQueries: 2,
+			Metrics: &qp.Metrics{
+				TimeMetrics: map[string]*qp.TimeStats{"Query_time": {Sum: 1, Max: &queryTime}},
+			},
+		},
+		Class: []*qp.Class{{
+			Id:           "3C8C2F6B6D8D0E5A",
+			Fingerprint:  `db.orders.find({"status":"?"})`,
+			TotalQueries: 2,
+			Example:      &qp.Example{Db: "shop"},
+			Metrics: &qp.Metrics{
+				TimeMetrics: map[string]*qp.TimeStats{"Query_time": {Sum: 1, Max: &queryTime}},
+				NumberMetrics: map[string]*qp.NumberStats{
+					"Rows_sent":     {Sum: 2},
+					"Rows_examined": {Sum: 500}, // docsExamined of older agents
+					"Keys_examined": {Sum: 20},
+				},
+			},
+		}},
+	}
+
+	qanHandler := qan.NewMySQLMetricWriter(db.DBManager, s.ih, s.m, s.nullStats)
+	defer qanHandler.Close()
+	err = qanHandler.Write(report)
+	t.Assert(err, IsNil)
+
+	var abstract, fingerprint, tables string
+	err = s.testDb.DB().QueryRow("SELECT abstract, fingerprint, tables FROM query_classes WHERE checksum = ?",
+		"3C8C2F6B6D8D0E5A").Scan(&abstract, &fingerprint, &tables)
+	t.Assert(err, IsNil)
+	t.Check(abstract, Equals, "FIND orders")
+	t.Check(fingerprint, Equals, `db.orders.find({"status":"?"})`)
+	t.Check(tables, Equals, `[{"Db":"shop","Table":"orders"}]`)
+
+	var docsExamined, keysExamined uint64
+	err = s.testDb.DB().QueryRow("SELECT Docs_examined_sum, Keys_examined_sum FROM query_class_metrics").Scan(&docsExamined, &keysExamined)
+	t.Assert(err, IsNil)
+	t.Check(docsExamined, Equals, uint64(500))
+	t.Check(keysExamined, Equals, uint64(20))
+}
@@ -0,0 +1,332 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/revel/revel"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+	"github.com/shatteredsilicon/qan-api/stats"
+	qp "github.com/shatteredsilicon/ssm/proto/qan"
+)
+
+var (
+	ErrQueueFull    = errors.New("QAN data queue is full")
+	ErrQueueStopped = errors.New("QAN data queue is stopped")
+)
+
+// DataQueue is the queue of the agent data websockets, see Agent.Data.
+var DataQueue *Queue
+
+const spoolExt = ".json"
+
+type QueueConfig struct {
+	Depth    int           // max reports spooled but not written yet
+	Workers  int           // number of writers
+	SpoolDir string        // where reports are spooled until written
+	Retry    time.Duration // wait before retrying a report if MySQL is down
+}
+
+// LoadQueueConfig reads the queue config from app.conf:
+//
+//	qan.queue.depth   = 1000
+//	qan.queue.workers = 4
+//	qan.queue.spool   = /srv/qan-api/spool
+//	qan.queue.retry   = 5s
+func LoadQueueConfig() (QueueConfig, error) {
+	cfg := QueueConfig{
+		Depth:    revel.Config.IntDefault("qan.queue.depth", 1000),
+		Workers:  revel.Config.IntDefault("qan.queue.workers", 4),
+		SpoolDir: revel.Config.StringDefault("qan.queue.spool", "/srv/qan-api/spool"),
+	}
+	if cfg.Depth <= 0 {
+		return cfg, fmt.Errorf("invalid qan.queue.depth: %d", cfg.Depth)
+	}
+	if cfg.Workers <= 0 {
+		return cfg, fmt.Errorf("invalid qan.queue.workers: %d", cfg.Workers)
+	}
+	if cfg.SpoolDir == "" {
+		return cfg, fmt.Errorf("qan.queue.spool is not set")
+	}
+	var err error
+	if cfg.Retry, err = time.ParseDuration(revel.Config.StringDefault("qan.queue.retry", "5s")); err != nil {
+		return cfg, fmt.Errorf("invalid qan.queue.retry: %s", err)
+	}
+	return cfg, nil
+}
+
+// Queue decouples agents from MySQL: Add spools a report to disk and returns,
+// and a pool of workers writes spooled reports to MySQL. If MySQL is down or
+// read-only, workers retry the report until it's written, and reports spooled
+// before a restart are written when the queue starts again. Add returns
+// ErrQueueFull when Depth reports are waiting so agents keep their data and
+// send it later.
+type Queue struct {
+	cfg       QueueConfig
+	newWriter func() MetricWriter
+	stats     *stats.Stats
+	// --
+	files   chan string
+	stop    chan struct{}
+	wg      *sync.WaitGroup
+	mux     *sync.Mutex
+	pending int
+	seq     uint64
+	stopped bool
+}
+
+// NewQueue creates a queue. newWriter is called once per worker; the writer
+// is closed when the worker stops if it's an io.Closer.
+func NewQueue(cfg QueueConfig, newWriter func() MetricWriter, stats *stats.Stats) *Queue {
+	q := &Queue{
+		cfg:       cfg,
+		newWriter: newWriter,
+		stats:     stats,
+		// --
+		files: make(chan string, cfg.Depth),
+		stop:  make(chan struct{}),
+		wg:    &sync.WaitGroup{},
+		mux:   &sync.Mutex{},
+	}
+	return q
+}
+
+// Start creates the spool dir, starts the workers and queues the reports
+// left in the spool by the last run.
+func (q *Queue) Start() error {
+	if err := os.MkdirAll(q.cfg.SpoolDir, 0750); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(q.cfg.SpoolDir, "*"+spoolExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files) // oldest first, see Add
+
+	q.mux.Lock()
+	q.pending += len(files)
+	q.mux.Unlock()
+	q.gauge()
+	if len(files) > 0 {
+		log.Printf("INFO: qan.Queue: %d reports in spool %s", len(files), q.cfg.SpoolDir)
+	}
+
+	for i := 0; i < q.cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+
+	// More than Depth reports can be left in the spool, so don't block here.
+	// Add rejects reports until the queue drains below Depth, so the files
+	// channel can't fill up.
+	go func() {
+		for _, file := range files {
+			select {
+			case q.files <- file:
+			case <-q.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the workers after their current report. Reports not written
+// yet stay in the spool for the next Start.
+func (q *Queue) Stop() {
+	q.mux.Lock()
+	if q.stopped {
+		q.mux.Unlock()
+		return
+	}
+	q.stopped = true
+	close(q.stop)
+	q.mux.Unlock()
+	q.wg.Wait()
+}
+
+// Depth returns the number of reports spooled but not written yet.
+func (q *Queue) Depth() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.pending
+}
+
+// Add spools the report. When it returns nil the report is on disk and will
+// be written even if the API restarts, so the agent can remove its copy.
+func (q *Queue) Add(report qp.Report) error {
+	q.mux.Lock()
+	if q.stopped {
+		q.mux.Unlock()
+		return ErrQueueStopped
+	}
+	if q.pending >= q.cfg.Depth {
+		q.mux.Unlock()
+		return ErrQueueFull
+	}
+	q.pending++
+	q.seq++
+	// Names sort in the order reports were added, also across restarts.
+	name := fmt.Sprintf("%019d-%06d%s", time.Now().UnixNano(), q.seq%1000000, spoolExt)
+	q.mux.Unlock()
+
+	file := filepath.Join(q.cfg.SpoolDir, name)
+	if err := q.spool(file, report); err != nil {
+		q.done()
+		return err
+	}
+	q.gauge()
+
+	// Can't block: pending < Depth so there's room in the channel.
+	q.files <- file
+	return nil
+}
+
+func (q *Queue) spool(file string, report qp.Report) error {
+	bytes, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	// Write a temp file and rename it so Start never sees a partial report.
+	tmp, err := ioutil.TempFile(q.cfg.SpoolDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after rename
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (q *Queue) worker() {
+	defer q.wg.Done()
+
+	w := q.newWriter()
+	if c, ok := w.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	for {
+		select {
+		case file := <-q.files:
+			q.write(w, file)
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// write writes the spooled report and removes it from the spool, or leaves
+// it there if the queue is stopped before MySQL comes back.
+func (q *Queue) write(w MetricWriter, file string) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Printf("WARN: qan.Queue: cannot read %s: %s", file, err)
+		q.remove(file)
+		return
+	}
+	var report qp.Report
+	if err := json.Unmarshal(bytes, &report); err != nil {
+		log.Printf("WARN: qan.Queue: invalid report in %s: %s", file, err)
+		q.stats.Inc(q.stats.Metric("qan.queue.err-spool"), 1, q.stats.SampleRate)
+		q.remove(file)
+		return
+	}
+
+	for {
+		t := time.Now()
+		err := w.Write(report)
+		q.stats.TimingDuration(q.stats.Metric("qan.queue.db"), time.Now().Sub(t), q.stats.SampleRate)
+		if err == nil {
+			break
+		}
+		if !retryable(err) {
+			// Usually bad data or an instance that was removed, stuff we can't
+			// recover from, so drop the report and move on.
+			log.Printf("WARN: qan.Queue: dropping report %s for %s: %s", file, report.UUID, err)
+			q.stats.Inc(q.stats.Metric("qan.queue.err-db"), 1, q.stats.SampleRate)
+			break
+		}
+		log.Printf("WARN: qan.Queue: cannot write report %s, retrying in %s: %s", file, q.cfg.Retry, err)
+		q.stats.Inc(q.stats.Metric("qan.queue.retry"), 1, q.stats.SampleRate)
+		select {
+		case <-time.After(q.cfg.Retry):
+		case <-q.stop:
+			q.done()
+			return
+		}
+	}
+	q.remove(file)
+}
+
+func (q *Queue) remove(file string) {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		log.Printf("WARN: qan.Queue: cannot remove %s: %s", file, err)
+	}
+	q.done()
+}
+
+func (q *Queue) done() {
+	q.mux.Lock()
+	q.pending--
+	q.mux.Unlock()
+	q.gauge()
+}
+
+func (q *Queue) gauge() {
+	q.stats.Gauge(q.stats.Metric("qan.queue.depth"), int64(q.Depth()), 1)
+}
+
+// retryable returns true if the error is MySQL being unavailable rather
+// than a problem with the report.
+func retryable(err error) bool {
+	var netErr *net.OpError
+	switch {
+	case errors.As(err, &netErr),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, gomysql.ErrInvalidConn),
+		errors.Is(err, shared.ErrReadOnlyDb),
+		errors.Is(err, shared.ErrQueryTimeout):
+		return true
+	}
+	return false
+}
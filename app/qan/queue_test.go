@@ -0,0 +1,220 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package qan_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/app/instance"
+	"github.com/shatteredsilicon/qan-api/app/qan"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+	"github.com/shatteredsilicon/qan-api/stats"
+	"github.com/shatteredsilicon/ssm/proto"
+	qp "github.com/shatteredsilicon/ssm/proto/qan"
+	. "gopkg.in/check.v1"
+)
+
+// mockWriter records the UUIDs of the reports it writes. Write blocks while
+// block is set and returns err if set.
+type mockWriter struct {
+	mux   *sync.Mutex
+	uuids []string
+	err   error
+	block chan struct{}
+}
+
+func newMockWriter() *mockWriter {
+	return &mockWriter{mux: &sync.Mutex{}}
+}
+
+func (w *mockWriter) Write(report qp.Report) error {
+	if w.block != nil {
+		<-w.block
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.uuids = append(w.uuids, report.UUID)
+	return nil
+}
+
+func (w *mockWriter) written() []string {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return append([]string{}, w.uuids...)
+}
+
+// downInstanceHandler is an instance handler when MySQL is down: Get
+// returns a network error like the MySQL driver does.
+type downInstanceHandler struct {
+	instance.DbHandler
+	mux  *sync.Mutex
+	gets int
+}
+
+func (h *downInstanceHandler) Get(uuid string) (uint, *proto.Instance, error) {
+	h.mux.Lock()
+	h.gets++
+	h.mux.Unlock()
+	err := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	return 0, nil, mysql.Error(err, "MySQLHandler.Get: SELECT instances")
+}
+
+type QueueTestSuite struct {
+	spoolDir string
+}
+
+var _ = Suite(&QueueTestSuite{})
+
+func (s *QueueTestSuite) SetUpTest(t *C) {
+	var err error
+	s.spoolDir, err = ioutil.TempDir("", "qan-spool")
+	t.Assert(err, IsNil)
+}
+
+func (s *QueueTestSuite) TearDownTest(t *C) {
+	os.RemoveAll(s.spoolDir)
+}
+
+func (s *QueueTestSuite) newQueue(depth int, w *mockWriter) *qan.Queue {
+	cfg := qan.QueueConfig{
+		Depth:    depth,
+		Workers:  1,
+		SpoolDir: s.spoolDir,
+		Retry:    10 * time.Millisecond,
+	}
+	return qan.NewQueue(cfg, func() qan.MetricWriter { return w }, stats.NullStats())
+}
+
+func (s *QueueTestSuite) spooled(t *C) int {
+	files, err := filepath.Glob(filepath.Join(s.spoolDir, "*.json"))
+	t.Assert(err, IsNil)
+	return len(files)
+}
+
+func waitEmpty(q *qan.Queue) int {
+	for i := 0; i < 100 && q.Depth() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return q.Depth()
+}
+
+// --------------------------------------------------------------------------
+
+func (s *QueueTestSuite) TestWrite(t *C) {
+	w := newMockWriter()
+	q := s.newQueue(10, w)
+	t.Assert(q.Start(), IsNil)
+	defer q.Stop()
+
+	for _, uuid := range []string{"1", "2", "3"} {
+		err := q.Add(qp.Report{UUID: uuid})
+		t.Assert(err, IsNil)
+	}
+	t.Assert(waitEmpty(q), Equals, 0)
+	t.Check(w.written(), DeepEquals, []string{"1", "2", "3"})
+	t.Check(s.spooled(t), Equals, 0)
+}
+
+func (s *QueueTestSuite) TestFull(t *C) {
+	w := newMockWriter()
+	w.block = make(chan struct{})
+	q := s.newQueue(2, w)
+	t.Assert(q.Start(), IsNil)
+	defer q.Stop()
+
+	t.Check(q.Add(qp.Report{UUID: "1"}), IsNil)
+	t.Check(q.Add(qp.Report{UUID: "2"}), IsNil)
+	t.Check(q.Add(qp.Report{UUID: "3"}), Equals, qan.ErrQueueFull)
+	t.Check(q.Depth(), Equals, 2)
+
+	close(w.block)
+	t.Assert(waitEmpty(q), Equals, 0)
+	t.Check(w.written(), DeepEquals, []string{"1", "2"})
+	t.Check(q.Add(qp.Report{UUID: "3"}), IsNil)
+}
+
+func (s *QueueTestSuite) TestRestart(t *C) {
+	// MySQL is read-only so the reports stay in the spool.
+	w := newMockWriter()
+	w.err = shared.ErrReadOnlyDb
+	q := s.newQueue(10, w)
+	t.Assert(q.Start(), IsNil)
+	t.Check(q.Add(qp.Report{UUID: "1"}), IsNil)
+	t.Check(q.Add(qp.Report{UUID: "2"}), IsNil)
+	time.Sleep(50 * time.Millisecond)
+	q.Stop()
+	t.Check(q.Add(qp.Report{UUID: "3"}), Equals, qan.ErrQueueStopped)
+	t.Check(s.spooled(t), Equals, 2)
+
+	// After a restart, the spooled reports are written in order.
+	w = newMockWriter()
+	q = s.newQueue(10, w)
+	t.Assert(q.Start(), IsNil)
+	defer q.Stop()
+	t.Assert(waitEmpty(q), Equals, 0)
+	t.Check(w.written(), DeepEquals, []string{"1", "2"})
+	t.Check(s.spooled(t), Equals, 0)
+}
+
+func (s *QueueTestSuite) TestDrop(t *C) {
+	// Errors other than MySQL being unavailable drop the report.
+	w := newMockWriter()
+	w.err = errors.New("missing report.Global")
+	q := s.newQueue(10, w)
+	t.Assert(q.Start(), IsNil)
+	defer q.Stop()
+
+	t.Check(q.Add(qp.Report{UUID: "1"}), IsNil)
+	t.Assert(waitEmpty(q), Equals, 0)
+	t.Check(w.written(), HasLen, 0)
+	t.Check(s.spooled(t), Equals, 0)
+}
+
+func (s *QueueTestSuite) TestMySQLDown(t *C) {
+	// The first query of a MySQLMetricWriter fails because MySQL is down or
+	// restarting: the report is retried and stays in the spool.
+	ih := &downInstanceHandler{mux: &sync.Mutex{}}
+	w := qan.NewMySQLMetricWriter(nil, ih, nil, stats.NullStats())
+	cfg := qan.QueueConfig{
+		Depth:    10,
+		Workers:  1,
+		SpoolDir: s.spoolDir,
+		Retry:    10 * time.Millisecond,
+	}
+	q := qan.NewQueue(cfg, func() qan.MetricWriter { return w }, stats.NullStats())
+	t.Assert(q.Start(), IsNil)
+	t.Check(q.Add(qp.Report{UUID: "1"}), IsNil)
+	time.Sleep(50 * time.Millisecond)
+	q.Stop()
+
+	ih.mux.Lock()
+	gets := ih.gets
+	ih.mux.Unlock()
+	t.Check(gets > 1, Equals, true)
+	t.Check(s.spooled(t), Equals, 1)
+}
@@ -0,0 +1,244 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package query
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+)
+
+// Note is a markdown note attached to a query class, e.g. why the query is
+// slow and what was done about it. Tags are searchable, see ValidTag.
+type Note struct {
+	Id      uint
+	QueryId string // checksum, set by the API
+	User    string
+	Body    string   // markdown
+	Tickets []string // e.g. JIRA-1234 or a URL
+	Tags    []string
+	Created time.Time
+	Updated time.Time
+}
+
+const (
+	maxNoteBody = 65535 // TEXT
+	maxTickets  = 255   // bytes, JSON encoded
+	maxTags     = 20
+)
+
+var tagRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,31}$`)
+
+// ValidTag returns true if tag is 1 to 32 lowercase letters, digits, _, .
+// or -, starting with a letter or digit.
+func ValidTag(tag string) bool {
+	return tagRe.MatchString(tag)
+}
+
+// Validate checks the note. Tags are lowercased, trimmed and deduplicated.
+func (n *Note) Validate() error {
+	if n.User == "" {
+		return fmt.Errorf("User is required")
+	}
+	if strings.TrimSpace(n.Body) == "" {
+		return fmt.Errorf("Body is required")
+	}
+	if len(n.Body) > maxNoteBody {
+		return fmt.Errorf("Body is too long: %d bytes, max %d", len(n.Body), maxNoteBody)
+	}
+	if n.Tickets == nil {
+		n.Tickets = []string{}
+	}
+	if ticketsJSON, _ := json.Marshal(n.Tickets); len(ticketsJSON) > maxTickets {
+		return fmt.Errorf("Tickets are too long: %d bytes, max %d", len(ticketsJSON), maxTickets)
+	}
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range n.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !ValidTag(tag) {
+			return fmt.Errorf("invalid tag: %s: must be 1 to 32 letters, digits, _, . or -", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTags {
+		return fmt.Errorf("too many tags: %d, max %d", len(tags), maxTags)
+	}
+	n.Tags = tags
+	return nil
+}
+
+// Notes returns the notes of the query class, the oldest first.
+func (h *MySQLHandler) Notes(classId uint) ([]Note, error) {
+	return h.notes("WHERE n.query_class_id = ?", classId)
+}
+
+// Note returns the note of the query class, or shared.ErrNotFound.
+func (h *MySQLHandler) Note(classId, noteId uint) (*Note, error) {
+	notes, err := h.notes("WHERE n.query_class_id = ? AND n.note_id = ?", classId, noteId)
+	if err != nil {
+		return nil, err
+	}
+	if len(notes) == 0 {
+		return nil, shared.ErrNotFound
+	}
+	return &notes[0], nil
+}
+
+func (h *MySQLHandler) notes(where string, args ...interface{}) ([]Note, error) {
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(),
+		"SELECT n.note_id, c.checksum, n.user, n.body, n.tickets, COALESCE(GROUP_CONCAT(t.tag ORDER BY t.tag), ''), n.created, n.updated"+
+			" FROM query_notes n"+
+			" JOIN query_classes c USING (query_class_id)"+
+			" LEFT JOIN query_note_tags t USING (note_id)"+
+			" "+where+
+			" GROUP BY n.note_id"+
+			" ORDER BY n.created, n.note_id",
+		args...)
+	if err != nil {
+		return nil, mysql.Error(err, "Notes: SELECT query_notes")
+	}
+	defer rows.Close()
+	notes := []Note{}
+	for rows.Next() {
+		n := Note{}
+		var ticketsJSON, tags string
+		if err := rows.Scan(&n.Id, &n.QueryId, &n.User, &n.Body, &ticketsJSON, &tags, &n.Created, &n.Updated); err != nil {
+			return nil, mysql.Error(err, "Notes: rows.Scan")
+		}
+		if err := json.Unmarshal([]byte(ticketsJSON), &n.Tickets); err != nil {
+			return nil, err
+		}
+		n.Tags = []string{}
+		if tags != "" {
+			n.Tags = strings.Split(tags, ",")
+		}
+		notes = append(notes, n)
+	}
+	return notes, mysql.Error(rows.Err(), "Notes: rows.Next")
+}
+
+// CreateNote inserts a validated note and returns its ID.
+func (h *MySQLHandler) CreateNote(classId uint, n Note) (uint, error) {
+	ticketsJSON, err := json.Marshal(n.Tickets)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := h.dbm.DB().BeginTx(h.dbm.Context(), nil)
+	if err != nil {
+		return 0, mysql.Error(err, "CreateNote: Begin")
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	res, err := tx.Exec(
+		"INSERT INTO query_notes (query_class_id, user, body, tickets, created, updated) VALUES (?, ?, ?, ?, ?, ?)",
+		classId, n.User, n.Body, ticketsJSON, now, now)
+	if err != nil {
+		return 0, mysql.Error(err, "CreateNote: INSERT query_notes")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("cannot get note last insert id")
+	}
+	if err := setTags(tx, classId, uint(id), n.Tags); err != nil {
+		return 0, err
+	}
+	return uint(id), mysql.Error(tx.Commit(), "CreateNote: Commit")
+}
+
+// UpdateNote replaces the validated note with ID n.Id.
+func (h *MySQLHandler) UpdateNote(classId uint, n Note) error {
+	ticketsJSON, err := json.Marshal(n.Tickets)
+	if err != nil {
+		return err
+	}
+	tx, err := h.dbm.DB().BeginTx(h.dbm.Context(), nil)
+	if err != nil {
+		return mysql.Error(err, "UpdateNote: Begin")
+	}
+	defer tx.Rollback()
+
+	var id uint
+	err = tx.QueryRow("SELECT note_id FROM query_notes WHERE query_class_id = ? AND note_id = ? FOR UPDATE", classId, n.Id).Scan(&id)
+	if err == sql.ErrNoRows {
+		return shared.ErrNotFound
+	}
+	if err != nil {
+		return mysql.Error(err, "UpdateNote: SELECT query_notes")
+	}
+	_, err = tx.Exec(
+		"UPDATE query_notes SET user = ?, body = ?, tickets = ?, updated = ? WHERE note_id = ?",
+		n.User, n.Body, ticketsJSON, time.Now().UTC().Truncate(time.Second), n.Id)
+	if err != nil {
+		return mysql.Error(err, "UpdateNote: UPDATE query_notes")
+	}
+	if err := setTags(tx, classId, n.Id, n.Tags); err != nil {
+		return err
+	}
+	return mysql.Error(tx.Commit(), "UpdateNote: Commit")
+}
+
+// DeleteNote deletes the note of the query class.
+func (h *MySQLHandler) DeleteNote(classId, noteId uint) error {
+	tx, err := h.dbm.DB().BeginTx(h.dbm.Context(), nil)
+	if err != nil {
+		return mysql.Error(err, "DeleteNote: Begin")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM query_notes WHERE query_class_id = ? AND note_id = ?", classId, noteId)
+	if err != nil {
+		return mysql.Error(err, "DeleteNote: DELETE query_notes")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return shared.ErrNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM query_note_tags WHERE note_id = ?", noteId); err != nil {
+		return mysql.Error(err, "DeleteNote: DELETE query_note_tags")
+	}
+	return mysql.Error(tx.Commit(), "DeleteNote: Commit")
+}
+
+// setTags replaces the tags of the note. query_class_id is denormalized into
+// query_note_tags so a profile can filter classes by tag without a join.
+func setTags(tx *sql.Tx, classId, noteId uint, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM query_note_tags WHERE note_id = ?", noteId); err != nil {
+		return mysql.Error(err, "setTags: DELETE query_note_tags")
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	values := make([]string, len(tags))
+	args := make([]interface{}, 0, len(tags)*3)
+	for i, tag := range tags {
+		values[i] = "(?, ?, ?)"
+		args = append(args, noteId, classId, tag)
+	}
+	_, err := tx.Exec("INSERT INTO query_note_tags (note_id, query_class_id, tag) VALUES "+strings.Join(values, ", "), args...)
+	return mysql.Error(err, "setTags: INSERT query_note_tags")
+}
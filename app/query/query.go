@@ -18,6 +18,7 @@
 package query
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -28,18 +29,19 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/shatteredsilicon/qan-api/app/db"
 	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/app/instance"
 	"github.com/shatteredsilicon/qan-api/app/shared"
 	queryService "github.com/shatteredsilicon/qan-api/service/query"
 	"github.com/shatteredsilicon/qan-api/stats"
 	queryProto "github.com/shatteredsilicon/ssm/proto/query"
 )
 
-func GetClassId(db *sql.DB, checksum string) (uint, error) {
+func GetClassId(ctx context.Context, db *sql.DB, checksum string) (uint, error) {
 	if checksum == "" {
 		return 0, nil
 	}
 	var classId uint
-	err := db.QueryRow("SELECT query_class_id FROM query_classes WHERE checksum = ?", checksum).Scan(&classId)
+	err := db.QueryRowContext(ctx, "SELECT query_class_id FROM query_classes WHERE checksum = ?", checksum).Scan(&classId)
 	if err != nil {
 		return 0, mysql.Error(err, "GetClassId: SELECT query_classes")
 	}
@@ -64,7 +66,7 @@ func (h *MySQLHandler) Get(ids []string) (map[string]queryProto.Query, error) {
 		" FROM query_classes" +
 		" WHERE checksum IN (" + shared.Placeholders(len(ids)) + ")"
 	v := shared.GenericStringList(ids)
-	rows, err := h.dbm.DB().Query(q, v...)
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(), q, v...)
 	if err != nil {
 		return nil, err
 	}
@@ -120,7 +122,7 @@ func (h *MySQLHandler) Examples(classId, instanceId uint) ([]queryProto.Example,
 	}
 	q += " ORDER BY period DESC"
 
-	rows, err := h.dbm.DB().Query(q, params...)
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(), q, params...)
 	if err != nil {
 		return nil, err
 	}
@@ -161,7 +163,7 @@ func (h *MySQLHandler) Example(classId uint, instanceIds []uint, period time.Tim
 		" WHERE query_class_id = ? AND qe.instance_id IN (%s) AND period <= ?"+
 		" ORDER BY period DESC, Query_time DESC"+
 		" LIMIT 1", placeholders)
-	err := h.dbm.DB().QueryRow(q, values...).Scan(&e.Period, &e.Ts, &e.Db, &e.QueryTime, &e.Query, &e.Explain, &e.InstanceUUID)
+	err := h.dbm.DB().QueryRowContext(h.dbm.Context(), q, values...).Scan(&e.Period, &e.Ts, &e.Db, &e.QueryTime, &e.Query, &e.Explain, &e.InstanceUUID)
 	if err != nil {
 		return e, mysql.Error(err, "Example: SELECT query_examples")
 	}
@@ -188,7 +190,7 @@ func (h *MySQLHandler) UserSources(classId uint, instanceIds []uint, begin, end
 		return nil, mysql.Error(err, "UserSource: sqlx IN")
 	}
 
-	rows, err := h.dbm.DB().Query(query, args...)
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(), query, args...)
 	if err != nil {
 		return nil, mysql.Error(err, "UserSource: SELECT query_user_sources")
 	}
@@ -216,7 +218,7 @@ func (h *MySQLHandler) UserSources(classId uint, instanceIds []uint, begin, end
 
 func (h *MySQLHandler) UpdateExample(classId, instanceId uint, example queryProto.Example) error {
 	// todo: WHERE query_class_id=? AND instance_id=? AND period=?
-	r, err := h.dbm.DB().Exec(
+	r, err := h.dbm.DB().ExecContext(h.dbm.Context(),
 		"UPDATE query_examples SET db = ?"+
 			" WHERE query_class_id = ? AND instance_id = ? AND period = ?",
 		example.Db, classId, instanceId, example.Period,
@@ -239,7 +241,7 @@ func (h *MySQLHandler) UpdateTables(classID uint, tables []queryProto.Table) err
 	if err != nil {
 		return err
 	}
-	_, err = h.dbm.DB().Exec("UPDATE query_classes SET tables = ? WHERE query_class_id = ?", string(bytes), classID)
+	_, err = h.dbm.DB().ExecContext(h.dbm.Context(), "UPDATE query_classes SET tables = ? WHERE query_class_id = ?", string(bytes), classID)
 	if err != nil {
 		return mysql.Error(err, "UpdateTables: UPDATE query_classes")
 	}
@@ -254,7 +256,7 @@ func (h *MySQLHandler) UpdateProcedures(classID uint, procedures []queryProto.Pr
 	if err != nil {
 		return err
 	}
-	_, err = h.dbm.DB().Exec("UPDATE query_classes SET procedures = ? WHERE query_class_id = ?", string(bytes), classID)
+	_, err = h.dbm.DB().ExecContext(h.dbm.Context(), "UPDATE query_classes SET procedures = ? WHERE query_class_id = ?", string(bytes), classID)
 	if err != nil {
 		return mysql.Error(err, "UpdateProcedures: UPDATE query_classes")
 	}
@@ -274,7 +276,7 @@ func (h *MySQLHandler) UpdateTablesAndProcedures(classID uint, tables []queryPro
 		return err
 	}
 
-	_, err = h.dbm.DB().Exec("UPDATE query_classes SET tables = ?, procedures = ? WHERE query_class_id = ?", string(tableBytes), string(procedureBytes), classID)
+	_, err = h.dbm.DB().ExecContext(h.dbm.Context(), "UPDATE query_classes SET tables = ?, procedures = ? WHERE query_class_id = ?", string(tableBytes), string(procedureBytes), classID)
 	if err != nil {
 		return mysql.Error(err, "UpdateTablesAndProcedures: UPDATE query_classes")
 	}
@@ -285,7 +287,7 @@ func (h *MySQLHandler) Tables(classId uint, m *queryService.Mini) ([]queryProto.
 	// First try to get the tables. If we're lucky, they've already been parsed
 	// and we're done.
 	var tablesJSON string
-	err := h.dbm.DB().QueryRow("SELECT COALESCE(tables, '') FROM query_classes WHERE query_class_id = ?", classId).Scan(&tablesJSON)
+	err := h.dbm.DB().QueryRowContext(h.dbm.Context(), "SELECT COALESCE(tables, '') FROM query_classes WHERE query_class_id = ?", classId).Scan(&tablesJSON)
 	if err != nil {
 		return nil, mysql.Error(err, "Tables: SELECT query_classes (tables)")
 	}
@@ -301,34 +303,39 @@ func (h *MySQLHandler) Tables(classId uint, m *queryService.Mini) ([]queryProto.
 
 	// We're not lucky: this query hasn't been parsed yet, so do it now, if possible.
 	var fingerprint string
-	err = h.dbm.DB().QueryRow("SELECT fingerprint FROM query_classes WHERE query_class_id = ?", classId).Scan(&fingerprint)
+	err = h.dbm.DB().QueryRowContext(h.dbm.Context(), "SELECT fingerprint FROM query_classes WHERE query_class_id = ?", classId).Scan(&fingerprint)
 	if err != nil {
 		return nil, mysql.Error(err, "Tables: SELECT query_classes (fingerprint)")
 	}
 
-	// Get database from latest example.
+	// Get database and subsystem from latest example.
 	var example, db string
-	err = h.dbm.DB().QueryRow(
-		"SELECT query, db "+
+	var subsystemId uint
+	err = h.dbm.DB().QueryRowContext(h.dbm.Context(),
+		"SELECT query, db, i.subsystem_id "+
 			" FROM query_examples "+
 			" JOIN query_classes c USING (query_class_id)"+
 			" JOIN instances i USING (instance_id)"+
 			" WHERE query_class_id = ?"+
 			" ORDER BY period DESC",
 		classId,
-	).Scan(&example, &db)
+	).Scan(&example, &db, &subsystemId)
 	if err != nil {
 		return nil, mysql.Error(err, "Tables: SELECT query_examples (db)")
 	}
 
-	// If this returns an error, then youtube/vitess/go/sqltypes/sqlparser
-	// doesn't support the query type.
-	tableInfo, err := m.Parse(fingerprint, example, db)
+	subsystem, err := instance.LookupId(subsystemId)
+	if err != nil {
+		return nil, shared.ErrNotImplemented
+	}
+	// If this returns an error, then the parser of the subsystem, e.g.
+	// youtube/vitess/go/sqltypes/sqlparser, doesn't support the query type.
+	tableInfo, err := subsystem.Parse(m, fingerprint, example, db)
 	if err != nil {
 		return nil, shared.ErrNotImplemented
 	}
 
-	// The sqlparser was able to handle the query, so marshal the tables
+	// The query was parsed, so marshal the tables
 	// into a string and update the tables column so next time we don't
 	// have to parse the query.
 	if err := h.UpdateTablesAndProcedures(classId, tableInfo.Tables, tableInfo.Procedures); err != nil {
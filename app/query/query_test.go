@@ -18,6 +18,7 @@
 package query_test
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"testing"
@@ -26,6 +27,7 @@ import (
 	"github.com/cactus/go-statsd-client/statsd"
 	"github.com/shatteredsilicon/qan-api/app/db"
 	"github.com/shatteredsilicon/qan-api/app/query"
+	"github.com/shatteredsilicon/qan-api/app/shared"
 	"github.com/shatteredsilicon/qan-api/config"
 	queryService "github.com/shatteredsilicon/qan-api/service/query"
 	"github.com/shatteredsilicon/qan-api/stats"
@@ -105,3 +107,160 @@ func (s *TestSuite) TestTables(t *C) {
 	assert.NoError(t, err)
 	assert.Equal(t, []queryProto.Table([]queryProto.Table{{Db: "percona", Table: "cache"}}), got)
 }
+
+func (s *TestSuite) TestStatus(t *C) {
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+
+	id := "92F3B1B361FB0E5B"
+	classId, err := query.GetClassId(context.Background(), s.testDb.DB(), id)
+	t.Assert(err, IsNil)
+
+	qh := query.NewMySQLHandler(db.DBManager, s.nullStats)
+	err = qh.SetStatus(classId, "done", "dba", "")
+	t.Check(err, NotNil)
+
+	err = qh.SetStatus(classId, query.StatusReviewed, "dba", "looks ok")
+	t.Assert(err, IsNil)
+	err = qh.SetStatus(classId, query.StatusFixed, "dev", "added index")
+	t.Assert(err, IsNil)
+
+	got, err := qh.Get([]string{id})
+	t.Assert(err, IsNil)
+	t.Check(got[id].Status, Equals, query.StatusFixed)
+
+	log, err := qh.StatusLog(classId)
+	t.Assert(err, IsNil)
+	t.Assert(log, HasLen, 2)
+	t.Check(log[0].QueryId, Equals, id)
+	t.Check(log[0].OldStatus, Equals, query.StatusReviewed)
+	t.Check(log[0].NewStatus, Equals, query.StatusFixed)
+	t.Check(log[0].User, Equals, "dev")
+	t.Check(log[0].Comment, Equals, "added index")
+	t.Check(log[1].OldStatus, Equals, query.StatusNew)
+	t.Check(log[1].NewStatus, Equals, query.StatusReviewed)
+}
+
+func (s *TestSuite) TestReverter(t *C) {
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+
+	id := "92F3B1B361FB0E5B"
+	classId, err := query.GetClassId(context.Background(), s.testDb.DB(), id)
+	t.Assert(err, IsNil)
+	qh := query.NewMySQLHandler(db.DBManager, s.nullStats)
+	err = qh.SetStatus(classId, query.StatusFixed, "dev", "")
+	t.Assert(err, IsNil)
+
+	fixedAt := time.Date(2015, time.June, 01, 0, 0, 0, 0, time.UTC)
+	_, err = s.testDb.DB().Exec("UPDATE query_classes SET status_changed = ? WHERE query_class_id = ?", fixedAt, classId)
+	t.Assert(err, IsNil)
+	insert := func(ts time.Time, queryTimeSum float64) {
+		_, err := s.testDb.DB().Exec(
+			"INSERT INTO query_class_metrics (query_class_id, instance_id, start_ts, end_ts, query_count, Query_time_sum)"+
+				" VALUES (?, 1, ?, ?, 1, ?)",
+			classId, ts, ts.Add(time.Minute), queryTimeSum)
+		t.Assert(err, IsNil)
+	}
+
+	cfg := query.ReverterConfig{
+		Window:  time.Hour,
+		Factor:  2,
+		MinLoad: 0.01,
+	}
+	r := query.NewReverter(db.DBManager, cfg, s.nullStats)
+
+	// Load the first hour after the fix: 36s / 3600s = 0.01
+	insert(fixedAt.Add(10*time.Minute), 36)
+	n, err := r.Check(fixedAt.Add(30 * time.Minute))
+	t.Assert(err, IsNil)
+	t.Check(n, Equals, uint(0))
+	n, err = r.Check(fixedAt.Add(time.Hour))
+	t.Assert(err, IsNil)
+	t.Check(n, Equals, uint(0))
+
+	// Same load: still fixed.
+	insert(fixedAt.Add(70*time.Minute), 36)
+	n, err = r.Check(fixedAt.Add(2 * time.Hour))
+	t.Assert(err, IsNil)
+	t.Check(n, Equals, uint(0))
+
+	// 10x the load: needs attention.
+	insert(fixedAt.Add(130*time.Minute), 360)
+	n, err = r.Check(fixedAt.Add(3 * time.Hour))
+	t.Assert(err, IsNil)
+	t.Check(n, Equals, uint(1))
+
+	got, err := qh.Get([]string{id})
+	t.Assert(err, IsNil)
+	t.Check(got[id].Status, Equals, query.StatusNeedsAttention)
+	log, err := qh.StatusLog(classId)
+	t.Assert(err, IsNil)
+	t.Check(log[0].User, Equals, query.SystemUser)
+	t.Check(log[0].OldStatus, Equals, query.StatusFixed)
+}
+
+func (s *TestSuite) TestRegressed(t *C) {
+	t.Check(query.Regressed(0.1, 0.01, 2, 0.01), Equals, true)
+	t.Check(query.Regressed(0.015, 0.01, 2, 0.01), Equals, false)
+	t.Check(query.Regressed(0.005, 0, 2, 0.01), Equals, false) // below min load
+	t.Check(query.Regressed(0.02, 0, 2, 0.01), Equals, true)
+}
+
+func (s *TestSuite) TestNotes(t *C) {
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+
+	id := "92F3B1B361FB0E5B"
+	classId, err := query.GetClassId(context.Background(), s.testDb.DB(), id)
+	t.Assert(err, IsNil)
+	qh := query.NewMySQLHandler(db.DBManager, s.nullStats)
+
+	notes, err := qh.Notes(classId)
+	t.Assert(err, IsNil)
+	t.Check(notes, HasLen, 0)
+
+	n := query.Note{
+		User:    "dba",
+		Body:    "Full scan, see ticket.",
+		Tickets: []string{"OPS-42"},
+		Tags:    []string{"Full-Scan", " orm ", "full-scan"},
+	}
+	t.Assert(n.Validate(), IsNil)
+	t.Check(n.Tags, DeepEquals, []string{"full-scan", "orm"})
+	noteId, err := qh.CreateNote(classId, n)
+	t.Assert(err, IsNil)
+
+	got, err := qh.Note(classId, noteId)
+	t.Assert(err, IsNil)
+	t.Check(got.QueryId, Equals, id)
+	t.Check(got.User, Equals, "dba")
+	t.Check(got.Body, Equals, n.Body)
+	t.Check(got.Tickets, DeepEquals, []string{"OPS-42"})
+	t.Check(got.Tags, DeepEquals, []string{"full-scan", "orm"})
+
+	n.Id = noteId
+	n.Tags = []string{"fixed-in-app"}
+	n.Tickets = nil
+	t.Assert(n.Validate(), IsNil)
+	t.Assert(qh.UpdateNote(classId, n), IsNil)
+	notes, err = qh.Notes(classId)
+	t.Assert(err, IsNil)
+	t.Assert(notes, HasLen, 1)
+	t.Check(notes[0].Tags, DeepEquals, []string{"fixed-in-app"})
+	t.Check(notes[0].Tickets, DeepEquals, []string{})
+
+	// Notes belong to a class.
+	t.Check(qh.UpdateNote(classId+1, n), Equals, shared.ErrNotFound)
+	t.Check(qh.DeleteNote(classId+1, noteId), Equals, shared.ErrNotFound)
+
+	t.Assert(qh.DeleteNote(classId, noteId), IsNil)
+	_, err = qh.Note(classId, noteId)
+	t.Check(err, Equals, shared.ErrNotFound)
+	var tags int
+	err = s.testDb.DB().QueryRow("SELECT COUNT(*) FROM query_note_tags").Scan(&tags)
+	t.Assert(err, IsNil)
+	t.Check(tags, Equals, 0)
+
+	bad := query.Note{User: "dba", Body: "x", Tags: []string{"two words"}}
+	t.Check(bad.Validate(), NotNil)
+	bad = query.Note{User: "dba", Body: " "}
+	t.Check(bad.Validate(), NotNil)
+}
@@ -0,0 +1,313 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package query
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/revel/revel"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	"github.com/shatteredsilicon/qan-api/stats"
+)
+
+// Query class statuses, query_classes.status. Every class starts as new;
+// users change the status as they triage it, except fixed which reverts to
+// needs-attention when the load of the class rises again, see Reverter.
+const (
+	StatusNew            = "new"
+	StatusReviewed       = "reviewed"
+	StatusIgnored        = "ignored"
+	StatusFixed          = "fixed"
+	StatusNeedsAttention = "needs-attention"
+)
+
+var Statuses = []string{StatusNew, StatusReviewed, StatusIgnored, StatusFixed, StatusNeedsAttention}
+
+// ValidStatus returns true if status is one of Statuses.
+func ValidStatus(status string) bool {
+	for _, s := range Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// User recorded in the status log for automatic changes.
+const SystemUser = "qan-api"
+
+// StatusChange is a change of a query class status in the status log.
+type StatusChange struct {
+	QueryId   string // checksum
+	OldStatus string
+	NewStatus string
+	User      string
+	Comment   string
+	Ts        time.Time
+}
+
+// SetStatus changes the status of the query class and logs the change. A
+// status is logged even if it didn't change so the comment is kept.
+func (h *MySQLHandler) SetStatus(classId uint, status, user, comment string) error {
+	if !ValidStatus(status) {
+		return fmt.Errorf("invalid status: %s", status)
+	}
+	tx, err := h.dbm.DB().BeginTx(h.dbm.Context(), nil)
+	if err != nil {
+		return mysql.Error(err, "SetStatus: Begin")
+	}
+	defer tx.Rollback()
+
+	var oldStatus string
+	err = tx.QueryRow("SELECT status FROM query_classes WHERE query_class_id = ? FOR UPDATE", classId).Scan(&oldStatus)
+	if err != nil {
+		return mysql.Error(err, "SetStatus: SELECT query_classes")
+	}
+	if err := setStatus(tx, classId, oldStatus, status, user, comment, time.Now()); err != nil {
+		return err
+	}
+	return mysql.Error(tx.Commit(), "SetStatus: Commit")
+}
+
+func setStatus(tx *sql.Tx, classId uint, oldStatus, status, user, comment string, ts time.Time) error {
+	// fixed_load is set by Reverter after the class was fixed, see Reverter.
+	ts = ts.UTC().Truncate(time.Second)
+	_, err := tx.Exec(
+		"UPDATE query_classes SET status = ?, status_changed = ?, fixed_load = NULL WHERE query_class_id = ?",
+		status, ts, classId)
+	if err != nil {
+		return mysql.Error(err, "SetStatus: UPDATE query_classes")
+	}
+	_, err = tx.Exec(
+		"INSERT INTO query_class_status_log (query_class_id, old_status, new_status, user, comment, ts)"+
+			" VALUES (?, ?, ?, ?, ?, ?)",
+		classId, oldStatus, status, user, comment, ts)
+	if err != nil {
+		return mysql.Error(err, "SetStatus: INSERT query_class_status_log")
+	}
+	return nil
+}
+
+// StatusLog returns the status changes of the query class, the most recent
+// first.
+func (h *MySQLHandler) StatusLog(classId uint) ([]StatusChange, error) {
+	rows, err := h.dbm.DB().QueryContext(h.dbm.Context(),
+		"SELECT c.checksum, l.old_status, l.new_status, l.user, l.comment, l.ts"+
+			" FROM query_class_status_log l JOIN query_classes c USING (query_class_id)"+
+			" WHERE l.query_class_id = ?"+
+			" ORDER BY l.ts DESC, l.id DESC",
+		classId)
+	if err != nil {
+		return nil, mysql.Error(err, "StatusLog: SELECT query_class_status_log")
+	}
+	defer rows.Close()
+	log := []StatusChange{}
+	for rows.Next() {
+		c := StatusChange{}
+		if err := rows.Scan(&c.QueryId, &c.OldStatus, &c.NewStatus, &c.User, &c.Comment, &c.Ts); err != nil {
+			return nil, mysql.Error(err, "StatusLog: rows.Scan")
+		}
+		log = append(log, c)
+	}
+	return log, mysql.Error(rows.Err(), "StatusLog: rows.Next")
+}
+
+// --------------------------------------------------------------------------
+
+type ReverterConfig struct {
+	Interval time.Duration // how often to check fixed classes
+	Window   time.Duration // load is Query_time_sum over this
+	Factor   float64       // revert if load > Factor * load after the fix
+	MinLoad  float64       // and load > MinLoad
+}
+
+// LoadReverterConfig reads the reverter config from app.conf:
+//
+//	status.revert.interval  = 5m
+//	status.revert.window    = 1h
+//	status.revert.factor    = 2
+//	status.revert.min_load  = 0.01
+func LoadReverterConfig() (ReverterConfig, error) {
+	cfg := ReverterConfig{}
+	var err error
+	if cfg.Interval, err = time.ParseDuration(revel.Config.StringDefault("status.revert.interval", "5m")); err != nil {
+		return cfg, fmt.Errorf("invalid status.revert.interval: %s", err)
+	}
+	if cfg.Window, err = time.ParseDuration(revel.Config.StringDefault("status.revert.window", "1h")); err != nil || cfg.Window <= 0 {
+		return cfg, fmt.Errorf("invalid status.revert.window: %s", revel.Config.StringDefault("status.revert.window", ""))
+	}
+	if cfg.Factor, err = strconv.ParseFloat(revel.Config.StringDefault("status.revert.factor", "2"), 64); err != nil || cfg.Factor < 1 {
+		return cfg, fmt.Errorf("invalid status.revert.factor: %s: must be >= 1", revel.Config.StringDefault("status.revert.factor", ""))
+	}
+	if cfg.MinLoad, err = strconv.ParseFloat(revel.Config.StringDefault("status.revert.min_load", "0.01"), 64); err != nil || cfg.MinLoad < 0 {
+		return cfg, fmt.Errorf("invalid status.revert.min_load: %s", revel.Config.StringDefault("status.revert.min_load", ""))
+	}
+	return cfg, nil
+}
+
+// Reverter periodically reverts fixed query classes to needs-attention when
+// their load rises again. The load of a class is its Query_time_sum on all
+// instances over Window. The first Window after a class is fixed, its load
+// is saved as the fixed load; after that, if the load of the last Window is
+// more than Factor times the fixed load, the fix didn't hold.
+type Reverter struct {
+	dbm   db.Manager
+	cfg   ReverterConfig
+	stats *stats.Stats
+}
+
+func NewReverter(dbm db.Manager, cfg ReverterConfig, stats *stats.Stats) *Reverter {
+	r := &Reverter{
+		dbm:   dbm,
+		cfg:   cfg,
+		stats: stats,
+	}
+	return r
+}
+
+func (r *Reverter) Run() {
+	if r.cfg.Interval <= 0 {
+		revel.WARN.Printf("Status reverter disabled: status.revert.interval=%s", r.cfg.Interval)
+		return
+	}
+	t := time.NewTicker(r.cfg.Interval)
+	defer t.Stop()
+	for now := range t.C {
+		if _, err := r.Check(now); err != nil {
+			revel.ERROR.Printf("Status reverter: %s", err)
+		}
+	}
+}
+
+// Check checks all fixed classes and returns the number reverted.
+func (r *Reverter) Check(now time.Time) (uint, error) {
+	if err := r.dbm.Open(); err != nil {
+		return 0, fmt.Errorf("dbm.Open: %s", err)
+	}
+	now = now.UTC()
+
+	type fixed struct {
+		classId   uint
+		changed   time.Time
+		fixedLoad sql.NullFloat64
+	}
+	rows, err := r.dbm.DB().QueryContext(r.dbm.Context(),
+		"SELECT query_class_id, status_changed, fixed_load FROM query_classes"+
+			" WHERE status = ? AND status_changed IS NOT NULL",
+		StatusFixed)
+	if err != nil {
+		return 0, mysql.Error(err, "Reverter: SELECT query_classes")
+	}
+	classes := []fixed{}
+	for rows.Next() {
+		f := fixed{}
+		if err := rows.Scan(&f.classId, &f.changed, &f.fixedLoad); err != nil {
+			rows.Close()
+			return 0, mysql.Error(err, "Reverter: rows.Scan")
+		}
+		classes = append(classes, f)
+	}
+	rows.Close()
+
+	var reverted uint
+	for _, f := range classes {
+		if !f.fixedLoad.Valid {
+			end := f.changed.Add(r.cfg.Window)
+			if end.After(now) {
+				continue // too soon after the fix
+			}
+			load, err := r.load(f.classId, f.changed, end)
+			if err != nil {
+				return reverted, err
+			}
+			_, err = r.dbm.DB().ExecContext(r.dbm.Context(),
+				"UPDATE query_classes SET fixed_load = ? WHERE query_class_id = ? AND status = ? AND status_changed = ?",
+				load, f.classId, StatusFixed, f.changed)
+			if err != nil {
+				return reverted, mysql.Error(err, "Reverter: UPDATE query_classes")
+			}
+			continue
+		}
+
+		load, err := r.load(f.classId, now.Add(-r.cfg.Window), now)
+		if err != nil {
+			return reverted, err
+		}
+		if !Regressed(load, f.fixedLoad.Float64, r.cfg.Factor, r.cfg.MinLoad) {
+			continue
+		}
+		comment := fmt.Sprintf("load rose from %.4f to %.4f since fixed", f.fixedLoad.Float64, load)
+		ok, err := r.revert(f.classId, f.changed, comment)
+		if err != nil {
+			return reverted, err
+		}
+		if ok {
+			reverted++
+			revel.INFO.Printf("Status reverter: query class %d: %s", f.classId, comment)
+		}
+	}
+	if reverted > 0 {
+		r.stats.Inc(r.stats.System("status-reverted"), int64(reverted), r.stats.SampleRate)
+	}
+	return reverted, nil
+}
+
+// Regressed returns true if load is more than factor times the fixed load
+// and more than minLoad.
+func Regressed(load, fixedLoad, factor, minLoad float64) bool {
+	return load > minLoad && load > factor*fixedLoad
+}
+
+func (r *Reverter) load(classId uint, begin, end time.Time) (float64, error) {
+	var sum float64
+	err := r.dbm.DB().QueryRowContext(r.dbm.Context(),
+		"SELECT COALESCE(SUM(Query_time_sum), 0) FROM query_class_metrics"+
+			" WHERE query_class_id = ? AND start_ts >= ? AND start_ts < ?",
+		classId, begin, end).Scan(&sum)
+	if err != nil {
+		return 0, mysql.Error(err, "Reverter: SELECT query_class_metrics")
+	}
+	return sum / end.Sub(begin).Seconds(), nil
+}
+
+// revert sets the status to needs-attention unless a user changed it since
+// the class was checked.
+func (r *Reverter) revert(classId uint, changed time.Time, comment string) (bool, error) {
+	tx, err := r.dbm.DB().BeginTx(r.dbm.Context(), nil)
+	if err != nil {
+		return false, mysql.Error(err, "Reverter: Begin")
+	}
+	defer tx.Rollback()
+	var status string
+	var statusChanged time.Time
+	err = tx.QueryRow("SELECT status, status_changed FROM query_classes WHERE query_class_id = ? FOR UPDATE", classId).Scan(&status, &statusChanged)
+	if err != nil {
+		return false, mysql.Error(err, "Reverter: SELECT query_classes")
+	}
+	if status != StatusFixed || !statusChanged.Equal(changed) {
+		return false, nil
+	}
+	if err := setStatus(tx, classId, status, StatusNeedsAttention, SystemUser, comment, time.Now()); err != nil {
+		return false, err
+	}
+	return true, mysql.Error(tx.Commit(), "Reverter: Commit")
+}
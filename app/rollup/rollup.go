@@ -0,0 +1,382 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package rollup
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/revel/revel"
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/db/mysql"
+	appMetrics "github.com/shatteredsilicon/qan-api/app/metrics"
+	"github.com/shatteredsilicon/qan-api/app/sketch"
+	"github.com/shatteredsilicon/qan-api/stats"
+	"github.com/shatteredsilicon/ssm/proto/metrics"
+)
+
+// A Level is one rollup granularity. Its tables have the same columns as
+// query_class_metrics and query_global_metrics, with one row per query
+// class (or instance) per Period, start_ts being the start of the period.
+type Level struct {
+	Name        string
+	Period      time.Duration
+	ClassTable  string
+	GlobalTable string
+	srcClass    string        // table rolled up from
+	srcGlobal   string        // table rolled up from
+	chunk       time.Duration // max range rolled up per statement
+}
+
+var (
+	Hourly = Level{
+		Name:        "hourly",
+		Period:      time.Hour,
+		ClassTable:  "query_class_metrics_hourly",
+		GlobalTable: "query_global_metrics_hourly",
+		srcClass:    "query_class_metrics",
+		srcGlobal:   "query_global_metrics",
+		chunk:       24 * time.Hour,
+	}
+	Daily = Level{
+		Name:        "daily",
+		Period:      24 * time.Hour,
+		ClassTable:  "query_class_metrics_daily",
+		GlobalTable: "query_global_metrics_daily",
+		srcClass:    "query_class_metrics_hourly",
+		srcGlobal:   "query_global_metrics_hourly",
+		chunk:       30 * 24 * time.Hour,
+	}
+)
+
+// Levels from finest to coarsest. Each level is rolled up from the one
+// before it, so the order is significant.
+var Levels = []Level{Hourly, Daily}
+
+type Queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// RolledUpTo returns the time up to which the level is complete: its tables
+// have all data with start_ts before the returned time. A zero time means
+// the level hasn't been rolled up yet.
+func RolledUpTo(q Queryer, level Level) (time.Time, error) {
+	var ts time.Time
+	err := q.QueryRow("SELECT rolled_up_to FROM query_rollups WHERE level = ?", level.Name).Scan(&ts)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, mysql.Error(err, "RolledUpTo: SELECT query_rollups")
+	}
+	return ts, nil
+}
+
+type Config struct {
+	Interval time.Duration            // how often to roll up
+	Lookback map[string]time.Duration // keyed on level name, how far back to re-roll for late data
+}
+
+// LoadConfig reads the rollup config from app.conf:
+//
+//	rollup.interval         = 5m
+//	rollup.lookback.hourly  = 3h
+//	rollup.lookback.daily   = 48h
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		Lookback: map[string]time.Duration{},
+	}
+	var err error
+	if cfg.Interval, err = time.ParseDuration(revel.Config.StringDefault("rollup.interval", "5m")); err != nil {
+		return cfg, fmt.Errorf("invalid rollup.interval: %s", err)
+	}
+	for _, l := range Levels {
+		def := 3 * l.Period
+		if cfg.Lookback[l.Name], err = time.ParseDuration(revel.Config.StringDefault("rollup.lookback."+l.Name, def.String())); err != nil {
+			return cfg, fmt.Errorf("invalid rollup.lookback.%s: %s", l.Name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Aggregator periodically rolls up query_class_metrics and query_global_metrics
+// into the hourly and daily tables that models.Report and models.Metrics use
+// for long time ranges. Only complete periods are rolled up. Every run re-rolls
+// the periods within the lookback so data from agents that were behind is
+// included.
+type Aggregator struct {
+	dbm   db.Manager
+	cfg   Config
+	stats *stats.Stats
+}
+
+func NewAggregator(dbm db.Manager, cfg Config, stats *stats.Stats) *Aggregator {
+	a := &Aggregator{
+		dbm:   dbm,
+		cfg:   cfg,
+		stats: stats,
+	}
+	return a
+}
+
+func (a *Aggregator) Run() {
+	if a.cfg.Interval <= 0 {
+		revel.WARN.Printf("Rollup aggregator disabled: rollup.interval=%s", a.cfg.Interval)
+		return
+	}
+	t := time.NewTicker(a.cfg.Interval)
+	defer t.Stop()
+	for now := range t.C {
+		if err := a.Aggregate(now); err != nil {
+			revel.ERROR.Printf("Rollup aggregator: %s", err)
+		}
+	}
+}
+
+// Aggregate rolls up all complete periods before now for every level.
+func (a *Aggregator) Aggregate(now time.Time) error {
+	if err := a.dbm.Open(); err != nil {
+		return fmt.Errorf("dbm.Open: %s", err)
+	}
+
+	// The first level can be rolled up to now, the next levels only as far
+	// as the level they're rolled up from.
+	upTo := now.UTC()
+	for _, l := range Levels {
+		to, err := a.aggregate(l, upTo)
+		if err != nil {
+			return err
+		}
+		upTo = to
+	}
+	return nil
+}
+
+func (a *Aggregator) aggregate(l Level, upTo time.Time) (time.Time, error) {
+	to := upTo.Truncate(l.Period)
+
+	last, err := RolledUpTo(a.dbm.DB(), l)
+	if err != nil {
+		return last, err
+	}
+
+	var from time.Time
+	if last.IsZero() {
+		// First run: roll up everything in the source table.
+		var first sql.NullTime
+		if err := a.dbm.DB().QueryRow("SELECT MIN(start_ts) FROM " + l.srcClass).Scan(&first); err != nil {
+			return last, mysql.Error(err, "Aggregator: SELECT MIN(start_ts) FROM "+l.srcClass)
+		}
+		if !first.Valid {
+			return last, nil // no data yet
+		}
+		from = first.Time
+	} else {
+		from = last.Add(-a.cfg.Lookback[l.Name])
+	}
+	from = from.Truncate(l.Period)
+
+	if !from.Before(to) {
+		return last, nil
+	}
+
+	t := time.Now()
+	for begin := from; begin.Before(to); begin = begin.Add(l.chunk) {
+		end := begin.Add(l.chunk)
+		if end.After(to) {
+			end = to
+		}
+		if _, err := a.dbm.DB().Exec(rollupClassSQL(l), begin, end); err != nil {
+			return last, mysql.Error(err, "Aggregator: REPLACE "+l.ClassTable)
+		}
+		if _, err := a.dbm.DB().Exec(rollupGlobalSQL(l), begin, end); err != nil {
+			return last, mysql.Error(err, "Aggregator: REPLACE "+l.GlobalTable)
+		}
+		if err := a.rollupSketches(l, l.srcClass, l.ClassTable, "query_class_id", begin, end); err != nil {
+			return last, err
+		}
+		if err := a.rollupSketches(l, l.srcGlobal, l.GlobalTable, "0", begin, end); err != nil {
+			return last, err
+		}
+	}
+	a.stats.TimingDuration(a.stats.System("rollup-"+l.Name), time.Now().Sub(t), a.stats.SampleRate)
+
+	if !to.After(last) {
+		return last, nil
+	}
+	_, err = a.dbm.DB().Exec(
+		"INSERT INTO query_rollups (level, rolled_up_to) VALUES (?, ?)"+
+			" ON DUPLICATE KEY UPDATE rolled_up_to = VALUES(rolled_up_to)",
+		l.Name, to)
+	if err != nil {
+		return last, mysql.Error(err, "Aggregator: INSERT query_rollups")
+	}
+	revel.INFO.Printf("Rollup aggregator: %s rolled up to %s", l.Name, to)
+	return to, nil
+}
+
+// rollupSketches merges the Query_time sketches of the rows rolled up into
+// each period. Sketches can't be merged in SQL, so the rows are read in
+// order and each period is updated when all its sketches are merged.
+// classCol is "0" for the global tables which don't have query_class_id.
+func (a *Aggregator) rollupSketches(l Level, src, dst, classCol string, begin, end time.Time) error {
+	rows, err := a.dbm.DB().Query(fmt.Sprintf(
+		"SELECT %s, instance_id, %s AS period_ts, Query_time_sketch FROM %s"+
+			" WHERE start_ts >= ? AND start_ts < ? AND Query_time_sketch IS NOT NULL"+
+			" ORDER BY 1, 2, 3",
+		classCol, periodStart(l), src), begin, end)
+	if err != nil {
+		return mysql.Error(err, "Aggregator: SELECT Query_time_sketch FROM "+src)
+	}
+	defer rows.Close()
+
+	where := "query_class_id = ? AND instance_id = ? AND start_ts = ?"
+	if classCol == "0" {
+		where = "0 = ? AND instance_id = ? AND start_ts = ?"
+	}
+	stmt, err := a.dbm.DB().Prepare("UPDATE " + dst + " SET Query_time_sketch = ? WHERE " + where)
+	if err != nil {
+		return mysql.Error(err, "Aggregator: prepare UPDATE "+dst)
+	}
+	defer stmt.Close()
+
+	type key struct {
+		classId    uint
+		instanceId uint
+		ts         time.Time
+	}
+	var cur key
+	var merged *sketch.Sketch
+	flush := func() error {
+		if merged == nil {
+			return nil
+		}
+		data, err := merged.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(data, cur.classId, cur.instanceId, cur.ts); err != nil {
+			return mysql.Error(err, "Aggregator: UPDATE "+dst)
+		}
+		return nil
+	}
+	for rows.Next() {
+		var k key
+		var data []byte
+		if err := rows.Scan(&k.classId, &k.instanceId, &k.ts, &data); err != nil {
+			return mysql.Error(err, "Aggregator: rows.Scan")
+		}
+		s, err := sketch.Unmarshal(data)
+		if err != nil {
+			revel.WARN.Printf("Rollup aggregator: invalid Query_time_sketch in %s: class %d, instance %d: %s",
+				src, k.classId, k.instanceId, err)
+			continue
+		}
+		if merged == nil || k != cur {
+			if err := flush(); err != nil {
+				return err
+			}
+			cur, merged = k, s
+			continue
+		}
+		merged.Merge(s)
+	}
+	if err := rows.Err(); err != nil {
+		return mysql.Error(err, "Aggregator: rows.Next")
+	}
+	return flush()
+}
+
+// rollupClassSQL returns a REPLACE ... SELECT that rolls up the class metrics
+// with start_ts in [?, ?).
+func rollupClassSQL(l Level) string {
+	return fmt.Sprintf(
+		"REPLACE INTO %s (query_class_id, instance_id, start_ts, end_ts, query_count, lrq_count, %s)"+
+			" SELECT query_class_id, instance_id, %s AS period_ts, MAX(end_ts), SUM(query_count), SUM(lrq_count), %s"+
+			" FROM %s WHERE start_ts >= ? AND start_ts < ?"+
+			" GROUP BY query_class_id, instance_id, period_ts",
+		l.ClassTable, strings.Join(metricColumns, ", "),
+		periodStart(l), strings.Join(metricAggregates("query_count"), ", "),
+		l.srcClass,
+	)
+}
+
+// rollupGlobalSQL is like rollupClassSQL for the global metrics. The number of
+// unique queries can't be summed, so the max per period is kept.
+func rollupGlobalSQL(l Level) string {
+	return fmt.Sprintf(
+		"REPLACE INTO %s (instance_id, start_ts, end_ts, run_time, total_query_count, unique_query_count,"+
+			" rate_type, rate_limit, log_file, log_file_size, start_offset, end_offset, stop_offset, %s)"+
+			" SELECT instance_id, %s AS period_ts, MAX(end_ts), SUM(run_time), SUM(total_query_count), MAX(unique_query_count),"+
+			" MAX(rate_type), MAX(rate_limit), MAX(log_file), MAX(log_file_size), MIN(start_offset), MAX(end_offset), MAX(stop_offset), %s"+
+			" FROM %s WHERE start_ts >= ? AND start_ts < ?"+
+			" GROUP BY instance_id, period_ts",
+		l.GlobalTable, strings.Join(metricColumns, ", "),
+		periodStart(l), strings.Join(metricAggregates("total_query_count"), ", "),
+		l.srcGlobal,
+	)
+}
+
+func periodStart(l Level) string {
+	s := int64(l.Period.Seconds())
+	return fmt.Sprintf("FROM_UNIXTIME(UNIX_TIMESTAMP(start_ts) DIV %d * %d)", s, s)
+}
+
+// metricAggregates returns the aggregate for every metricColumns column.
+// Sums, mins and maxes roll up exactly. The avg is recomputed from the sum.
+// Medians and p95 can't be combined exactly, so they're averaged weighted
+// by query count which is closer than AVG() when traffic is uneven.
+func metricAggregates(cntCol string) []string {
+	aggs := make([]string, len(metricColumns))
+	for i, col := range metricColumns {
+		n := strings.LastIndex(col, "_")
+		metric, stat := col[:n], col[n+1:]
+		switch stat {
+		case "sum":
+			aggs[i] = fmt.Sprintf("SUM(%s)", col)
+		case "min":
+			aggs[i] = fmt.Sprintf("MIN(%s)", col)
+		case "max":
+			aggs[i] = fmt.Sprintf("MAX(%s)", col)
+		case "avg":
+			aggs[i] = fmt.Sprintf("SUM(%s_sum)/SUM(%s)", metric, cntCol)
+		default:
+			aggs[i] = fmt.Sprintf("SUM(%s*%s)/SUM(IF(%s IS NULL, 0, %s))", col, cntCol, col, cntCol)
+		}
+	}
+	return aggs
+}
+
+var metricColumns []string
+
+func init() {
+	for _, m := range appMetrics.Query {
+		if (m.Flags & metrics.COUNTER) != 0 {
+			metricColumns = append(metricColumns, m.Name+"_sum")
+			continue
+		}
+		for _, stat := range metrics.StatNames {
+			if stat == "p5" {
+				continue
+			}
+			metricColumns = append(metricColumns, m.Name+"_"+stat)
+		}
+	}
+}
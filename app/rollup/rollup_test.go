@@ -0,0 +1,124 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package rollup_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/rollup"
+	"github.com/shatteredsilicon/qan-api/config"
+	"github.com/shatteredsilicon/qan-api/stats"
+	testDb "github.com/shatteredsilicon/qan-api/tests/setup/db"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type RollupTestSuite struct {
+	testDb *testDb.Db
+	cfg    rollup.Config
+}
+
+var _ = Suite(&RollupTestSuite{})
+
+func (s *RollupTestSuite) SetUpSuite(t *C) {
+	dsn := config.Get("mysql.dsn")
+	s.testDb = testDb.NewDb(dsn, config.SchemaDir, config.TestDir)
+	if err := s.testDb.Start(); err != nil {
+		t.Fatalf("Could not prepare org db for %s: %s", dsn, err)
+	}
+	s.cfg = rollup.Config{
+		Lookback: map[string]time.Duration{
+			rollup.Hourly.Name: 3 * time.Hour,
+			rollup.Daily.Name:  48 * time.Hour,
+		},
+	}
+}
+
+func (s *RollupTestSuite) SetUpTest(t *C) {
+	s.testDb.TruncateDataTables()
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/01")
+	s.testDb.LoadDataInfiles(config.TestDir + "/qan/may-2015/02")
+}
+
+func (s *RollupTestSuite) sum(t *C, q string, args ...interface{}) float64 {
+	var n float64
+	err := s.testDb.DB().QueryRow(q, args...).Scan(&n)
+	t.Assert(err, IsNil)
+	return n
+}
+
+// --------------------------------------------------------------------------
+
+func (s *RollupTestSuite) TestAggregate(t *C) {
+	now := time.Date(2015, time.May, 03, 0, 30, 0, 0, time.UTC)
+	a := rollup.NewAggregator(db.DBManager, s.cfg, stats.NullStats())
+	err := a.Aggregate(now)
+	t.Assert(err, IsNil)
+
+	upTo, err := rollup.RolledUpTo(s.testDb.DB(), rollup.Hourly)
+	t.Assert(err, IsNil)
+	t.Check(upTo.Equal(time.Date(2015, time.May, 03, 0, 0, 0, 0, time.UTC)), Equals, true)
+	upTo, err = rollup.RolledUpTo(s.testDb.DB(), rollup.Daily)
+	t.Assert(err, IsNil)
+	t.Check(upTo.Equal(time.Date(2015, time.May, 03, 0, 0, 0, 0, time.UTC)), Equals, true)
+
+	// Sums must roll up exactly.
+	for _, l := range rollup.Levels {
+		for _, q := range []string{
+			"SELECT COALESCE(SUM(query_count), 0) FROM %s",
+			"SELECT COALESCE(SUM(Query_time_sum), 0) FROM %s",
+		} {
+			raw := s.sum(t, fmt.Sprintf(q, "query_class_metrics"))
+			t.Assert(raw > 0, Equals, true)
+			t.Check(s.sum(t, fmt.Sprintf(q, l.ClassTable)), Equals, raw, Commentf("%s %s", l.Name, q))
+		}
+		raw := s.sum(t, "SELECT SUM(total_query_count) FROM query_global_metrics")
+		t.Check(s.sum(t, "SELECT SUM(total_query_count) FROM "+l.GlobalTable), Equals, raw, Commentf(l.Name))
+
+		// One row per period.
+		n := s.sum(t, "SELECT COUNT(*) FROM "+l.ClassTable+
+			" WHERE UNIX_TIMESTAMP(start_ts) % ? != 0", int64(l.Period.Seconds()))
+		t.Check(n, Equals, float64(0), Commentf(l.Name))
+	}
+
+	// Rolling up again, e.g. for late data in the lookback, mustn't count
+	// data twice.
+	hourly := s.sum(t, "SELECT SUM(query_count) FROM query_class_metrics_hourly")
+	err = a.Aggregate(now.Add(5 * time.Minute))
+	t.Assert(err, IsNil)
+	t.Check(s.sum(t, "SELECT SUM(query_count) FROM query_class_metrics_hourly"), Equals, hourly)
+}
+
+func (s *RollupTestSuite) TestIncompletePeriods(t *C) {
+	// Only complete periods are rolled up: May 2 10:00 is rolled up hourly
+	// but the day isn't complete.
+	now := time.Date(2015, time.May, 02, 10, 59, 0, 0, time.UTC)
+	a := rollup.NewAggregator(db.DBManager, s.cfg, stats.NullStats())
+	err := a.Aggregate(now)
+	t.Assert(err, IsNil)
+
+	n := s.sum(t, "SELECT COUNT(*) FROM query_class_metrics_hourly WHERE start_ts >= '2015-05-02 10:00:00'")
+	t.Check(n, Equals, float64(0))
+	n = s.sum(t, "SELECT COUNT(*) FROM query_class_metrics_daily WHERE start_ts >= '2015-05-02 00:00:00'")
+	t.Check(n, Equals, float64(0))
+}
@@ -40,6 +40,8 @@ var (
 	ErrNotImplemented    = errors.New("not implemented")
 	ErrTimeout           = errors.New("timeout")
 	ErrAgentReplyError   = errors.New("agent reply error")
+	ErrQueryTimeout      = errors.New("query deadline exceeded")
+	ErrQueryCanceled     = errors.New("query canceled")
 )
 
 func IsNetworkError(err error) bool {
@@ -20,6 +20,7 @@ package shared
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -46,6 +47,32 @@ func AtLeastVersion(v1, v2 string) (bool, error) {
 	return c.Check(v), nil
 }
 
+// UintList returns the ids comma-separated, e.g. for IN (...). Unlike
+// strings, ids are safe to put into SQL as-is.
+func UintList(ids []uint) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(s, ",")
+}
+
+// AppendIds appends the ids not in instanceIds, e.g. the UUIDs can be
+// members of the group too.
+func AppendIds(instanceIds, ids []uint) []uint {
+	seen := map[uint]bool{}
+	for _, id := range instanceIds {
+		seen[id] = true
+	}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			instanceIds = append(instanceIds, id)
+		}
+	}
+	return instanceIds
+}
+
 func Placeholders(length int) string {
 	return strings.Join(strings.Split(strings.Repeat("?", length), ""), ",")
 }
@@ -0,0 +1,268 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package sketch implements a compact, mergeable approximation of a
+// distribution used to compute percentiles over many QAN intervals.
+//
+// A Sketch is a piecewise-linear CDF: a list of knots (value, number of
+// queries <= value). Merging two sketches sums their CDFs, which is exact,
+// so the percentiles of merged sketches are the percentiles of all queries
+// in them, within the error of the sketches themselves. Agents only report
+// min, avg, median, p95 and max per interval, so a sketch built from one
+// interval is exact at those points and interpolated between them.
+//
+// The binary encoding is self-delimiting so concatenated encodings are a
+// valid encoding of the merged sketch. That's how sketches are merged in
+// SQL: CONCAT(Query_time_sketch, VALUES(Query_time_sketch)).
+package sketch
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+const (
+	version = 1
+
+	// MaxKnots is the max number of knots kept after merging. More knots
+	// are resampled to the quantiles in resampleAt.
+	MaxKnots = 64
+)
+
+// Quantiles kept when a sketch is resampled, denser in the tail where
+// latency percentiles are read.
+var resampleAt = []float64{
+	0, 0.01, 0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.75, 0.8, 0.85, 0.9,
+	0.925, 0.95, 0.96, 0.97, 0.98, 0.99, 0.995, 0.999, 1,
+}
+
+var ErrInvalid = errors.New("invalid sketch")
+
+type knot struct {
+	v float64 // value, e.g. Query_time
+	c float64 // cumulative count of values <= v
+}
+
+// Sketch is not safe for concurrent use. The zero value is an empty sketch.
+type Sketch struct {
+	knots []knot // sorted by v then c
+}
+
+// FromStats returns a sketch of n values with the given stats, or nil if
+// med or p95 is nil because a sketch of only min and max would be worse
+// than the stats it's built from. min and max default to med and p95.
+//
+// The tail above p95 is usually long, so if avg is given it's used to place
+// a knot at p99 such that the mean of the sketch is avg, else it's halfway
+// between p95 and max. Either way the p99 of the sketch is an estimate, not
+// a value the agent measured.
+func FromStats(n uint64, min, avg, med, p95, max *float64) *Sketch {
+	if n == 0 || med == nil || p95 == nil {
+		return nil
+	}
+	lo, hi := *med, *p95
+	if min != nil {
+		lo = *min
+	}
+	if max != nil {
+		hi = *max
+	}
+
+	// Values are uniform between knots, so the mean of the tail is
+	// (0.04*(p95+p99)/2 + 0.01*(p99+max)/2) / 0.05.
+	p99 := (*p95 + hi) / 2
+	if avg != nil {
+		tail := (*avg - 0.5*(lo+*med)/2 - 0.45*(*med+*p95)/2) / 0.05
+		p99 = 2*tail - 0.8**p95 - 0.2*hi
+	}
+	p99 = math.Max(*p95, math.Min(hi, p99))
+
+	cnt := float64(n)
+	s := &Sketch{}
+	prev := math.Inf(-1)
+	for _, k := range []knot{{lo, 0}, {*med, 0.5 * cnt}, {*p95, 0.95 * cnt}, {p99, 0.99 * cnt}, {hi, cnt}} {
+		// Stats should be ordered, but don't trust the agent.
+		if k.v < prev {
+			k.v = prev
+		}
+		prev = k.v
+		s.knots = append(s.knots, k)
+	}
+	return s
+}
+
+// Count returns the number of values in the sketch.
+func (s *Sketch) Count() float64 {
+	if s == nil || len(s.knots) == 0 {
+		return 0
+	}
+	return s.knots[len(s.knots)-1].c
+}
+
+// Quantile returns the value at quantile q in [0, 1], or zero if the sketch
+// is empty.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s == nil || len(s.knots) == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.knots[0].v
+	}
+	t := q * s.Count()
+	i := sort.Search(len(s.knots), func(i int) bool { return s.knots[i].c >= t })
+	if i == 0 {
+		return s.knots[0].v
+	}
+	if i == len(s.knots) {
+		return s.knots[i-1].v
+	}
+	a, b := s.knots[i-1], s.knots[i]
+	if b.c == a.c {
+		return b.v
+	}
+	return a.v + (b.v-a.v)*(t-a.c)/(b.c-a.c)
+}
+
+// Merge adds the values in o to s.
+func (s *Sketch) Merge(o *Sketch) {
+	if o == nil || len(o.knots) == 0 {
+		return
+	}
+	if len(s.knots) == 0 {
+		s.knots = append([]knot(nil), o.knots...)
+		return
+	}
+
+	vals := make([]float64, 0, len(s.knots)+len(o.knots))
+	for _, k := range s.knots {
+		vals = append(vals, k.v)
+	}
+	for _, k := range o.knots {
+		vals = append(vals, k.v)
+	}
+	sort.Float64s(vals)
+
+	// Both CDFs are piecewise linear between the knots, so their sum is
+	// piecewise linear between the union of the knots. A step (several
+	// knots with the same value) needs a knot on each side of it.
+	merged := make([]knot, 0, len(vals)+2)
+	for i, v := range vals {
+		if i > 0 && v == vals[i-1] {
+			continue
+		}
+		left := s.cdfLeft(v) + o.cdfLeft(v)
+		right := s.cdfRight(v) + o.cdfRight(v)
+		merged = append(merged, knot{v, left})
+		if right > left {
+			merged = append(merged, knot{v, right})
+		}
+	}
+	s.knots = merged
+
+	if len(s.knots) > MaxKnots {
+		s.resample()
+	}
+}
+
+// cdfLeft returns the number of values < v, cdfRight the number <= v.
+func (s *Sketch) cdfLeft(v float64) float64 {
+	j := sort.Search(len(s.knots), func(j int) bool { return s.knots[j].v >= v })
+	if j == 0 {
+		return 0
+	}
+	if j == len(s.knots) {
+		return s.Count()
+	}
+	return interpolate(s.knots[j-1], s.knots[j], v)
+}
+
+func (s *Sketch) cdfRight(v float64) float64 {
+	j := sort.Search(len(s.knots), func(j int) bool { return s.knots[j].v > v })
+	if j == 0 {
+		return 0
+	}
+	if j == len(s.knots) {
+		return s.Count()
+	}
+	return interpolate(s.knots[j-1], s.knots[j], v)
+}
+
+func interpolate(a, b knot, v float64) float64 {
+	if b.v == a.v {
+		return b.c
+	}
+	return a.c + (b.c-a.c)*(v-a.v)/(b.v-a.v)
+}
+
+func (s *Sketch) resample() {
+	n := s.Count()
+	knots := make([]knot, len(resampleAt))
+	for i, q := range resampleAt {
+		knots[i] = knot{s.Quantile(q), q * n}
+	}
+	s.knots = knots
+}
+
+// MarshalBinary encodes the sketch: a version byte, the number of knots
+// as a uvarint, then each knot as two little-endian float64.
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 1+binary.MaxVarintLen64+16*len(s.knots))
+	buf[0] = version
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(s.knots)))
+	for _, k := range s.knots {
+		binary.LittleEndian.PutUint64(buf[n:], math.Float64bits(k.v))
+		binary.LittleEndian.PutUint64(buf[n+8:], math.Float64bits(k.c))
+		n += 16
+	}
+	return buf[:n], nil
+}
+
+// Unmarshal decodes one or more concatenated encoded sketches and returns
+// them merged. Empty data is an empty sketch.
+func Unmarshal(data []byte) (*Sketch, error) {
+	s := &Sketch{}
+	for len(data) > 0 {
+		if data[0] != version {
+			return nil, ErrInvalid
+		}
+		nKnots, n := binary.Uvarint(data[1:])
+		if n <= 0 || nKnots > uint64(len(data)) {
+			return nil, ErrInvalid
+		}
+		data = data[1+n:]
+		if uint64(len(data)) < nKnots*16 {
+			return nil, ErrInvalid
+		}
+		o := &Sketch{knots: make([]knot, nKnots)}
+		prev := knot{math.Inf(-1), 0}
+		for i := range o.knots {
+			k := knot{
+				v: math.Float64frombits(binary.LittleEndian.Uint64(data)),
+				c: math.Float64frombits(binary.LittleEndian.Uint64(data[8:])),
+			}
+			if k.v < prev.v || k.c < prev.c || math.IsNaN(k.v) || math.IsNaN(k.c) {
+				return nil, ErrInvalid
+			}
+			o.knots[i], prev = k, k
+			data = data[16:]
+		}
+		s.Merge(o)
+	}
+	return s, nil
+}
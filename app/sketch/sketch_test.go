@@ -0,0 +1,157 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package sketch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func f(v float64) *float64 { return &v }
+
+// stats returns the stats an agent reports for vals.
+func stats(vals []float64) (min, avg, med, p95, max *float64) {
+	sorted := append([]float64(nil), vals...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	sum := 0.0
+	for _, v := range vals {
+		sum += v
+	}
+	return f(sorted[0]), f(sum / float64(n)), f(sorted[n/2]), f(sorted[n*95/100]), f(sorted[n-1])
+}
+
+func TestFromStats(t *testing.T) {
+	s := FromStats(100, f(0.1), nil, f(0.5), f(0.95), f(2))
+	require.NotNil(t, s)
+	assert.Equal(t, float64(100), s.Count())
+	assert.Equal(t, 0.1, s.Quantile(0))
+	assert.Equal(t, 0.5, s.Quantile(0.5))
+	assert.InDelta(t, 0.95, s.Quantile(0.95), 1e-9)
+	assert.Equal(t, float64(2), s.Quantile(1))
+
+	// No median or p95, e.g. Performance Schema.
+	assert.Nil(t, FromStats(100, f(0.1), nil, nil, nil, f(2)))
+	assert.Nil(t, FromStats(0, f(0.1), nil, f(0.5), f(0.95), f(2)))
+
+	// Min and max are optional.
+	s = FromStats(10, nil, nil, f(0.5), f(0.95), nil)
+	require.NotNil(t, s)
+	assert.Equal(t, 0.5, s.Quantile(0))
+	assert.Equal(t, 0.95, s.Quantile(1))
+}
+
+func TestMerge(t *testing.T) {
+	// Merging the same distribution doesn't change it.
+	s := FromStats(100, f(0.1), nil, f(0.5), f(0.95), f(2))
+	s.Merge(FromStats(100, f(0.1), nil, f(0.5), f(0.95), f(2)))
+	assert.Equal(t, float64(200), s.Count())
+	assert.InDelta(t, 0.5, s.Quantile(0.5), 1e-9)
+	assert.InDelta(t, 0.95, s.Quantile(0.95), 1e-9)
+
+	// A fast and a slow interval: the p95 of both is in the slow one,
+	// not the average of their p95.
+	fast := FromStats(900, f(0.001), nil, f(0.002), f(0.003), f(0.004))
+	slow := FromStats(100, f(1), nil, f(2), f(3), f(4))
+	fast.Merge(slow)
+	assert.Equal(t, float64(1000), fast.Count())
+	assert.InDelta(t, 0.002, fast.Quantile(0.45), 0.0001)
+	assert.InDelta(t, 2, fast.Quantile(0.95), 0.0001)
+
+	// Merging into or with an empty sketch.
+	e := &Sketch{}
+	e.Merge(slow)
+	assert.Equal(t, slow.Quantile(0.95), e.Quantile(0.95))
+	e.Merge(nil)
+	e.Merge(&Sketch{})
+	assert.Equal(t, float64(100), e.Count())
+
+	// Point masses.
+	p := FromStats(10, f(1), nil, f(1), f(1), f(1))
+	p.Merge(FromStats(10, f(3), nil, f(3), f(3), f(3)))
+	assert.Equal(t, float64(1), p.Quantile(0.25))
+	assert.Equal(t, float64(3), p.Quantile(0.75))
+}
+
+func TestAccuracy(t *testing.T) {
+	// Merge many intervals with different latencies and compare with the
+	// true percentiles of all values. Within an interval values are assumed
+	// to be uniform between the reported stats which is the main error for
+	// skewed distributions like this one.
+	r := rand.New(rand.NewSource(1))
+	all := []float64{}
+	s := &Sketch{}
+	for i := 0; i < 500; i++ {
+		scale := 0.01 * float64(1+i%7)
+		n := 50 + r.Intn(500)
+		vals := make([]float64, n)
+		for j := range vals {
+			vals[j] = r.ExpFloat64() * scale
+		}
+		all = append(all, vals...)
+		min, avg, med, p95, max := stats(vals)
+		s.Merge(FromStats(uint64(n), min, avg, med, p95, max))
+	}
+	assert.True(t, len(s.knots) <= MaxKnots)
+	assert.Equal(t, float64(len(all)), s.Count())
+
+	sort.Float64s(all)
+	for _, q := range []float64{0.5, 0.95, 0.99} {
+		want := all[int(q*float64(len(all)))]
+		got := s.Quantile(q)
+		assert.True(t, math.Abs(got-want)/want < 0.25, "q=%.2f: got %f, want %f", q, got, want)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	a := FromStats(100, f(0.1), nil, f(0.5), f(0.95), f(2))
+	b := FromStats(50, f(1), nil, f(1.5), f(1.95), f(3))
+	da, err := a.MarshalBinary()
+	require.NoError(t, err)
+	db, err := b.MarshalBinary()
+	require.NoError(t, err)
+
+	got, err := Unmarshal(da)
+	require.NoError(t, err)
+	assert.Equal(t, a, got)
+
+	// Concatenated sketches are merged.
+	got, err = Unmarshal(append(append([]byte{}, da...), db...))
+	require.NoError(t, err)
+	a.Merge(b)
+	assert.Equal(t, a, got)
+
+	got, err = Unmarshal(nil)
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), got.Count())
+
+	for _, bad := range [][]byte{
+		{0},
+		{version},
+		{version, 2, 0, 0},
+		da[:len(da)-1],
+	} {
+		_, err = Unmarshal(bad)
+		assert.Equal(t, ErrInvalid, err, "%v", bad)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package slowlog
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	qp "github.com/shatteredsilicon/ssm/proto/qan"
+)
+
+const (
+	// MaxExampleBytes is the max size of a query example. Larger examples
+	// are truncated and TruncatedExampleSuffix is appended.
+	MaxExampleBytes        = 10240
+	TruncatedExampleSuffix = "..."
+
+	exampleTsLayout = "2006-01-02 15:04:05" // shared.MYSQL_DATETIME_LAYOUT
+)
+
+// Aggregator aggregates events into reports of an interval, e.g. one
+// minute, like an agent. Events must be added in log order.
+type Aggregator struct {
+	uuid     string
+	interval time.Duration
+	// --
+	start       time.Time // of the current interval
+	startOffset int64
+	endOffset   int64
+	rateLimit   uint
+	global      *classStats
+	classes     map[string]*classStats // keyed on Id
+	t0          time.Time              // when the first event of the interval was added
+}
+
+// NewAggregator returns an Aggregator of the events of the instance.
+func NewAggregator(uuid string, interval time.Duration) *Aggregator {
+	a := &Aggregator{
+		uuid:     uuid,
+		interval: interval,
+	}
+	return a
+}
+
+// Add adds the event to the current interval. If the event is after the
+// interval, Add returns the report of the interval and the event starts the
+// next one. Events a little before the interval, e.g. slow queries that
+// started earlier but ended later, are added to it.
+func (a *Aggregator) Add(e *Event) *qp.Report {
+	var report *qp.Report
+	if a.global != nil && !e.Ts.Before(a.start.Add(a.interval)) {
+		report = a.Finish()
+	}
+	if a.global == nil {
+		a.start = e.Ts.Truncate(a.interval)
+		a.startOffset = e.Offset
+		a.global = newClassStats(&qp.Class{})
+		a.classes = map[string]*classStats{}
+		a.t0 = time.Now()
+	}
+	a.endOffset = e.EndOffset
+	if e.RateLimit > 0 {
+		a.rateLimit = e.RateLimit
+	}
+
+	fingerprint := Fingerprint(e.Query)
+	id := Id(fingerprint)
+	c, ok := a.classes[id]
+	if !ok {
+		c = newClassStats(&qp.Class{
+			Id:          id,
+			Fingerprint: fingerprint,
+		})
+		a.classes[id] = c
+	}
+	c.add(e, true)
+	a.global.add(e, false)
+	return report
+}
+
+// Finish returns the report of the current interval, or nil if no events
+// were added since the last report.
+func (a *Aggregator) Finish() *qp.Report {
+	if a.global == nil {
+		return nil
+	}
+
+	classes := make([]*qp.Class, 0, len(a.classes))
+	for _, c := range a.classes {
+		classes = append(classes, c.finish())
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		return classes[i].Id < classes[j].Id
+	})
+	global := a.global.finish()
+	global.UniqueQueries = uint(len(classes))
+
+	report := &qp.Report{
+		UUID:        a.uuid,
+		StartTs:     a.start,
+		EndTs:       a.start.Add(a.interval),
+		RunTime:     time.Now().Sub(a.t0).Seconds(),
+		Global:      global,
+		Class:       classes,
+		StartOffset: a.startOffset,
+		EndOffset:   a.endOffset,
+		StopOffset:  a.endOffset,
+		RateLimit:   a.rateLimit,
+	}
+	a.global = nil
+	a.classes = nil
+	return report
+}
+
+// classStats are the values of the metrics of the events of a class, or of
+// all events for the global class.
+type classStats struct {
+	class   *qp.Class
+	times   map[string][]float64
+	numbers map[string][]uint64
+	bools   map[string]uint64
+	sources map[string]*qp.UserSource // keyed on user@host
+}
+
+func newClassStats(class *qp.Class) *classStats {
+	c := &classStats{
+		class:   class,
+		times:   map[string][]float64{},
+		numbers: map[string][]uint64{},
+		bools:   map[string]uint64{},
+		sources: map[string]*qp.UserSource{},
+	}
+	return c
+}
+
+func (c *classStats) add(e *Event, example bool) {
+	class := c.class
+	class.TotalQueries++
+	if class.StartAt.IsZero() || e.Ts.Before(class.StartAt) {
+		class.StartAt = e.Ts
+	}
+	if e.Ts.After(class.EndAt) {
+		class.EndAt = e.Ts
+	}
+	for name, v := range e.TimeMetrics {
+		c.times[name] = append(c.times[name], v)
+	}
+	for name, v := range e.NumberMetrics {
+		c.numbers[name] = append(c.numbers[name], v)
+	}
+	for name, v := range e.BoolMetrics {
+		if _, ok := c.bools[name]; !ok {
+			c.bools[name] = 0
+		}
+		if v {
+			c.bools[name]++
+		}
+	}
+	if !example {
+		return
+	}
+
+	if e.User != "" || e.Host != "" {
+		key := e.User + "@" + e.Host
+		s, ok := c.sources[key]
+		if !ok {
+			s = &qp.UserSource{User: e.User, Host: e.Host}
+			c.sources[key] = s
+		}
+		s.Count++
+		if e.Ts.After(s.Ts) {
+			s.Ts = e.Ts
+		}
+	}
+
+	// The example is the query with the greatest Query_time.
+	queryTime := e.TimeMetrics["Query_time"]
+	if class.Example != nil && queryTime <= class.Example.QueryTime {
+		return
+	}
+	class.Example = &qp.Example{
+		QueryTime: queryTime,
+		Db:        e.Db,
+		Query:     e.Query,
+		Ts:        e.Ts.Format(exampleTsLayout),
+	}
+	if len(e.Query) > MaxExampleBytes {
+		q := strings.ToValidUTF8(e.Query[:MaxExampleBytes-len(TruncatedExampleSuffix)], "")
+		class.Example.Query = q + TruncatedExampleSuffix
+		class.Example.Size = len(e.Query)
+	}
+}
+
+// finish sets the stats of the metrics and returns the class. The median and
+// 95th percentile are those of agents: vals[n/2] and vals[n*95/100].
+func (c *classStats) finish() *qp.Class {
+	m := &qp.Metrics{
+		TimeMetrics:   map[string]*qp.TimeStats{},
+		NumberMetrics: map[string]*qp.NumberStats{},
+		BoolMetrics:   map[string]*qp.BoolStats{},
+	}
+	for name, vals := range c.times {
+		sort.Float64s(vals)
+		n := len(vals)
+		s := &qp.TimeStats{}
+		for _, v := range vals {
+			s.Sum += v
+		}
+		avg := s.Sum / float64(n)
+		s.Min, s.Avg, s.Med, s.P95, s.Max = &vals[0], &avg, &vals[n/2], &vals[n*95/100], &vals[n-1]
+		m.TimeMetrics[name] = s
+	}
+	for name, vals := range c.numbers {
+		sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+		n := len(vals)
+		s := &qp.NumberStats{}
+		for _, v := range vals {
+			s.Sum += v
+		}
+		avg := s.Sum / uint64(n)
+		s.Min, s.Avg, s.Med, s.P95, s.Max = &vals[0], &avg, &vals[n/2], &vals[n*95/100], &vals[n-1]
+		m.NumberMetrics[name] = s
+	}
+	for name, sum := range c.bools {
+		m.BoolMetrics[name] = &qp.BoolStats{Sum: sum}
+	}
+	c.class.Metrics = m
+
+	if len(c.sources) > 0 {
+		keys := make([]string, 0, len(c.sources))
+		for key := range c.sources {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			c.class.UserSources = append(c.class.UserSources, *c.sources[key])
+		}
+	}
+	if c.class.Id != "" {
+		c.class.UniqueQueries = 1
+	}
+	return c.class
+}
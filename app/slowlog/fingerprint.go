@@ -0,0 +1,152 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package slowlog
+
+import (
+	"crypto/md5"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	valueListRe = regexp.MustCompile(`\b(in|values?)\s*\(\s*\?(\s*,\s*\?)*\s*\)(\s*,\s*\(\s*\?(\s*,\s*\?)*\s*\))*`)
+	limitRe     = regexp.MustCompile(`\blimit \?(\s*,\s*\?| offset \?)?`)
+	useRe       = regexp.MustCompile(`^use \S+$`)
+	spaceRe     = regexp.MustCompile(`\s+`)
+)
+
+// Fingerprint returns the canonical form of the query like pt-query-digest
+// and agents: lowercase, without comments, with values replaced with "?" and
+// lists of values with "?+", e.g. "select * from t where id in(?+)". Version
+// comments are kept, e.g. "/*!? sql_no_cache */".
+func Fingerprint(q string) string {
+	q = strings.TrimSpace(q)
+	b := make([]byte, 0, len(q))
+	word := func() bool { // last byte is part of a word
+		if len(b) == 0 {
+			return false
+		}
+		c := b[len(b)-1]
+		return c == '_' || c == '$' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z'
+	}
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case c == '/' && strings.HasPrefix(q[i:], "/*!"):
+			b = append(b, "/*!"...)
+			i += 3
+			for i < len(q) && q[i] >= '0' && q[i] <= '9' {
+				i++
+			}
+			if i < len(q) && q[i-1] >= '0' && q[i-1] <= '9' {
+				b = append(b, '?')
+			}
+			i--
+		case c == '/' && strings.HasPrefix(q[i:], "/*"):
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				i = len(q)
+			} else {
+				i += 2 + end + 1
+			}
+			b = append(b, ' ')
+		case c == '#' || (c == '-' && strings.HasPrefix(q[i:], "-- ")):
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				i = len(q)
+			} else {
+				i += end
+			}
+			b = append(b, ' ')
+		case c == '\'' || c == '"':
+			// String value, with \ escapes and doubled quotes.
+			for i++; i < len(q); i++ {
+				if q[i] == '\\' {
+					i++
+				} else if q[i] == c {
+					if i+1 < len(q) && q[i+1] == c {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			b = append(b, '?')
+		case c == '`':
+			j := i + 1
+			for j < len(q) && q[j] != '`' {
+				j++
+			}
+			if j < len(q) {
+				j++
+			}
+			b = append(b, strings.ToLower(q[i:j])...)
+			i = j - 1
+		case c >= '0' && c <= '9' && !word():
+			// Number, e.g. 1, 1.5, 1e-3 or 0x1F.
+			for i++; i < len(q); i++ {
+				d := q[i] | 0x20 // lowercase
+				if !(d >= '0' && d <= '9' || d == '.' || d == 'x' || d >= 'a' && d <= 'f' ||
+					(q[i] == '-' || q[i] == '+') && (q[i-1]|0x20) == 'e') {
+					break
+				}
+			}
+			i--
+			b = append(b, '?')
+		case c == 'n' || c == 'N':
+			if !word() && len(q) >= i+4 && strings.EqualFold(q[i:i+4], "null") && (len(q) == i+4 || !isWordByte(q[i+4])) {
+				b = append(b, '?')
+				i += 3
+				continue
+			}
+			b = append(b, 'n')
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			b = append(b, ' ')
+		default:
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			b = append(b, c)
+		}
+	}
+
+	f := strings.TrimSpace(spaceRe.ReplaceAllString(string(b), " "))
+	f = strings.TrimSpace(strings.TrimSuffix(f, ";"))
+	if useRe.MatchString(f) {
+		return "use ?"
+	}
+	f = valueListRe.ReplaceAllStringFunc(f, func(s string) string {
+		if strings.HasPrefix(s, "in") {
+			return "in(?+)"
+		}
+		return strings.TrimRight(s[:strings.IndexByte(s, '(')], " ") + " (?+)"
+	})
+	f = limitRe.ReplaceAllString(f, "limit ?")
+	return strings.TrimSpace(f)
+}
+
+// Id returns the checksum of the fingerprint, the query class ID of agents.
+func Id(fingerprint string) string {
+	h := fmt.Sprintf("%x", md5.Sum([]byte(fingerprint)))
+	return strings.ToUpper(h[16:32])
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
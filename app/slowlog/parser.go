@@ -0,0 +1,350 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// Package slowlog parses MySQL slow logs and aggregates them into QAN
+// reports like an agent does, see bin/ssm-qan-import.
+package slowlog
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shatteredsilicon/ssm/proto/metrics"
+)
+
+// An Event is a query in the slow log.
+type Event struct {
+	Offset    int64     // of the first line of the event
+	EndOffset int64     // of the line after the event, where parsing resumes
+	Ts        time.Time // UTC, when the query ended
+	User      string
+	Host      string
+	Db        string
+	Query     string // without the trailing ";"
+	// Metrics in metrics.Query, keyed on name, e.g. Query_time. Other
+	// metrics in the log, e.g. Killed, are ignored.
+	TimeMetrics   map[string]float64 // seconds
+	NumberMetrics map[string]uint64
+	BoolMetrics   map[string]bool
+	RateLimit     uint // Percona Server log_slow_rate_limit
+}
+
+// metricNames maps the lowercase names of metrics.Query to their names: MySQL,
+// Percona Server and MariaDB don't agree on case, e.g. QC_Hit and QC_hit.
+var metricNames = map[string]metrics.MetricFlags{}
+
+func init() {
+	for _, m := range metrics.Query {
+		if (m.Flags & metrics.META) != 0 {
+			continue
+		}
+		metricNames[strings.ToLower(m.Name)] = m
+	}
+}
+
+// Parser reads the events of a slow log. It handles the standard format of
+// MySQL and the extended formats of Percona Server and MariaDB.
+type Parser struct {
+	r   *bufio.Reader
+	loc *time.Location
+	// --
+	offset  int64     // of the next line
+	next    []string  // lines to read again, see unread
+	partial string    // last line without a newline, see readLine
+	lastTs  time.Time // of the last event, for events without "# Time"
+}
+
+// NewParser returns a parser of r at offset, which must be the start of an
+// event or 0. loc is the time zone of "# Time" values without a time zone,
+// e.g. "# Time: 150102  3:04:05" in MySQL < 5.7.
+func NewParser(r io.Reader, offset int64, loc *time.Location) *Parser {
+	p := &Parser{
+		r:      bufio.NewReaderSize(r, 64*1024),
+		loc:    loc,
+		offset: offset,
+	}
+	return p
+}
+
+// Offset returns the offset after the last event returned by Next, or where
+// the parser started.
+func (p *Parser) Offset() int64 {
+	return p.offset
+}
+
+// Next returns the next event, or io.EOF if there are no more complete
+// events. Administrator commands, e.g. Quit, are skipped. If the log is
+// still being written, Next can be called again after io.EOF.
+func (p *Parser) Next() (*Event, error) {
+	var e *Event
+	var query []string
+	inQuery := false
+	admin := false
+	start := p.offset
+	read := []string{} // lines of this call, to read again after io.EOF
+	for {
+		lineOffset := p.offset
+		line, err := p.readLine()
+		if err == io.EOF {
+			if e != nil && !admin && p.finish(e, query) {
+				return e, nil
+			}
+			// The last event isn't complete yet, or there are no events.
+			p.next = append(read, p.next...)
+			p.offset = start
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		read = append(read, line)
+		s := strings.TrimRight(line, "\r\n")
+
+		if serverHeader(s) || strings.HasPrefix(s, "#") {
+			if inQuery {
+				// Start of the next event.
+				p.unread(line)
+				read = read[:len(read)-1]
+				if !admin && p.finish(e, query) {
+					return e, nil
+				}
+				e, query, inQuery, admin = nil, nil, false, false
+				continue
+			}
+			if serverHeader(s) {
+				// mysqld restarted or the log was flushed. Drop the header
+				// lines of an event that has no query.
+				e = nil
+				continue
+			}
+			if e == nil {
+				e = &Event{
+					Offset:        lineOffset,
+					TimeMetrics:   map[string]float64{},
+					NumberMetrics: map[string]uint64{},
+					BoolMetrics:   map[string]bool{},
+				}
+			}
+			if strings.HasPrefix(s, "# administrator command:") {
+				// The whole event, e.g. "# administrator command: Quit;".
+				admin = true
+				inQuery = true
+				continue
+			}
+			p.parseHeader(e, s)
+			continue
+		}
+
+		if e == nil {
+			// Query without a header, e.g. the first lines of a log that
+			// doesn't start at an event.
+			continue
+		}
+		if len(query) == 0 {
+			// Statements the server logs before the query.
+			lower := strings.ToLower(s)
+			if strings.HasPrefix(lower, "set ") && strings.Contains(lower, "timestamp=") {
+				p.setTimestamp(e, lower)
+				inQuery = true
+				continue
+			}
+			if strings.HasPrefix(lower, "use ") && strings.HasSuffix(s, ";") && !strings.Contains(s[4:len(s)-1], " ") {
+				e.Db = strings.Trim(s[4:len(s)-1], "`")
+				inQuery = true
+				continue
+			}
+		}
+		query = append(query, s)
+		inQuery = true
+	}
+}
+
+// finish sets the query and end of the event, and returns false if the event
+// has no query.
+func (p *Parser) finish(e *Event, query []string) bool {
+	q := strings.TrimSpace(strings.Join(query, "\n"))
+	q = strings.TrimSpace(strings.TrimSuffix(q, ";"))
+	if q == "" {
+		if e.Db == "" {
+			return false
+		}
+		// Only "use db;"
+		q = "use " + e.Db
+	}
+	e.Query = q
+	e.EndOffset = p.offset
+	if e.Ts.IsZero() {
+		e.Ts = p.lastTs
+	}
+	p.lastTs = e.Ts
+	return true
+}
+
+// readLine returns the next complete line. A last line without a newline is
+// not returned, but kept until the rest of it is written.
+func (p *Parser) readLine() (string, error) {
+	if len(p.next) > 0 {
+		line := p.next[0]
+		p.next = p.next[1:]
+		p.offset += int64(len(line))
+		return line, nil
+	}
+	s, err := p.r.ReadString('\n')
+	p.partial += s
+	if err != nil {
+		return "", err
+	}
+	line := p.partial
+	p.partial = ""
+	p.offset += int64(len(line))
+	return line, nil
+}
+
+// unread returns the line to be read again by the next readLine.
+func (p *Parser) unread(line string) {
+	p.next = append([]string{line}, p.next...)
+	p.offset -= int64(len(line))
+}
+
+// serverHeader returns true if the line is one of the lines mysqld writes
+// when it opens the log.
+func serverHeader(s string) bool {
+	return (strings.Contains(s, ", Version: ") && strings.HasSuffix(s, "started with:")) ||
+		strings.HasPrefix(s, "Tcp port: ") ||
+		(strings.HasPrefix(s, "Time ") && strings.Contains(s, " Id Command"))
+}
+
+// parseHeader parses a "# " line of the event.
+func (p *Parser) parseHeader(e *Event, s string) {
+	s = strings.TrimSpace(strings.TrimPrefix(s, "#"))
+	switch {
+	case strings.HasPrefix(s, "Time:"):
+		if ts, ok := p.parseTime(strings.TrimSpace(s[5:])); ok {
+			e.Ts = ts
+		}
+		return
+	case strings.HasPrefix(s, "User@Host:"):
+		parseUserHost(e, strings.TrimSpace(s[10:]))
+		return
+	}
+
+	// "Name: value" pairs, e.g. "Query_time: 0.000123  Lock_time: 0.000010".
+	fields := strings.Fields(s)
+	for i := 0; i+1 < len(fields); i++ {
+		if !strings.HasSuffix(fields[i], ":") {
+			continue
+		}
+		name, val := strings.TrimSuffix(fields[i], ":"), fields[i+1]
+		i++
+		switch name {
+		case "Schema":
+			e.Db = val
+			continue
+		case "Log_slow_rate_limit":
+			if n, err := strconv.ParseUint(val, 10, 32); err == nil {
+				e.RateLimit = uint(n)
+			}
+			continue
+		}
+		m, ok := metricNames[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		switch {
+		case (m.Flags & metrics.COUNTER) != 0:
+			e.BoolMetrics[m.Name] = val == "Yes" || val == "1"
+		case (m.Flags & metrics.MICROSECOND) != 0:
+			if f, err := strconv.ParseFloat(val, 64); err == nil {
+				e.TimeMetrics[m.Name] = f
+			}
+		default:
+			if n, err := strconv.ParseUint(val, 10, 64); err == nil {
+				e.NumberMetrics[m.Name] = n
+			}
+		}
+	}
+}
+
+// parseTime parses "# Time" values: "2015-01-02T03:04:05.123456Z" (MySQL >=
+// 5.7), with a time zone offset if log_timestamps=SYSTEM, or "150102
+// 3:04:05" in loc.
+func (p *Parser) parseTime(s string) (time.Time, bool) {
+	if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return ts.UTC(), true
+	}
+	if ts, err := time.ParseInLocation("2006-01-02T15:04:05.999999", s, p.loc); err == nil {
+		return ts.UTC(), true
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return time.Time{}, false
+	}
+	if len(fields[1]) == 7 {
+		fields[1] = "0" + fields[1] // 3:04:05
+	}
+	ts, err := time.ParseInLocation("060102 15:04:05", fields[0]+" "+fields[1], p.loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts.UTC(), true
+}
+
+// setTimestamp sets the event time from "SET timestamp=N;" if the event has
+// no "# Time". MySQL < 5.7 writes "# Time" only when the second changes.
+func (p *Parser) setTimestamp(e *Event, lower string) {
+	if !e.Ts.IsZero() {
+		return
+	}
+	i := strings.Index(lower, "timestamp=")
+	n := strings.TrimLeft(lower[i+len("timestamp="):], " ")
+	if j := strings.IndexAny(n, ",; "); j >= 0 {
+		n = n[:j]
+	}
+	if sec, err := strconv.ParseFloat(n, 64); err == nil {
+		e.Ts = time.Unix(0, int64(sec*1e9)).UTC().Truncate(time.Microsecond)
+	}
+}
+
+// parseUserHost parses "root[root] @ localhost [127.0.0.1]  Id:     8". The
+// host is the host name, or the IP if the server doesn't resolve names.
+func parseUserHost(e *Event, s string) {
+	if i := strings.Index(s, "  Id:"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.SplitN(s, "@", 2)
+	user := strings.TrimSpace(parts[0])
+	if i := strings.Index(user, "["); i >= 0 {
+		user = user[:i]
+	}
+	e.User = user
+	if len(parts) < 2 {
+		return
+	}
+	host := strings.TrimSpace(parts[1])
+	ip := ""
+	if i := strings.Index(host, "["); i >= 0 {
+		ip = strings.Trim(host[i:], "[] ")
+		host = strings.TrimSpace(host[:i])
+	}
+	if host == "" {
+		host = ip
+	}
+	e.Host = host
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package slowlog
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mysqlLog = `/usr/sbin/mysqld, Version: 8.0.36 (MySQL Community Server - GPL). started with:
+Tcp port: 3306  Unix socket: /var/run/mysqld/mysqld.sock
+Time                 Id Command    Argument
+# Time: 2024-01-02T03:04:05.123456Z
+# User@Host: app[app] @ web1 [10.0.0.1]  Id:     8
+# Query_time: 1.500000  Lock_time: 0.000100 Rows_sent: 1  Rows_examined: 1000
+use shop;
+SET timestamp=1704164645;
+SELECT * FROM orders
+WHERE id = 10;
+# Time: 2024-01-02T03:04:30.000000Z
+# User@Host: app[app] @  [10.0.0.2]  Id:     9
+# Query_time: 0.500000  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 10
+SET timestamp=1704164670;
+SELECT * FROM orders WHERE id = 11;
+# Time: 2024-01-02T03:04:31.000000Z
+# User@Host: app[app] @ web1 [10.0.0.1]  Id:     8
+# Query_time: 0.000010  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 0
+SET timestamp=1704164671;
+# administrator command: Quit;
+# Time: 2024-01-02T03:05:10.000000Z
+# User@Host: root[root] @ localhost []  Id:    10
+# Query_time: 2.000000  Lock_time: 0.000200 Rows_sent: 0  Rows_examined: 5
+SET timestamp=1704164710;
+UPDATE orders SET status = 'paid' WHERE id IN (1, 2, 3);
+`
+
+const perconaLog = `# Time: 150102  3:04:05
+# User@Host: app[app] @ web1 []
+# Thread_id: 1  Schema: shop  Last_errno: 0  Killed: 0
+# Query_time: 0.250000  Lock_time: 0.000050  Rows_sent: 5  Rows_examined: 50  Rows_affected: 0
+# Bytes_sent: 512  Tmp_tables: 1  Tmp_disk_tables: 0  Tmp_table_sizes: 4096
+# QC_Hit: No  Full_scan: Yes  Full_join: No  Tmp_table: Yes  Tmp_table_on_disk: No
+# Filesort: Yes  Filesort_on_disk: No  Merge_passes: 0
+#   InnoDB_IO_r_ops: 2  InnoDB_IO_r_bytes: 32768  InnoDB_IO_r_wait: 0.001000
+#   InnoDB_rec_lock_wait: 0.000000  InnoDB_queue_wait: 0.000000
+#   InnoDB_pages_distinct: 3
+# Log_slow_rate_type: query  Log_slow_rate_limit: 10
+SET timestamp=1420167845;
+SELECT name FROM products ORDER BY name LIMIT 5;
+`
+
+func events(t *testing.T, log string, offset int64) []*Event {
+	p := NewParser(strings.NewReader(log[offset:]), offset, time.UTC)
+	events := []*Event{}
+	for {
+		e, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		events = append(events, e)
+	}
+	assert.Equal(t, int64(len(log)), p.Offset())
+	return events
+}
+
+func TestParseMySQL(t *testing.T) {
+	got := events(t, mysqlLog, 0)
+	require.Len(t, got, 3) // not the Quit
+
+	e := got[0]
+	assert.Equal(t, int64(strings.Index(mysqlLog, "# Time")), e.Offset)
+	assert.Equal(t, int64(strings.Index(mysqlLog, "# Time: 2024-01-02T03:04:30")), e.EndOffset)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC), e.Ts)
+	assert.Equal(t, "app", e.User)
+	assert.Equal(t, "web1", e.Host)
+	assert.Equal(t, "shop", e.Db)
+	assert.Equal(t, "SELECT * FROM orders\nWHERE id = 10", e.Query)
+	assert.Equal(t, map[string]float64{"Query_time": 1.5, "Lock_time": 0.0001}, e.TimeMetrics)
+	assert.Equal(t, map[string]uint64{"Rows_sent": 1, "Rows_examined": 1000}, e.NumberMetrics)
+	assert.Empty(t, e.BoolMetrics)
+
+	assert.Equal(t, "10.0.0.2", got[1].Host) // no host name
+	assert.Equal(t, "", got[1].Db)
+
+	// Resume at the end of the first event.
+	resumed := events(t, mysqlLog, e.EndOffset)
+	require.Len(t, resumed, 2)
+	assert.Equal(t, got[1:], resumed)
+}
+
+func TestParsePercona(t *testing.T) {
+	got := events(t, perconaLog, 0)
+	require.Len(t, got, 1)
+	e := got[0]
+	assert.Equal(t, time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC), e.Ts)
+	assert.Equal(t, "shop", e.Db)
+	assert.Equal(t, "web1", e.Host)
+	assert.Equal(t, uint(10), e.RateLimit)
+	assert.Equal(t, "SELECT name FROM products ORDER BY name LIMIT 5", e.Query)
+	assert.Equal(t, map[string]float64{
+		"Query_time":           0.25,
+		"Lock_time":            0.00005,
+		"InnoDB_IO_r_wait":     0.001,
+		"InnoDB_rec_lock_wait": 0,
+		"InnoDB_queue_wait":    0,
+	}, e.TimeMetrics)
+	assert.Equal(t, map[string]uint64{
+		"Rows_sent":             5,
+		"Rows_examined":         50,
+		"Rows_affected":         0,
+		"Bytes_sent":            512,
+		"Tmp_tables":            1,
+		"Tmp_disk_tables":       0,
+		"Tmp_table_sizes":       4096,
+		"Merge_passes":          0,
+		"InnoDB_IO_r_ops":       2,
+		"InnoDB_IO_r_bytes":     32768,
+		"InnoDB_pages_distinct": 3,
+	}, e.NumberMetrics)
+	assert.Equal(t, map[string]bool{
+		"QC_Hit":            false,
+		"Full_scan":         true,
+		"Full_join":         false,
+		"Tmp_table":         true,
+		"Tmp_table_on_disk": false,
+		"Filesort":          true,
+		"Filesort_on_disk":  false,
+	}, e.BoolMetrics)
+}
+
+func TestParsePartial(t *testing.T) {
+	// The last line is still being written: the last event isn't complete.
+	log := strings.TrimSuffix(mysqlLog, "3);\n")
+	p := NewParser(strings.NewReader(log), 0, time.UTC)
+	n := 0
+	for {
+		_, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		n++
+	}
+	assert.Equal(t, 2, n)
+	assert.Equal(t, int64(strings.Index(mysqlLog, "# Time: 2024-01-02T03:04:31")), p.Offset())
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct{ query, fingerprint string }{
+		{"SELECT * FROM orders\nWHERE id = 10;", "select * from orders where id = ?"},
+		{"select c from t where s='it''s' and d = \"x\\\"y\" and n IS NULL", "select c from t where s=? and d = ? and n is ?"},
+		{"SELECT /*!40001 SQL_NO_CACHE */ * FROM `Wp_Logs`", "select /*!? sql_no_cache */ * from `wp_logs`"},
+		{"select id from t1 where id in (1, 2,3) /* comment */ limit 10, 20", "select id from t1 where id in(?+) limit ?"},
+		{"INSERT INTO cache (cid, data) VALUES (1, 'a'), (2, 'b') ON DUPLICATE KEY UPDATE data = VALUES(data)",
+			"insert into cache (cid, data) values (?+) on duplicate key update data = values(data)"},
+		{"select a -- comment\nfrom t where x = -1.5e-3 and y = 0x1F", "select a from t where x = -? and y = ?"},
+		{"use `shop`", "use ?"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.fingerprint, Fingerprint(test.query), test.query)
+	}
+	assert.Equal(t, "296E90D8F864A512", Id("select * from orders where id = ?"))
+}
+
+func TestAggregate(t *testing.T) {
+	a := NewAggregator("1", time.Minute)
+	got := events(t, mysqlLog, 0)
+	assert.Nil(t, a.Add(got[0]))
+	assert.Nil(t, a.Add(got[1]))
+
+	// Next interval.
+	report := a.Add(got[2])
+	require.NotNil(t, report)
+	assert.Equal(t, "1", report.UUID)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC), report.StartTs)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 5, 0, 0, time.UTC), report.EndTs)
+	assert.Equal(t, got[0].Offset, report.StartOffset)
+	assert.Equal(t, got[1].EndOffset, report.EndOffset)
+
+	require.Len(t, report.Class, 1)
+	c := report.Class[0]
+	assert.Equal(t, Id("select * from orders where id = ?"), c.Id)
+	assert.Equal(t, uint(2), c.TotalQueries)
+	assert.Equal(t, 2.0, c.Metrics.TimeMetrics["Query_time"].Sum)
+	assert.Equal(t, 0.5, *c.Metrics.TimeMetrics["Query_time"].Min)
+	assert.Equal(t, 1.0, *c.Metrics.TimeMetrics["Query_time"].Avg)
+	assert.Equal(t, 1.5, *c.Metrics.TimeMetrics["Query_time"].Max)
+	assert.Equal(t, uint64(1010), c.Metrics.NumberMetrics["Rows_examined"].Sum)
+	require.NotNil(t, c.Example)
+	assert.Equal(t, 1.5, c.Example.QueryTime)
+	assert.Equal(t, "shop", c.Example.Db)
+	assert.Equal(t, "2024-01-02 03:04:05", c.Example.Ts)
+	require.Len(t, c.UserSources, 2)
+	assert.Equal(t, "10.0.0.2", c.UserSources[0].Host)
+	assert.Equal(t, "web1", c.UserSources[1].Host)
+
+	assert.Equal(t, uint(2), report.Global.TotalQueries)
+	assert.Equal(t, uint(1), report.Global.UniqueQueries)
+	assert.Nil(t, report.Global.Example)
+
+	report = a.Finish()
+	require.NotNil(t, report)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 5, 0, 0, time.UTC), report.StartTs)
+	assert.Equal(t, int64(len(mysqlLog)), report.EndOffset)
+	require.Len(t, report.Class, 1)
+	assert.Equal(t, "update orders set status = ? where id in(?+)", report.Class[0].Fingerprint)
+
+	assert.Nil(t, a.Finish())
+}
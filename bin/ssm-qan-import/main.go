@@ -0,0 +1,191 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+// ssm-qan-import imports a MySQL slow log into QAN for an instance, e.g. the
+// slow log of a server without an agent. The log is aggregated into reports
+// like an agent's, which are written to the QAN database the API uses: set
+// PERCONA_DATASTORE_CONF and PERCONA_DATASTORE_BASEDIR like the API service.
+//
+// The reports have the file name and offsets, so importing the same file
+// again resumes after the last report written, e.g. to import the new
+// queries of a log copied again later.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/shatteredsilicon/qan-api/app/db"
+	"github.com/shatteredsilicon/qan-api/app/instance"
+	"github.com/shatteredsilicon/qan-api/app/qan"
+	"github.com/shatteredsilicon/qan-api/app/shared"
+	"github.com/shatteredsilicon/qan-api/app/slowlog"
+	"github.com/shatteredsilicon/qan-api/config"
+	queryService "github.com/shatteredsilicon/qan-api/service/query"
+	qp "github.com/shatteredsilicon/ssm/proto/qan"
+)
+
+const maxLogFile = 100 // query_global_metrics.log_file
+
+var (
+	flagUUID     string
+	flagInterval time.Duration
+	flagOffset   int64
+	flagTimezone string
+	flagJSON     bool
+)
+
+func init() {
+	flag.StringVar(&flagUUID, "uuid", "", "UUID of the MySQL instance (required)")
+	flag.DurationVar(&flagInterval, "interval", time.Minute, "Report interval, like the agent's QAN interval")
+	flag.Int64Var(&flagOffset, "offset", -1, "Offset in the file to start at, -1 to resume after the last report written")
+	flag.StringVar(&flagTimezone, "timezone", "UTC", "Time zone of log times without one, e.g. \"# Time: 150102  3:04:05\"")
+	flag.BoolVar(&flagJSON, "json", false, "Print the reports as JSON lines for POST /qan/reports instead of writing them")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -uuid UUID [options] slow.log\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flagUUID == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if flagInterval < time.Second {
+		log.Fatalf("Invalid -interval %s: must be at least 1s", flagInterval)
+	}
+	loc, err := time.LoadLocation(flagTimezone)
+	if err != nil {
+		log.Fatalf("Invalid -timezone %s: %s", flagTimezone, err)
+	}
+
+	file, err := filepath.Abs(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(file) > maxLogFile {
+		log.Fatalf("File name %s longer than %d characters, move the file or copy it to a shorter path", file, maxLogFile)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var h *qan.MySQLMetricWriter
+	write := func(report *qp.Report) error {
+		if flagJSON {
+			return json.NewEncoder(os.Stdout).Encode(report)
+		}
+		return h.Write(*report)
+	}
+
+	offset := flagOffset
+	if !flagJSON {
+		dbm := db.NewMySQLManager()
+		if err := dbm.Open(); err != nil {
+			log.Fatal(err)
+		}
+		defer dbm.Close()
+
+		ih := instance.NewMySQLHandler(dbm)
+		_, in, err := ih.Get(flagUUID)
+		if err != nil {
+			log.Fatalf("Cannot get instance %s: %s", flagUUID, err)
+		}
+		if in.Subsystem != instance.SubsystemNameMySQL {
+			log.Fatalf("Instance %s is a %s instance, not %s", flagUUID, in.Subsystem, instance.SubsystemNameMySQL)
+		}
+
+		// Tables and abstracts of new query classes, like the API.
+		m := queryService.NewMini(config.ApiRootDir + "/service/query")
+		go m.Run()
+		defer m.Stop()
+
+		importStats := shared.InternalStats // copy
+		importStats.SetComponent("qan-import")
+		h = qan.NewMySQLMetricWriter(dbm, ih, m, &importStats)
+		defer h.Close()
+
+		if offset < 0 {
+			if offset, err = h.SlowLogOffset(flagUUID, file); err != nil {
+				log.Fatal(err)
+			}
+			if offset > fi.Size() {
+				log.Printf("%s is smaller than when it was imported (%d < %d bytes), importing all of it", file, fi.Size(), offset)
+				offset = 0
+			} else if offset > 0 {
+				log.Printf("Resuming %s at offset %d", file, offset)
+			}
+		}
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		log.Fatal(err)
+	}
+
+	p := slowlog.NewParser(f, offset, loc)
+	a := slowlog.NewAggregator(flagUUID, flagInterval)
+	nEvents, nSkipped, nReports := 0, 0, 0
+	flush := func(report *qp.Report) {
+		if report == nil {
+			return
+		}
+		report.SlowLogFile = file
+		report.SlowLogFileSize = fi.Size()
+		if err := write(report); err != nil {
+			log.Fatalf("Cannot write report %s to %s (offsets %d to %d), run again to resume: %s",
+				report.StartTs, report.EndTs, report.StartOffset, report.EndOffset, err)
+		}
+		nReports++
+	}
+	for {
+		e, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Cannot read %s at offset %d: %s", file, p.Offset(), err)
+		}
+		if e.Ts.IsZero() {
+			// No "# Time" or "SET timestamp" yet, e.g. the first events of
+			// a log that doesn't start at an event.
+			nSkipped++
+			continue
+		}
+		nEvents++
+		flush(a.Add(e))
+	}
+	flush(a.Finish())
+
+	log.Printf("Imported %d queries in %d reports from %s, offset %d (%d queries without a time skipped)",
+		nEvents, nReports, file, p.Offset(), nSkipped)
+}
@@ -74,6 +74,17 @@ func Get(name string) string {
 	return value
 }
 
+// GetDefault returns the value of the option, or def if it's not set.
+func GetDefault(name, def string) string {
+	if gConfig == nil {
+		log.Panic("No config")
+	}
+	if !gConfig.HasOption(config.DefaultSection, name) {
+		return def
+	}
+	return Get(name)
+}
+
 func loadConfig(configFile string) (conf *config.Config, err error) {
 	if configFile != "" && configFile[0] == '/' {
 		log.Printf("Loading %s", configFile)
@@ -2,7 +2,7 @@ SET time_zone='+00:00'; -- be sure we use right timezone otherwise dates like '1
 
 CREATE TABLE IF NOT EXISTS instances (
   instance_id   INT UNSIGNED NOT NULL AUTO_INCREMENT,
-  subsystem_id  INT UNSIGNED NOT NULL, -- 1=os, 2=agent, 3=mysql
+  subsystem_id  INT UNSIGNED NOT NULL, -- see app/instance/subsystem.go
   parent_uuid   CHAR(32) NULL,
   uuid          CHAR(32) NOT NULL,
   name          VARCHAR(100) CHARSET 'utf8' NOT NULL,
@@ -33,7 +33,8 @@ CREATE TABLE IF NOT EXISTS agent_log (
   level          TINYINT(1) UNSIGNED NOT NULL, -- 7 debug, 6 info, ...
   service        VARCHAR(50) NOT NULL,         -- service + instance name, e.g. mm-mysql-db01
   msg            VARCHAR(5000) CHARSET 'utf8' NOT NULL,
-  INDEX (instance_id, sec, level)
+  INDEX (instance_id, sec, level),
+  INDEX (sec) -- for purging
 );
 
 CREATE TABLE IF NOT EXISTS query_classes (
@@ -49,7 +50,8 @@ CREATE TABLE IF NOT EXISTS query_classes (
   status             CHAR(3) NOT NULL DEFAULT 'new',
   --
   PRIMARY KEY (query_class_id),
-  UNIQUE INDEX (checksum)
+  UNIQUE INDEX (checksum),
+  INDEX (last_seen) -- for purging
 ) CHARSET='utf8';
 
 CREATE TABLE IF NOT EXISTS query_examples (
@@ -62,7 +64,8 @@ CREATE TABLE IF NOT EXISTS query_examples (
   query           TEXT NOT NULL,
   `explain`       TEXT NOT NULL,
   --
-  PRIMARY KEY (query_class_id, instance_id, period)
+  PRIMARY KEY (query_class_id, instance_id, period),
+  INDEX (period) -- for purging
 ) CHARSET='utf8';
 
 CREATE TABLE IF NOT EXISTS query_global_metrics (
@@ -231,6 +234,7 @@ CREATE TABLE IF NOT EXISTS query_global_metrics (
   Sort_scan_sum                 BIGINT UNSIGNED,
   No_index_used_sum             BIGINT UNSIGNED,
   No_good_index_used_sum        BIGINT UNSIGNED,
+  Query_time_sketch             BLOB,  -- see app/sketch
   --
   PRIMARY KEY (instance_id, start_ts),
   INDEX (start_ts)
@@ -394,6 +398,7 @@ CREATE TABLE IF NOT EXISTS query_class_metrics (
   Sort_scan_sum                 BIGINT UNSIGNED,
   No_index_used_sum             BIGINT UNSIGNED,
   No_good_index_used_sum        BIGINT UNSIGNED,
+  Query_time_sketch             BLOB,  -- see app/sketch
   --
   PRIMARY KEY (query_class_id, instance_id, start_ts),
   INDEX (start_ts),
@@ -415,5 +420,530 @@ CREATE TABLE IF NOT EXISTS query_user_sources (
   user_class_id   INT UNSIGNED NOT NULL,
   ts              TIMESTAMP NOT NULL,
   count           INT UNSIGNED NOT NULL,
-  PRIMARY KEY (query_class_id, instance_id, user_class_id, ts)
-);
\ No newline at end of file
+  PRIMARY KEY (query_class_id, instance_id, user_class_id, ts),
+  INDEX (ts) -- for purging
+);
+-- Indexes for purging added after the tables were created.
+CREATE INDEX IF NOT EXISTS sec ON agent_log (sec);
+CREATE INDEX IF NOT EXISTS period ON query_examples (period);
+CREATE INDEX IF NOT EXISTS ts ON query_user_sources (ts);
+CREATE INDEX IF NOT EXISTS last_seen ON query_classes (last_seen);
+
+-- Hourly and daily rollups of the metrics tables, see app/rollup. They must
+-- have the same columns in the same order as the tables they roll up.
+CREATE TABLE IF NOT EXISTS query_class_metrics_hourly LIKE query_class_metrics;
+CREATE TABLE IF NOT EXISTS query_class_metrics_daily LIKE query_class_metrics;
+CREATE TABLE IF NOT EXISTS query_global_metrics_hourly LIKE query_global_metrics;
+CREATE TABLE IF NOT EXISTS query_global_metrics_daily LIKE query_global_metrics;
+
+CREATE TABLE IF NOT EXISTS query_rollups (
+  level         VARCHAR(10) NOT NULL,
+  rolled_up_to  TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:01', -- rollup has all data with start_ts before this
+  PRIMARY KEY (level)
+);
+
+-- Query_time sketches added after the tables were created. Add them to the
+-- rollup tables too so they keep the same columns in the same order.
+ALTER TABLE query_class_metrics ADD COLUMN IF NOT EXISTS Query_time_sketch BLOB;
+ALTER TABLE query_global_metrics ADD COLUMN IF NOT EXISTS Query_time_sketch BLOB;
+ALTER TABLE query_class_metrics_hourly ADD COLUMN IF NOT EXISTS Query_time_sketch BLOB;
+ALTER TABLE query_class_metrics_daily ADD COLUMN IF NOT EXISTS Query_time_sketch BLOB;
+ALTER TABLE query_global_metrics_hourly ADD COLUMN IF NOT EXISTS Query_time_sketch BLOB;
+ALTER TABLE query_global_metrics_daily ADD COLUMN IF NOT EXISTS Query_time_sketch BLOB;
+
+-- Anomaly analyzer, see app/anomaly. A baseline is the mean and stddev of
+-- a query class's hourly values in the same hour of the previous weeks.
+CREATE TABLE IF NOT EXISTS query_class_baselines (
+  query_class_id          INT UNSIGNED NOT NULL,
+  instance_id             INT UNSIGNED NOT NULL,
+  hour_of_week            SMALLINT UNSIGNED NOT NULL, -- 0 = Sunday 00:00 UTC
+  samples                 SMALLINT UNSIGNED NOT NULL, -- weeks with queries
+  query_time_avg_mean     FLOAT,
+  query_time_avg_stddev   FLOAT,
+  query_count_mean        FLOAT NOT NULL,
+  query_count_stddev      FLOAT NOT NULL,
+  PRIMARY KEY (query_class_id, instance_id, hour_of_week)
+);
+
+CREATE TABLE IF NOT EXISTS query_anomalies (
+  query_class_id          INT UNSIGNED NOT NULL,
+  instance_id             INT UNSIGNED NOT NULL,
+  start_ts                TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:01', -- hour
+  metric                  VARCHAR(32) NOT NULL, -- Query_time_avg or query_count
+  value                   FLOAT NOT NULL,
+  baseline_mean           FLOAT NOT NULL,
+  baseline_stddev         FLOAT NOT NULL,
+  score                   FLOAT NOT NULL, -- stddevs from the mean
+  PRIMARY KEY (query_class_id, instance_id, start_ts, metric),
+  KEY (start_ts)
+);
+
+-- Alert rules and their webhook notifications, see app/alert.
+CREATE TABLE IF NOT EXISTS alert_rules (
+  rule_id         INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  name            VARCHAR(100) CHARSET 'utf8' NOT NULL,
+  instance_uuid   CHAR(32) NOT NULL,
+  type            VARCHAR(10) NOT NULL, -- share, load or new
+  metric          VARCHAR(64) NOT NULL DEFAULT '', -- for share
+  stat            VARCHAR(10) NOT NULL DEFAULT '', -- for share
+  threshold       DOUBLE NOT NULL,
+  window_sec      INT UNSIGNED NOT NULL,
+  webhook_url     VARCHAR(2048) CHARSET 'utf8' NOT NULL,
+  enabled         TINYINT(1) NOT NULL DEFAULT 1,
+  created         TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated         TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (rule_id)
+);
+
+CREATE TABLE IF NOT EXISTS alert_notifications (
+  notification_id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+  rule_id         INT UNSIGNED NOT NULL,
+  checksum        CHAR(32) NOT NULL, -- query_classes.checksum
+  fired_at        TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:01',
+  payload         MEDIUMTEXT NOT NULL, -- JSON POSTed to the webhook
+  status          VARCHAR(10) NOT NULL, -- pending, sent or failed
+  attempts        INT UNSIGNED NOT NULL DEFAULT 0,
+  next_attempt    TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:01',
+  sent_at         TIMESTAMP NULL DEFAULT NULL,
+  last_error      VARCHAR(255) NULL DEFAULT NULL,
+  PRIMARY KEY (notification_id),
+  INDEX (rule_id, checksum, fired_at), -- dedup
+  INDEX (status, next_attempt),
+  INDEX (fired_at) -- for purging
+);
+
+-- Query class status workflow, see app/query/status.go. The status was
+-- CHAR(3) for 'new' only.
+ALTER TABLE query_classes MODIFY status VARCHAR(16) NOT NULL DEFAULT 'new';
+ALTER TABLE query_classes ADD COLUMN IF NOT EXISTS status_changed TIMESTAMP NULL DEFAULT NULL;
+ALTER TABLE query_classes ADD COLUMN IF NOT EXISTS fixed_load FLOAT NULL DEFAULT NULL; -- load the first window after fixed
+CREATE INDEX IF NOT EXISTS status ON query_classes (status);
+
+CREATE TABLE IF NOT EXISTS query_class_status_log (
+  id              BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+  query_class_id  INT UNSIGNED NOT NULL,
+  old_status      VARCHAR(16) NOT NULL,
+  new_status      VARCHAR(16) NOT NULL,
+  user            VARCHAR(100) CHARSET 'utf8' NOT NULL,
+  comment         TEXT CHARSET 'utf8' NOT NULL,
+  ts              TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (id),
+  INDEX (query_class_id, ts)
+);
+
+-- Notes attached to query classes, see app/query/notes.go.
+CREATE TABLE IF NOT EXISTS query_notes (
+  note_id         INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  query_class_id  INT UNSIGNED NOT NULL,
+  user            VARCHAR(100) CHARSET 'utf8' NOT NULL,
+  body            TEXT CHARSET 'utf8mb4' NOT NULL, -- markdown
+  tickets         VARCHAR(255) CHARSET 'utf8' NOT NULL DEFAULT '[]', -- JSON array
+  created         TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:01',
+  updated         TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:01',
+  PRIMARY KEY (note_id),
+  INDEX (query_class_id)
+);
+
+CREATE TABLE IF NOT EXISTS query_note_tags (
+  note_id         INT UNSIGNED NOT NULL,
+  query_class_id  INT UNSIGNED NOT NULL, -- query_notes.query_class_id
+  tag             VARCHAR(32) NOT NULL,
+  PRIMARY KEY (note_id, tag),
+  INDEX (tag, query_class_id)
+);
+
+-- Deploys, migrations, etc. shown on sparklines, see app/models/events.go.
+CREATE TABLE IF NOT EXISTS events (
+  event_id        INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  instance_id     INT UNSIGNED NOT NULL,
+  ts              TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:01',
+  type            VARCHAR(16) NOT NULL, -- deploy, migration, config, failover or other
+  label           VARCHAR(255) CHARSET 'utf8' NOT NULL,
+  user            VARCHAR(100) CHARSET 'utf8' NOT NULL DEFAULT '',
+  PRIMARY KEY (event_id),
+  INDEX (instance_id, ts),
+  INDEX (ts) -- for purging
+);
+
+-- Ledger of the QAN reports written by qan.MySQLMetricWriter so a report an
+-- agent resends isn't counted twice, see app/qan/ledger.go.
+CREATE TABLE IF NOT EXISTS query_reports (
+  fingerprint     CHAR(40) NOT NULL, -- SHA1 of instance UUID, interval and slow log offsets
+  instance_id     INT UNSIGNED NOT NULL,
+  start_ts        TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:01',
+  end_ts          TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:01',
+  start_offset    BIGINT UNSIGNED NOT NULL DEFAULT 0,
+  end_offset      BIGINT UNSIGNED NOT NULL DEFAULT 0,
+  written         TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:01',
+  duplicates      INT UNSIGNED NOT NULL DEFAULT 0, -- times resent after written
+  last_duplicate  TIMESTAMP NULL DEFAULT NULL,
+  PRIMARY KEY (fingerprint),
+  INDEX (instance_id, start_ts),
+  INDEX (written) -- for purging
+);
+
+-- PostgreSQL metrics, see app/metrics/postgresql.go.
+ALTER TABLE query_class_metrics
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Plan_time_sum FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_min FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_avg FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_med FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_p95 FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_max FLOAT;
+ALTER TABLE query_global_metrics
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Plan_time_sum FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_min FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_avg FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_med FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_p95 FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_max FLOAT;
+ALTER TABLE query_class_metrics_hourly
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Plan_time_sum FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_min FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_avg FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_med FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_p95 FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_max FLOAT;
+ALTER TABLE query_class_metrics_daily
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Plan_time_sum FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_min FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_avg FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_med FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_p95 FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_max FLOAT;
+ALTER TABLE query_global_metrics_hourly
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Plan_time_sum FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_min FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_avg FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_med FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_p95 FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_max FLOAT;
+ALTER TABLE query_global_metrics_daily
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_hit_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Shared_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_read_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Temp_blks_written_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Wal_bytes_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Plan_time_sum FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_min FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_avg FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_med FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_p95 FLOAT,
+  ADD COLUMN IF NOT EXISTS Plan_time_max FLOAT;
+
+-- MongoDB metrics, see app/metrics/mongo.go.
+ALTER TABLE query_class_metrics
+  ADD COLUMN IF NOT EXISTS Docs_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_max BIGINT UNSIGNED;
+ALTER TABLE query_global_metrics
+  ADD COLUMN IF NOT EXISTS Docs_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_max BIGINT UNSIGNED;
+ALTER TABLE query_class_metrics_hourly
+  ADD COLUMN IF NOT EXISTS Docs_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_max BIGINT UNSIGNED;
+ALTER TABLE query_class_metrics_daily
+  ADD COLUMN IF NOT EXISTS Docs_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_max BIGINT UNSIGNED;
+ALTER TABLE query_global_metrics_hourly
+  ADD COLUMN IF NOT EXISTS Docs_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_max BIGINT UNSIGNED;
+ALTER TABLE query_global_metrics_daily
+  ADD COLUMN IF NOT EXISTS Docs_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Docs_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Keys_examined_max BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_sum BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_min BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_avg BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_med BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_p95 BIGINT UNSIGNED,
+  ADD COLUMN IF NOT EXISTS Response_length_max BIGINT UNSIGNED;
+
+-- Named instance groups, e.g. clusters, see app/instance/group.go.
+CREATE TABLE IF NOT EXISTS instance_groups (
+  group_id      INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  name          VARCHAR(100) CHARSET 'utf8' NOT NULL,
+  type          VARCHAR(32) NOT NULL DEFAULT '', -- e.g. cluster, replica-set, environment
+  created       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (group_id),
+  UNIQUE INDEX (name)
+);
+
+CREATE TABLE IF NOT EXISTS instance_group_members (
+  group_id      INT UNSIGNED NOT NULL,
+  instance_id   INT UNSIGNED NOT NULL,
+  PRIMARY KEY (group_id, instance_id),
+  INDEX (instance_id)
+);
+
+-- Key/value labels of instances, e.g. env=prod, see app/instance/label.go.
+CREATE TABLE IF NOT EXISTS instance_labels (
+  instance_id   INT UNSIGNED NOT NULL,
+  name          VARCHAR(63) NOT NULL,
+  value         VARCHAR(63) NOT NULL DEFAULT '',
+  PRIMARY KEY (instance_id, name),
+  INDEX (name, value)
+);
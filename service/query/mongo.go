@@ -0,0 +1,110 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package query
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	queryProto "github.com/shatteredsilicon/ssm/proto/query"
+)
+
+var (
+	ErrNotMongoFingerprint = errors.New("not a MongoDB fingerprint")
+)
+
+var (
+	// FIND orders status,total
+	mongoLegacyRe = regexp.MustCompile(`^([A-Za-z]+)(?:\s+(\S+))?(?:\s|$)`)
+	// db.orders.find({"status":"?"}).sort({"ts":1})
+	mongoShellRe = regexp.MustCompile(`^db\.(?:([^(]+)\.)?([A-Za-z]+)\(`)
+	// "ns": "shop.orders" of the profiler document of the example
+	mongoNsRe = regexp.MustCompile(`"ns"\s*:\s*"([^"]+)"`)
+)
+
+// mongoOps are the operations of the mongo shell methods that aren't just
+// the method uppercase, e.g. find is FIND but insertOne is INSERT.
+var mongoOps = map[string]string{
+	"query":                  "FIND",
+	"findone":                "FIND",
+	"insertone":              "INSERT",
+	"insertmany":             "INSERT",
+	"updateone":              "UPDATE",
+	"updatemany":             "UPDATE",
+	"replaceone":             "UPDATE",
+	"deleteone":              "REMOVE",
+	"deletemany":             "REMOVE",
+	"findoneandupdate":       "FINDANDMODIFY",
+	"findoneandreplace":      "FINDANDMODIFY",
+	"findoneanddelete":       "FINDANDMODIFY",
+	"countdocuments":         "COUNT",
+	"estimateddocumentcount": "COUNT",
+	"runcommand":             "COMMAND",
+	"admincommand":           "COMMAND",
+}
+
+// ParseMongo returns the abstract and collections of a MongoDB query class,
+// e.g. "FIND orders" and the orders collection of the database, like
+// Mini.Parse for MySQL. The collections are tables, with the database as
+// Db. The fingerprint is that of agents, either the operation, collection
+// and keys, e.g. "FIND orders status,total", or mongo shell-like, e.g.
+// db.orders.find({"status":"?"}). The database is defaultDb, if any, else
+// the namespace of the example, which is the document of the profiler.
+func ParseMongo(fingerprint, example, defaultDb string) (QueryInfo, error) {
+	fingerprint = strings.TrimSpace(fingerprint)
+	q := QueryInfo{
+		Fingerprint: fingerprint,
+		Tables:      []queryProto.Table{},
+	}
+
+	var op, collection string
+	if m := mongoShellRe.FindStringSubmatch(fingerprint); m != nil {
+		collection, op = m[1], m[2]
+	} else if m := mongoLegacyRe.FindStringSubmatch(fingerprint); m != nil {
+		op, collection = m[1], m[2]
+	} else {
+		return q, ErrNotMongoFingerprint
+	}
+	if o, ok := mongoOps[strings.ToLower(op)]; ok {
+		op = o
+	} else {
+		op = strings.ToUpper(op)
+	}
+	if op == "COMMAND" {
+		collection = "" // db.runCommand, "COMMAND admin.$cmd"
+	}
+
+	db := defaultDb
+	if m := mongoNsRe.FindStringSubmatch(example); m != nil {
+		ns := strings.SplitN(m[1], ".", 2)
+		if db == "" {
+			db = ns[0]
+		}
+		if collection == "" && op != "COMMAND" && len(ns) == 2 {
+			collection = ns[1]
+		}
+	}
+
+	q.Abstract = op
+	if collection != "" {
+		q.Abstract += " " + collection
+		q.Tables = append(q.Tables, queryProto.Table{Db: db, Table: collection})
+	}
+	return q, nil
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package query_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/shatteredsilicon/qan-api/service/query"
+	qp "github.com/shatteredsilicon/ssm/proto/query"
+)
+
+func TestParseMongo(t *testing.T) {
+	tests := []struct {
+		fingerprint string
+		example     string
+		db          string
+		abstract    string
+		tables      []qp.Table
+	}{
+		{
+			"FIND orders status,total", "", "shop",
+			"FIND orders",
+			[]qp.Table{{Db: "shop", Table: "orders"}},
+		},
+		{ // #1
+			`db.orders.find({"status":"?"}).sort({"ts":1})`, "", "shop",
+			"FIND orders",
+			[]qp.Table{{Db: "shop", Table: "orders"}},
+		},
+		{ // #2
+			`db.fs.chunks.insertMany([{"files_id":"?"}])`, "", "",
+			"INSERT fs.chunks",
+			[]qp.Table{{Db: "", Table: "fs.chunks"}},
+		},
+		{ // #3: database of the namespace of the example
+			"UPDATE users name", `{"op":"update","ns":"app.users","command":{"q":{"name":"x"}}}`, "",
+			"UPDATE users",
+			[]qp.Table{{Db: "app", Table: "users"}},
+		},
+		{ // #4: collection of the namespace of the example
+			"GETMORE", `{"op":"getmore","ns":"app.events"}`, "",
+			"GETMORE events",
+			[]qp.Table{{Db: "app", Table: "events"}},
+		},
+		{ // #5
+			`db.runCommand({"dbStats":1})`, `{"op":"command","ns":"app.$cmd"}`, "",
+			"COMMAND",
+			[]qp.Table{},
+		},
+	}
+	for i, test := range tests {
+		q, err := query.ParseMongo(test.fingerprint, test.example, test.db)
+		if err != nil {
+			t.Errorf("Error in test # %d: %s", i, err)
+			continue
+		}
+		if q.Fingerprint != test.fingerprint {
+			t.Errorf("Test # %d: fingerprint changed: %s", i, q.Fingerprint)
+		}
+		if q.Abstract != test.abstract {
+			t.Errorf("Test # %d: abstracts are different.\nWant: %s\nGot: %s", i, test.abstract, q.Abstract)
+		}
+		if !reflect.DeepEqual(q.Tables, test.tables) {
+			t.Errorf("Test # %d: tables are different.\nWant: %#v\nGot: %#v", i, test.tables, q.Tables)
+		}
+	}
+
+	if _, err := query.ParseMongo(`{"find":"orders"}`, "", ""); err != query.ErrNotMongoFingerprint {
+		t.Errorf("Got %v, expected ErrNotMongoFingerprint", err)
+	}
+}
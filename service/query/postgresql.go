@@ -0,0 +1,478 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package query
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	queryProto "github.com/shatteredsilicon/ssm/proto/query"
+)
+
+// PostgreSQL SQL isn't parsed by sqlparser or mini.pl, which are MySQL only,
+// so it's tokenized here: enough for the fingerprint, the abstract and the
+// tables of the statement, not to validate it.
+
+var (
+	ErrEmptyQuery = errors.New("empty query")
+)
+
+const (
+	pgWord  = iota // keyword or unquoted identifier, lowercase
+	pgIdent        // "quoted identifier", without the quotes
+	pgValue        // string, number or $n parameter
+	pgPunct        // operator or punctuation, e.g. "(", "::" or "<>"
+)
+
+type pgToken struct {
+	kind  int
+	text  string
+	space bool // whitespace or a comment before the token
+}
+
+var (
+	pgInListRe     = regexp.MustCompile(`\bin ?\( ?\?( ?, ?\?)* ?\)`)
+	pgValuesListRe = regexp.MustCompile(`\bvalues ?\( ?\?( ?, ?\?)* ?\)( ?, ?\( ?\?( ?, ?\?)* ?\))*`)
+)
+
+// FingerprintPostgreSQL returns the canonical form of the PostgreSQL query
+// like the fingerprints of MySQL queries: lowercase, without comments, with
+// values and $n parameters replaced with "?" and lists of values with "?+",
+// e.g. "select * from t where id in(?+)". Quoted identifiers are kept as is
+// because they are case-sensitive.
+func FingerprintPostgreSQL(query string) string {
+	var b strings.Builder
+	for i, t := range pgTokenize(query) {
+		if t.kind == pgPunct && t.text == ";" {
+			continue
+		}
+		if i > 0 && t.space {
+			b.WriteByte(' ')
+		}
+		switch t.kind {
+		case pgIdent:
+			b.WriteString(`"` + strings.Replace(t.text, `"`, `""`, -1) + `"`)
+		case pgValue:
+			b.WriteByte('?')
+		default:
+			b.WriteString(t.text)
+		}
+	}
+	f := strings.TrimSpace(b.String())
+	f = pgInListRe.ReplaceAllString(f, "in(?+)")
+	f = pgValuesListRe.ReplaceAllString(f, "values (?+)")
+	return f
+}
+
+// ParsePostgreSQL returns the fingerprint, abstract, tables and procedures
+// of a PostgreSQL query class like Mini.Parse does for MySQL. The example is
+// parsed if given, else the fingerprint, e.g. the normalized query of
+// pg_stat_statements. Tables and procedures without a schema get the
+// default one, if any.
+func ParsePostgreSQL(fingerprint, example, defaultDb string) (QueryInfo, error) {
+	fingerprint = strings.TrimSpace(fingerprint)
+	example = strings.TrimSpace(example)
+	query := fingerprint
+	if example != "" {
+		query = example
+	}
+	if fingerprint == "" {
+		fingerprint = example
+	}
+	tokens := pgTokenize(query)
+	if len(tokens) == 0 {
+		return QueryInfo{}, ErrEmptyQuery
+	}
+
+	q := QueryInfo{
+		Fingerprint: FingerprintPostgreSQL(fingerprint),
+		Tables:      pgTables(tokens),
+	}
+	abstract := []string{pgVerb(tokens)}
+	for _, t := range q.Tables {
+		abstract = append(abstract, t.String())
+	}
+	q.Abstract = strings.Join(abstract, " ")
+	if tokens[0].is("call") {
+		if name, _ := pgName(tokens, 1); len(name) > 0 {
+			q.Procedures = []queryProto.Procedure{{
+				DB:   pgQualifier(name),
+				Name: name[len(name)-1],
+			}}
+		}
+	}
+
+	if defaultDb != "" {
+		for n, t := range q.Tables {
+			if t.Db == "" {
+				q.Tables[n].Db = defaultDb
+			}
+		}
+		for n, t := range q.Procedures {
+			if t.DB == "" {
+				q.Procedures[n].DB = defaultDb
+			}
+		}
+	}
+	return q, nil
+}
+
+func (t pgToken) is(word string) bool {
+	return t.kind == pgWord && t.text == word
+}
+
+func (t pgToken) isPunct(p string) bool {
+	return t.kind == pgPunct && t.text == p
+}
+
+// pgVerb returns the command of the statement for the abstract, e.g. SELECT,
+// or CREATE TABLE. The command of a WITH statement is that of the statement
+// after the common table expressions.
+func pgVerb(tokens []pgToken) string {
+	first := tokens[0]
+	if first.kind != pgWord {
+		return ""
+	}
+	switch first.text {
+	case "with":
+		depth := 0
+		for _, t := range tokens[1:] {
+			switch {
+			case t.isPunct("("):
+				depth++
+			case t.isPunct(")"):
+				depth--
+			case depth == 0 && t.kind == pgWord:
+				switch t.text {
+				case "select", "insert", "update", "delete", "merge":
+					return strings.ToUpper(t.text)
+				}
+			}
+		}
+	case "create", "alter", "drop":
+		// CREATE [OR REPLACE] [UNIQUE] [TEMPORARY|UNLOGGED] TABLE|INDEX|...
+		for _, t := range tokens[1:] {
+			if t.kind != pgWord {
+				break
+			}
+			switch t.text {
+			case "or", "replace", "unique", "temp", "temporary", "unlogged", "global", "local", "materialized":
+				continue
+			}
+			return strings.ToUpper(first.text + " " + t.text)
+		}
+	}
+	return strings.ToUpper(first.text)
+}
+
+// pgTables returns the tables of the statement, e.g. those after FROM and
+// JOIN, in the order they appear, without common table expressions, table
+// functions and duplicates.
+func pgTables(tokens []pgToken) []queryProto.Table {
+	tables := []queryProto.Table{}
+	ctes := map[string]bool{}
+
+	// Parentheses are subqueries or not, e.g. the arguments of
+	// extract(year from ts), the FROM of which isn't a table.
+	subquery := []bool{true}
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.isPunct("("):
+			sub := i+1 < len(tokens) && (tokens[i+1].is("select") || tokens[i+1].is("with") || tokens[i+1].is("values"))
+			subquery = append(subquery, sub)
+			continue
+		case t.isPunct(")"):
+			if len(subquery) > 1 {
+				subquery = subquery[:len(subquery)-1]
+			}
+			continue
+		case t.kind == pgWord || t.kind == pgIdent:
+			// name AS [NOT MATERIALIZED] ( is a common table expression.
+			j := i + 1
+			if j < len(tokens) && tokens[j].is("as") {
+				for j++; j < len(tokens) && (tokens[j].is("not") || tokens[j].is("materialized")); j++ {
+				}
+				if j < len(tokens) && tokens[j].isPunct("(") && i > 0 && (tokens[i-1].is("with") || tokens[i-1].is("recursive") || tokens[i-1].isPunct(",")) {
+					ctes[t.text] = true
+				}
+			}
+		}
+		if t.kind != pgWord || !subquery[len(subquery)-1] {
+			continue
+		}
+
+		switch t.text {
+		case "from":
+			if i > 0 && tokens[i-1].is("distinct") { // IS DISTINCT FROM
+				continue
+			}
+		case "update":
+			if i > 0 && (tokens[i-1].is("do") || tokens[i-1].is("for") || tokens[i-1].is("key")) {
+				continue // ON CONFLICT DO UPDATE, FOR [NO KEY] UPDATE
+			}
+		case "join", "into", "copy", "truncate", "table":
+		default:
+			continue
+		}
+		// A name followed by ( after FROM or JOIN is a function, e.g.
+		// generate_series(1, 10).
+		functions := t.text == "from" || t.text == "join"
+
+		// FROM a, b: the tables of the list.
+		for j := i + 1; j < len(tokens); {
+			for j < len(tokens) && (tokens[j].is("only") || tokens[j].is("if") || tokens[j].is("not") || tokens[j].is("exists") || tokens[j].is("table")) {
+				j++
+			}
+			name, next := pgName(tokens, j)
+			if len(name) == 0 || functions && next < len(tokens) && tokens[next].isPunct("(") {
+				break
+			}
+			tables = append(tables, queryProto.Table{
+				Db:    pgQualifier(name),
+				Table: name[len(name)-1],
+			})
+			if t.text != "from" {
+				break
+			}
+			// Skip [AS] alias to the comma, if any.
+			j = next
+			if j < len(tokens) && tokens[j].is("as") {
+				j++
+			}
+			if j < len(tokens) && (tokens[j].kind == pgIdent || tokens[j].kind == pgWord && !pgKeywords[tokens[j].text]) {
+				j++
+			}
+			if j >= len(tokens) || !tokens[j].isPunct(",") {
+				break
+			}
+			j++
+		}
+	}
+
+	valid := tables[:0]
+	for _, t := range tables {
+		if t.Db == "" && ctes[t.Table] {
+			continue
+		}
+		valid = append(valid, t)
+	}
+	return RemoveDuplicateTables(valid)
+}
+
+// pgName returns the parts of the qualified name at tokens[i], e.g. schema
+// and table, and the index of the token after it. The name is nil if there
+// is none, e.g. a subquery.
+func pgName(tokens []pgToken, i int) ([]string, int) {
+	var name []string
+	for i < len(tokens) {
+		t := tokens[i]
+		if t.kind != pgIdent && (t.kind != pgWord || pgKeywords[t.text]) {
+			break
+		}
+		name = append(name, t.text)
+		i++
+		if i+1 >= len(tokens) || !tokens[i].isPunct(".") {
+			break
+		}
+		i++
+	}
+	return name, i
+}
+
+// pgQualifier returns the schema of the qualified name: schema.table or
+// database.schema.table.
+func pgQualifier(name []string) string {
+	if len(name) < 2 {
+		return ""
+	}
+	return name[len(name)-2]
+}
+
+// pgKeywords are the keywords that can follow a table name, so they aren't
+// taken for a table or an alias.
+var pgKeywords = map[string]bool{
+	"as": true, "on": true, "using": true, "where": true, "group": true, "order": true,
+	"having": true, "limit": true, "offset": true, "fetch": true, "for": true, "union": true,
+	"intersect": true, "except": true, "window": true, "returning": true, "set": true,
+	"values": true, "select": true, "default": true, "join": true, "inner": true, "left": true,
+	"right": true, "full": true, "outer": true, "cross": true, "natural": true, "lateral": true,
+	"tablesample": true, "with": true, "from": true, "to": true, "do": true, "when": true,
+	"overriding": true, "cascade": true, "restrict": true, "restart": true, "continue": true,
+	"identity": true, "only": true, "add": true, "alter": true, "drop": true, "rename": true,
+	"owner": true, "and": true, "or": true, "not": true, "into": true, "partition": true,
+	"stdin": true, "stdout": true, "program": true,
+}
+
+// pgTokenize returns the tokens of the query, without comments. Unterminated
+// strings, identifiers and comments end at the end of the query.
+func pgTokenize(query string) []pgToken {
+	tokens := []pgToken{}
+	space := false
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			space = true
+			i++
+			continue
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			i += end
+			space = true
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			// Comments nest in PostgreSQL.
+			depth := 0
+			for i < len(query) {
+				if strings.HasPrefix(query[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(query[i:], "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+			space = true
+			continue
+		}
+
+		t := pgToken{space: space}
+		space = false
+		switch {
+		case c == '\'':
+			t.kind, i = pgValue, pgString(query, i, false)
+		case (c == 'e' || c == 'E') && strings.HasPrefix(query[i+1:], "'"):
+			t.kind, i = pgValue, pgString(query, i+1, true) // E'escape\'s'
+		case (c == 'b' || c == 'B' || c == 'x' || c == 'X' || c == 'n' || c == 'N') && strings.HasPrefix(query[i+1:], "'"):
+			t.kind, i = pgValue, pgString(query, i+1, false) // bit, hex and national strings
+		case c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			j := i + 1
+			for j < len(query) && isDigit(query[j]) {
+				j++
+			}
+			t.kind, i = pgValue, j
+		case c == '$' && pgDollarTag(query[i:]) != "":
+			tag := pgDollarTag(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + end + len(tag)
+			}
+			t.kind = pgValue
+		case c == '"':
+			j := i + 1
+			var name strings.Builder
+			for j < len(query) {
+				if query[j] == '"' {
+					if j+1 < len(query) && query[j+1] == '"' {
+						name.WriteByte('"')
+						j += 2
+						continue
+					}
+					j++
+					break
+				}
+				name.WriteByte(query[j])
+				j++
+			}
+			t.kind, t.text, i = pgIdent, name.String(), j
+		case isDigit(c) || c == '.' && i+1 < len(query) && isDigit(query[i+1]):
+			j := i + 1
+			for j < len(query) {
+				d := query[j]
+				if isDigit(d) || d == '.' || d == '_' || d == 'e' || d == 'E' ||
+					(d == '+' || d == '-') && (query[j-1] == 'e' || query[j-1] == 'E') {
+					j++
+					continue
+				}
+				break
+			}
+			t.kind, i = pgValue, j
+		case isPgWordStart(c):
+			j := i + 1
+			for j < len(query) && (isPgWordStart(query[j]) || isDigit(query[j]) || query[j] == '$') {
+				j++
+			}
+			t.kind, t.text, i = pgWord, strings.ToLower(query[i:j]), j
+		case c == ':' && strings.HasPrefix(query[i:], "::"):
+			t.kind, t.text, i = pgPunct, "::", i+2
+		case strings.IndexByte("+-*/<>=~!@#%^&|`?", c) >= 0:
+			j := i + 1
+			for j < len(query) && strings.IndexByte("+-*/<>=~!@#%^&|`?", query[j]) >= 0 &&
+				!strings.HasPrefix(query[j:], "--") && !strings.HasPrefix(query[j:], "/*") {
+				j++
+			}
+			t.kind, t.text, i = pgPunct, query[i:j], j
+		default:
+			t.kind, t.text, i = pgPunct, string(c), i+1
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+// pgString returns the index after the string that starts with the quote at
+// query[i]. Quotes are doubled, or escaped with \ in E'...' strings.
+func pgString(query string, i int, escapes bool) int {
+	for i++; i < len(query); i++ {
+		switch {
+		case escapes && query[i] == '\\':
+			i++
+		case query[i] == '\'':
+			if i+1 < len(query) && query[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// pgDollarTag returns the tag that starts a dollar-quoted string, e.g. "$$"
+// or "$body$", or "" if s doesn't start with one.
+func pgDollarTag(s string) string {
+	for j := 1; j < len(s); j++ {
+		if s[j] == '$' {
+			return s[:j+1]
+		}
+		if !isPgWordStart(s[j]) && !(j > 1 && isDigit(s[j])) {
+			return ""
+		}
+	}
+	return ""
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isPgWordStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
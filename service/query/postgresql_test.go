@@ -0,0 +1,160 @@
+/*
+   Copyright (c) 2016, Percona LLC and/or its affiliates. All rights reserved.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>
+*/
+
+package query_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/shatteredsilicon/qan-api/service/query"
+	qp "github.com/shatteredsilicon/ssm/proto/query"
+)
+
+var pgExamples = []example{
+	{
+		"SELECT c FROM t WHERE id = $1",
+		"SELECT t",
+		[]qp.Table{{Db: "", Table: "t"}},
+	},
+	{ // #1
+		`select c from public.t a, "Orders" o where a.id = o.id`,
+		"SELECT public.t Orders",
+		[]qp.Table{
+			{Db: "public", Table: "t"},
+			{Db: "", Table: "Orders"},
+		},
+	},
+	{ // #2
+		"SELECT * FROM ta JOIN shop.tb ON ta.id = tb.id LEFT JOIN tc USING (id)",
+		"SELECT ta shop.tb tc",
+		[]qp.Table{
+			{Db: "", Table: "ta"},
+			{Db: "shop", Table: "tb"},
+			{Db: "", Table: "tc"},
+		},
+	},
+	{ // #3
+		"SELECT extract(year FROM ts), x FROM t WHERE y IS DISTINCT FROM $1 AND z IN (SELECT z FROM t2)",
+		"SELECT t t2",
+		[]qp.Table{
+			{Db: "", Table: "t"},
+			{Db: "", Table: "t2"},
+		},
+	},
+	{ // #4
+		"WITH recent AS MATERIALIZED (SELECT * FROM orders WHERE ts > now() - $1::interval) " +
+			"UPDATE customers c SET last = r.ts FROM recent r WHERE c.id = r.customer_id",
+		"UPDATE orders customers",
+		[]qp.Table{
+			{Db: "", Table: "orders"},
+			{Db: "", Table: "customers"},
+		},
+	},
+	{ // #5
+		"INSERT INTO t (a, b) VALUES ($1, $2) ON CONFLICT (a) DO UPDATE SET b = excluded.b",
+		"INSERT t",
+		[]qp.Table{{Db: "", Table: "t"}},
+	},
+	{ // #6
+		"DELETE FROM ONLY t WHERE id = $1 RETURNING id",
+		"DELETE t",
+		[]qp.Table{{Db: "", Table: "t"}},
+	},
+	{ // #7
+		"SELECT * FROM generate_series($1, $2) g JOIN t ON t.id = g FOR UPDATE",
+		"SELECT t",
+		[]qp.Table{{Db: "", Table: "t"}},
+	},
+	{ // #8
+		"CREATE TABLE IF NOT EXISTS s.t (id int)",
+		"CREATE TABLE s.t",
+		[]qp.Table{{Db: "s", Table: "t"}},
+	},
+	{ // #9
+		"TRUNCATE TABLE t",
+		"TRUNCATE t",
+		[]qp.Table{{Db: "", Table: "t"}},
+	},
+	{ // #10
+		"COPY t FROM STDIN",
+		"COPY t",
+		[]qp.Table{{Db: "", Table: "t"}},
+	},
+	{ // #11
+		"SET application_name = $1",
+		"SET",
+		[]qp.Table{},
+	},
+}
+
+func TestParsePostgreSQL(t *testing.T) {
+	for _, defaultDb := range []string{"", "public"} {
+		for i, e := range pgExamples {
+			q, err := query.ParsePostgreSQL(e.query, "", defaultDb)
+			if err != nil {
+				t.Errorf("Error in test # %d: %s", i, err)
+				continue
+			}
+			tables := make([]qp.Table, len(e.tables))
+			copy(tables, e.tables)
+			// The abstract has the tables as written, like MySQL's.
+			if q.Abstract != e.abstract {
+				t.Errorf("Test # %d: abstracts are different.\nWant: %s\nGot: %s", i, e.abstract, q.Abstract)
+			}
+			if defaultDb != "" {
+				for i := range tables {
+					if tables[i].Db == "" {
+						tables[i].Db = defaultDb
+					}
+				}
+			}
+			if !reflect.DeepEqual(q.Tables, tables) {
+				t.Errorf("Test # %d: tables are different.\nWant: %#v\nGot: %#v", i, tables, q.Tables)
+			}
+		}
+	}
+
+	q, err := query.ParsePostgreSQL("CALL shop.refresh($1)", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []qp.Procedure{{DB: "shop", Name: "refresh"}}; !reflect.DeepEqual(q.Procedures, want) {
+		t.Errorf("Procedures are different.\nWant: %#v\nGot: %#v", want, q.Procedures)
+	}
+
+	if _, err := query.ParsePostgreSQL(" -- nothing\n", "", ""); err != query.ErrEmptyQuery {
+		t.Errorf("Got %v, expected ErrEmptyQuery", err)
+	}
+}
+
+func TestFingerprintPostgreSQL(t *testing.T) {
+	tests := []struct{ query, fingerprint string }{
+		{"SELECT c FROM t WHERE id = $1", "select c from t where id = ?"},
+		{"select  c\nfrom t -- comment\nwhere s = 'it''s' and e = E'\\'x' /* a /* nested */ comment */ and n = 1.5e-3;",
+			"select c from t where s = ? and e = ? and n = ?"},
+		{`SELECT "Id" FROM "Orders" WHERE id IN ($1, $2, $3) AND ts > $4::timestamptz`,
+			`select "Id" from "Orders" where id in(?+) and ts > ?::timestamptz`},
+		{"INSERT INTO t (a, b) VALUES ($1, $2), ($3, $4)", "insert into t (a, b) values (?+)"},
+		{"SELECT $body$ it's; -- not a comment $body$, $$x$$", "select ?, ?"},
+	}
+	for _, test := range tests {
+		if got := query.FingerprintPostgreSQL(test.query); got != test.fingerprint {
+			t.Errorf("Fingerprint of %q:\nWant: %s\nGot: %s", test.query, test.fingerprint, got)
+		}
+	}
+}
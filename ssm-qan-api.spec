@@ -59,6 +59,7 @@ popd
 
 GO111MODULE=off go build -o ./revel ${GOPATH}/src/%{provider_prefix}/vendor/github.com/revel/cmd/revel
 GO111MODULE=off ./revel build %{provider_prefix} release prod
+GO111MODULE=off go build -o ./bin/ssm-qan-import %{provider_prefix}/bin/ssm-qan-import
 rm -rf release/src/github.com/shatteredsilicon/qan-api
 mkdir -p ./src
 mv ${HOME}/go/src/%{provider_prefix}/* ./src/
@@ -67,6 +68,7 @@ mv ${HOME}/go/src/%{provider_prefix}/* ./src/
 %install
 install -d -p %{buildroot}%{_sbindir}
 mv ./release/%{repo} %{buildroot}%{_sbindir}/%{name}
+install -p -m 0755 ./bin/ssm-qan-import %{buildroot}%{_sbindir}/ssm-qan-import
 install -d -p %{buildroot}%{_datadir}
 cp -rpa ./release %{buildroot}%{_datadir}/%{name}
 install -d -p %{buildroot}%{_datadir}/%{name}/src/%{provider_prefix}/app/views
@@ -113,6 +115,7 @@ fi
 %license src/LICENSE
 %doc src/README.md src/CHANGELOG.md
 %attr(0755, root, root) %{_sbindir}/%{name}
+%attr(0755, root, root) %{_sbindir}/ssm-qan-import
 %{_datadir}/%{name}
 /usr/lib/systemd/system/%{name}.service
 %config %{_sysconfdir}/ssm-qan-api.conf